@@ -0,0 +1,150 @@
+package tracker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// HealthChecker may be implemented by a RecordStore whose storage lives
+// outside of the process. CheckHealth should return an error if the store
+// cannot currently be reached.
+type HealthChecker interface {
+	CheckHealth() error
+}
+
+// RecordCounter may be implemented by a RecordStore that is able to
+// report how many records it holds.
+type RecordCounter interface {
+	CountRecords() (addresses int, aliases int)
+}
+
+// TrackerStatus is the document served at /status by the admin server.
+type TrackerStatus struct {
+	Address   string            `json:"address"`
+	Listening string            `json:"listening,omitempty"`
+	Started   time.Time         `json:"started,omitempty"`
+	Uptime    string            `json:"uptime"`
+	Addresses int               `json:"addresses"`
+	Aliases   int               `json:"aliases"`
+	Config    map[string]string `json:"config"`
+	Cache     *CacheStats       `json:"cache,omitempty"`
+	Mirror    *MirrorInfo       `json:"mirror,omitempty"`
+}
+
+// Status will return a snapshot of the tracker's runtime state.
+func (t *Tracker) Status() *TrackerStatus {
+	t.stateLock.RLock()
+	listener, started := t.listener, t.started
+	t.stateLock.RUnlock()
+
+	status := &TrackerStatus{
+		Address:   t.Key.Address.String(),
+		Addresses: -1,
+		Aliases:   -1,
+		Config:    t.configSummary(),
+	}
+
+	if listener != nil {
+		status.Listening = listener.Addr().String()
+		status.Started = started
+		status.Uptime = time.Since(started).String()
+	}
+
+	if c, ok := t.records().(RecordCounter); ok {
+		status.Addresses, status.Aliases = c.CountRecords()
+	}
+
+	if t.Cache != nil {
+		stats := t.Cache.Stats()
+		status.Cache = &stats
+	}
+
+	if t.Mirror != nil {
+		status.Mirror = t.Mirror.Info()
+	}
+
+	return status
+}
+
+// configSummary describes how the tracker has been configured, without
+// revealing anything secret.
+func (t *Tracker) configSummary() map[string]string {
+	return map[string]string{
+		"delegate":    fmt.Sprintf("%T", t.Delegate),
+		"store":       fmt.Sprintf("%T", t.records()),
+		"metrics":     fmt.Sprintf("%t", t.Metrics != nil),
+		"sweeper":     fmt.Sprintf("%t", t.Sweeper != nil),
+		"cache":       fmt.Sprintf("%t", t.Cache != nil),
+		"replication": fmt.Sprintf("%t", t.Replication != nil),
+		"mirror":      fmt.Sprintf("%t", t.Mirror != nil),
+		"partition":   fmt.Sprintf("%t", t.Partition != nil),
+		"forwarding":  fmt.Sprintf("%t", t.Forwarding != nil),
+		"namespaces":  fmt.Sprintf("%t", t.Namespaces != nil),
+		"migration":   fmt.Sprintf("%t", t.Migration != nil),
+	}
+}
+
+// checkReady returns nil if the tracker is accepting connections and its
+// store is reachable.
+func (t *Tracker) checkReady() error {
+	t.stateLock.RLock()
+	listening := t.listener != nil
+	t.stateLock.RUnlock()
+
+	if !listening {
+		return errors.New("Tracker is not listening.")
+	}
+
+	if h, ok := t.records().(HealthChecker); ok {
+		if err := h.CheckHealth(); err != nil {
+			return fmt.Errorf("Store is unreachable: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// AdminHandler will return an http.Handler that serves the admin endpoints:
+//
+//	/healthz - liveness, always OK while the process is running
+//	/readyz  - readiness, OK once the listener is up and the store responds
+//	/status  - a JSON TrackerStatus document
+//	/metrics - the tracker's Metrics, if they are enabled
+func (t *Tracker) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := t.checkReady(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(t.Status())
+	})
+
+	if t.Metrics != nil {
+		mux.Handle("/metrics", t.Metrics)
+	}
+
+	return mux
+}
+
+// StartAdminServer will serve the AdminHandler on the specified address.
+// It is meant to be run alongside StartServer, and blocks in the same way.
+func (t *Tracker) StartAdminServer(addr string) error {
+	t.Delegate.LogMessage("Serving Admin Endpoints on " + addr)
+	return http.ListenAndServe(addr, t.AdminHandler())
+}
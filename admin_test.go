@@ -0,0 +1,107 @@
+package tracker
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"airdispat.ch/identity"
+)
+
+// unhealthyStore is a MemoryStore whose backing storage can be cut off.
+type unhealthyStore struct {
+	*MemoryStore
+	err error
+}
+
+func (s *unhealthyStore) CheckHealth() error {
+	return s.err
+}
+
+func TestAdminHandler(t *testing.T) {
+	key, err := identity.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &unhealthyStore{MemoryStore: NewMemoryStore()}
+	tracker := &Tracker{
+		Key:      key,
+		Delegate: BasicTracker{},
+		Store:    store,
+	}
+
+	get := func(handler http.Handler, path string) (int, string) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		body, _ := ioutil.ReadAll(w.Body)
+		return w.Code, string(body)
+	}
+
+	handler := tracker.AdminHandler()
+	if code, body := get(handler, "/healthz"); code != http.StatusOK || body != "ok\n" {
+		t.Errorf("Expected the tracker to be live, got %d %q.", code, body)
+	}
+
+	// The tracker is not ready until it is listening.
+	if code, _ := get(handler, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the tracker not to be ready before it listens, got %d.", code)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	tracker.stateLock.Lock()
+	tracker.listener, tracker.started = listener, time.Now()
+	tracker.stateLock.Unlock()
+
+	if code, body := get(handler, "/readyz"); code != http.StatusOK || body != "ok\n" {
+		t.Errorf("Expected the tracker to be ready, got %d %q.", code, body)
+	}
+
+	store.err = errors.New("connection refused")
+	if code, body := get(handler, "/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "Store is unreachable") {
+		t.Errorf("Expected an unreachable store to make the tracker unready, got %d %q.", code, body)
+	}
+	store.err = nil
+
+	id, record := createTestRecord(t, "hunter", time.Now().Add(time.Hour))
+	store.SaveRecord(id.Address, record, "hunter")
+
+	code, body := get(handler, "/status")
+	if code != http.StatusOK {
+		t.Fatalf("Expected the status to be served, got %d.", code)
+	}
+
+	status := &TrackerStatus{}
+	err = json.Unmarshal([]byte(body), status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Address != key.Address.String() || status.Listening != listener.Addr().String() {
+		t.Errorf("Expected the status to describe the tracker, got %+v.", status)
+	}
+	if status.Addresses != 1 || status.Aliases != 1 || status.Config["metrics"] != "false" {
+		t.Errorf("Expected the status to count the records, got %+v.", status)
+	}
+
+	// Metrics are only served when they are enabled.
+	if code, _ := get(handler, "/metrics"); code != http.StatusNotFound {
+		t.Errorf("Expected no metrics without Metrics, got %d.", code)
+	}
+
+	tracker.Metrics = NewMetrics()
+	tracker.Metrics.inc("tracker_registrations_total", "accepted")
+	if code, body := get(tracker.AdminHandler(), "/metrics"); code != http.StatusOK || !strings.Contains(body, `tracker_registrations_total{outcome="accepted"} 1`) {
+		t.Errorf("Expected the metrics to be served, got %d.", code)
+	}
+}
@@ -0,0 +1,555 @@
+package tracker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	adErrors "airdispat.ch/errors"
+	"airdispat.ch/identity"
+	"airdispat.ch/tracker/wire"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+const (
+	// DigestPrefixLength is how many characters of an address are used to
+	// put its record into a digest bucket.
+	DigestPrefixLength = 2
+
+	// DefaultSyncInterval is how often the tracker compares its records
+	// with each peer if no other interval is given.
+	DefaultSyncInterval = 10 * time.Minute
+)
+
+// ErrNoDigest is returned when the tracker's store can not list its
+// records, so no digest can be made of them.
+var ErrNoDigest = errors.New("Store does not support listing records.")
+
+// DigestEntry summarises a single record in a digest.
+type DigestEntry struct {
+	Address string
+	Expires time.Time
+	Hash    []byte
+
+	// Alias is the alias that the address owns on the tracker, which is
+	// empty if the record has lost its alias to another address.
+	Alias string
+}
+
+// Digest is a two level Merkle tree of the records that a tracker holds.
+// Records are put into buckets by the start of their address, and each
+// bucket is hashed from the entries of its records, so two trackers only
+// need to compare the records in the buckets whose hashes differ.
+type Digest struct {
+	Buckets map[string][]byte
+}
+
+// Root will return a single hash of every bucket in the digest.
+func (d *Digest) Root() []byte {
+	prefixes := make([]string, 0, len(d.Buckets))
+	for p := range d.Buckets {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+
+	h := sha256.New()
+	for _, p := range prefixes {
+		h.Write([]byte(p))
+		h.Write(d.Buckets[p])
+	}
+	return h.Sum(nil)
+}
+
+// Diff will return the prefixes of every bucket that differs between two
+// digests, including buckets that only one of them holds.
+func (d *Digest) Diff(other *Digest) []string {
+	var out []string
+	for p, h := range d.Buckets {
+		if !bytes.Equal(h, other.Buckets[p]) {
+			out = append(out, p)
+		}
+	}
+	for p := range other.Buckets {
+		if _, ok := d.Buckets[p]; !ok {
+			out = append(out, p)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// SyncResult reports what a single anti-entropy exchange with a peer did.
+type SyncResult struct {
+	// Buckets is the number of digest buckets that differed.
+	Buckets int
+	// Pulled is the number of newer records that were taken from the peer.
+	Pulled int
+	// Pushed is the number of newer records that were sent to the peer.
+	Pushed int
+	// Settled is the number of aliases that were given to the record that
+	// wins them after the peer was found to hold a different owner.
+	Settled int
+}
+
+func digestPrefix(address string) string {
+	if len(address) < DigestPrefixLength {
+		return address
+	}
+	return address[:DigestPrefixLength]
+}
+
+func newDigestEntry(r *StoredRecord) (*DigestEntry, error) {
+	data, err := MarshalRecord(r.Record)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(data)
+	return &DigestEntry{
+		Address: r.Address,
+		Expires: r.Expires,
+		Hash:    hash[:],
+		Alias:   r.Alias,
+	}, nil
+}
+
+// newerThan decides which of two records for the same address wins. The
+// record that expires last is newer, and ties are broken by hash so that
+// every tracker picks the same record.
+func (e *DigestEntry) newerThan(other *DigestEntry) bool {
+	if !e.Expires.Equal(other.Expires) {
+		return e.Expires.After(other.Expires)
+	}
+	return bytes.Compare(e.Hash, other.Hash) > 0
+}
+
+// unsettled will return true if two trackers hold the same record, but only
+// the one with e gives it its alias.
+func unsettled(e *DigestEntry, other *DigestEntry) bool {
+	return e.Alias != "" && other.Alias == "" && bytes.Equal(e.Hash, other.Hash)
+}
+
+// liveRecords will list the live records held by the tracker, keyed by
+// address. If prefixes is not nil, only records in those buckets are listed.
+// Records that have lost their alias to another address are listed without
+// it.
+func (t *Tracker) liveRecords(prefixes map[string]bool) (map[string]*StoredRecord, error) {
+	it, ok := t.records().(RecordIterator)
+	if !ok {
+		return nil, ErrNoDigest
+	}
+
+	now := time.Now()
+	out := make(map[string]*StoredRecord)
+	err := it.ForEachRecord(func(r *StoredRecord) error {
+		if r.Expired(now) {
+			return nil
+		}
+		if prefixes != nil && !prefixes[digestPrefix(r.Address)] {
+			return nil
+		}
+		if r.Alias != "" && !t.holdsAlias(r.Alias, r.Address) {
+			c := *r
+			c.Alias = ""
+			r = &c
+		}
+		out[r.Address] = r
+		return nil
+	})
+	return out, err
+}
+
+func (t *Tracker) digestEntries(prefixes map[string]bool) (map[string]*DigestEntry, error) {
+	records, err := t.liveRecords(prefixes)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]*DigestEntry)
+	for address, r := range records {
+		out[address], err = newDigestEntry(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// Digest will summarise every live record that the tracker holds.
+func (t *Tracker) Digest() (*Digest, error) {
+	entries, err := t.digestEntries(nil)
+	if err != nil {
+		return nil, err
+	}
+	return digestFromEntries(entries), nil
+}
+
+func digestFromEntries(entries map[string]*DigestEntry) *Digest {
+	buckets := make(map[string][]*DigestEntry)
+	for address, e := range entries {
+		p := digestPrefix(address)
+		buckets[p] = append(buckets[p], e)
+	}
+
+	d := &Digest{Buckets: make(map[string][]byte)}
+	for p, bucket := range buckets {
+		sort.Slice(bucket, func(i, j int) bool { return bucket[i].Address < bucket[j].Address })
+
+		h := sha256.New()
+		for _, e := range bucket {
+			var expires [8]byte
+			binary.BigEndian.PutUint64(expires[:], uint64(e.Expires.Unix()))
+
+			h.Write([]byte(e.Address))
+			h.Write([]byte{0})
+			h.Write(expires[:])
+			h.Write(e.Hash)
+			h.Write([]byte(e.Alias))
+			h.Write([]byte{0})
+		}
+		d.Buckets[p] = h.Sum(nil)
+	}
+	return d
+}
+
+// handleDigest will answer a peer comparing its records with the tracker.
+func (t *Tracker) handleDigest(theAddress *identity.Address, req *wire.TrackerDigestQuery, conn net.Conn) {
+	if !t.Replication.mayCopy(theAddress.String()) && !t.Partition.member(theAddress.String()) {
+		adErrors.CreateError(adErrors.UnexpectedError, "Not a replication peer or mirror.", t.Key.Address).Send(t.Key, conn)
+		return
+	}
+
+	response, err := t.digestResponse(req)
+	if err == ErrNoDigest {
+		adErrors.CreateError(adErrors.UnexpectedError, "This tracker can not list its records.", t.Key.Address).Send(t.Key, conn)
+		return
+	} else if err != nil {
+		t.handleError("Handle Digest (Reading Records)", err)
+		adErrors.CreateError(adErrors.InternalError, "Couldn't read the records.", t.Key.Address).Send(t.Key, conn)
+		return
+	}
+
+	err = t.reply(theAddress, wire.DigestCode, response, conn)
+	if err != nil {
+		t.handleError("Handle Digest (Sending Response)", err)
+	}
+}
+
+func (t *Tracker) digestResponse(req *wire.TrackerDigestQuery) (*wire.TrackerDigest, error) {
+	response := &wire.TrackerDigest{}
+
+	if len(req.GetFetch()) > 0 {
+		for _, v := range req.GetFetch() {
+			addr := identity.CreateAddressFromString(v)
+			if addr == nil {
+				continue
+			}
+
+			record := t.records().GetRecordByAddress(addr)
+			if record == nil {
+				continue
+			}
+
+			data, err := MarshalRecord(record)
+			if err != nil {
+				return nil, err
+			}
+
+			address := v
+			response.Record = append(response.Record, &wire.ReplicatedRecord{
+				Address: &address,
+				Record:  data,
+			})
+		}
+		return response, nil
+	}
+
+	if len(req.GetBucket()) > 0 {
+		prefixes := make(map[string]bool)
+		for _, p := range req.GetBucket() {
+			prefixes[p] = true
+		}
+
+		entries, err := t.digestEntries(prefixes)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			address := e.Address
+			expires := uint64(e.Expires.Unix())
+			entry := &wire.DigestEntry{
+				Address: &address,
+				Expires: &expires,
+				Hash:    e.Hash,
+			}
+			if e.Alias != "" {
+				alias := e.Alias
+				entry.Alias = &alias
+			}
+			response.Entry = append(response.Entry, entry)
+		}
+		return response, nil
+	}
+
+	d, err := t.Digest()
+	if err != nil {
+		return nil, err
+	}
+
+	for p, h := range d.Buckets {
+		prefix := p
+		response.Bucket = append(response.Bucket, &wire.BucketDigest{
+			Prefix: &prefix,
+			Hash:   h,
+		})
+	}
+	return response, nil
+}
+
+// Sync will compare the tracker's records with a peer, taking every record
+// that is newer on the peer and sending every record that is newer here.
+// When both hold the same record but only one gives it its alias, the
+// tracker that does not settles who owns the alias with the same rule as
+// for conflicting registrations.
+func (t *Tracker) Sync(p *Peer) (*SyncResult, error) {
+	router := &Router{
+		URL:    p.URL,
+		Origin: t.Key,
+	}
+	result := &SyncResult{}
+
+	local, err := t.Digest()
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := router.Digest()
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(local.Root(), remote.Root()) {
+		return result, nil
+	}
+
+	differing := local.Diff(remote)
+	result.Buckets = len(differing)
+
+	prefixes := make(map[string]bool)
+	for _, v := range differing {
+		prefixes[v] = true
+	}
+
+	localRecords, err := t.liveRecords(prefixes)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteEntries, err := router.DigestEntries(differing)
+	if err != nil {
+		return nil, err
+	}
+
+	var fetch []string
+	var settle []*StoredRecord
+	for address, theirs := range remoteEntries {
+		mine, ok := localRecords[address]
+		if !ok {
+			fetch = append(fetch, address)
+			continue
+		}
+
+		entry, err := newDigestEntry(mine)
+		if err != nil {
+			return nil, err
+		}
+		if theirs.newerThan(entry) {
+			fetch = append(fetch, address)
+		} else if unsettled(theirs, entry) {
+			claim := registrationFromRecord(mine.Record).Alias
+			settle = append(settle, NewStoredRecord(identity.CreateAddressFromString(address), mine.Record, claim))
+		}
+	}
+
+	for _, r := range settle {
+		if t.acceptReplica(r, p.Address) {
+			result.Settled++
+		}
+	}
+
+	var push []*StoredRecord
+	for address, mine := range localRecords {
+		theirs, ok := remoteEntries[address]
+		if ok {
+			entry, err := newDigestEntry(mine)
+			if err != nil {
+				return nil, err
+			}
+			if !entry.newerThan(theirs) && !unsettled(entry, theirs) {
+				continue
+			}
+		}
+		push = append(push, mine)
+	}
+
+	size := t.Replication.batchSize()
+	for len(fetch) > 0 {
+		n := size
+		if n > len(fetch) {
+			n = len(fetch)
+		}
+
+		records, err := router.Fetch(fetch[:n])
+		if err != nil {
+			return result, err
+		}
+		fetch = fetch[n:]
+
+		for _, r := range records {
+			if t.acceptReplica(r, p.Address) {
+				result.Pulled++
+			}
+		}
+	}
+
+	for len(push) > 0 {
+		n := size
+		if n > len(push) {
+			n = len(push)
+		}
+
+		_, err := router.Replicate(push[:n])
+		if err != nil {
+			return result, err
+		}
+		result.Pushed += n
+		push = push[n:]
+	}
+
+	return result, nil
+}
+
+// StartAntiEntropy will compare the tracker's records with every peer each
+// Replication.SyncInterval, so that peers converge after missing updates.
+// It blocks like StartServer, and Replication must be set before it is
+// called.
+func (t *Tracker) StartAntiEntropy() {
+	interval := t.Replication.SyncInterval
+	if interval <= 0 {
+		interval = DefaultSyncInterval
+	}
+
+	t.Delegate.LogMessage("Synchronizing with Peers every " + interval.String())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, p := range t.Replication.Peers {
+			result, err := t.Sync(p)
+			if err != nil {
+				t.Metrics.inc("tracker_syncs_total", "error")
+				t.handleError("Sync With "+p.URL, err)
+				continue
+			}
+			t.Metrics.inc("tracker_syncs_total", "ok")
+
+			if result.Pulled > 0 || result.Pushed > 0 || result.Settled > 0 {
+				t.Delegate.LogMessage(fmt.Sprintf("Synchronized with %s: %d buckets differed, %d records pulled, %d pushed, %d aliases settled.",
+					p.URL, result.Buckets, result.Pulled, result.Pushed, result.Settled))
+			}
+		}
+	}
+}
+
+// Digest will fetch the digest of every record that a peer tracker holds.
+func (a *Router) Digest() (digest *Digest, err error) {
+	defer func(start time.Time) { a.observe("digest", start, err) }(time.Now())
+
+	response, err := a.digest(&DigestQueryMessage{From: a.Origin})
+	if err != nil {
+		return nil, err
+	}
+
+	digest = &Digest{Buckets: make(map[string][]byte)}
+	for _, v := range response.GetBucket() {
+		digest.Buckets[v.GetPrefix()] = v.GetHash()
+	}
+	return digest, nil
+}
+
+// DigestEntries will fetch an entry for every record that a peer tracker
+// holds in the given buckets, keyed by address.
+func (a *Router) DigestEntries(buckets []string) (entries map[string]*DigestEntry, err error) {
+	defer func(start time.Time) { a.observe("digest", start, err) }(time.Now())
+
+	response, err := a.digest(&DigestQueryMessage{From: a.Origin, Buckets: buckets})
+	if err != nil {
+		return nil, err
+	}
+
+	entries = make(map[string]*DigestEntry)
+	for _, v := range response.GetEntry() {
+		entries[v.GetAddress()] = &DigestEntry{
+			Address: v.GetAddress(),
+			Expires: time.Unix(int64(v.GetExpires()), 0),
+			Hash:    v.GetHash(),
+			Alias:   v.GetAlias(),
+		}
+	}
+	return entries, nil
+}
+
+// Fetch will fetch the current records of a set of addresses from a peer
+// tracker. Records are verified before they are returned, and addresses
+// that the peer does not hold are left out.
+func (a *Router) Fetch(addresses []string) (records []*StoredRecord, err error) {
+	defer func(start time.Time) { a.observe("fetch", start, err) }(time.Now())
+
+	response, err := a.digest(&DigestQueryMessage{From: a.Origin, Fetch: addresses})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range response.GetRecord() {
+		record, err := UnmarshalRecord(v.GetRecord())
+		if err != nil {
+			return nil, err
+		}
+
+		err = VerifyRecord(v.GetAddress(), record)
+		if err != nil {
+			return nil, err
+		}
+
+		address := identity.CreateAddressFromString(v.GetAddress())
+		records = append(records, NewStoredRecord(address, record, registrationFromRecord(record).Alias))
+	}
+	return records, nil
+}
+
+func (a *Router) digest(q *DigestQueryMessage) (*wire.TrackerDigest, error) {
+	conn, err := a.send(q, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	_, d, _, err := readResponse(conn, wire.DigestCode)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &wire.TrackerDigest{}
+	err = proto.Unmarshal(d, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
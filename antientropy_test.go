@@ -0,0 +1,137 @@
+package tracker
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"airdispat.ch/identity"
+)
+
+func TestAntiEntropy(t *testing.T) {
+	keys := make([]*identity.Identity, 2)
+	for i := range keys {
+		key, err := identity.CreateIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+	}
+
+	firstStore, secondStore := newTestingTracker(), newTestingTracker()
+	first := &Tracker{
+		Key:      keys[0],
+		Delegate: firstStore,
+		Replication: &Replication{
+			Peers: []*Peer{{URL: "localhost:9097", Address: keys[1].Address.String()}},
+		},
+	}
+	second := &Tracker{
+		Key:      keys[1],
+		Delegate: secondStore,
+		Replication: &Replication{
+			Peers: []*Peer{{URL: "localhost:9096", Address: keys[0].Address.String()}},
+		},
+	}
+
+	go first.StartServer("9096")
+	go second.StartServer("9097")
+
+	// Wait for Server to Startup
+	time.Sleep(1 * time.Second)
+
+	// Each tracker has missed some of the other's registrations.
+	future := time.Now().Add(time.Hour)
+	onlyFirst, onlyFirstRecord := createTestRecord(t, "first", future)
+	onlySecond, onlySecondRecord := createTestRecord(t, "second", future)
+	shared, olderRecord := createTestRecord(t, "shared", future)
+	newerRecord := signTestRecord(t, shared, "shared", future.Add(time.Hour))
+
+	firstStore.SaveRecord(onlyFirst.Address, onlyFirstRecord, "first")
+	firstStore.SaveRecord(shared.Address, olderRecord, "shared")
+	secondStore.SaveRecord(onlySecond.Address, onlySecondRecord, "second")
+	secondStore.SaveRecord(shared.Address, newerRecord, "shared")
+
+	result, err := first.Sync(first.Replication.Peers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Pulled != 2 || result.Pushed != 1 {
+		t.Errorf("Expected 2 records pulled and 1 pushed, got %+v.", result)
+	}
+
+	if firstStore.GetRecordByAlias("second") == nil {
+		t.Error("Expected the missing record to be pulled.")
+	}
+	pulled := NewStoredRecord(shared.Address, firstStore.GetRecordByAddress(shared.Address), "")
+	if !pulled.Expires.Equal(future.Add(time.Hour).Truncate(time.Second)) {
+		t.Error("Expected the newer record to be pulled.")
+	}
+	if secondStore.GetRecordByAlias("first") == nil {
+		t.Error("Expected the missing record to be pushed.")
+	}
+
+	firstDigest, err := first.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondDigest, err := second.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(firstDigest.Root(), secondDigest.Root()) {
+		t.Error("Expected the trackers to converge.")
+	}
+
+	// Once converged, nothing is transferred.
+	result, err = first.Sync(first.Replication.Peers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Buckets != 0 || result.Pulled != 0 || result.Pushed != 0 {
+		t.Errorf("Expected nothing to differ, got %+v.", result)
+	}
+
+	// Trackers that hold the same records but gave an alias to different
+	// owners converge on the claim that expires last.
+	winner, winning := createTestRecord(t, "bob", future.Add(2*time.Hour))
+	loser, losing := createTestRecord(t, "bob", future.Add(time.Hour))
+	firstStore.SaveRecord(loser.Address, losing, "bob")
+	firstStore.SaveRecord(winner.Address, winning, "bob")
+	secondStore.SaveRecord(winner.Address, winning, "bob")
+	secondStore.SaveRecord(loser.Address, losing, "bob")
+
+	result, err = first.Sync(first.Replication.Peers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Pulled != 0 || result.Pushed != 1 || result.Settled != 0 {
+		t.Errorf("Expected the winning record to be pushed, got %+v.", result)
+	}
+	if owner := secondStore.AliasOwner("bob"); owner != winner.Address.String() {
+		t.Errorf("Expected the peer to give the alias to the newer claim, got %s.", owner)
+	}
+
+	firstDigest, err = first.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondDigest, err = second.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(firstDigest.Root(), secondDigest.Root()) {
+		t.Error("Expected the trackers to agree on the alias's owner.")
+	}
+
+	// The tracker that gave the alias to the older claim settles it
+	// itself when it syncs.
+	secondStore.SaveRecord(loser.Address, losing, "bob")
+	result, err = second.Sync(second.Replication.Peers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Settled != 1 || secondStore.AliasOwner("bob") != winner.Address.String() {
+		t.Errorf("Expected the alias to be settled, got %+v.", result)
+	}
+}
@@ -0,0 +1,365 @@
+// Package audit implements an append-only, hash chained and signed log of
+// every registration that a tracker accepts or rejects.
+//
+// Each entry is a single line of JSON. The hash of an entry covers the hash
+// of the entry before it, so removing or editing any line breaks the chain
+// for every line that follows. Entries are additionally signed with the
+// tracker's signing key, so the chain cannot simply be recomputed by someone
+// with access to the files.
+package audit
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"airdispat.ch/identity"
+)
+
+// Registration outcomes.
+const (
+	Accepted = "accepted"
+	Rejected = "rejected"
+)
+
+// DefaultMaxSize is the size at which a log file is rotated if no other
+// size is given.
+const DefaultMaxSize = 64 << 20
+
+// filePattern is used to name the files in an audit directory. The numbering
+// is what orders the chain across rotations.
+const filePattern = "audit-%06d.log"
+
+// Entry is a single record in the audit log.
+type Entry struct {
+	Sequence uint64    `json:"seq"`
+	Time     time.Time `json:"time"`
+	Outcome  string    `json:"outcome"`
+	Reason   string    `json:"reason,omitempty"`
+
+	Sender      string `json:"sender"`
+	Alias       string `json:"alias,omitempty"`
+	OldAlias    string `json:"old_alias,omitempty"`
+	OldLocation string `json:"old_location,omitempty"`
+	NewLocation string `json:"new_location,omitempty"`
+	OldKey      string `json:"old_key,omitempty"`
+	NewKey      string `json:"new_key,omitempty"`
+
+	// The address that held Alias before the registration, if it was not
+	// the sender, and its location and key.
+	AliasOwner         string `json:"alias_owner,omitempty"`
+	AliasOwnerLocation string `json:"alias_owner_location,omitempty"`
+	AliasOwnerKey      string `json:"alias_owner_key,omitempty"`
+
+	PrevHash  string `json:"prev"`
+	Hash      string `json:"hash"`
+	Signature string `json:"sig,omitempty"`
+}
+
+// KeyFingerprint will return a short, printable fingerprint of an encryption
+// key so that key changes show up in the log without storing the key itself.
+func KeyFingerprint(key []byte) string {
+	if len(key) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:16])
+}
+
+// computeHash returns the chained hash of an entry. The Hash and Signature
+// fields are not covered.
+func (e *Entry) computeHash() (string, error) {
+	c := *e
+	c.Hash = ""
+	c.Signature = ""
+
+	data, err := json.Marshal(&c)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write([]byte(e.PrevHash))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Log is an open audit directory that entries can be appended to. It is
+// safe for concurrent use.
+type Log struct {
+	Dir     string
+	MaxSize int64
+
+	signer *ecdsa.PrivateKey
+
+	lock  sync.Mutex
+	file  *os.File
+	index int
+	size  int64
+	seq   uint64
+	last  string
+}
+
+// Open will open (or create) the audit log in dir. Entries are signed with
+// the signing key of key, which may be nil to produce an unsigned chain.
+func Open(dir string, key *identity.Identity, maxSize int64) (*Log, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		Dir:     dir,
+		MaxSize: maxSize,
+	}
+	if key != nil {
+		l.signer = key.SigningKey
+	}
+
+	files, err := logFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l.index = 1
+	if len(files) > 0 {
+		// Recover the chain from the final entry of the newest file.
+		newest := files[len(files)-1]
+		_, err = fmt.Sscanf(filepath.Base(newest), filePattern, &l.index)
+		if err != nil {
+			return nil, err
+		}
+
+		// The newest file may be empty if we stopped right after rotating.
+		for i := len(files) - 1; i >= 0 && l.seq == 0; i-- {
+			err = readFile(files[i], func(e *Entry) error {
+				l.seq = e.Sequence
+				l.last = e.Hash
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	err = l.openFile()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) openFile() error {
+	name := filepath.Join(l.Dir, fmt.Sprintf(filePattern, l.index))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// rotate will close the current file and start the next one.
+func (l *Log) rotate() error {
+	err := l.file.Close()
+	if err != nil {
+		return err
+	}
+	l.index++
+	return l.openFile()
+}
+
+// Append will chain, sign and durably write a single entry. The Sequence,
+// PrevHash, Hash and Signature fields are filled in by the log.
+func (l *Log) Append(e *Entry) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file == nil {
+		return errors.New("Audit log is closed.")
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+	e.Sequence = l.seq + 1
+	e.PrevHash = l.last
+
+	hash, err := e.computeHash()
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+	e.Signature = ""
+
+	if l.signer != nil {
+		digest, _ := hex.DecodeString(hash)
+		sig, err := ecdsa.SignASN1(rand.Reader, l.signer, digest)
+		if err != nil {
+			return err
+		}
+		e.Signature = hex.EncodeToString(sig)
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if l.size > 0 && l.size+int64(len(line)) > l.MaxSize {
+		err = l.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	err = l.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	l.seq = e.Sequence
+	l.last = e.Hash
+	return nil
+}
+
+// Close will close the current log file.
+func (l *Log) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// logFiles returns the audit files in dir, oldest first.
+func logFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "audit-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func readFile(name string, fn func(*Entry) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		e := &Entry{}
+		err = json.Unmarshal(scanner.Bytes(), e)
+		if err != nil {
+			return fmt.Errorf("%s:%d: corrupt entry: %s", filepath.Base(name), line, err)
+		}
+
+		err = fn(e)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", filepath.Base(name), line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Read will call fn for every entry in the audit directory, in order.
+func Read(dir string, fn func(*Entry) error) error {
+	files, err := logFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range files {
+		err = readFile(name, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify will walk the audit directory and check that the hash chain is
+// intact. If key is not nil, every entry must also carry a valid signature
+// from it. It returns the number of entries that were verified.
+func Verify(dir string, key *ecdsa.PublicKey) (int, error) {
+	var (
+		count int
+		seq   uint64
+		last  string
+	)
+
+	err := Read(dir, func(e *Entry) error {
+		if e.Sequence != seq+1 {
+			return fmt.Errorf("sequence %d follows %d", e.Sequence, seq)
+		}
+
+		if e.PrevHash != last {
+			return fmt.Errorf("entry %d does not chain to the previous entry", e.Sequence)
+		}
+
+		hash, err := e.computeHash()
+		if err != nil {
+			return err
+		}
+		if hash != e.Hash {
+			return fmt.Errorf("entry %d has been modified", e.Sequence)
+		}
+
+		if key != nil {
+			digest, _ := hex.DecodeString(e.Hash)
+			sig, err := hex.DecodeString(e.Signature)
+			if err != nil || !ecdsa.VerifyASN1(key, digest, sig) {
+				return fmt.Errorf("entry %d has an invalid signature", e.Sequence)
+			}
+		}
+
+		count++
+		seq = e.Sequence
+		last = e.Hash
+		return nil
+	})
+
+	return count, err
+}
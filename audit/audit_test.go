@@ -0,0 +1,72 @@
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"airdispat.ch/identity"
+)
+
+func TestAuditChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := identity.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A tiny maximum size forces a rotation on every entry.
+	l, err := Open(dir, key, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, a := range []string{"hunter", "hunter", "other"} {
+		err = l.Append(&Entry{Outcome: Accepted, Sender: "abc", Alias: a})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+
+	// Reopening must continue the existing chain.
+	l, err = Open(dir, key, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Append(&Entry{Outcome: Rejected, Sender: "abc", Reason: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	count, err := Verify(dir, &key.SigningKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("Expected 4 verified entries, got %d.", count)
+	}
+
+	// Tampering with an entry must be detected.
+	name := filepath.Join(dir, "audit-000002.log")
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(name, []byte(strings.Replace(string(data), "hunter", "mallory", 1)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = Verify(dir, nil); err == nil {
+		t.Error("Expected a modified entry to fail verification.")
+	}
+}
@@ -0,0 +1,550 @@
+// Package boltstore implements a durable tracker.RecordStore on top of an
+// embedded bbolt database.
+//
+// Records are kept in four buckets: the records themselves keyed by address,
+// an alias index pointing at the owning address, an expiry index ordered by
+// expiration time and the change feed ordered by sequence number. A bounded
+// history of past records is kept in two more. Every update to all of them
+// happens in a single transaction, so a crash can never leave the indexes
+// pointing at the wrong record.
+package boltstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"time"
+
+	"airdispat.ch/identity"
+	"airdispat.ch/message"
+	"airdispat.ch/tracker"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	recordsBucket = []byte("records")
+	aliasesBucket = []byte("aliases")
+	expiryBucket  = []byte("expiry")
+	changesBucket = []byte("changes")
+)
+
+// DefaultFeedRetention is the number of changes kept in the change feed if
+// no other retention is given.
+const DefaultFeedRetention = 100000
+
+// Options configures how the database is opened.
+type Options struct {
+	// NoSync skips the fsync after every commit. This is much faster, but
+	// the most recent registrations may be lost if the machine crashes.
+	NoSync bool
+
+	// Timeout is how long to wait for the lock on the database file.
+	Timeout time.Duration
+
+	// FeedRetention is the number of changes kept in the change feed.
+	FeedRetention int
+
+	// HistoryLimit is the number of past records kept for each address and
+	// alias.
+	HistoryLimit int
+}
+
+// Store is a tracker.RecordStore backed by a bbolt database file.
+type Store struct {
+	// ErrorHandler is called when the database fails. If it is not set,
+	// errors are logged.
+	ErrorHandler func(err *tracker.TrackerError)
+
+	db           *bolt.DB
+	retention    uint64
+	historyLimit int
+}
+
+// entry is how a record is encoded in the records bucket.
+type entry struct {
+	Alias   string `json:"alias,omitempty"`
+	Expires int64  `json:"expires,omitempty"`
+	Record  []byte `json:"record"`
+}
+
+// change is how a change is encoded in the changes bucket.
+type change struct {
+	Kind    tracker.ChangeKind `json:"kind"`
+	Address string             `json:"address"`
+	Alias   string             `json:"alias,omitempty"`
+	Time    int64              `json:"time"`
+	Record  []byte             `json:"record,omitempty"`
+}
+
+// Open will open (or create) a database at path.
+func Open(path string, opts *Options) (*Store, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{
+		Timeout: timeout,
+		NoSync:  opts.NoSync,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{recordsBucket, aliasesBucket, expiryBucket, changesBucket, historyBucket, aliasHistoryBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	retention := uint64(opts.FeedRetention)
+	if retention == 0 {
+		retention = DefaultFeedRetention
+	}
+
+	historyLimit := opts.HistoryLimit
+	if historyLimit == 0 {
+		historyLimit = DefaultHistoryLimit
+	}
+
+	return &Store{
+		db:           db,
+		retention:    retention,
+		historyLimit: historyLimit,
+	}, nil
+}
+
+// Close will close the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Sync will force all committed changes to disk. It is only needed when
+// the store was opened with NoSync.
+func (s *Store) Sync() error {
+	return s.db.Sync()
+}
+
+func (s *Store) handleError(location string, err error) {
+	if s.ErrorHandler != nil {
+		s.ErrorHandler(&tracker.TrackerError{
+			Location: location,
+			Error:    err,
+		})
+		return
+	}
+	log.Println("Bolt Store Error At:", location, "-", err)
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// expiryKey orders the expiry index by time, then by address.
+func expiryKey(expires int64, address string) []byte {
+	return append(itob(uint64(expires)), address...)
+}
+
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func decodeEntry(address string, data []byte) (*tracker.StoredRecord, error) {
+	e := &entry{}
+	err := json.Unmarshal(data, e)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := tracker.UnmarshalRecord(e.Record)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &tracker.StoredRecord{
+		Address: address,
+		Alias:   e.Alias,
+		Record:  record,
+	}
+	if e.Expires != 0 {
+		r.Expires = time.Unix(e.Expires, 0)
+	}
+	return r, nil
+}
+
+// appendChange will add to the change feed and trim it to the retention.
+func (s *Store) appendChange(tx *bolt.Tx, kind tracker.ChangeKind, address string, alias string, record []byte) error {
+	b := tx.Bucket(changesBucket)
+
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(&change{
+		Kind:    kind,
+		Address: address,
+		Alias:   alias,
+		Time:    time.Now().Unix(),
+		Record:  record,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = b.Put(itob(seq), data)
+	if err != nil {
+		return err
+	}
+
+	if seq > s.retention {
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= seq-s.retention; k, _ = c.Next() {
+			err = c.Delete()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// remove will delete a record and its index entries. It returns the
+// removed entry, or nil if there was none.
+func remove(tx *bolt.Tx, address string) (*entry, error) {
+	data := tx.Bucket(recordsBucket).Get([]byte(address))
+	if data == nil {
+		return nil, nil
+	}
+
+	old := &entry{}
+	err := json.Unmarshal(data, old)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Bucket(recordsBucket).Delete([]byte(address))
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Bucket(expiryBucket).Delete(expiryKey(old.Expires, address))
+	if err != nil {
+		return nil, err
+	}
+
+	aliases := tx.Bucket(aliasesBucket)
+	if old.Alias != "" && string(aliases.Get([]byte(old.Alias))) == address {
+		err = aliases.Delete([]byte(old.Alias))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = markReplaced(tx, address, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return old, nil
+}
+
+func (s *Store) put(tx *bolt.Tx, r *tracker.StoredRecord) error {
+	data, err := tracker.MarshalRecord(r.Record)
+	if err != nil {
+		return err
+	}
+
+	// Removing the old record releases its alias and expiry entries.
+	_, err = remove(tx, r.Address)
+	if err != nil {
+		return err
+	}
+
+	e := &entry{
+		Alias:   r.Alias,
+		Expires: unixTime(r.Expires),
+		Record:  data,
+	}
+
+	encoded, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket(recordsBucket).Put([]byte(r.Address), encoded)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket(expiryBucket).Put(expiryKey(e.Expires, r.Address), nil)
+	if err != nil {
+		return err
+	}
+
+	if r.Alias != "" {
+		err = tx.Bucket(aliasesBucket).Put([]byte(r.Alias), []byte(r.Address))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.saveVersion(tx, r, data, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return s.appendChange(tx, tracker.ChangeUpdate, r.Address, r.Alias, data)
+}
+
+// SaveRecord will store a record, replacing any earlier record for the same
+// address. Claiming an alias takes it away from its previous owner.
+func (s *Store) SaveRecord(address *identity.Address, record *message.SignedMessage, alias string) {
+	r := tracker.NewStoredRecord(address, record, alias)
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return s.put(tx, r)
+	})
+	if err != nil {
+		s.handleError("Save Record", err)
+	}
+}
+
+// get must be called inside of a transaction.
+func get(tx *bolt.Tx, address string) (*tracker.StoredRecord, error) {
+	data := tx.Bucket(recordsBucket).Get([]byte(address))
+	if data == nil {
+		return nil, nil
+	}
+	return decodeEntry(address, data)
+}
+
+// GetRecordByAddress will return the current record for an address.
+func (s *Store) GetRecordByAddress(address *identity.Address) *message.SignedMessage {
+	var r *tracker.StoredRecord
+	err := s.db.View(func(tx *bolt.Tx) (err error) {
+		r, err = get(tx, address.String())
+		return
+	})
+
+	if err != nil {
+		s.handleError("Get Record By Address", err)
+		return nil
+	}
+
+	if r == nil || r.Expired(time.Now()) {
+		return nil
+	}
+	return r.Record
+}
+
+// GetRecordByAlias will return the current record of the owner of an alias.
+func (s *Store) GetRecordByAlias(alias string) *message.SignedMessage {
+	var r *tracker.StoredRecord
+	err := s.db.View(func(tx *bolt.Tx) (err error) {
+		address := tx.Bucket(aliasesBucket).Get([]byte(alias))
+		if address == nil {
+			return nil
+		}
+		r, err = get(tx, string(address))
+		return
+	})
+
+	if err != nil {
+		s.handleError("Get Record By Alias", err)
+		return nil
+	}
+
+	if r == nil || r.Alias != alias || r.Expired(time.Now()) {
+		return nil
+	}
+	return r.Record
+}
+
+// AliasOwner will return the address that currently owns an alias, or the
+// empty string if it is free.
+func (s *Store) AliasOwner(alias string) string {
+	var r *tracker.StoredRecord
+	err := s.db.View(func(tx *bolt.Tx) (err error) {
+		address := tx.Bucket(aliasesBucket).Get([]byte(alias))
+		if address == nil {
+			return nil
+		}
+		r, err = get(tx, string(address))
+		return
+	})
+
+	if err != nil {
+		s.handleError("Alias Owner", err)
+		return ""
+	}
+
+	if r == nil || r.Expired(time.Now()) {
+		return ""
+	}
+	return r.Address
+}
+
+// DeleteRecord implements tracker.RecordDeleter.
+func (s *Store) DeleteRecord(address *identity.Address) {
+	s.delete(address, tracker.ChangeDelete)
+}
+
+// ExpireRecord implements tracker.RecordExpirer.
+func (s *Store) ExpireRecord(address *identity.Address) {
+	s.delete(address, tracker.ChangeExpire)
+}
+
+func (s *Store) delete(address *identity.Address, kind tracker.ChangeKind) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		old, err := remove(tx, address.String())
+		if err != nil || old == nil {
+			return err
+		}
+		return s.appendChange(tx, kind, address.String(), old.Alias, nil)
+	})
+	if err != nil {
+		s.handleError("Delete Record", err)
+	}
+}
+
+// ForEachRecord implements tracker.RecordIterator.
+func (s *Store) ForEachRecord(fn func(record *tracker.StoredRecord) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(recordsBucket).ForEach(func(k, v []byte) error {
+			r, err := decodeEntry(string(k), v)
+			if err != nil {
+				return err
+			}
+			return fn(r)
+		})
+	})
+}
+
+// ForEachExpired will call fn for every record that expires before the
+// given time, soonest first, using the expiry index.
+func (s *Store) ForEachExpired(before time.Time, fn func(record *tracker.StoredRecord) error) error {
+	limit := itob(uint64(before.Unix()))
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(expiryBucket).Cursor()
+
+		// Records without an expiry are indexed at zero, and never expire.
+		for k, _ := c.Seek(itob(1)); k != nil && bytes.Compare(k[:8], limit) < 0; k, _ = c.Next() {
+			r, err := get(tx, string(k[8:]))
+			if err != nil {
+				return err
+			}
+			if r == nil {
+				continue
+			}
+
+			err = fn(r)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CountRecords implements tracker.RecordCounter.
+func (s *Store) CountRecords() (addresses int, aliases int) {
+	err := s.db.View(func(tx *bolt.Tx) error {
+		addresses = tx.Bucket(recordsBucket).Stats().KeyN
+		aliases = tx.Bucket(aliasesBucket).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		s.handleError("Count Records", err)
+	}
+	return
+}
+
+// CheckHealth implements tracker.HealthChecker.
+func (s *Store) CheckHealth() error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
+// ChangesSince implements tracker.ChangeFeed.
+func (s *Store) ChangesSince(cursor uint64, limit int) ([]*tracker.Change, error) {
+	var changes []*tracker.Change
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(changesBucket)
+		c := b.Cursor()
+
+		if cursor > b.Sequence() {
+			return tracker.ErrFeedTruncated
+		}
+
+		first, _ := c.First()
+		if first != nil && cursor+1 < binary.BigEndian.Uint64(first) {
+			return tracker.ErrFeedTruncated
+		}
+
+		for k, v := c.Seek(itob(cursor + 1)); k != nil; k, v = c.Next() {
+			if limit > 0 && len(changes) >= limit {
+				break
+			}
+
+			ch := &change{}
+			err := json.Unmarshal(v, ch)
+			if err != nil {
+				return err
+			}
+
+			out := &tracker.Change{
+				Sequence: binary.BigEndian.Uint64(k),
+				Kind:     ch.Kind,
+				Address:  ch.Address,
+				Alias:    ch.Alias,
+				Time:     time.Unix(ch.Time, 0),
+			}
+
+			if ch.Record != nil {
+				out.Record, err = tracker.UnmarshalRecord(ch.Record)
+				if err != nil {
+					return err
+				}
+			}
+
+			changes = append(changes, out)
+		}
+		return nil
+	})
+
+	return changes, err
+}
+
+// LastSequence implements tracker.ChangeFeed.
+func (s *Store) LastSequence() (seq uint64) {
+	err := s.db.View(func(tx *bolt.Tx) error {
+		seq = tx.Bucket(changesBucket).Sequence()
+		return nil
+	})
+	if err != nil {
+		s.handleError("Last Sequence", err)
+	}
+	return
+}
@@ -0,0 +1,91 @@
+package boltstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"airdispat.ch/tracker"
+	"airdispat.ch/tracker/storetest"
+)
+
+func TestBoltStorePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "records.db")
+
+	store, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, firstRecord := storetest.CreateRecord(t, "hunter", time.Now().Add(time.Hour))
+	second, secondRecord := storetest.CreateRecord(t, "old", time.Now().Add(-time.Hour))
+	store.SaveRecord(first.Address, firstRecord, "hunter")
+	store.SaveRecord(second.Address, secondRecord, "old")
+	store.Close()
+
+	// Everything must survive reopening the database.
+	store, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if store.GetRecordByAlias("hunter") == nil || store.GetRecordByAddress(first.Address) == nil {
+		t.Error("Expected the record to be persisted.")
+	}
+	if store.GetRecordByAddress(second.Address) != nil {
+		t.Error("Expected the expired record to be hidden.")
+	}
+
+	var expired []string
+	err = store.ForEachExpired(time.Now(), func(r *tracker.StoredRecord) error {
+		expired = append(expired, r.Address)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0] != second.Address.String() {
+		t.Error("Expected the expiry index to return only the expired record.")
+	}
+
+	store.DeleteRecord(first.Address)
+	if store.AliasOwner("hunter") != "" {
+		t.Error("Expected deleting the record to release its alias.")
+	}
+
+	changes, err := store.ChangesSince(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 || changes[2].Kind != tracker.ChangeDelete || store.LastSequence() != 3 {
+		t.Error("Expected two updates followed by a tombstone.")
+	}
+}
+
+func TestBoltStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (tracker.RecordStore, func()) {
+		dir, err := ioutil.TempDir("", "boltstore")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		store, err := Open(filepath.Join(dir, "records.db"), &Options{NoSync: true})
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+
+		return store, func() {
+			store.Close()
+			os.RemoveAll(dir)
+		}
+	})
+}
@@ -0,0 +1,231 @@
+package boltstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"airdispat.ch/tracker"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Every record that is saved is also kept in the history bucket, keyed by
+// its address and a version number, until it is trimmed. The alias history
+// bucket indexes the same versions by alias.
+var (
+	historyBucket      = []byte("history")
+	aliasHistoryBucket = []byte("alias_history")
+)
+
+// DefaultHistoryLimit is the number of past records kept for each address
+// and alias if no other limit is given.
+const DefaultHistoryLimit = 16
+
+// version is how a record is encoded in the history bucket.
+type version struct {
+	Alias    string `json:"alias,omitempty"`
+	Expires  int64  `json:"expires,omitempty"`
+	Saved    int64  `json:"saved"`
+	Replaced int64  `json:"replaced,omitempty"`
+	Record   []byte `json:"record"`
+}
+
+// historyKey orders versions by their owner, then by version number.
+func historyKey(owner string, v uint64) []byte {
+	key := make([]byte, 0, len(owner)+9)
+	key = append(key, owner...)
+	key = append(key, 0)
+	return append(key, itob(v)...)
+}
+
+func historyPrefix(owner string) []byte {
+	return append([]byte(owner), 0)
+}
+
+// saveVersion will add a newly saved record to the history.
+func (s *Store) saveVersion(tx *bolt.Tx, r *tracker.StoredRecord, data []byte, now time.Time) error {
+	hb := tx.Bucket(historyBucket)
+
+	v, err := hb.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(&version{
+		Alias:   r.Alias,
+		Expires: unixTime(r.Expires),
+		Saved:   now.Unix(),
+		Record:  data,
+	})
+	if err != nil {
+		return err
+	}
+
+	key := historyKey(r.Address, v)
+	err = hb.Put(key, encoded)
+	if err != nil {
+		return err
+	}
+
+	// Keep the current record as well as the limit.
+	err = trim(hb, historyPrefix(r.Address), s.historyLimit+1)
+	if err != nil {
+		return err
+	}
+
+	if r.Alias == "" {
+		return nil
+	}
+
+	ab := tx.Bucket(aliasHistoryBucket)
+	err = ab.Put(historyKey(r.Alias, v), key)
+	if err != nil {
+		return err
+	}
+	return trim(ab, historyPrefix(r.Alias), s.historyLimit)
+}
+
+// markReplaced will record when the newest version of an address stopped
+// being current.
+func markReplaced(tx *bolt.Tx, address string, now time.Time) error {
+	hb := tx.Bucket(historyBucket)
+	prefix := historyPrefix(address)
+
+	k, data := last(hb.Cursor(), prefix)
+	if k == nil {
+		return nil
+	}
+
+	v := &version{}
+	err := json.Unmarshal(data, v)
+	if err != nil {
+		return err
+	}
+	if v.Replaced != 0 {
+		return nil
+	}
+
+	v.Replaced = now.Unix()
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return hb.Put(k, encoded)
+}
+
+// last will position a cursor on the newest key with the given prefix.
+func last(c *bolt.Cursor, prefix []byte) ([]byte, []byte) {
+	// Seek to just past every key with the prefix, then step back.
+	end := append(append([]byte(nil), prefix[:len(prefix)-1]...), 1)
+
+	k, v := c.Seek(end)
+	if k == nil {
+		k, v = c.Last()
+	} else {
+		k, v = c.Prev()
+	}
+
+	if k == nil || !bytes.HasPrefix(k, prefix) {
+		return nil, nil
+	}
+	return k, v
+}
+
+// trim will delete the oldest keys with the given prefix until only limit
+// remain.
+func trim(b *bolt.Bucket, prefix []byte, limit int) error {
+	c := b.Cursor()
+
+	count := 0
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		count++
+	}
+
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) && count > limit; k, _ = c.Seek(prefix) {
+		err := c.Delete()
+		if err != nil {
+			return err
+		}
+		count--
+	}
+	return nil
+}
+
+func decodeVersion(key []byte, data []byte) (*tracker.HistoricalRecord, error) {
+	v := &version{}
+	err := json.Unmarshal(data, v)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := tracker.UnmarshalRecord(v.Record)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &tracker.HistoricalRecord{
+		StoredRecord: tracker.StoredRecord{
+			Address: string(key[:len(key)-9]),
+			Alias:   v.Alias,
+			Record:  record,
+		},
+		Saved: time.Unix(v.Saved, 0),
+	}
+	if v.Expires != 0 {
+		h.Expires = time.Unix(v.Expires, 0)
+	}
+	if v.Replaced != 0 {
+		h.Replaced = time.Unix(v.Replaced, 0)
+	}
+	return h, nil
+}
+
+// AddressHistory implements tracker.RecordHistory.
+func (s *Store) AddressHistory(address string) ([]*tracker.HistoricalRecord, error) {
+	var out []*tracker.HistoricalRecord
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := historyPrefix(address)
+		c := tx.Bucket(historyBucket).Cursor()
+
+		for k, v := last(c, prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Prev() {
+			h, err := decodeVersion(k, v)
+			if err != nil {
+				return err
+			}
+			out = append(out, h)
+		}
+		return nil
+	})
+
+	return out, err
+}
+
+// AliasHistory implements tracker.RecordHistory.
+func (s *Store) AliasHistory(alias string) ([]*tracker.HistoricalRecord, error) {
+	var out []*tracker.HistoricalRecord
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := historyPrefix(alias)
+		hb := tx.Bucket(historyBucket)
+		c := tx.Bucket(aliasHistoryBucket).Cursor()
+
+		for k, ref := last(c, prefix); k != nil && bytes.HasPrefix(k, prefix); k, ref = c.Prev() {
+			// The version may have been trimmed from its address's
+			// history already.
+			data := hb.Get(ref)
+			if data == nil {
+				continue
+			}
+
+			h, err := decodeVersion(ref, data)
+			if err != nil {
+				return err
+			}
+			out = append(out, h)
+		}
+		return nil
+	})
+
+	return out, err
+}
@@ -0,0 +1,264 @@
+package tracker
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"airdispat.ch/identity"
+	"airdispat.ch/message"
+)
+
+// DefaultCacheSize is the number of lookups kept by a RecordCache if no
+// other size is given.
+const DefaultCacheSize = 10000
+
+// DefaultCacheTTL is how long a RecordCache keeps a lookup if no other TTL
+// is given.
+const DefaultCacheTTL = time.Minute
+
+// RecordCache keeps recently queried records in memory so that repeated
+// queries do not have to reach the RecordStore. Entries are kept for at
+// most TTL, and never past the expiry of the record itself. The tracker
+// invalidates entries whenever it saves or sweeps a record, so a cache
+// should not be shared with a store that is written to by anything else.
+type RecordCache struct {
+	// Size is the most lookups that are kept. The least recently used
+	// lookup is evicted to make room for a new one.
+	Size int
+
+	// TTL is the longest that a lookup is kept.
+	TTL time.Duration
+
+	lock    sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+
+	// Keys of the cached lookups that resolve to each address.
+	owners map[string]map[string]bool
+
+	// epoch is advanced by every invalidation, so that a lookup which
+	// raced with a save is not cached.
+	epoch uint64
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// CacheStats reports how a RecordCache has performed.
+type CacheStats struct {
+	Entries   int    `json:"entries"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+type cacheEntry struct {
+	key     string
+	owner   string
+	record  *message.SignedMessage
+	expires time.Time
+}
+
+// NewRecordCache will create a cache that holds up to size lookups for ttl
+// each. Sizes and TTLs that are not positive are replaced by the defaults.
+func NewRecordCache(size int, ttl time.Duration) *RecordCache {
+	return &RecordCache{
+		Size: size,
+		TTL:  ttl,
+	}
+}
+
+func (c *RecordCache) size() int {
+	if c.Size <= 0 {
+		return DefaultCacheSize
+	}
+	return c.Size
+}
+
+func (c *RecordCache) ttl() time.Duration {
+	if c.TTL <= 0 {
+		return DefaultCacheTTL
+	}
+	return c.TTL
+}
+
+// get will return a cached record and the epoch that a lookup for it must
+// be stored under.
+func (c *RecordCache) get(key string, now time.Time) (*message.SignedMessage, uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*cacheEntry)
+		if now.Before(e.expires) {
+			c.hits++
+			c.order.MoveToFront(el)
+			return e.record, c.epoch
+		}
+		c.remove(el)
+	}
+
+	c.misses++
+	return nil, c.epoch
+}
+
+// put will cache a record that was looked up in the store, unless the
+// store has been written to since the lookup began.
+func (c *RecordCache) put(key string, record *message.SignedMessage, epoch uint64, now time.Time) {
+	reg := registrationFromRecord(record)
+	if reg == nil {
+		return
+	}
+
+	expires := now.Add(c.ttl())
+	if !reg.Expires.IsZero() && reg.Expires.Before(expires) {
+		expires = reg.Expires
+	}
+	if !now.Before(expires) {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if epoch != c.epoch {
+		return
+	}
+
+	if c.entries == nil {
+		c.order = list.New()
+		c.entries = make(map[string]*list.Element)
+		c.owners = make(map[string]map[string]bool)
+	}
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+
+	e := &cacheEntry{
+		key:     key,
+		owner:   reg.Address,
+		record:  record,
+		expires: expires,
+	}
+	c.entries[key] = c.order.PushFront(e)
+
+	keys, ok := c.owners[e.owner]
+	if !ok {
+		keys = make(map[string]bool)
+		c.owners[e.owner] = keys
+	}
+	keys[key] = true
+
+	for c.order.Len() > c.size() {
+		c.remove(c.order.Back())
+		c.evictions++
+	}
+}
+
+// remove must be called with the lock held.
+func (c *RecordCache) remove(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	c.order.Remove(el)
+	delete(c.entries, e.key)
+
+	if keys, ok := c.owners[e.owner]; ok {
+		delete(keys, e.key)
+		if len(keys) == 0 {
+			delete(c.owners, e.owner)
+		}
+	}
+}
+
+// Invalidate will drop every cached lookup that resolves to the address,
+// as well as any lookup of the alias.
+func (c *RecordCache) Invalidate(address string, alias string) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.epoch++
+
+	for key := range c.owners[address] {
+		c.remove(c.entries[key])
+	}
+
+	if alias != "" {
+		if el, ok := c.entries[aliasWatchKey(alias)]; ok {
+			c.remove(el)
+		}
+	}
+}
+
+// Purge will empty the cache.
+func (c *RecordCache) Purge() {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.epoch++
+	c.order = nil
+	c.entries = nil
+	c.owners = nil
+}
+
+// Stats will return the current size of the cache and how often it has
+// been used.
+func (c *RecordCache) Stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stats := CacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+	if c.order != nil {
+		stats.Entries = c.order.Len()
+	}
+	return stats
+}
+
+// lookupAddress will find the record for an address, consulting the
+// tracker's cache if it has one.
+func (t *Tracker) lookupAddress(address *identity.Address) *message.SignedMessage {
+	return t.lookup(addressWatchKey(address.String()), func() *message.SignedMessage {
+		return t.records().GetRecordByAddress(address)
+	})
+}
+
+// lookupAlias will find the record for an alias, consulting the tracker's
+// cache if it has one.
+func (t *Tracker) lookupAlias(alias string) *message.SignedMessage {
+	return t.lookup(aliasWatchKey(alias), func() *message.SignedMessage {
+		return t.records().GetRecordByAlias(alias)
+	})
+}
+
+func (t *Tracker) lookup(key string, load func() *message.SignedMessage) *message.SignedMessage {
+	if t.Cache == nil {
+		return load()
+	}
+
+	now := time.Now()
+	record, epoch := t.Cache.get(key, now)
+	if record != nil {
+		t.Metrics.inc("tracker_cache_requests_total", "hit")
+		return record
+	}
+	t.Metrics.inc("tracker_cache_requests_total", "miss")
+
+	record = load()
+	if record != nil {
+		t.Cache.put(key, record, epoch, now)
+	}
+	return record
+}
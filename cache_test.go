@@ -0,0 +1,110 @@
+package tracker
+
+import (
+	"testing"
+	"time"
+
+	"airdispat.ch/identity"
+	"airdispat.ch/message"
+)
+
+// countingStore counts how often lookups reach the store.
+type countingStore struct {
+	*MemoryStore
+	loads int
+}
+
+func (c *countingStore) GetRecordByAddress(address *identity.Address) *message.SignedMessage {
+	c.loads++
+	return c.MemoryStore.GetRecordByAddress(address)
+}
+
+func (c *countingStore) GetRecordByAlias(alias string) *message.SignedMessage {
+	c.loads++
+	return c.MemoryStore.GetRecordByAlias(alias)
+}
+
+func TestRecordCache(t *testing.T) {
+	store := &countingStore{MemoryStore: NewMemoryStore()}
+	tracker := &Tracker{
+		Delegate: newTestingTracker(),
+		Store:    store,
+		Metrics:  NewMetrics(),
+		Cache:    NewRecordCache(10, time.Hour),
+	}
+
+	id, record := createTestRecord(t, "hunter", time.Now().Add(time.Hour))
+	tracker.saveRecord(id.Address, record, "hunter")
+
+	for i := 0; i < 3; i++ {
+		if tracker.lookupAlias("hunter") != record || tracker.lookupAddress(id.Address) != record {
+			t.Fatal("Expected to find the saved record.")
+		}
+	}
+	if store.loads != 2 {
+		t.Errorf("Expected the store to be used for the first lookups only, got %d loads.", store.loads)
+	}
+
+	stats := tracker.Cache.Stats()
+	if stats.Entries != 2 || stats.Hits != 4 || stats.Misses != 2 {
+		t.Errorf("Unexpected cache stats %+v.", stats)
+	}
+	if tracker.Metrics.Value("tracker_cache_requests_total", "hit") != 4 {
+		t.Error("Expected cache hits to be counted.")
+	}
+
+	// Moving to a new alias must drop the cached lookup of the old one.
+	renamed := signTestRecord(t, id, "renamed", time.Now().Add(time.Hour))
+	tracker.saveRecord(id.Address, renamed, "renamed")
+
+	if tracker.lookupAlias("hunter") != nil {
+		t.Error("Expected the old alias lookup to be invalidated.")
+	}
+	if tracker.lookupAddress(id.Address) != renamed {
+		t.Error("Expected the address lookup to be invalidated.")
+	}
+}
+
+func TestRecordCacheLimits(t *testing.T) {
+	cache := NewRecordCache(2, time.Hour)
+	now := time.Now()
+
+	var records []*message.SignedMessage
+	for i, alias := range []string{"a", "b", "c"} {
+		_, record := createTestRecord(t, alias, now.Add(time.Hour))
+		records = append(records, record)
+
+		_, epoch := cache.get(aliasWatchKey(alias), now)
+		cache.put(aliasWatchKey(alias), records[i], epoch, now)
+	}
+
+	// The least recently used lookup is evicted.
+	if r, _ := cache.get(aliasWatchKey("a"), now); r != nil {
+		t.Error("Expected the oldest lookup to be evicted.")
+	}
+	if r, _ := cache.get(aliasWatchKey("c"), now); r != records[2] {
+		t.Error("Expected the newest lookup to be cached.")
+	}
+	if stats := cache.Stats(); stats.Evictions != 1 || stats.Entries != 2 {
+		t.Errorf("Unexpected cache stats %+v.", stats)
+	}
+
+	// Entries never outlive the record that they hold.
+	_, soon := createTestRecord(t, "soon", now.Add(time.Minute))
+	_, epoch := cache.get(aliasWatchKey("soon"), now)
+	cache.put(aliasWatchKey("soon"), soon, epoch, now)
+
+	if r, _ := cache.get(aliasWatchKey("soon"), now.Add(2*time.Minute)); r != nil {
+		t.Error("Expected the lookup to lapse with the record.")
+	}
+
+	// A lookup that raced with a save is not cached.
+	_, epoch = cache.get(aliasWatchKey("d"), now)
+	cache.Invalidate("someone", "d")
+	_, record := createTestRecord(t, "d", now.Add(time.Hour))
+	cache.put(aliasWatchKey("d"), record, epoch, now)
+
+	if r, _ := cache.get(aliasWatchKey("d"), now); r != nil {
+		t.Error("Expected a stale lookup not to be cached.")
+	}
+}
@@ -0,0 +1,266 @@
+package cluster
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"airdispat.ch/identity"
+	"airdispat.ch/tracker"
+	"airdispat.ch/tracker/storetest"
+)
+
+func listen(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// startCluster will run a cluster of nodes on local ports. If dir is set,
+// each node keeps its log in a subdirectory of it.
+func startCluster(t *testing.T, size int, dir string) ([]*Node, []*Config) {
+	listeners := make([]net.Listener, size)
+	peers := make(map[string]string)
+	for i := range listeners {
+		listeners[i] = listen(t)
+		peers[fmt.Sprint("node", i)] = listeners[i].Addr().String()
+	}
+
+	nodes := make([]*Node, size)
+	configs := make([]*Config, size)
+	for i := range nodes {
+		configs[i] = &Config{
+			ID:                fmt.Sprint("node", i),
+			Peers:             peers,
+			Store:             tracker.NewMemoryStore(),
+			Linearizable:      true,
+			HeartbeatInterval: 10 * time.Millisecond,
+			ElectionTimeout:   100 * time.Millisecond,
+			ProposeTimeout:    2 * time.Second,
+		}
+		if dir != "" {
+			configs[i].Dir = filepath.Join(dir, configs[i].ID)
+		}
+
+		n, err := New(configs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i] = n
+		go n.Run(listeners[i])
+	}
+
+	return nodes, configs
+}
+
+func stopCluster(nodes []*Node) {
+	for _, n := range nodes {
+		n.Close()
+	}
+}
+
+// waitForLeader will return the node that leads the running nodes.
+func waitForLeader(t *testing.T, nodes []*Node) *Node {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, n := range nodes {
+			if n != nil && n.IsLeader() {
+				return n
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Expected the cluster to elect a leader.")
+	return nil
+}
+
+func TestNodeConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (tracker.RecordStore, func()) {
+		nodes, _ := startCluster(t, 1, "")
+		waitForLeader(t, nodes)
+		return nodes[0], func() { stopCluster(nodes) }
+	})
+}
+
+func TestCluster(t *testing.T) {
+	nodes, _ := startCluster(t, 3, "")
+	defer stopCluster(nodes)
+
+	leader := waitForLeader(t, nodes)
+	var follower *Node
+	for _, n := range nodes {
+		if n != leader {
+			follower = n
+			break
+		}
+	}
+
+	// Writes through a follower are forwarded to the leader, and every
+	// node applies them.
+	id, record := storetest.CreateRecord(t, "hunter", time.Now().Add(time.Hour))
+	follower.SaveRecord(id.Address, record, "hunter")
+
+	for _, n := range nodes {
+		if !storetest.SameRecord(n.GetRecordByAlias("hunter"), record) {
+			t.Errorf("Expected %s to hold the registration.", n.config.ID)
+		}
+	}
+
+	// The cluster keeps working after its leader fails.
+	leader.Close()
+	var rest []*Node
+	for _, n := range nodes {
+		if n != leader {
+			rest = append(rest, n)
+		}
+	}
+
+	next := waitForLeader(t, rest)
+	if next == leader {
+		t.Fatal("Expected a new leader to be elected.")
+	}
+
+	otherID, other := storetest.CreateRecord(t, "other", time.Now().Add(time.Hour))
+	rest[0].SaveRecord(otherID.Address, other, "other")
+	rest[0].DeleteRecord(id.Address)
+
+	for _, n := range rest {
+		if !storetest.SameRecord(n.GetRecordByAlias("other"), other) {
+			t.Errorf("Expected %s to hold the new registration.", n.config.ID)
+		}
+		if n.GetRecordByAddress(id.Address) != nil {
+			t.Errorf("Expected %s to have deleted the registration.", n.config.ID)
+		}
+	}
+
+	if status := rest[0].Status(); status.Leader != next.config.ID || status.Applied != status.Commit {
+		t.Errorf("Unexpected status %+v.", status)
+	}
+}
+
+func TestClusterWithoutMajority(t *testing.T) {
+	nodes, _ := startCluster(t, 3, "")
+	defer stopCluster(nodes)
+
+	leader := waitForLeader(t, nodes)
+	for _, n := range nodes {
+		if n != leader {
+			n.Close()
+		}
+	}
+
+	var errs []*tracker.TrackerError
+	leader.ErrorHandler = func(err *tracker.TrackerError) { errs = append(errs, err) }
+	leader.config.ProposeTimeout = 200 * time.Millisecond
+
+	id, record := storetest.CreateRecord(t, "hunter", time.Now().Add(time.Hour))
+	leader.SaveRecord(id.Address, record, "hunter")
+	if len(errs) != 1 {
+		t.Fatalf("Expected the write to fail, got %v.", errs)
+	}
+
+	// A leader without a majority can not confirm that it still leads.
+	if leader.GetRecordByAlias("hunter") != nil || len(errs) != 2 {
+		t.Error("Expected the read to fail.")
+	}
+}
+
+func TestClusterRegistrationWithoutMajority(t *testing.T) {
+	nodes, _ := startCluster(t, 3, "")
+	defer stopCluster(nodes)
+
+	leader := waitForLeader(t, nodes)
+	for _, n := range nodes {
+		if n != leader {
+			n.Close()
+		}
+	}
+	leader.ErrorHandler = func(err *tracker.TrackerError) {}
+	leader.config.ProposeTimeout = 200 * time.Millisecond
+
+	key, err := identity.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	theTracker := &tracker.Tracker{
+		Key:      key,
+		Delegate: tracker.BasicTracker{},
+		Store:    leader,
+		Metrics:  tracker.NewMetrics(),
+	}
+	go theTracker.StartServer("9118")
+
+	// Wait for Server to Startup
+	time.Sleep(1 * time.Second)
+
+	toLog, err := identity.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	toLog.SetLocation("example.com")
+
+	// The tracker must not accept a registration that the cluster did not
+	// commit.
+	err = (&tracker.Router{URL: "localhost:9118", Origin: toLog}).Register(toLog, "hunter", nil)
+	if err == nil {
+		t.Error("Expected the registration to be refused.")
+	}
+	if theTracker.Metrics.Value("tracker_registrations_total", "rejected") != 1 {
+		t.Error("Expected the registration to be counted as rejected.")
+	}
+	if leader.config.Store.GetRecordByAddress(toLog.Address) != nil {
+		t.Error("Expected the registration not to be applied.")
+	}
+}
+
+func TestClusterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	nodes, configs := startCluster(t, 3, dir)
+	waitForLeader(t, nodes)
+
+	id, record := storetest.CreateRecord(t, "hunter", time.Now().Add(time.Hour))
+	nodes[0].SaveRecord(id.Address, record, "hunter")
+	stopCluster(nodes)
+
+	// Restarted nodes rebuild their stores from the log.
+	for i, c := range configs {
+		l, err := net.Listen("tcp", c.Peers[c.ID])
+		if err != nil {
+			t.Skip("Unable to listen on the same port again:", err)
+		}
+
+		c.Store = tracker.NewMemoryStore()
+		nodes[i], err = New(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go nodes[i].Run(l)
+	}
+	defer stopCluster(nodes)
+
+	waitForLeader(t, nodes)
+	for _, n := range nodes {
+		if !storetest.SameRecord(n.GetRecordByAlias("hunter"), record) {
+			t.Errorf("Expected %s to hold the registration after restarting.", n.config.ID)
+		}
+	}
+
+	// Replaying the log into a store that still holds its records would
+	// apply every change twice.
+	c := *configs[0]
+	c.Dir = ""
+	if _, err := New(&c); err != ErrStoreNotEmpty {
+		t.Errorf("Expected a store that holds records to be refused, got %v.", err)
+	}
+}
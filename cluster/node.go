@@ -0,0 +1,687 @@
+// Package cluster replicates a tracker's records across a group of nodes
+// with the Raft consensus algorithm, so that every node agrees on who owns
+// each alias.
+//
+// A Node is a tracker.RecordStore. Every SaveRecord and DeleteRecord is
+// written to the Raft log by the leader and is only applied to the nodes'
+// stores once a majority of the cluster holds it. Followers forward their
+// writes to the leader. Reads are served from the local store, which may be
+// slightly behind the leader, unless Config.Linearizable is set, in which
+// case every read first checks with the leader that the local store has
+// caught up.
+//
+// Nodes talk to each other over their own TCP connections, which are not
+// authenticated, so cluster addresses should only be reachable by the
+// other nodes.
+package cluster
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"airdispat.ch/identity"
+	"airdispat.ch/message"
+	"airdispat.ch/tracker"
+)
+
+// Role is the part that a node currently plays in the cluster.
+type Role string
+
+// The roles of a Raft node.
+const (
+	Follower  Role = "follower"
+	Candidate Role = "candidate"
+	Leader    Role = "leader"
+)
+
+const (
+	// DefaultHeartbeatInterval is how often the leader contacts its
+	// followers if no other interval is given.
+	DefaultHeartbeatInterval = 50 * time.Millisecond
+
+	// DefaultElectionTimeout is how long a follower waits to hear from a
+	// leader before standing for election, if no other timeout is given.
+	// The actual timeout is randomised between this and twice this.
+	DefaultElectionTimeout = 500 * time.Millisecond
+
+	// DefaultProposeTimeout is how long a write waits to be committed if
+	// no other timeout is given.
+	DefaultProposeTimeout = 5 * time.Second
+
+	// maxAppendEntries is the most entries sent to a follower at once.
+	maxAppendEntries = 256
+)
+
+var (
+	// ErrNotLeader is returned when a leader's work is asked of a node
+	// that is not the leader.
+	ErrNotLeader = errors.New("This node is not the leader.")
+
+	// ErrNoLeader is returned when a write or linearizable read can not
+	// be served because the cluster has no leader.
+	ErrNoLeader = errors.New("The cluster does not have a leader.")
+
+	// ErrTimeout is returned when the cluster does not commit a write, or
+	// confirm a read, in time.
+	ErrTimeout = errors.New("The cluster did not answer in time.")
+
+	// ErrLeadershipLost is returned when the leader that accepted a write
+	// was replaced before the write was committed. The write was lost.
+	ErrLeadershipLost = errors.New("Leadership was lost before the change was committed.")
+
+	// ErrClosed is returned when a node is used after it has been closed.
+	ErrClosed = errors.New("Node is closed.")
+
+	// ErrStoreNotEmpty is returned by New when Config.Store already holds
+	// records, which replaying the Raft log would apply a second time.
+	ErrStoreNotEmpty = errors.New("The node's store must start out empty.")
+)
+
+// Config describes a node and the cluster that it belongs to.
+type Config struct {
+	// ID names this node. It must be one of the keys of Peers.
+	ID string
+
+	// Peers is the address of every node in the cluster, including this
+	// one, by ID.
+	Peers map[string]string
+
+	// Store is where committed records are applied. The Raft log is never
+	// compacted and is replayed into the Store whenever the node starts,
+	// so New refuses a Store that already holds records. A durable store
+	// would hold every record again after a restart, so a
+	// tracker.MemoryStore should be used.
+	Store tracker.RecordStore
+
+	// Dir is optional. If it is set, the node's term, vote and log are
+	// kept in this directory, so that the node can safely rejoin the
+	// cluster after a restart. Otherwise a restarted node must be treated
+	// as a new, empty node.
+	Dir string
+
+	// Linearizable makes every read confirm with the leader that it sees
+	// every committed write.
+	Linearizable bool
+
+	HeartbeatInterval time.Duration
+	ElectionTimeout   time.Duration
+	ProposeTimeout    time.Duration
+
+	// OnApply is optional. It is called after each committed change has
+	// been applied to Store. The record is nil for deletions.
+	OnApply func(address string, alias string, record *message.SignedMessage)
+}
+
+// Status is a snapshot of a node's view of the cluster.
+type Status struct {
+	ID      string `json:"id"`
+	Role    Role   `json:"role"`
+	Term    uint64 `json:"term"`
+	Leader  string `json:"leader,omitempty"`
+	Index   uint64 `json:"index"`
+	Commit  uint64 `json:"commit"`
+	Applied uint64 `json:"applied"`
+}
+
+// The operations that can be written to the log.
+const (
+	opSave   = "save"
+	opDelete = "delete"
+)
+
+// command is a change to the records.
+type command struct {
+	Op      string
+	Address string
+	Alias   string
+	Record  []byte
+}
+
+// entry is a single entry in the Raft log. Leaders write an entry without
+// a command when they are elected.
+type entry struct {
+	Term    uint64   `json:"term"`
+	Command *command `json:"command,omitempty"`
+}
+
+// Node is a member of a tracker cluster.
+type Node struct {
+	// ErrorHandler is called when a write can not be committed or a read
+	// can not be confirmed. If it is not set, errors are logged.
+	ErrorHandler func(err *tracker.TrackerError)
+
+	config  Config
+	peers   map[string]*peer
+	storage *storage
+
+	lock sync.Mutex
+	cond *sync.Cond
+
+	role     Role
+	term     uint64
+	votedFor string
+	leader   string
+	deadline time.Time
+
+	// log[0] is a placeholder, so that entries are indexed from one.
+	log     []*entry
+	commit  uint64
+	applied uint64
+
+	// Leader state.
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	inflight    map[string]bool
+	round       uint64
+	acknowledge map[string]uint64
+
+	listener net.Listener
+	conns    map[net.Conn]bool
+	stop     chan bool
+	closed   bool
+}
+
+// New will create a node, loading its state from Config.Dir if it is set.
+// The node does not take part in the cluster until Run is called.
+func New(config *Config) (*Node, error) {
+	if _, ok := config.Peers[config.ID]; !ok {
+		return nil, errors.New("The node's ID must be one of its peers.")
+	}
+	if holdsRecords(config.Store) {
+		return nil, ErrStoreNotEmpty
+	}
+
+	n := &Node{
+		config: *config,
+		peers:  make(map[string]*peer),
+		role:   Follower,
+		log:    []*entry{{}},
+		conns:  make(map[net.Conn]bool),
+		stop:   make(chan bool),
+	}
+	n.cond = sync.NewCond(&n.lock)
+
+	if n.config.HeartbeatInterval <= 0 {
+		n.config.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if n.config.ElectionTimeout <= 0 {
+		n.config.ElectionTimeout = DefaultElectionTimeout
+	}
+	if n.config.ProposeTimeout <= 0 {
+		n.config.ProposeTimeout = DefaultProposeTimeout
+	}
+
+	for id, address := range config.Peers {
+		if id != config.ID {
+			n.peers[id] = &peer{id: id, address: address}
+		}
+	}
+
+	if config.Dir != "" {
+		s, state, entries, err := openStorage(config.Dir)
+		if err != nil {
+			return nil, err
+		}
+		n.storage = s
+		n.term = state.Term
+		n.votedFor = state.VotedFor
+		n.log = append(n.log, entries...)
+	}
+
+	return n, nil
+}
+
+// holdsRecords will return true if a store is known to hold any records.
+func holdsRecords(store tracker.RecordStore) bool {
+	if c, ok := store.(tracker.RecordCounter); ok {
+		if addresses, _ := c.CountRecords(); addresses > 0 {
+			return true
+		}
+	}
+
+	it, ok := store.(tracker.RecordIterator)
+	if !ok {
+		return false
+	}
+
+	found := errors.New("Found a record.")
+	return it.ForEachRecord(func(r *tracker.StoredRecord) error { return found }) == found
+}
+
+// Start will listen on this node's address from Config.Peers and Run.
+func (n *Node) Start() error {
+	l, err := net.Listen("tcp", n.config.Peers[n.config.ID])
+	if err != nil {
+		return err
+	}
+	return n.Run(l)
+}
+
+// Run will take part in the cluster, answering other nodes on the
+// listener. It blocks until the node is closed.
+func (n *Node) Run(l net.Listener) error {
+	n.lock.Lock()
+	if n.closed {
+		n.lock.Unlock()
+		l.Close()
+		return ErrClosed
+	}
+	n.listener = l
+	n.resetDeadline()
+	n.lock.Unlock()
+
+	go n.applier()
+	go n.ticker()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			n.lock.Lock()
+			closed := n.closed
+			n.lock.Unlock()
+
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		n.lock.Lock()
+		if n.closed {
+			n.lock.Unlock()
+			conn.Close()
+			return nil
+		}
+		n.conns[conn] = true
+		n.lock.Unlock()
+
+		go n.serve(conn)
+	}
+}
+
+// Close will stop the node taking part in the cluster.
+func (n *Node) Close() error {
+	n.lock.Lock()
+	if n.closed {
+		n.lock.Unlock()
+		return ErrClosed
+	}
+	n.closed = true
+	close(n.stop)
+	if n.listener != nil {
+		n.listener.Close()
+	}
+	for conn := range n.conns {
+		conn.Close()
+	}
+	n.cond.Broadcast()
+	n.lock.Unlock()
+
+	for _, p := range n.peers {
+		p.close()
+	}
+	return n.storage.close()
+}
+
+// Status will return the node's current view of the cluster.
+func (n *Node) Status() *Status {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return &Status{
+		ID:      n.config.ID,
+		Role:    n.role,
+		Term:    n.term,
+		Leader:  n.leader,
+		Index:   n.lastIndex(),
+		Commit:  n.commit,
+		Applied: n.applied,
+	}
+}
+
+// IsLeader will return true if the node believes that it leads the
+// cluster.
+func (n *Node) IsLeader() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.role == Leader
+}
+
+func (n *Node) handleError(location string, err error) {
+	if n.ErrorHandler != nil {
+		n.ErrorHandler(&tracker.TrackerError{
+			Location: location,
+			Error:    err,
+		})
+		return
+	}
+	log.Println("Cluster Error At:", location, "-", err)
+}
+
+// resetDeadline must be called with the lock held.
+func (n *Node) resetDeadline() {
+	timeout := n.config.ElectionTimeout
+	n.deadline = time.Now().Add(timeout + time.Duration(rand.Int63n(int64(timeout))))
+}
+
+// waitFor will wait, with the lock held, until done returns true.
+func (n *Node) waitFor(done func() bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		n.lock.Lock()
+		n.cond.Broadcast()
+		n.lock.Unlock()
+	})
+	defer timer.Stop()
+
+	for !done() {
+		if n.closed {
+			return ErrClosed
+		}
+		if !time.Now().Before(deadline) {
+			return ErrTimeout
+		}
+		n.cond.Wait()
+	}
+	return nil
+}
+
+// submit will commit a command, forwarding it to the leader if this node
+// does not lead.
+func (n *Node) submit(c *command) error {
+	deadline := time.Now().Add(n.config.ProposeTimeout)
+	for {
+		err := n.propose(c)
+		if err != ErrNotLeader {
+			return err
+		}
+
+		p, err := n.leaderPeer(deadline)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			// This node was elected in the meantime.
+			continue
+		}
+
+		res, err := p.call(&request{Forward: c}, n.config.ProposeTimeout)
+		if err != nil {
+			return err
+		}
+		if res.Forward == nil {
+			return errors.New("Leader did not answer the forwarded write.")
+		}
+		if res.Forward.Error == ErrNotLeader.Error() && time.Now().Before(deadline) {
+			// Leadership moved while the write was in flight.
+			time.Sleep(n.config.HeartbeatInterval)
+			continue
+		}
+		if res.Forward.Error != "" {
+			return errors.New(res.Forward.Error)
+		}
+		return nil
+	}
+}
+
+// leaderPeer will wait until a leader is known, returning it if it is
+// another node and nil if it is this one.
+func (n *Node) leaderPeer(deadline time.Time) (*peer, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	err := n.waitFor(func() bool { return n.leader != "" }, time.Until(deadline))
+	if err == ErrTimeout {
+		return nil, ErrNoLeader
+	} else if err != nil {
+		return nil, err
+	}
+
+	return n.peers[n.leader], nil
+}
+
+// propose will append a command to the leader's log and wait until it has
+// been committed and applied.
+func (n *Node) propose(c *command) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.closed {
+		return ErrClosed
+	}
+	if n.role != Leader {
+		return ErrNotLeader
+	}
+
+	e := &entry{Term: n.term, Command: c}
+	err := n.storage.append([]*entry{e})
+	if err != nil {
+		return err
+	}
+	n.log = append(n.log, e)
+	index, term := n.lastIndex(), n.term
+
+	n.advanceCommit()
+	n.broadcast()
+
+	err = n.waitFor(func() bool { return n.applied >= index }, n.config.ProposeTimeout)
+	if err != nil {
+		return err
+	}
+
+	if index > n.lastIndex() || n.log[index].Term != term {
+		return ErrLeadershipLost
+	}
+	return nil
+}
+
+// readIndex will return a commit index that includes every write that was
+// committed before it was called.
+func (n *Node) readIndex() (uint64, error) {
+	index, err := n.leaderReadIndex()
+	if err != ErrNotLeader {
+		return index, err
+	}
+
+	p, err := n.leaderPeer(time.Now().Add(n.config.ProposeTimeout))
+	if err != nil {
+		return 0, err
+	}
+	if p == nil {
+		return n.leaderReadIndex()
+	}
+
+	res, err := p.call(&request{ReadIndex: true}, n.config.ProposeTimeout)
+	if err != nil {
+		return 0, err
+	}
+	if res.ReadIndex == nil {
+		return 0, errors.New("Leader did not answer the read.")
+	}
+	if res.ReadIndex.Error != "" {
+		return 0, errors.New(res.ReadIndex.Error)
+	}
+	return res.ReadIndex.Index, nil
+}
+
+// barrier will wait until the local store holds every write that was
+// committed before it was called.
+func (n *Node) barrier() error {
+	index, err := n.readIndex()
+	if err != nil {
+		return err
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.waitFor(func() bool { return n.applied >= index }, n.config.ProposeTimeout)
+}
+
+// applier will apply committed entries to the store in order.
+func (n *Node) applier() {
+	for {
+		n.lock.Lock()
+		for !n.closed && n.applied >= n.commit {
+			n.cond.Wait()
+		}
+		if n.closed {
+			n.lock.Unlock()
+			return
+		}
+		start, end := n.applied+1, n.commit
+		entries := append([]*entry(nil), n.log[start:end+1]...)
+		n.lock.Unlock()
+
+		for _, e := range entries {
+			n.apply(e.Command)
+		}
+
+		n.lock.Lock()
+		n.applied = end
+		n.cond.Broadcast()
+		n.lock.Unlock()
+	}
+}
+
+func (n *Node) apply(c *command) {
+	if c == nil {
+		return
+	}
+
+	address := identity.CreateAddressFromString(c.Address)
+	if address == nil {
+		n.handleError("Apply", errors.New("Log holds an invalid address."))
+		return
+	}
+
+	var record *message.SignedMessage
+	switch c.Op {
+	case opSave:
+		var err error
+		record, err = tracker.UnmarshalRecord(c.Record)
+		if err != nil {
+			n.handleError("Apply (Unmarshalling Record)", err)
+			return
+		}
+		n.config.Store.SaveRecord(address, record, c.Alias)
+
+	case opDelete:
+		if d, ok := n.config.Store.(tracker.RecordDeleter); ok {
+			d.DeleteRecord(address)
+		}
+
+	default:
+		return
+	}
+
+	if n.config.OnApply != nil {
+		n.config.OnApply(c.Address, c.Alias, record)
+	}
+}
+
+// SaveRecord will commit a record to the cluster, reporting any failure to
+// ErrorHandler.
+func (n *Node) SaveRecord(address *identity.Address, record *message.SignedMessage, alias string) {
+	err := n.CommitRecord(address, record, alias)
+	if err != nil {
+		n.handleError("Save Record", err)
+	}
+}
+
+// CommitRecord implements tracker.RecordCommitter, returning an error if
+// the cluster did not commit the record, such as when a majority of its
+// nodes can not be reached.
+func (n *Node) CommitRecord(address *identity.Address, record *message.SignedMessage, alias string) error {
+	data, err := tracker.MarshalRecord(record)
+	if err != nil {
+		return err
+	}
+
+	return n.submit(&command{
+		Op:      opSave,
+		Address: address.String(),
+		Alias:   alias,
+		Record:  data,
+	})
+}
+
+// DeleteRecord implements tracker.RecordDeleter, committing the deletion
+// to the cluster.
+func (n *Node) DeleteRecord(address *identity.Address) {
+	err := n.submit(&command{
+		Op:      opDelete,
+		Address: address.String(),
+	})
+	if err != nil {
+		n.handleError("Delete Record", err)
+	}
+}
+
+// read will wait for the local store to catch up before a linearizable
+// read, returning false if it could not.
+func (n *Node) read() bool {
+	if !n.config.Linearizable {
+		return true
+	}
+
+	err := n.barrier()
+	if err != nil {
+		n.handleError("Read", err)
+		return false
+	}
+	return true
+}
+
+// GetRecordByAddress will read a record from the local store.
+func (n *Node) GetRecordByAddress(address *identity.Address) *message.SignedMessage {
+	if !n.read() {
+		return nil
+	}
+	return n.config.Store.GetRecordByAddress(address)
+}
+
+// GetRecordByAlias will read a record from the local store.
+func (n *Node) GetRecordByAlias(alias string) *message.SignedMessage {
+	if !n.read() {
+		return nil
+	}
+	return n.config.Store.GetRecordByAlias(alias)
+}
+
+// ForEachRecord implements tracker.RecordIterator if the local store does.
+func (n *Node) ForEachRecord(fn func(record *tracker.StoredRecord) error) error {
+	it, ok := n.config.Store.(tracker.RecordIterator)
+	if !ok {
+		return errors.New("Store does not support listing records.")
+	}
+	return it.ForEachRecord(fn)
+}
+
+// CountRecords implements tracker.RecordCounter if the local store does.
+func (n *Node) CountRecords() (int, int) {
+	if c, ok := n.config.Store.(tracker.RecordCounter); ok {
+		return c.CountRecords()
+	}
+	return -1, -1
+}
+
+// CheckHealth implements tracker.HealthChecker, failing while the node does
+// not know of a leader.
+func (n *Node) CheckHealth() error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.closed {
+		return ErrClosed
+	}
+	if n.leader == "" {
+		return ErrNoLeader
+	}
+	return nil
+}
@@ -0,0 +1,415 @@
+package cluster
+
+import (
+	"time"
+)
+
+// The functions in this file implement Raft's leader election and log
+// replication. Unless noted, they must be called with the node's lock
+// held.
+
+func (n *Node) lastIndex() uint64 {
+	return uint64(len(n.log) - 1)
+}
+
+func (n *Node) lastTerm() uint64 {
+	return n.log[len(n.log)-1].Term
+}
+
+// quorum is the number of nodes, including this one, that form a majority.
+func (n *Node) quorum() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+func (n *Node) saveState() error {
+	return n.storage.saveState(&hardState{
+		Term:     n.term,
+		VotedFor: n.votedFor,
+	})
+}
+
+// stepDown will make the node a follower, moving to a newer term if one is
+// given.
+func (n *Node) stepDown(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.leader = ""
+		if err := n.saveState(); err != nil {
+			n.handleError("Step Down (Saving State)", err)
+		}
+	}
+
+	if n.role != Follower {
+		n.role = Follower
+		n.resetDeadline()
+	}
+	n.cond.Broadcast()
+}
+
+// ticker will send heartbeats while the node leads, and stand for election
+// when it has not heard from a leader in time.
+func (n *Node) ticker() {
+	t := time.NewTicker(n.config.HeartbeatInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case now := <-t.C:
+			n.lock.Lock()
+			if n.role == Leader {
+				n.broadcast()
+			} else if now.After(n.deadline) {
+				n.startElection()
+			}
+			n.lock.Unlock()
+		}
+	}
+}
+
+func (n *Node) startElection() {
+	n.role = Candidate
+	n.term++
+	n.votedFor = n.config.ID
+	n.leader = ""
+	n.resetDeadline()
+	if err := n.saveState(); err != nil {
+		n.handleError("Start Election (Saving State)", err)
+		return
+	}
+
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+
+	req := &voteRequest{
+		Term:         n.term,
+		Candidate:    n.config.ID,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.lastTerm(),
+	}
+
+	for _, p := range n.peers {
+		go func(p *peer) {
+			res, err := p.call(&request{Vote: req}, n.config.ElectionTimeout)
+			if err != nil || res.Vote == nil {
+				return
+			}
+
+			n.lock.Lock()
+			defer n.lock.Unlock()
+
+			if res.Vote.Term > n.term {
+				n.stepDown(res.Vote.Term)
+				return
+			}
+			if n.role != Candidate || n.term != req.Term || !res.Vote.Granted {
+				return
+			}
+
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}(p)
+	}
+}
+
+func (n *Node) becomeLeader() {
+	n.role = Leader
+	n.leader = n.config.ID
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.inflight = make(map[string]bool)
+	n.acknowledge = make(map[string]uint64)
+	for id := range n.peers {
+		n.nextIndex[id] = n.lastIndex() + 1
+	}
+
+	// Entries from earlier terms can only be committed alongside one from
+	// this term, so the leader starts by writing an empty entry.
+	e := &entry{Term: n.term}
+	if err := n.storage.append([]*entry{e}); err != nil {
+		n.handleError("Become Leader (Appending Entry)", err)
+		n.stepDown(n.term)
+		return
+	}
+	n.log = append(n.log, e)
+
+	n.advanceCommit()
+	n.broadcast()
+	n.cond.Broadcast()
+}
+
+// broadcast will send any new entries, or a heartbeat, to every follower
+// that is not already waiting on an answer.
+func (n *Node) broadcast() {
+	for id, p := range n.peers {
+		if !n.inflight[id] {
+			n.inflight[id] = true
+			go n.replicateTo(p)
+		}
+	}
+}
+
+// replicateTo will bring a follower's log up to date with this node's. Only
+// one replicateTo runs for each follower at a time.
+func (n *Node) replicateTo(p *peer) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	inflight := n.inflight
+	defer func() { inflight[p.id] = false }()
+
+	for n.role == Leader && !n.closed {
+		next := n.nextIndex[p.id]
+		end := n.lastIndex() + 1
+		if end-next > maxAppendEntries {
+			end = next + maxAppendEntries
+		}
+
+		req := &appendRequest{
+			Term:         n.term,
+			Leader:       n.config.ID,
+			PrevLogIndex: next - 1,
+			PrevLogTerm:  n.log[next-1].Term,
+			Entries:      append([]*entry(nil), n.log[next:end]...),
+			LeaderCommit: n.commit,
+		}
+		round := n.round
+
+		n.lock.Unlock()
+		res, err := p.call(&request{Append: req}, n.config.ElectionTimeout)
+		n.lock.Lock()
+
+		if err != nil || res.Append == nil {
+			// The next heartbeat will try again.
+			return
+		}
+		if res.Append.Term > n.term {
+			n.stepDown(res.Append.Term)
+			return
+		}
+		if n.role != Leader || n.term != req.Term {
+			return
+		}
+
+		if round > n.acknowledge[p.id] {
+			n.acknowledge[p.id] = round
+			n.cond.Broadcast()
+		}
+
+		if res.Append.Success {
+			match := req.PrevLogIndex + uint64(len(req.Entries))
+			if match > n.matchIndex[p.id] {
+				n.matchIndex[p.id] = match
+			}
+			n.nextIndex[p.id] = match + 1
+			n.advanceCommit()
+		} else {
+			retry := next - 1
+			if hint := res.Append.NextIndex; hint > 0 && hint < retry {
+				retry = hint
+			}
+			if retry < 1 {
+				retry = 1
+			}
+			n.nextIndex[p.id] = retry
+		}
+
+		if n.nextIndex[p.id] > n.lastIndex() && round == n.round {
+			return
+		}
+	}
+}
+
+// advanceCommit will commit the newest entry from this term that a majority
+// of the cluster holds.
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commit; index-- {
+		if n.log[index].Term != n.term {
+			return
+		}
+
+		count := 1
+		for id := range n.peers {
+			if n.matchIndex[id] >= index {
+				count++
+			}
+		}
+
+		if count >= n.quorum() {
+			n.commit = index
+			n.cond.Broadcast()
+			return
+		}
+	}
+}
+
+// leaderReadIndex will confirm that this node still leads, and return the
+// commit index that a read must wait for. It takes the lock itself.
+func (n *Node) leaderReadIndex() (uint64, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.closed {
+		return 0, ErrClosed
+	}
+	if n.role != Leader {
+		return 0, ErrNotLeader
+	}
+	term := n.term
+
+	// Until an entry from this term is committed, the leader may not know
+	// about every entry that its predecessor committed.
+	err := n.waitFor(func() bool {
+		return n.role != Leader || n.log[n.commit].Term == term
+	}, n.config.ProposeTimeout)
+	if err != nil {
+		return 0, err
+	}
+	if n.role != Leader || n.term != term {
+		return 0, ErrLeadershipLost
+	}
+	index := n.commit
+
+	// A majority must answer a heartbeat sent after the read began, in
+	// case a newer leader has been elected without this node noticing.
+	n.round++
+	round := n.round
+	n.broadcast()
+
+	err = n.waitFor(func() bool {
+		if n.role != Leader || n.term != term {
+			return true
+		}
+		count := 1
+		for id := range n.peers {
+			if n.acknowledge[id] >= round {
+				count++
+			}
+		}
+		return count >= n.quorum()
+	}, n.config.ProposeTimeout)
+	if err != nil {
+		return 0, err
+	}
+	if n.role != Leader || n.term != term {
+		return 0, ErrLeadershipLost
+	}
+
+	return index, nil
+}
+
+// handleVote will answer a candidate's request for a vote. It takes the
+// lock itself.
+func (n *Node) handleVote(req *voteRequest) *voteResponse {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if req.Term > n.term {
+		n.stepDown(req.Term)
+	}
+
+	res := &voteResponse{Term: n.term}
+	if req.Term < n.term {
+		return res
+	}
+	if n.votedFor != "" && n.votedFor != req.Candidate {
+		return res
+	}
+
+	// Only vote for candidates whose logs hold every committed entry.
+	if req.LastLogTerm < n.lastTerm() ||
+		(req.LastLogTerm == n.lastTerm() && req.LastLogIndex < n.lastIndex()) {
+		return res
+	}
+
+	n.votedFor = req.Candidate
+	if err := n.saveState(); err != nil {
+		n.handleError("Handle Vote (Saving State)", err)
+		n.votedFor = ""
+		return res
+	}
+
+	n.resetDeadline()
+	res.Granted = true
+	return res
+}
+
+// handleAppend will add a leader's entries to the log. It takes the lock
+// itself.
+func (n *Node) handleAppend(req *appendRequest) *appendResponse {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if req.Term < n.term {
+		return &appendResponse{Term: n.term}
+	}
+
+	n.stepDown(req.Term)
+	n.leader = req.Leader
+	n.resetDeadline()
+
+	res := &appendResponse{Term: n.term}
+	if req.PrevLogIndex > n.lastIndex() {
+		res.NextIndex = n.lastIndex() + 1
+		return res
+	}
+
+	if term := n.log[req.PrevLogIndex].Term; term != req.PrevLogTerm {
+		// Skip back over every entry from the conflicting term at once.
+		index := req.PrevLogIndex
+		for index > n.commit+1 && n.log[index-1].Term == term {
+			index--
+		}
+		res.NextIndex = index
+		return res
+	}
+
+	entries := n.log
+	truncated := false
+	added := []*entry{}
+	for i, e := range req.Entries {
+		index := req.PrevLogIndex + 1 + uint64(i)
+		if index < uint64(len(entries)) {
+			if entries[index].Term == e.Term {
+				continue
+			}
+			entries = entries[:index:index]
+			truncated = true
+		}
+		entries = append(entries, e)
+		added = append(added, e)
+	}
+
+	var err error
+	if truncated {
+		err = n.storage.rewrite(entries[1:])
+	} else {
+		err = n.storage.append(added)
+	}
+	if err != nil {
+		n.handleError("Handle Append (Saving Log)", err)
+		res.NextIndex = req.PrevLogIndex + 1
+		return res
+	}
+	n.log = entries
+
+	if req.LeaderCommit > n.commit {
+		last := req.PrevLogIndex + uint64(len(req.Entries))
+		if req.LeaderCommit < last {
+			last = req.LeaderCommit
+		}
+		if last > n.commit {
+			n.commit = last
+		}
+	}
+
+	n.cond.Broadcast()
+	res.Success = true
+	return res
+}
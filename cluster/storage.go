@@ -0,0 +1,166 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	stateName = "raft.state"
+	logName   = "raft.log"
+)
+
+// hardState is what a node must remember across restarts to vote safely.
+type hardState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for,omitempty"`
+}
+
+// storage keeps a node's term, vote and log on disk. A nil storage keeps
+// nothing, and the node forgets everything when it stops.
+type storage struct {
+	dir string
+	log *os.File
+}
+
+func openStorage(dir string) (*storage, *hardState, []*entry, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	state := &hardState{}
+	data, err := ioutil.ReadFile(filepath.Join(dir, stateName))
+	if err == nil {
+		err = json.Unmarshal(data, state)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, logName), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var entries []*entry
+	partial := false
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		e := &entry{}
+		if json.Unmarshal(scanner.Bytes(), e) != nil {
+			// A partially written entry left behind by a crash was
+			// never acknowledged, so it can be dropped.
+			partial = true
+			break
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+
+	s := &storage{dir: dir, log: f}
+	if partial {
+		// Rewrite the log without the partial entry.
+		err = s.rewrite(entries)
+		if err != nil {
+			f.Close()
+			return nil, nil, nil, err
+		}
+	}
+
+	return s, state, entries, nil
+}
+
+func (s *storage) saveState(state *hardState) error {
+	if s == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(s.dir, stateName+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(s.dir, stateName))
+}
+
+// append will add entries to the end of the log.
+func (s *storage) append(entries []*entry) error {
+	if s == nil || len(entries) == 0 {
+		return nil
+	}
+
+	w := bufio.NewWriter(s.log)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		err := enc.Encode(e)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// rewrite will replace the whole log, which is only needed when a follower
+// discards entries that conflict with its leader.
+func (s *storage) rewrite(entries []*entry) error {
+	if s == nil {
+		return nil
+	}
+
+	tmp := filepath.Join(s.dir, logName+".tmp")
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	old := s.log
+	s.log = f
+	err = s.append(entries)
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(s.dir, logName))
+	}
+	if err != nil {
+		s.log = old
+		f.Close()
+		return err
+	}
+
+	old.Close()
+	return nil
+}
+
+func (s *storage) close() error {
+	if s == nil {
+		return nil
+	}
+	return s.log.Close()
+}
@@ -0,0 +1,205 @@
+package cluster
+
+import (
+	"encoding/gob"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// The messages exchanged between nodes. Each request is gob encoded in a
+// single envelope, and answered with a single response envelope on the
+// same connection.
+
+type voteRequest struct {
+	Term         uint64
+	Candidate    string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type voteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+type appendRequest struct {
+	Term         uint64
+	Leader       string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []*entry
+	LeaderCommit uint64
+}
+
+type appendResponse struct {
+	Term    uint64
+	Success bool
+
+	// NextIndex is where the leader should try again from when Success is
+	// false, so that a follower that is far behind does not need one
+	// round trip per missing entry.
+	NextIndex uint64
+}
+
+type forwardResponse struct {
+	Error string
+}
+
+type readIndexResponse struct {
+	Index uint64
+	Error string
+}
+
+// request holds exactly one request.
+type request struct {
+	Vote      *voteRequest
+	Append    *appendRequest
+	Forward   *command
+	ReadIndex bool
+}
+
+// response holds the answer to a request.
+type response struct {
+	Vote      *voteResponse
+	Append    *appendResponse
+	Forward   *forwardResponse
+	ReadIndex *readIndexResponse
+}
+
+// errTimeout is returned when a peer does not answer in time.
+var errTimeout = errors.New("Peer did not answer in time.")
+
+// serve will answer the requests sent on a connection until it is closed.
+func (n *Node) serve(conn net.Conn) {
+	defer func() {
+		n.lock.Lock()
+		delete(n.conns, conn)
+		n.lock.Unlock()
+		conn.Close()
+	}()
+
+	dec := gob.NewDecoder(conn)
+	enc := gob.NewEncoder(conn)
+	for {
+		req := &request{}
+		err := dec.Decode(req)
+		if err != nil {
+			return
+		}
+
+		res := &response{}
+		switch {
+		case req.Vote != nil:
+			res.Vote = n.handleVote(req.Vote)
+		case req.Append != nil:
+			res.Append = n.handleAppend(req.Append)
+		case req.Forward != nil:
+			res.Forward = &forwardResponse{}
+			if err := n.propose(req.Forward); err != nil {
+				res.Forward.Error = err.Error()
+			}
+		case req.ReadIndex:
+			res.ReadIndex = &readIndexResponse{}
+			res.ReadIndex.Index, err = n.leaderReadIndex()
+			if err != nil {
+				res.ReadIndex.Error = err.Error()
+			}
+		}
+
+		err = enc.Encode(res)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// conn is an open connection to a peer.
+type conn struct {
+	net.Conn
+	enc *gob.Encoder
+	dec *gob.Decoder
+}
+
+// peer is another node in the cluster. Connections to it are kept open and
+// reused, and a request that is already waiting on one connection does not
+// hold up requests on another.
+type peer struct {
+	id      string
+	address string
+
+	lock sync.Mutex
+	idle []*conn
+}
+
+func (p *peer) call(req *request, timeout time.Duration) (*response, error) {
+	c, err := p.get(timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c.SetDeadline(time.Now().Add(timeout))
+
+	res := &response{}
+	err = c.enc.Encode(req)
+	if err == nil {
+		err = c.dec.Decode(res)
+	}
+	if err != nil {
+		c.Close()
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return nil, errTimeout
+		}
+		return nil, err
+	}
+
+	p.put(c)
+	return res, nil
+}
+
+func (p *peer) get(timeout time.Duration) (*conn, error) {
+	p.lock.Lock()
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.lock.Unlock()
+		return c, nil
+	}
+	p.lock.Unlock()
+
+	nc, err := net.DialTimeout("tcp", p.address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &conn{
+		Conn: nc,
+		enc:  gob.NewEncoder(nc),
+		dec:  gob.NewDecoder(nc),
+	}, nil
+}
+
+// maxIdle is the most connections kept open to each peer.
+const maxIdle = 4
+
+func (p *peer) put(c *conn) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.idle) >= maxIdle {
+		c.Close()
+		return
+	}
+	p.idle = append(p.idle, c)
+}
+
+func (p *peer) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, c := range p.idle {
+		c.Close()
+	}
+	p.idle = nil
+}
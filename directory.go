@@ -0,0 +1,340 @@
+package tracker
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"airdispat.ch/identity"
+	"airdispat.ch/message"
+	"airdispat.ch/routing"
+	"airdispat.ch/tracker/wire"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// DefaultDirectoryRefresh is how often a ListRouter created from a
+// directory loads it again if no other interval is given.
+const DefaultDirectoryRefresh = time.Hour
+
+// ErrDirectoryExpired is returned by a ListRouter whose directory has
+// expired without a newer one being loaded.
+var ErrDirectoryExpired = errors.New("Tracker directory has expired.")
+
+// Capabilities that a tracker may list in a directory.
+const (
+	CapabilityQuery    = "query"
+	CapabilityRegister = "register"
+	CapabilityWatch    = "watch"
+	CapabilityFeed     = "feed"
+)
+
+// Directory is a signed list of trackers that clients can start from
+// instead of a list of URLs built into them. It is written with
+// SignDirectory and read back with LoadDirectory, which checks that it was
+// signed by a trusted key.
+type Directory struct {
+	Trackers []*DirectoryEntry
+
+	// Issued is when the directory was signed. Clients refuse a directory
+	// issued before the one that they already hold.
+	Issued time.Time
+
+	// Expires is optional. If it is set, clients stop trusting the
+	// directory after it, and a ListRouter created from it refuses every
+	// request until a newer directory is loaded.
+	Expires time.Time
+
+	// Signer is the address that signed the directory. It is set by
+	// LoadDirectory.
+	Signer string
+}
+
+// DirectoryEntry describes a single tracker in a Directory. A ListRouter
+// created from the directory only accepts the messages that a tracker signs
+// itself from the tracker's Address, and, if Key is set, carrying its Key.
+type DirectoryEntry struct {
+	URL          string
+	Address      string
+	Key          []byte
+	Region       string
+	Capabilities []string
+}
+
+// Has will return true if the tracker lists a capability.
+func (e *DirectoryEntry) Has(capability string) bool {
+	for _, v := range e.Capabilities {
+		if v == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Select will return the trackers with a capability in a region. An empty
+// capability or region matches every tracker.
+func (d *Directory) Select(capability string, region string) []*DirectoryEntry {
+	var out []*DirectoryEntry
+	for _, v := range d.Trackers {
+		if (capability == "" || v.Has(capability)) && (region == "" || v.Region == region) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// SignDirectory will sign a directory with key, returning the document to
+// publish. If the directory has no Issued time, the current time is used.
+func SignDirectory(d *Directory, key *identity.Identity) ([]byte, error) {
+	issued := d.Issued
+	if issued.IsZero() {
+		issued = time.Now()
+	}
+	issuedTime := uint64(issued.Unix())
+
+	body := &wire.TrackerDirectory{Issued: &issuedTime}
+	if !d.Expires.IsZero() {
+		expirationTime := uint64(d.Expires.Unix())
+		body.Expires = &expirationTime
+	}
+
+	for _, v := range d.Trackers {
+		url, address, region := v.URL, v.Address, v.Region
+		entry := &wire.DirectoryEntry{
+			Url:           &url,
+			Address:       &address,
+			EncryptionKey: v.Key,
+			Capability:    v.Capabilities,
+		}
+		if region != "" {
+			entry.Region = &region
+		}
+		body.Tracker = append(body.Tracker, entry)
+	}
+
+	signed, err := message.SignMessage(&wireMessage{
+		from: key.Address,
+		code: wire.DirectoryCode,
+		body: body,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	return signed.Marshal()
+}
+
+// LoadDirectory will read a directory created by SignDirectory, checking
+// that it was signed by the trusted address and has not expired.
+func LoadDirectory(data []byte, trusted string) (*Directory, error) {
+	signed, err := message.CreateSignedMessageFromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if !signed.Verify() {
+		return nil, errors.New("Unable to verify directory.")
+	}
+
+	d, typ, h, err := signed.ReconstructMessage()
+	if err != nil || typ != wire.DirectoryCode {
+		return nil, errors.New("Document is not a tracker directory.")
+	}
+
+	if h.From == nil || h.From.String() != trusted {
+		return nil, errors.New("Directory is not signed by a trusted key.")
+	}
+
+	body := &wire.TrackerDirectory{}
+	err = proto.Unmarshal(d, body)
+	if err != nil {
+		return nil, errors.New("Unable to unpack directory.")
+	}
+
+	dir := &Directory{
+		Issued: time.Unix(int64(body.GetIssued()), 0),
+		Signer: h.From.String(),
+	}
+	if body.Expires != nil {
+		dir.Expires = time.Unix(int64(body.GetExpires()), 0)
+		if !time.Now().Before(dir.Expires) {
+			return nil, errors.New("Directory has expired.")
+		}
+	}
+
+	for _, v := range body.GetTracker() {
+		dir.Trackers = append(dir.Trackers, &DirectoryEntry{
+			URL:          v.GetUrl(),
+			Address:      v.GetAddress(),
+			Key:          v.GetEncryptionKey(),
+			Region:       v.GetRegion(),
+			Capabilities: v.GetCapability(),
+		})
+	}
+	return dir, nil
+}
+
+// DirectoryFile will return a loader for a directory kept in a file.
+func DirectoryFile(path string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		return ioutil.ReadFile(path)
+	}
+}
+
+// DirectoryURL will return a loader for a directory published over HTTP.
+func DirectoryURL(url string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		resp, err := http.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New("Unable to fetch directory: " + resp.Status)
+		}
+		return ioutil.ReadAll(resp.Body)
+	}
+}
+
+// CreateListRouterFromDirectory will return a ListRouter for the trackers
+// in a directory that answer queries. The directory is loaded with load and
+// checked against the trusted address, and is then loaded again every
+// refresh until the ListRouter is closed. A refresh of zero uses
+// DefaultDirectoryRefresh, and a negative refresh never loads it again.
+func CreateListRouterFromDirectory(redirect RedirectHandler, currentIdentity *identity.Identity, trusted string, load func() ([]byte, error), refresh time.Duration) (*ListRouter, error) {
+	output := &ListRouter{}
+	output.reload = func() error {
+		data, err := load()
+		if err != nil {
+			return err
+		}
+
+		dir, err := LoadDirectory(data, trusted)
+		if err != nil {
+			return err
+		}
+
+		return output.setDirectory(dir, redirect, currentIdentity)
+	}
+
+	err := output.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	if refresh == 0 {
+		refresh = DefaultDirectoryRefresh
+	}
+	if refresh > 0 {
+		output.stop = make(chan bool)
+		go output.refreshDirectory(refresh, output.stop)
+	}
+	return output, nil
+}
+
+// expired will return ErrDirectoryExpired if the ListRouter's directory
+// has expired.
+func (a *ListRouter) expired() error {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if a.directory != nil && !a.directory.Expires.IsZero() && !time.Now().Before(a.directory.Expires) {
+		return ErrDirectoryExpired
+	}
+	return nil
+}
+
+// Directory will return the directory that the ListRouter was last loaded
+// from, or nil if it was not created from one.
+func (a *ListRouter) Directory() *Directory {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return a.directory
+}
+
+// RefreshDirectory will load the ListRouter's directory again straight
+// away.
+func (a *ListRouter) RefreshDirectory() error {
+	if a.reload == nil {
+		return errors.New("ListRouter was not created from a directory.")
+	}
+
+	err := a.reload()
+	if err != nil {
+		a.Metrics.inc("tracker_client_directory_refreshes_total", "error")
+		return err
+	}
+	a.Metrics.inc("tracker_client_directory_refreshes_total", "ok")
+	return nil
+}
+
+// Close will stop refreshing the ListRouter's directory.
+func (a *ListRouter) Close() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.stop != nil {
+		close(a.stop)
+		a.stop = nil
+	}
+}
+
+func (a *ListRouter) refreshDirectory(interval time.Duration, stop <-chan bool) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+
+		a.RefreshDirectory()
+	}
+}
+
+// setDirectory will replace the ListRouter's trackers with those in a
+// directory, keeping the Routers for trackers that are listed again.
+func (a *ListRouter) setDirectory(dir *Directory, redirect RedirectHandler, currentIdentity *identity.Identity) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.directory != nil && dir.Issued.Before(a.directory.Issued) {
+		return errors.New("Directory is older than the one already loaded.")
+	}
+
+	existing := make(map[string]*Router)
+	for _, v := range a.trackers {
+		if r, ok := v.(*Router); ok {
+			existing[r.URL+" "+r.Address+" "+string(r.Key)] = r
+		}
+	}
+
+	var trackers []routing.Router
+	for _, v := range dir.Trackers {
+		if len(v.Capabilities) > 0 && !v.Has(CapabilityQuery) {
+			continue
+		}
+
+		r, ok := existing[v.URL+" "+v.Address+" "+string(v.Key)]
+		if !ok {
+			r = &Router{
+				URL:        v.URL,
+				Address:    v.Address,
+				Key:        v.Key,
+				Origin:     currentIdentity,
+				Redirector: redirect,
+				Metrics:    a.Metrics,
+			}
+			a.watchMigration(r)
+		}
+		trackers = append(trackers, r)
+	}
+
+	if len(trackers) == 0 {
+		return errors.New("Directory does not list any trackers to query.")
+	}
+
+	a.trackers = trackers
+	a.directory = dir
+	return nil
+}
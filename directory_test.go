@@ -0,0 +1,186 @@
+package tracker
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"airdispat.ch/crypto"
+	"airdispat.ch/identity"
+	"airdispat.ch/routing"
+)
+
+func TestDirectory(t *testing.T) {
+	keys := make([]*identity.Identity, 3)
+	for i := range keys {
+		key, err := identity.CreateIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key.SetLocation("example.com")
+		keys[i] = key
+	}
+	publisher, stranger, toLog := keys[0], keys[1], keys[2]
+
+	ports := []string{"9114", "9115"}
+	entries := make([]*DirectoryEntry, len(ports))
+	for i, port := range ports {
+		key, err := identity.CreateIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go (&Tracker{
+			Key:      key,
+			Delegate: newTestingTracker(),
+		}).StartServer(port)
+
+		entries[i] = &DirectoryEntry{
+			URL:          "localhost:" + port,
+			Address:      key.Address.String(),
+			Key:          crypto.RSAToBytes(key.Address.EncryptionKey),
+			Region:       "eu",
+			Capabilities: []string{CapabilityQuery, CapabilityRegister},
+		}
+	}
+
+	issued := time.Now().Add(-time.Hour)
+	first, err := SignDirectory(&Directory{
+		Trackers: []*DirectoryEntry{
+			entries[0],
+			{URL: "localhost:1", Address: stranger.Address.String(), Region: "us", Capabilities: []string{CapabilityFeed}},
+		},
+		Issued: issued,
+	}, publisher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := LoadDirectory(first, publisher.Address.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dir.Trackers) != 2 || dir.Trackers[0].Address != entries[0].Address || dir.Signer != publisher.Address.String() {
+		t.Errorf("Expected the directory to list its trackers, got %+v.", dir)
+	}
+	if !bytes.Equal(dir.Trackers[0].Key, entries[0].Key) || dir.Trackers[1].Key != nil {
+		t.Error("Expected the directory to carry the trackers' keys.")
+	}
+	if s := dir.Select(CapabilityQuery, "eu"); len(s) != 1 || s[0].URL != entries[0].URL {
+		t.Error("Expected to select the tracker that answers queries.")
+	}
+
+	if _, err := LoadDirectory(first, stranger.Address.String()); err == nil {
+		t.Error("Expected a directory from an untrusted key to be refused.")
+	}
+
+	expired, err := SignDirectory(&Directory{Trackers: entries, Expires: time.Now().Add(-time.Minute)}, publisher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadDirectory(expired, publisher.Address.String()); err == nil {
+		t.Error("Expected an expired directory to be refused.")
+	}
+
+	// Wait for Server to Startup
+	time.Sleep(1 * time.Second)
+
+	err = (&Router{URL: entries[0].URL, Origin: toLog}).Register(toLog, "hunter", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	published := first
+	load := func() ([]byte, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		return published, nil
+	}
+
+	list, err := CreateListRouterFromDirectory(nil, toLog, publisher.Address.String(), load, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer list.Close()
+
+	if len(list.routers()) != 1 {
+		t.Error("Expected the list to leave out trackers that do not answer queries.")
+	}
+	if r := list.routers()[0].(*Router); r.Address != entries[0].Address || !bytes.Equal(r.Key, entries[0].Key) {
+		t.Error("Expected the tracker's address and key to be pinned.")
+	}
+
+	addr, err := list.LookupAlias("hunter", routing.LookupTypeDEFAULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != toLog.Address.String() {
+		t.Error("Expected the listed tracker to answer for the alias.")
+	}
+
+	// A newer directory replaces the list.
+	second, err := SignDirectory(&Directory{Trackers: entries[1:], Issued: issued.Add(time.Minute)}, publisher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	published = second
+	lock.Unlock()
+
+	// Wait for the Directory to Refresh
+	time.Sleep(500 * time.Millisecond)
+
+	if d := list.Directory(); len(d.Trackers) != 1 || d.Trackers[0].URL != entries[1].URL {
+		t.Errorf("Expected the list to load the new directory, got %+v.", d)
+	}
+	if _, err := list.LookupAlias("hunter", routing.LookupTypeDEFAULT); err == nil {
+		t.Error("Expected the new tracker not to know the alias.")
+	}
+
+	// Older and untrusted directories are refused.
+	lock.Lock()
+	published = first
+	lock.Unlock()
+	if list.RefreshDirectory() == nil {
+		t.Error("Expected an older directory to be refused.")
+	}
+
+	untrusted, err := SignDirectory(&Directory{Trackers: entries, Issued: time.Now()}, stranger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	published = untrusted
+	lock.Unlock()
+	if list.RefreshDirectory() == nil {
+		t.Error("Expected an untrusted directory to be refused.")
+	}
+	if d := list.Directory(); d.Trackers[0].URL != entries[1].URL {
+		t.Error("Expected a refused directory to leave the list alone.")
+	}
+
+	// A directory is not used once it expires.
+	expiring, err := SignDirectory(&Directory{Trackers: entries, Issued: time.Now(), Expires: time.Now().Add(2 * time.Second)}, publisher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	published = expiring
+	lock.Unlock()
+	if err := list.RefreshDirectory(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := list.LookupAlias("hunter", routing.LookupTypeDEFAULT); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the Directory to Expire
+	time.Sleep(2 * time.Second)
+
+	if _, err := list.LookupAlias("hunter", routing.LookupTypeDEFAULT); err != ErrDirectoryExpired {
+		t.Errorf("Expected an expired directory to be refused, got %v.", err)
+	}
+}
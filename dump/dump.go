@@ -0,0 +1,279 @@
+// Package dump moves a tracker's registrations between record stores
+// through a portable, versioned file.
+//
+// A dump is a JSON lines file. The first line is a Header naming the format
+// and its version, and every following line is a Record holding one signed
+// registration exactly as the client sent it. Because every registration
+// keeps its signature, a dump can be checked on import without trusting the
+// machine that wrote it. A record's alias must be the one that it was signed
+// with.
+//
+// Claiming an alias takes it from its earlier holder, so records are written
+// with the owner of each alias after every other record, and a record that
+// has lost its alias to another address is written without it. Importing a
+// dump in order leaves every alias with the owner that it had.
+package dump
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"airdispat.ch/identity"
+	"airdispat.ch/tracker"
+)
+
+const (
+	// Format identifies a file as a tracker dump.
+	Format = "airdispatch-tracker-dump"
+
+	// Version is the newest version of the format that this package reads
+	// and the version that it writes.
+	Version = 1
+)
+
+// maxLine bounds a single line of a dump, which must hold the largest
+// record.
+const maxLine = 32 << 20
+
+// ErrNotIterable is returned when the source store can not list its
+// records.
+var ErrNotIterable = errors.New("Store does not implement tracker.RecordIterator.")
+
+// aliasOwner is implemented by stores that can report who holds an alias.
+type aliasOwner interface {
+	AliasOwner(alias string) string
+}
+
+// Header is the first line of a dump.
+type Header struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+// Record is a single registration in a dump.
+type Record struct {
+	Address string `json:"address"`
+	Alias   string `json:"alias,omitempty"`
+	Record  []byte `json:"record"`
+}
+
+// Stats counts what happened to the records in a dump.
+type Stats struct {
+	Copied  int
+	Expired int
+	Invalid int
+}
+
+// Options controls which records are imported.
+type Options struct {
+	// SkipExpired leaves out registrations that have already lapsed.
+	SkipExpired bool
+
+	// SkipInvalid leaves out records that fail verification, rather than
+	// stopping the import.
+	SkipInvalid bool
+
+	// InvalidHandler is called for every record that fails verification.
+	InvalidHandler func(address string, err error)
+}
+
+// Export will write every record in store to w.
+func Export(w io.Writer, store tracker.RecordStore) (int, error) {
+	records, err := collect(store)
+	if err != nil {
+		return 0, err
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	err = enc.Encode(&Header{
+		Format:  Format,
+		Version: Version,
+		Created: time.Now().UTC(),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, r := range settle(records, store) {
+		data, err := tracker.MarshalRecord(r.Record)
+		if err != nil {
+			return count, err
+		}
+
+		err = enc.Encode(&Record{
+			Address: r.Address,
+			Alias:   r.Alias,
+			Record:  data,
+		})
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, bw.Flush()
+}
+
+// Import will read a dump from r and save every record into store, checking
+// the signature of each one first.
+func Import(r io.Reader, store tracker.RecordStore, opts *Options) (*Stats, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), maxLine)
+
+	if !scanner.Scan() {
+		if scanner.Err() != nil {
+			return nil, scanner.Err()
+		}
+		return nil, errors.New("Dump is empty.")
+	}
+
+	h := &Header{}
+	err := json.Unmarshal(scanner.Bytes(), h)
+	if err != nil || h.Format != Format {
+		return nil, errors.New("File is not a tracker dump.")
+	}
+	if h.Version > Version {
+		return nil, fmt.Errorf("Dump is version %d, but only versions up to %d are understood.", h.Version, Version)
+	}
+
+	stats := &Stats{}
+	line := 1
+	for scanner.Scan() {
+		line++
+
+		e := &Record{}
+		err = json.Unmarshal(scanner.Bytes(), e)
+		if err != nil {
+			return stats, fmt.Errorf("Unable to read line %d: %v", line, err)
+		}
+
+		r, err := decode(e)
+		if err == nil {
+			err = copyRecord(r, store, opts, stats)
+		}
+		if err != nil {
+			return stats, fmt.Errorf("Unable to import line %d: %v", line, err)
+		}
+	}
+
+	return stats, scanner.Err()
+}
+
+// Migrate will copy every record from one store into another, checking the
+// signature of each one on the way.
+func Migrate(dst tracker.RecordStore, src tracker.RecordStore, opts *Options) (*Stats, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	// Collect first, so that migrating a store into itself (or into a
+	// store sharing its lock) can not deadlock.
+	records, err := collect(src)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{}
+	for _, r := range settle(records, src) {
+		err = copyRecord(r, dst, opts, stats)
+		if err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// collect will list every record in a store.
+func collect(store tracker.RecordStore) ([]*tracker.StoredRecord, error) {
+	it, ok := store.(tracker.RecordIterator)
+	if !ok {
+		return nil, ErrNotIterable
+	}
+
+	var records []*tracker.StoredRecord
+	err := it.ForEachRecord(func(r *tracker.StoredRecord) error {
+		records = append(records, r)
+		return nil
+	})
+	return records, err
+}
+
+// settle will order records so that they can be saved one after another:
+// records without an alias come first, then records whose alias has no
+// current owner, and the owner of each alias last. A record that has lost
+// its alias to another address is left without it.
+func settle(records []*tracker.StoredRecord, store tracker.RecordStore) []*tracker.StoredRecord {
+	owners, _ := store.(aliasOwner)
+
+	var plain, unowned, owned []*tracker.StoredRecord
+	for _, r := range records {
+		if r.Alias == "" {
+			plain = append(plain, r)
+			continue
+		}
+
+		owner := ""
+		if owners != nil {
+			owner = owners.AliasOwner(r.Alias)
+		}
+
+		switch owner {
+		case r.Address:
+			owned = append(owned, r)
+		case "":
+			unowned = append(unowned, r)
+		default:
+			c := *r
+			c.Alias = ""
+			plain = append(plain, &c)
+		}
+	}
+
+	out := append(plain, unowned...)
+	return append(out, owned...)
+}
+
+func decode(e *Record) (*tracker.StoredRecord, error) {
+	record, err := tracker.UnmarshalRecord(e.Record)
+	if err != nil {
+		return nil, err
+	}
+
+	return tracker.NewStoredRecord(identity.CreateAddressFromString(e.Address), record, e.Alias), nil
+}
+
+// copyRecord will verify a record and save it into store.
+func copyRecord(r *tracker.StoredRecord, store tracker.RecordStore, opts *Options, stats *Stats) error {
+	err := tracker.VerifyRecordAlias(r.Address, r.Alias, r.Record)
+	if err != nil {
+		if opts.InvalidHandler != nil {
+			opts.InvalidHandler(r.Address, err)
+		}
+		if !opts.SkipInvalid {
+			return fmt.Errorf("Record for %s is invalid: %v", r.Address, err)
+		}
+		stats.Invalid++
+		return nil
+	}
+
+	if opts.SkipExpired && r.Expired(time.Now()) {
+		stats.Expired++
+		return nil
+	}
+
+	store.SaveRecord(identity.CreateAddressFromString(r.Address), r.Record, r.Alias)
+	stats.Copied++
+	return nil
+}
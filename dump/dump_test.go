@@ -0,0 +1,145 @@
+package dump
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"airdispat.ch/tracker"
+	"airdispat.ch/tracker/storetest"
+)
+
+func TestExportImport(t *testing.T) {
+	src := tracker.NewMemoryStore()
+
+	live, liveRecord := storetest.CreateRecord(t, "live", time.Now().Add(time.Hour))
+	old, oldRecord := storetest.CreateRecord(t, "old", time.Now().Add(-time.Hour))
+	src.SaveRecord(live.Address, liveRecord, "live")
+	src.SaveRecord(old.Address, oldRecord, "old")
+
+	buf := &bytes.Buffer{}
+	count, err := Export(buf, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 records to be exported, got %d.", count)
+	}
+
+	dst := tracker.NewMemoryStore()
+	stats, err := Import(bytes.NewReader(buf.Bytes()), dst, &Options{SkipExpired: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied != 1 || stats.Expired != 1 {
+		t.Errorf("Expected 1 copied and 1 expired record, got %+v.", stats)
+	}
+	if !storetest.SameRecord(dst.GetRecordByAlias("live"), liveRecord) {
+		t.Error("Expected the imported record to be found by its alias.")
+	}
+
+	// Filing a record under someone else's address must be caught.
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	forged := &Record{}
+	json.Unmarshal([]byte(lines[1]), forged)
+	if forged.Address == live.Address.String() {
+		forged.Address = old.Address.String()
+	} else {
+		forged.Address = live.Address.String()
+	}
+	line, _ := json.Marshal(forged)
+	tampered := lines[0] + "\n" + string(line) + "\n"
+
+	_, err = Import(strings.NewReader(tampered), tracker.NewMemoryStore(), nil)
+	if err == nil {
+		t.Error("Expected a forged record to stop the import.")
+	}
+
+	stats, err = Import(strings.NewReader(tampered), tracker.NewMemoryStore(), &Options{SkipInvalid: true})
+	if err != nil || stats.Invalid != 1 {
+		t.Errorf("Expected the forged record to be skipped, got %+v and %v.", stats, err)
+	}
+}
+
+func TestImportVersion(t *testing.T) {
+	newer := `{"format":"airdispatch-tracker-dump","version":99}` + "\n"
+	_, err := Import(strings.NewReader(newer), tracker.NewMemoryStore(), nil)
+	if err == nil {
+		t.Error("Expected a newer dump to be refused.")
+	}
+
+	_, err = Import(strings.NewReader("{}\n"), tracker.NewMemoryStore(), nil)
+	if err == nil {
+		t.Error("Expected a file without a header to be refused.")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	src := tracker.NewMemoryStore()
+	for _, alias := range []string{"a", "b", "c"} {
+		id, record := storetest.CreateRecord(t, alias, time.Now().Add(time.Hour))
+		src.SaveRecord(id.Address, record, alias)
+	}
+
+	dst := tracker.NewMemoryStore()
+	stats, err := Migrate(dst, src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, b := dst.CountRecords(); stats.Copied != 3 || a != 3 || b != 3 {
+		t.Errorf("Expected all 3 records to be migrated, got %d addresses and %d aliases.", a, b)
+	}
+}
+
+func TestExportAliasOwners(t *testing.T) {
+	src := tracker.NewMemoryStore()
+
+	// The alias is taken from its first holder, who keeps their record.
+	first, firstRecord := storetest.CreateRecord(t, "bob", time.Now().Add(time.Hour))
+	owner, ownerRecord := storetest.CreateRecord(t, "bob", time.Now().Add(time.Hour))
+	src.SaveRecord(first.Address, firstRecord, "bob")
+	src.SaveRecord(owner.Address, ownerRecord, "bob")
+
+	buf := &bytes.Buffer{}
+	_, err := Export(buf, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	last := &Record{}
+	json.Unmarshal([]byte(lines[len(lines)-1]), last)
+	if last.Address != owner.Address.String() {
+		t.Error("Expected the owner of the alias to be written last.")
+	}
+
+	dst := tracker.NewMemoryStore()
+	_, err = Import(bytes.NewReader(buf.Bytes()), dst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dst.AliasOwner("bob"); got != owner.Address.String() {
+		t.Errorf("Expected the alias to keep its owner on import, got %s.", got)
+	}
+
+	migrated := tracker.NewMemoryStore()
+	_, err = Migrate(migrated, src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := migrated.AliasOwner("bob"); got != owner.Address.String() {
+		t.Errorf("Expected the alias to keep its owner on migration, got %s.", got)
+	}
+
+	// An alias that the record was not signed with must be caught.
+	last.Alias = "alice"
+	line, _ := json.Marshal(last)
+	tampered := lines[0] + "\n" + string(line) + "\n"
+
+	stats, err := Import(strings.NewReader(tampered), tracker.NewMemoryStore(), &Options{SkipInvalid: true})
+	if err != nil || stats.Invalid != 1 {
+		t.Errorf("Expected the changed alias to be skipped, got %+v and %v.", stats, err)
+	}
+}
@@ -0,0 +1,426 @@
+// Package encstore encrypts the records of another tracker.RecordStore, so
+// that the locations and keys that registrations hold can not be read from
+// the tracker's disk or from a copy of its database.
+//
+// Each record is sealed with AES-GCM and wrapped in a message signed by the
+// tracker before it is handed to the inner store. The inner store indexes
+// the sealed records by an HMAC of their address and alias, so lookups still
+// work without revealing who is registered.
+//
+// A Store may be given several keys. New records are always sealed with the
+// first key, while the others are only used to read records that were saved
+// before the keys were rotated. Rotate re-seals every old record, after
+// which the old keys can be dropped.
+//
+// The inner store never sees a registration, so it can not expire, verify
+// or keep the history of records itself. Stores that check signatures as
+// they load records, such as walstore, can not be wrapped.
+//
+// Wrapping a cluster.Node keeps registrations out of the cluster's Raft log
+// as well, but every node must then be given the same keys.
+package encstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"airdispat.ch/identity"
+	"airdispat.ch/message"
+	"airdispat.ch/tracker"
+)
+
+// sealedCode is the message type of the wrapper around a sealed record.
+const sealedCode = "TES"
+
+// ErrNoKeys is returned by New when it is not given any keys.
+var ErrNoKeys = errors.New("Encrypted store requires at least one key.")
+
+// ErrUnknownKey is returned when a record was sealed with a key that the
+// store was not given.
+var ErrUnknownKey = errors.New("Record was sealed with an unknown key.")
+
+// Backend is a store that can hold sealed records. Every store in this
+// repository except walstore can be used.
+type Backend interface {
+	tracker.RecordStore
+	tracker.RecordDeleter
+	tracker.RecordIterator
+}
+
+// Store is a tracker.RecordStore that encrypts records before saving them
+// to a Backend.
+type Store struct {
+	// ErrorHandler is called when a record can not be sealed or opened. If
+	// it is not set, errors are logged.
+	ErrorHandler func(err *tracker.TrackerError)
+
+	inner  Backend
+	signer *identity.Identity
+	keys   []*key
+}
+
+// payload is what is sealed inside each record.
+type payload struct {
+	Address string `json:"address"`
+	Alias   string `json:"alias,omitempty"`
+	Record  []byte `json:"record"`
+}
+
+// sealed wraps a sealed record so that it can be stored as a signed
+// message.
+type sealed struct {
+	from *identity.Address
+	data []byte
+}
+
+func (s *sealed) ToBytes() []byte { return s.data }
+func (s *sealed) Type() string    { return sealedCode }
+func (s *sealed) Header() message.Header {
+	return message.Header{
+		From:      s.from,
+		To:        nil,
+		Timestamp: time.Now().Unix(),
+	}
+}
+
+// New will wrap inner so that records are encrypted with keys, the first of
+// which is used for new records. Sealed records are signed by signer, which
+// is usually the tracker's own identity.
+func New(inner Backend, signer *identity.Identity, keys ...[]byte) (*Store, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	s := &Store{
+		inner:  inner,
+		signer: signer,
+	}
+	for _, secret := range keys {
+		k, err := newKey(secret)
+		if err != nil {
+			return nil, err
+		}
+		s.keys = append(s.keys, k)
+	}
+
+	return s, nil
+}
+
+func (s *Store) handleError(location string, err error) {
+	if s.ErrorHandler != nil {
+		s.ErrorHandler(&tracker.TrackerError{
+			Location: location,
+			Error:    err,
+		})
+		return
+	}
+	log.Println("Encrypted Store Error At:", location, "-", err)
+}
+
+func (s *Store) current() *key { return s.keys[0] }
+
+// seal will encrypt a record under k.
+func (s *Store) seal(k *key, address string, record *message.SignedMessage, alias string) (*message.SignedMessage, error) {
+	data, err := tracker.MarshalRecord(record)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := json.Marshal(&payload{
+		Address: address,
+		Alias:   alias,
+		Record:  data,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := k.seal(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return message.SignMessage(&sealed{
+		from: s.signer.Address,
+		data: ciphertext,
+	}, s.signer)
+}
+
+// open will decrypt a record held by the inner store.
+func (s *Store) open(record *message.SignedMessage) (*tracker.StoredRecord, *key, error) {
+	data, typ, _, err := record.ReconstructMessage()
+	if err != nil {
+		return nil, nil, err
+	}
+	if typ != sealedCode {
+		return nil, nil, errors.New("Record is not sealed.")
+	}
+
+	var k *key
+	for _, v := range s.keys {
+		if len(data) >= keyIDSize && bytes.Equal(v.id, data[:keyIDSize]) {
+			k = v
+			break
+		}
+	}
+	if k == nil {
+		return nil, nil, ErrUnknownKey
+	}
+
+	plaintext, err := k.open(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p := &payload{}
+	err = json.Unmarshal(plaintext, p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	inner, err := tracker.UnmarshalRecord(p.Record)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tracker.NewStoredRecord(identity.CreateAddressFromString(p.Address), inner, p.Alias), k, nil
+}
+
+// get will open the record of an address held under k, returning nil if
+// there is none.
+func (s *Store) get(k *key, address string) *tracker.StoredRecord {
+	record := s.inner.GetRecordByAddress(identity.CreateAddressFromString(k.address(address)))
+	if record == nil {
+		return nil
+	}
+
+	r, _, err := s.open(record)
+	if err != nil {
+		s.handleError("Open Record", err)
+		return nil
+	}
+	return r
+}
+
+// save will seal a record under k and hand it to the inner store.
+func (s *Store) save(k *key, r *tracker.StoredRecord) error {
+	record, err := s.seal(k, r.Address, r.Record, r.Alias)
+	if err != nil {
+		return err
+	}
+
+	address := identity.CreateAddressFromString(k.address(r.Address))
+	if c, ok := s.inner.(tracker.RecordCommitter); ok {
+		return c.CommitRecord(address, record, k.alias(r.Alias))
+	}
+	s.inner.SaveRecord(address, record, k.alias(r.Alias))
+	return nil
+}
+
+// SaveRecord will seal a record with the current key and save it.
+func (s *Store) SaveRecord(address *identity.Address, record *message.SignedMessage, alias string) {
+	err := s.CommitRecord(address, record, alias)
+	if err != nil {
+		s.handleError("Save Record", err)
+	}
+}
+
+// CommitRecord implements tracker.RecordCommitter, returning an error if the
+// record could not be sealed or the inner store could not save it.
+func (s *Store) CommitRecord(address *identity.Address, record *message.SignedMessage, alias string) error {
+	current := s.current()
+
+	// An alias that is still claimed under an old key would otherwise not
+	// be taken from its owner, so the owner is moved to the current key
+	// first.
+	if alias != "" {
+		for _, old := range s.keys[1:] {
+			err := s.rotateAlias(old, alias)
+			if err != nil {
+				s.handleError("Save Record (Rotating Alias)", err)
+			}
+		}
+	}
+
+	err := s.save(current, tracker.NewStoredRecord(address, record, alias))
+	if err != nil {
+		return err
+	}
+
+	for _, old := range s.keys[1:] {
+		s.inner.DeleteRecord(identity.CreateAddressFromString(old.address(address.String())))
+	}
+	return nil
+}
+
+// GetRecordByAddress will find and decrypt the record of an address.
+func (s *Store) GetRecordByAddress(address *identity.Address) *message.SignedMessage {
+	for _, k := range s.keys {
+		r := s.get(k, address.String())
+		if r == nil {
+			continue
+		}
+
+		if r.Address != address.String() || r.Expired(time.Now()) {
+			return nil
+		}
+		return r.Record
+	}
+	return nil
+}
+
+// GetRecordByAlias will find and decrypt the record of the owner of an
+// alias.
+func (s *Store) GetRecordByAlias(alias string) *message.SignedMessage {
+	if alias == "" {
+		return nil
+	}
+
+	for _, k := range s.keys {
+		record := s.inner.GetRecordByAlias(k.alias(alias))
+		if record == nil {
+			continue
+		}
+
+		r, _, err := s.open(record)
+		if err != nil {
+			s.handleError("Open Record", err)
+			return nil
+		}
+
+		if r.Alias != alias || r.Expired(time.Now()) {
+			return nil
+		}
+		return r.Record
+	}
+	return nil
+}
+
+// DeleteRecord will remove the record of an address under every key.
+func (s *Store) DeleteRecord(address *identity.Address) {
+	for _, k := range s.keys {
+		s.inner.DeleteRecord(identity.CreateAddressFromString(k.address(address.String())))
+	}
+}
+
+// ForEachRecord implements tracker.RecordIterator, listing the decrypted
+// records.
+func (s *Store) ForEachRecord(fn func(record *tracker.StoredRecord) error) error {
+	return s.inner.ForEachRecord(func(sealed *tracker.StoredRecord) error {
+		r, _, err := s.open(sealed.Record)
+		if err != nil {
+			return err
+		}
+		return fn(r)
+	})
+}
+
+// CountRecords implements tracker.RecordCounter if the inner store does.
+func (s *Store) CountRecords() (int, int) {
+	if c, ok := s.inner.(tracker.RecordCounter); ok {
+		return c.CountRecords()
+	}
+	return -1, -1
+}
+
+// CheckHealth implements tracker.HealthChecker if the inner store does.
+func (s *Store) CheckHealth() error {
+	if h, ok := s.inner.(tracker.HealthChecker); ok {
+		return h.CheckHealth()
+	}
+	return nil
+}
+
+// Close will close the inner store, if it needs closing.
+func (s *Store) Close() error {
+	if c, ok := s.inner.(interface {
+		Close() error
+	}); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// rotateAlias will move the owner of an alias claimed under an old key to
+// the current key.
+func (s *Store) rotateAlias(old *key, alias string) error {
+	record := s.inner.GetRecordByAlias(old.alias(alias))
+	if record == nil {
+		return nil
+	}
+
+	r, _, err := s.open(record)
+	if err != nil {
+		return err
+	}
+	if r.Alias != alias {
+		return nil
+	}
+
+	return s.rotate(old, r, alias)
+}
+
+// rotate will re-seal a record that is held under an old key with the
+// current key.
+func (s *Store) rotate(old *key, r *tracker.StoredRecord, alias string) error {
+	if s.get(s.current(), r.Address) == nil {
+		moved := *r
+		moved.Alias = alias
+
+		err := s.save(s.current(), &moved)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.inner.DeleteRecord(identity.CreateAddressFromString(old.address(r.Address)))
+	return nil
+}
+
+// Rotate will re-seal every record that is held under an old key with the
+// current key, returning how many records were moved. Once it succeeds,
+// the old keys are no longer needed.
+func (s *Store) Rotate() (int, error) {
+	type held struct {
+		key    *key
+		record *tracker.StoredRecord
+	}
+
+	var stale []held
+	err := s.inner.ForEachRecord(func(sealed *tracker.StoredRecord) error {
+		r, k, err := s.open(sealed.Record)
+		if err != nil {
+			return err
+		}
+		if k != s.current() {
+			stale = append(stale, held{k, r})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, v := range stale {
+		// A record keeps its alias only if it still owns it.
+		alias := ""
+		if v.record.Alias != "" {
+			if owner := s.inner.GetRecordByAlias(v.key.alias(v.record.Alias)); owner != nil {
+				o, _, err := s.open(owner)
+				if err == nil && o.Address == v.record.Address {
+					alias = v.record.Alias
+				}
+			}
+		}
+
+		err = s.rotate(v.key, v.record, alias)
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return len(stale), nil
+}
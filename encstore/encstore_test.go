@@ -0,0 +1,226 @@
+package encstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"airdispat.ch/identity"
+	"airdispat.ch/tracker"
+	"airdispat.ch/tracker/cluster"
+	"airdispat.ch/tracker/storetest"
+)
+
+func newKeys(t *testing.T, n int) [][]byte {
+	var keys [][]byte
+	for i := 0; i < n; i++ {
+		k, err := GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func newSigner(t *testing.T) *identity.Identity {
+	id, err := identity.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestEncryptedStoreConformance(t *testing.T) {
+	signer := newSigner(t)
+	storetest.Run(t, func(t *testing.T) (tracker.RecordStore, func()) {
+		s, err := New(tracker.NewMemoryStore(), signer, newKeys(t, 1)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, func() {}
+	})
+}
+
+func TestEncryptedStoreBlinding(t *testing.T) {
+	inner := tracker.NewMemoryStore()
+	s, err := New(inner, newSigner(t), IdentityKey(newSigner(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, record := storetest.CreateRecord(t, "hunter", time.Now().Add(time.Hour))
+	s.SaveRecord(id.Address, record, "hunter")
+
+	if inner.GetRecordByAddress(id.Address) != nil || inner.GetRecordByAlias("hunter") != nil {
+		t.Error("Expected the inner store not to index by the real address or alias.")
+	}
+
+	location := []byte(id.Address.Location)
+	inner.ForEachRecord(func(r *tracker.StoredRecord) error {
+		data, err := tracker.MarshalRecord(r.Record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, location) || r.Alias == "hunter" || r.Address == id.Address.String() {
+			t.Error("Expected the inner store to hold only sealed records.")
+		}
+		return nil
+	})
+
+	if !storetest.SameRecord(s.GetRecordByAlias("hunter"), record) {
+		t.Error("Expected to read the record back through the store.")
+	}
+
+	// A store with another key can not read the records.
+	other, err := New(inner, newSigner(t), newKeys(t, 1)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.ErrorHandler = func(*tracker.TrackerError) {}
+	if other.GetRecordByAddress(id.Address) != nil {
+		t.Error("Expected records to be unreadable without the key.")
+	}
+}
+
+func TestEncryptedStoreRotation(t *testing.T) {
+	inner := tracker.NewMemoryStore()
+	signer := newSigner(t)
+	keys := newKeys(t, 2)
+	future := time.Now().Add(time.Hour)
+
+	oldStore, err := New(inner, signer, keys[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, firstRecord := storetest.CreateRecord(t, "first", future)
+	second, secondRecord := storetest.CreateRecord(t, "second", future)
+	oldStore.SaveRecord(first.Address, firstRecord, "first")
+	oldStore.SaveRecord(second.Address, secondRecord, "second")
+
+	// Both keys are known while rotating, with the new key first.
+	s, err := New(inner, signer, keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !storetest.SameRecord(s.GetRecordByAlias("first"), firstRecord) {
+		t.Error("Expected records sealed with the old key to be readable.")
+	}
+
+	// Claiming an alias held under the old key takes it from its owner.
+	third, thirdRecord := storetest.CreateRecord(t, "second", future)
+	s.SaveRecord(third.Address, thirdRecord, "second")
+	if !storetest.SameRecord(s.GetRecordByAlias("second"), thirdRecord) {
+		t.Error("Expected the newest claim of an alias to win.")
+	}
+	if !storetest.SameRecord(s.GetRecordByAddress(second.Address), secondRecord) {
+		t.Error("Expected the previous owner to keep its record.")
+	}
+
+	moved, err := s.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 1 {
+		t.Errorf("Expected 1 record to be re-sealed, got %d.", moved)
+	}
+
+	// Once rotated, the old key is not needed.
+	rotated, err := New(inner, signer, keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !storetest.SameRecord(rotated.GetRecordByAlias("first"), firstRecord) {
+		t.Error("Expected the record to be readable with only the new key.")
+	}
+	if !storetest.SameRecord(rotated.GetRecordByAlias("second"), thirdRecord) {
+		t.Error("Expected the alias to stay with its newest owner.")
+	}
+	if a, _ := rotated.CountRecords(); a != 3 {
+		t.Errorf("Expected 3 records after rotation, got %d.", a)
+	}
+}
+
+func TestEncryptedCluster(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := cluster.New(&cluster.Config{
+		ID:              "node0",
+		Peers:           map[string]string{"node0": l.Addr().String()},
+		Store:           tracker.NewMemoryStore(),
+		Dir:             dir,
+		ElectionTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go node.Run(l)
+	defer node.Close()
+
+	s, err := New(node, newSigner(t), newKeys(t, 1)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sealed records are committed through the node, so that the raft log
+	// never holds a registration.
+	id, record := storetest.CreateRecord(t, "hunter", time.Now().Add(time.Hour))
+	err = s.CommitRecord(id.Address, record, "hunter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "raft.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) == 0 || bytes.Contains(data, []byte(id.Address.Location)) || bytes.Contains(data, []byte("hunter")) {
+		t.Error("Expected the raft log to hold only sealed records.")
+	}
+	if !storetest.SameRecord(s.GetRecordByAlias("hunter"), record) {
+		t.Error("Expected to read the record back through the store.")
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys")
+	keys := newKeys(t, 2)
+
+	err = SaveKeyFile(path, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 2 || !bytes.Equal(loaded[0], keys[0]) || !bytes.Equal(loaded[1], keys[1]) {
+		t.Error("Expected the keys to be read back in order.")
+	}
+
+	ioutil.WriteFile(path, []byte("not a key\n"), 0600)
+	if _, err := LoadKeyFile(path); err == nil {
+		t.Error("Expected a bad key file to be refused.")
+	}
+}
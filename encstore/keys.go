@@ -0,0 +1,176 @@
+package encstore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"airdispat.ch/identity"
+)
+
+// KeySize is the length, in bytes, of a store key.
+const KeySize = 32
+
+// ErrKeySize is returned when a key is not KeySize bytes long.
+var ErrKeySize = fmt.Errorf("Store keys must be %d bytes long.", KeySize)
+
+// GenerateKey will create a new random store key.
+func GenerateKey() ([]byte, error) {
+	k := make([]byte, KeySize)
+	_, err := rand.Read(k)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// IdentityKey will derive a store key from the private signing key of an
+// identity, so that a tracker can encrypt its records without keeping a
+// separate key file. Records encrypted this way can only be read while the
+// tracker keeps the same identity.
+func IdentityKey(id *identity.Identity) []byte {
+	mac := hmac.New(sha256.New, id.SigningKey.D.Bytes())
+	mac.Write([]byte("airdispatch tracker record encryption"))
+	return mac.Sum(nil)
+}
+
+// LoadKeyFile will read the keys from a key file. Each key is written in hex
+// on its own line, with the current key first. Blank lines and lines
+// starting with # are ignored.
+func LoadKeyFile(path string) ([][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys [][]byte
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		k, err := hex.DecodeString(text)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read key on line %d: %v", line, err)
+		}
+		if len(k) != KeySize {
+			return nil, fmt.Errorf("Unable to read key on line %d: %v", line, ErrKeySize)
+		}
+		keys = append(keys, k)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("Key file does not hold any keys.")
+	}
+	return keys, nil
+}
+
+// SaveKeyFile will write keys to a key file that can be read by
+// LoadKeyFile. The current key must be first.
+func SaveKeyFile(path string, keys [][]byte) error {
+	buf := &bytes.Buffer{}
+	fmt.Fprintln(buf, "# Tracker store keys. The first key encrypts new records.")
+	for _, k := range keys {
+		if len(k) != KeySize {
+			return ErrKeySize
+		}
+		fmt.Fprintln(buf, hex.EncodeToString(k))
+	}
+
+	tmp := path + ".tmp"
+	err := ioutil.WriteFile(tmp, buf.Bytes(), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// key holds what is derived from a single store key.
+type key struct {
+	id    []byte
+	aead  cipher.AEAD
+	index []byte
+}
+
+const keyIDSize = 4
+
+func derive(secret []byte, label string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func newKey(secret []byte) (*key, error) {
+	if len(secret) != KeySize {
+		return nil, ErrKeySize
+	}
+
+	block, err := aes.NewCipher(derive(secret, "encrypt"))
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &key{
+		id:    derive(secret, "id")[:keyIDSize],
+		aead:  aead,
+		index: derive(secret, "index"),
+	}, nil
+}
+
+// blind will hide a value that the inner store indexes by. Blinded values
+// are hex so that blinded addresses are still valid addresses.
+func (k *key) blind(kind string, value string) string {
+	mac := hmac.New(sha256.New, k.index)
+	mac.Write([]byte(kind))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:20])
+}
+
+func (k *key) address(address string) string { return k.blind("address", address) }
+
+func (k *key) alias(alias string) string {
+	if alias == "" {
+		return ""
+	}
+	return k.blind("alias", alias)
+}
+
+// seal will encrypt a payload. The payload carries its own address and
+// alias, which are checked after it is opened, so a sealed record that is
+// moved to another index entry is not accepted.
+func (k *key) seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	out := append(append([]byte(nil), k.id...), nonce...)
+	return k.aead.Seal(out, nonce, plaintext, k.id), nil
+}
+
+func (k *key) open(sealed []byte) ([]byte, error) {
+	n := keyIDSize + k.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, errors.New("Sealed record is too short.")
+	}
+	return k.aead.Open(nil, sealed[keyIDSize:n], sealed[n:], k.id)
+}
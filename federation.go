@@ -0,0 +1,220 @@
+package tracker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"airdispat.ch/identity"
+	"airdispat.ch/routing"
+)
+
+// DefaultDiscoverTTL is how long a FederatedRouter remembers the tracker
+// that it discovered for a domain if no other time is given.
+const DefaultDiscoverTTL = time.Hour
+
+// ParseQualifiedAlias will split an alias such as "hunter@example.org" into
+// its name and the domain of the tracker that holds it. Aliases without a
+// domain are returned with an empty domain.
+func ParseQualifiedAlias(alias string) (name string, domain string) {
+	i := strings.LastIndex(alias, "@")
+	if i < 0 {
+		return alias, ""
+	}
+	return alias[:i], strings.ToLower(alias[i+1:])
+}
+
+// QualifyAlias will join an alias to the domain of the tracker that holds
+// it.
+func QualifyAlias(name string, domain string) string {
+	if domain == "" {
+		return name
+	}
+	return name + "@" + domain
+}
+
+// DiscoverTracker will find the tracker for a domain from its SRV record, as
+// GetTrackingServerLocationFromURL does, returning "" if it has none.
+func DiscoverTracker(domain string) string {
+	_, recs, err := net.LookupSRV("adtp", "tcp", domain)
+	if err != nil || len(recs) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", recs[0].Target, recs[0].Port)
+}
+
+// FederatedRouter implements the AirDispatch routing.Router interface for
+// aliases qualified by a domain, such as "hunter@example.org". Lookups for
+// a qualified alias are sent to the tracker for its domain, while address
+// lookups, registrations and unqualified aliases are handled by a local
+// router.
+//
+// A tracker's Namespaces use the same syntax for aliases that the tracker
+// holds itself, such as "alice@corp.example". Those namespaces are listed
+// in Namespaces, and their aliases are kept whole and handled by the local
+// router.
+type FederatedRouter struct {
+	Origin     *identity.Identity
+	Redirector RedirectHandler
+
+	// Local answers address lookups, unqualified aliases and aliases in
+	// Domain, and accepts registrations.
+	Local routing.Router
+
+	// Domain is optional. If it is set, aliases qualified with it are
+	// looked up with Local.
+	Domain string
+
+	// Namespaces is optional. It lists the namespaces whose aliases are
+	// held by Local under their full name, and is consulted before
+	// Domains.
+	Namespaces []string
+
+	// Domains is optional. It maps a domain to the URL of the tracker that
+	// holds its aliases, and is consulted before Discover.
+	Domains map[string]string
+
+	// Discover is optional. If it is set, it finds the tracker for a
+	// domain that is not in Domains, returning "" if there is none.
+	// Otherwise DiscoverTracker is used. Trackers that are found are
+	// remembered for DiscoverTTL, while domains without one are tried
+	// again next time.
+	Discover func(domain string) string
+
+	// DiscoverTTL is how long a discovered tracker is remembered before
+	// its domain is looked up again.
+	DiscoverTTL time.Duration
+
+	// Metrics is optional. If it is set, the FederatedRouter and the
+	// routers that it creates will record the outcome of every request.
+	Metrics *Metrics
+
+	lock    sync.RWMutex
+	domains map[string]discoveredTracker
+}
+
+type discoveredTracker struct {
+	url   string
+	found time.Time
+}
+
+func (a *FederatedRouter) discoverTTL() time.Duration {
+	if a.DiscoverTTL <= 0 {
+		return DefaultDiscoverTTL
+	}
+	return a.DiscoverTTL
+}
+
+// CreateFederatedRouter will return a FederatedRouter that resolves
+// qualified aliases on the trackers of their domains, and everything else
+// with local.
+func CreateFederatedRouter(redirect RedirectHandler, currentIdentity *identity.Identity, local routing.Router, domains map[string]string) *FederatedRouter {
+	return &FederatedRouter{
+		Origin:     currentIdentity,
+		Redirector: redirect,
+		Local:      local,
+		Domains:    domains,
+	}
+}
+
+// tracker will return the URL of the tracker for a domain, and how it was
+// found.
+func (a *FederatedRouter) tracker(domain string) (string, string, error) {
+	if url, ok := a.Domains[domain]; ok {
+		return url, "static", nil
+	}
+
+	a.lock.RLock()
+	cached, ok := a.domains[domain]
+	a.lock.RUnlock()
+	if ok && time.Since(cached.found) < a.discoverTTL() {
+		return cached.url, "discovered", nil
+	}
+
+	discover := a.Discover
+	if discover == nil {
+		discover = DiscoverTracker
+	}
+	url := discover(domain)
+	if url == "" {
+		return "", "", errors.New("Unable to find the tracker for " + domain + ".")
+	}
+
+	a.lock.Lock()
+	if a.domains == nil {
+		a.domains = make(map[string]discoveredTracker)
+	}
+	a.domains[domain] = discoveredTracker{url, time.Now()}
+	a.lock.Unlock()
+
+	return url, "discovered", nil
+}
+
+// local will return the alias that Local holds an alias under, and true if
+// it is held by Local.
+func (a *FederatedRouter) local(alias string) (string, bool) {
+	short, domain := ParseQualifiedAlias(alias)
+	if domain == "" || domain == strings.ToLower(a.Domain) {
+		return short, true
+	}
+
+	for _, v := range a.Namespaces {
+		if strings.ToLower(v) == domain {
+			return alias, true
+		}
+	}
+	return "", false
+}
+
+// Lookup will perform a lookup on an address with the local router.
+func (a *FederatedRouter) Lookup(addr string, name routing.LookupType) (*identity.Address, error) {
+	return a.Local.Lookup(addr, name)
+}
+
+// LookupAlias will look up an alias on the tracker for its domain, or with
+// the local router if it is not qualified by another domain or is in one of
+// the Namespaces.
+func (a *FederatedRouter) LookupAlias(alias string, name routing.LookupType) (*identity.Address, error) {
+	if held, ok := a.local(alias); ok {
+		a.Metrics.inc("tracker_client_federated_lookups_total", "local")
+		return a.Local.LookupAlias(held, name)
+	}
+
+	short, domain := ParseQualifiedAlias(alias)
+
+	url, source, err := a.tracker(domain)
+	if err != nil {
+		a.Metrics.inc("tracker_client_federated_lookups_total", "error")
+		return nil, err
+	}
+
+	router := &Router{
+		URL:        url,
+		Origin:     a.Origin,
+		Redirector: a.Redirector,
+		Metrics:    a.Metrics,
+	}
+
+	addr, err := router.LookupAlias(short, name)
+	if err != nil {
+		a.Metrics.inc("tracker_client_federated_lookups_total", "error")
+		return nil, err
+	}
+	a.Metrics.inc("tracker_client_federated_lookups_total", source)
+
+	addr.Alias = QualifyAlias(short, domain)
+	return addr, nil
+}
+
+// Register will register an address with the local router. Aliases may
+// only be qualified with the router's own Domain or one of its Namespaces.
+func (a *FederatedRouter) Register(key *identity.Identity, alias string, redirects map[string]routing.Redirect) error {
+	held, ok := a.local(alias)
+	if !ok {
+		return errors.New("Can not register an alias in another domain.")
+	}
+	return a.Local.Register(key, held, redirects)
+}
@@ -0,0 +1,161 @@
+package tracker
+
+import (
+	"testing"
+	"time"
+
+	"airdispat.ch/identity"
+	"airdispat.ch/routing"
+)
+
+func TestParseQualifiedAlias(t *testing.T) {
+	tests := []struct {
+		alias, name, domain string
+	}{
+		{"hunter", "hunter", ""},
+		{"hunter@example.org", "hunter", "example.org"},
+		{"hunter@Example.ORG", "hunter", "example.org"},
+		{"first@last@example.org", "first@last", "example.org"},
+	}
+
+	for _, v := range tests {
+		name, domain := ParseQualifiedAlias(v.alias)
+		if name != v.name || domain != v.domain {
+			t.Errorf("Expected %s to parse as %s and %s, got %s and %s.", v.alias, v.name, v.domain, name, domain)
+		}
+	}
+
+	if QualifyAlias("hunter", "example.org") != "hunter@example.org" || QualifyAlias("hunter", "") != "hunter" {
+		t.Error("Expected aliases to be qualified with their domain.")
+	}
+}
+
+func TestFederatedRouter(t *testing.T) {
+	ports := []string{"9108", "9109"}
+	registered := make([]*identity.Identity, len(ports))
+	for _, port := range ports {
+		key, err := identity.CreateIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go (&Tracker{
+			Key:      key,
+			Delegate: newTestingTracker(),
+		}).StartServer(port)
+	}
+
+	// Wait for Server to Startup
+	time.Sleep(1 * time.Second)
+
+	// Both domains have someone called hunter.
+	for i, port := range ports {
+		id, err := identity.CreateIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id.SetLocation("example.com")
+
+		err = (&Router{URL: "localhost:" + port, Origin: id}).Register(id, "hunter", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		registered[i] = id
+	}
+
+	toLog, err := identity.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := &Router{URL: "localhost:9108", Origin: toLog}
+	router := CreateFederatedRouter(nil, toLog, local, map[string]string{"example.net": "localhost:9109"})
+	router.Domain = "example.org"
+	router.Metrics = NewMetrics()
+
+	discovered := 0
+	router.Discover = func(domain string) string {
+		if domain != "example.com" {
+			return ""
+		}
+		discovered++
+		return "localhost:9109"
+	}
+
+	tests := []struct {
+		alias string
+		owner *identity.Identity
+	}{
+		{"hunter", registered[0]},
+		{"hunter@example.org", registered[0]},
+		{"hunter@example.net", registered[1]},
+		{"hunter@example.com", registered[1]},
+		{"hunter@example.com", registered[1]},
+	}
+
+	for _, v := range tests {
+		addr, err := router.LookupAlias(v.alias, routing.LookupTypeDEFAULT)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.String() != v.owner.Address.String() {
+			t.Errorf("Expected %s to be found on the tracker for its domain.", v.alias)
+		}
+	}
+
+	if discovered != 1 {
+		t.Errorf("Expected the tracker for a domain to be discovered once, got %d.", discovered)
+	}
+
+	// Discovered trackers are looked up again once they are too old.
+	router.DiscoverTTL = time.Millisecond
+	time.Sleep(10 * time.Millisecond)
+	_, err = router.LookupAlias("hunter@example.com", routing.LookupTypeDEFAULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if discovered != 2 {
+		t.Errorf("Expected the tracker to be discovered again, got %d.", discovered)
+	}
+	router.DiscoverTTL = 0
+	if router.Metrics.Value("tracker_client_federated_lookups_total", "static") != 1 {
+		t.Error("Expected one lookup to use the static map.")
+	}
+
+	_, err = router.LookupAlias("hunter@unknown.org", routing.LookupTypeDEFAULT)
+	if err == nil {
+		t.Error("Expected a domain without a tracker to fail.")
+	}
+
+	err = router.Register(toLog, "hunter@example.net", nil)
+	if err == nil {
+		t.Error("Expected registering an alias in another domain to fail.")
+	}
+
+	// Aliases in a namespace that the local tracker holds keep their
+	// domain, and are not sent to the tracker for it.
+	member, err := identity.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	member.SetLocation("example.com")
+
+	router.Namespaces = []string{"Corp.Example"}
+	err = router.Register(member, "alice@corp.example", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := router.LookupAlias("alice@corp.example", routing.LookupTypeDEFAULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != member.Address.String() {
+		t.Error("Expected the namespaced alias to be found on the local tracker.")
+	}
+
+	addr, err = local.LookupAlias("alice@corp.example", routing.LookupTypeDEFAULT)
+	if err != nil || addr.String() != member.Address.String() {
+		t.Errorf("Expected the namespaced alias to be held in full, got %v.", err)
+	}
+}
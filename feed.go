@@ -0,0 +1,349 @@
+package tracker
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	adErrors "airdispat.ch/errors"
+	"airdispat.ch/identity"
+	"airdispat.ch/message"
+	"airdispat.ch/tracker/wire"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// ChangeKind describes what happened to a record in the change feed.
+type ChangeKind string
+
+// The kinds of change that may appear in a change feed. Deletions and
+// expiries are tombstones and do not carry a record.
+const (
+	ChangeUpdate ChangeKind = "update"
+	ChangeDelete ChangeKind = "delete"
+	ChangeExpire ChangeKind = "expire"
+)
+
+const (
+	// DefaultFeedLimit is the page size used when a query does not ask for
+	// one.
+	DefaultFeedLimit = 100
+
+	// MaxFeedLimit is the largest page that a tracker will return.
+	MaxFeedLimit = 1000
+
+	// DefaultChangeLogCapacity is the number of changes that a ChangeLog
+	// retains if no other capacity is given.
+	DefaultChangeLogCapacity = 10000
+)
+
+// ErrFeedTruncated is returned when a cursor refers to changes that are no
+// longer retained. The reader must start over from a full copy.
+var ErrFeedTruncated = errors.New("Changes after this cursor are no longer retained.")
+
+// Change is a single, sequence numbered entry in a tracker's change feed.
+type Change struct {
+	Sequence uint64
+	Kind     ChangeKind
+	Address  string
+	Alias    string
+	Time     time.Time
+	Record   *message.SignedMessage
+}
+
+// ChangeFeed may be implemented by a RecordStore that records every
+// change to its records, so that the tracker can serve the change feed.
+type ChangeFeed interface {
+	// ChangesSince returns up to limit changes with a sequence number
+	// greater than cursor, oldest first.
+	ChangesSince(cursor uint64, limit int) ([]*Change, error)
+	// LastSequence returns the newest sequence number.
+	LastSequence() uint64
+}
+
+// ChangeLog is a bounded, in-memory ChangeFeed that stores can use to
+// number their changes.
+type ChangeLog struct {
+	// Capacity is the number of changes retained. Older changes are
+	// discarded and reading from before them returns ErrFeedTruncated.
+	Capacity int
+
+	lock    sync.RWMutex
+	changes []*Change
+	seq     uint64
+}
+
+// Append will add a change to the log and return its sequence number.
+func (c *ChangeLog) Append(kind ChangeKind, address string, alias string, record *message.SignedMessage) uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.seq++
+	c.changes = append(c.changes, &Change{
+		Sequence: c.seq,
+		Kind:     kind,
+		Address:  address,
+		Alias:    alias,
+		Time:     time.Now(),
+		Record:   record,
+	})
+
+	capacity := c.Capacity
+	if capacity <= 0 {
+		capacity = DefaultChangeLogCapacity
+	}
+	if over := len(c.changes) - capacity; over > 0 {
+		c.changes = append([]*Change(nil), c.changes[over:]...)
+	}
+
+	return c.seq
+}
+
+// ChangesSince implements ChangeFeed.
+func (c *ChangeLog) ChangesSince(cursor uint64, limit int) ([]*Change, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	// A cursor from the future means that the log has been reset.
+	if cursor > c.seq {
+		return nil, ErrFeedTruncated
+	}
+
+	// Changes after the cursor have been discarded, either because the
+	// log is full or because it was reset.
+	first := c.seq + 1
+	if len(c.changes) > 0 {
+		first = c.changes[0].Sequence
+	}
+	if cursor+1 < first {
+		return nil, ErrFeedTruncated
+	}
+
+	i := sort.Search(len(c.changes), func(i int) bool {
+		return c.changes[i].Sequence > cursor
+	})
+
+	end := len(c.changes)
+	if limit > 0 && i+limit < end {
+		end = i + limit
+	}
+
+	return append([]*Change(nil), c.changes[i:end]...), nil
+}
+
+// Reset will discard every change in the log and carry on numbering after
+// seq, as when a store that was restarted carries on with an earlier feed.
+// Readers with a cursor before seq must start over.
+func (c *ChangeLog) Reset(seq uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.changes = nil
+	c.seq = seq
+}
+
+// LastSequence implements ChangeFeed.
+func (c *ChangeLog) LastSequence() uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.seq
+}
+
+// handleFeed will return a page of the change feed to the requester.
+func (t *Tracker) handleFeed(theAddress *identity.Address, req *wire.TrackerFeedQuery, conn net.Conn) {
+	feed, ok := t.records().(ChangeFeed)
+	if !ok {
+		adErrors.CreateError(adErrors.UnexpectedError, "This tracker does not publish a change feed.", t.Key.Address).Send(t.Key, conn)
+		return
+	}
+
+	limit := int(req.GetLimit())
+	if limit <= 0 {
+		limit = DefaultFeedLimit
+	} else if limit > MaxFeedLimit {
+		limit = MaxFeedLimit
+	}
+
+	// Ask for one extra change to find out whether there are more.
+	changes, err := feed.ChangesSince(req.GetCursor(), limit+1)
+	truncated := err == ErrFeedTruncated
+	if truncated {
+		changes = nil
+	} else if err != nil {
+		t.handleError("Handle Feed (Reading Changes)", err)
+		adErrors.CreateError(adErrors.InternalError, "Couldn't read the change feed.", t.Key.Address).Send(t.Key, conn)
+		return
+	}
+
+	more := len(changes) > limit
+	if more {
+		changes = changes[:limit]
+	}
+
+	cursor := req.GetCursor()
+	latest := feed.LastSequence()
+	response := &wire.TrackerFeed{
+		Cursor:    &cursor,
+		More:      &more,
+		Latest:    &latest,
+		Truncated: &truncated,
+	}
+
+	for _, c := range changes {
+		entry, err := changeToWire(c)
+		if err != nil {
+			t.handleError("Handle Feed (Packing Change)", err)
+			adErrors.CreateError(adErrors.InternalError, "Couldn't pack the change feed.", t.Key.Address).Send(t.Key, conn)
+			return
+		}
+
+		response.Entry = append(response.Entry, entry)
+		cursor = c.Sequence
+	}
+
+	err = t.reply(theAddress, wire.FeedCode, response, conn)
+	if err != nil {
+		t.handleError("Handle Feed (Sending Response)", err)
+	}
+}
+
+func changeToWire(c *Change) (*wire.FeedEntry, error) {
+	seq := c.Sequence
+	kind := string(c.Kind)
+	address := c.Address
+	alias := c.Alias
+	timestamp := uint64(c.Time.Unix())
+
+	entry := &wire.FeedEntry{
+		Sequence:  &seq,
+		Kind:      &kind,
+		Address:   &address,
+		Username:  &alias,
+		Timestamp: &timestamp,
+	}
+
+	if c.Record != nil {
+		data, err := MarshalRecord(c.Record)
+		if err != nil {
+			return nil, err
+		}
+		entry.Record = data
+	}
+
+	return entry, nil
+}
+
+// changeFromWire will unpack a change sent by a tracker, making sure that
+// any record it carries is correctly signed by the address it describes.
+func changeFromWire(entry *wire.FeedEntry) (*Change, error) {
+	c := &Change{
+		Sequence: entry.GetSequence(),
+		Kind:     ChangeKind(entry.GetKind()),
+		Address:  entry.GetAddress(),
+		Alias:    entry.GetUsername(),
+		Time:     time.Unix(int64(entry.GetTimestamp()), 0),
+	}
+
+	if c.Kind != ChangeUpdate {
+		return c, nil
+	}
+
+	record, err := UnmarshalRecord(entry.GetRecord())
+	if err != nil {
+		return nil, err
+	}
+
+	err = VerifyRecord(c.Address, record)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Record = record
+	return c, nil
+}
+
+// FeedPage is a single page of a tracker's change feed.
+type FeedPage struct {
+	Changes []*Change
+	Cursor  uint64
+	Latest  uint64
+	More    bool
+}
+
+// Changes will fetch the changes that a tracker has made after cursor. At
+// most limit changes are returned; zero uses the tracker's default. If the
+// changes are no longer retained, ErrFeedTruncated is returned along with an
+// empty page that reports the tracker's latest sequence number.
+func (a *Router) Changes(cursor uint64, limit int) (*FeedPage, error) {
+	q := &FeedQueryMessage{
+		From:   a.Origin,
+		Cursor: cursor,
+		Limit:  limit,
+	}
+
+	conn, err := a.send(q, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	_, d, _, err := readResponse(conn, wire.FeedCode)
+	if err != nil {
+		return nil, err
+	}
+
+	feed := &wire.TrackerFeed{}
+	err = proto.Unmarshal(d, feed)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &FeedPage{
+		Cursor: feed.GetCursor(),
+		Latest: feed.GetLatest(),
+		More:   feed.GetMore(),
+	}
+
+	// The page is returned with the error so that the reader knows where
+	// the feed stands once it has caught up some other way.
+	if feed.GetTruncated() {
+		return page, ErrFeedTruncated
+	}
+
+	for _, v := range feed.GetEntry() {
+		c, err := changeFromWire(v)
+		if err != nil {
+			return nil, err
+		}
+		page.Changes = append(page.Changes, c)
+	}
+
+	return page, nil
+}
+
+// FeedReader follows a tracker's change feed, remembering the cursor so that
+// reading can be resumed (for instance after a restart, by saving Cursor).
+type FeedReader struct {
+	Router *Router
+	Cursor uint64
+	Limit  int
+
+	// Latest is the newest sequence number reported by the tracker on the
+	// last read, which can be compared with Cursor to measure lag.
+	Latest uint64
+}
+
+// Next will fetch the next page of changes and advance the cursor. It
+// returns an empty slice once the reader has caught up.
+func (f *FeedReader) Next() ([]*Change, error) {
+	page, err := f.Router.Changes(f.Cursor, f.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	f.Cursor = page.Cursor
+	f.Latest = page.Latest
+	return page.Changes, nil
+}
@@ -0,0 +1,187 @@
+package tracker
+
+import (
+	"errors"
+	"time"
+
+	adErrors "airdispat.ch/errors"
+	"airdispat.ch/identity"
+	"airdispat.ch/message"
+	"airdispat.ch/tracker/wire"
+)
+
+// DefaultForwardHops is how many times a query may be passed between
+// trackers if no other limit is given.
+const DefaultForwardHops = 3
+
+// Forwarding lets a tracker answer queries for records that it does not
+// hold by asking its peers for them. The peer's signed record is returned
+// to the client with the forwarding tracker's signature added, so clients
+// only need to know a single tracker.
+//
+// Forwarded queries carry the address of every tracker that has passed
+// them on, and a count of the hops that remain, so that a ring of peers
+// will not pass a query around forever.
+type Forwarding struct {
+	// Peers are asked for a missing record in order, until one of them
+	// has it.
+	Peers []*Peer
+
+	// MaxHops is the most times that a query received from a client may
+	// be forwarded. Queries forwarded by other trackers keep their own
+	// limit if it is lower.
+	MaxHops int
+
+	// Cache is optional. If it is set, records found by peers are kept
+	// so that repeated queries are not forwarded again.
+	Cache *RecordCache
+}
+
+func (f *Forwarding) maxHops() int {
+	if f.MaxHops <= 0 {
+		return DefaultForwardHops
+	}
+	return f.MaxHops
+}
+
+// forwardQuery will ask the tracker's peers for a record that it does not
+// hold, returning nil if none of them have it or the query may not be
+// forwarded again.
+func (t *Tracker) forwardQuery(req *wire.TrackerQuery) *message.SignedMessage {
+	if t.Forwarding == nil {
+		return nil
+	}
+
+	self := t.Key.Address.String()
+	via := req.GetVia()
+	for _, v := range via {
+		if v == self {
+			t.Metrics.inc("tracker_forwarded_queries_total", "loop")
+			return nil
+		}
+	}
+
+	hops := t.Forwarding.maxHops()
+	if req.Hops != nil && int(req.GetHops()) < hops {
+		hops = int(req.GetHops())
+	}
+	if hops <= 0 {
+		t.Metrics.inc("tracker_forwarded_queries_total", "hop_limit")
+		return nil
+	}
+
+	key := aliasWatchKey(req.GetUsername())
+	if req.GetUsername() == "" {
+		key = addressWatchKey(req.GetAddress())
+	}
+
+	now := time.Now()
+	var epoch uint64
+	if t.Forwarding.Cache != nil {
+		var record *message.SignedMessage
+		record, epoch = t.Forwarding.Cache.get(key, now)
+		if record != nil {
+			t.Metrics.inc("tracker_forwarded_queries_total", "cached")
+			return record
+		}
+	}
+
+	q := &QueryMessage{
+		From:    t.Key,
+		Address: req.GetAddress(),
+		Alias:   req.GetUsername(),
+		Hops:    hops - 1,
+		Via:     append(append([]string{}, via...), self),
+	}
+
+	for _, p := range t.Forwarding.Peers {
+		if p.Address == self || containsString(via, p.Address) {
+			continue
+		}
+
+		router := &Router{
+			URL:    p.URL,
+			Origin: t.Key,
+		}
+
+		record, err := router.fetchRecord(q)
+		if err != nil {
+			if e, ok := err.(*adErrors.Error); !ok || e.Code != adErrors.AddressNotFound {
+				t.handleError("Forward Query To "+p.URL, err)
+			}
+			continue
+		}
+
+		err = checkForwardedRecord(q, record, now)
+		if err != nil {
+			t.handleError("Forward Query To "+p.URL, err)
+			continue
+		}
+
+		if t.Forwarding.Cache != nil {
+			t.Forwarding.Cache.put(key, record, epoch, now)
+		}
+		t.Metrics.inc("tracker_forwarded_queries_total", "found")
+		return record
+	}
+
+	t.Metrics.inc("tracker_forwarded_queries_total", "not_found")
+	return nil
+}
+
+// checkForwardedRecord will make sure that a record returned by a peer is
+// a current registration that answers the query.
+func checkForwardedRecord(q *QueryMessage, record *message.SignedMessage, now time.Time) error {
+	reg := registrationFromRecord(record)
+	if reg == nil {
+		return errors.New("Record is not a registration.")
+	}
+
+	err := VerifyRecord(reg.Address, record)
+	if err != nil {
+		return err
+	}
+
+	if q.Alias != "" && reg.Alias != q.Alias {
+		return errors.New("Record does not match the alias queried.")
+	} else if q.Alias == "" && reg.Address != q.Address {
+		return errors.New("Record does not match the address queried.")
+	}
+
+	if !reg.Expires.IsZero() && !now.Before(reg.Expires) {
+		return errors.New("Record has expired.")
+	}
+
+	return nil
+}
+
+// fetchRecord will send a query to the tracker and return the signed
+// record that it answers with.
+func (a *Router) fetchRecord(q *QueryMessage) (*message.SignedMessage, error) {
+	conn, err := a.send(q, identity.CreateAddressFromString(q.Address))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	sin, d, h, err := readResponse(conn, wire.RegistrationCode)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = registrationFromResponse(d, h)
+	if err != nil {
+		return nil, err
+	}
+
+	return sin, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
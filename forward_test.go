@@ -0,0 +1,98 @@
+package tracker
+
+import (
+	"testing"
+	"time"
+
+	adErrors "airdispat.ch/errors"
+	"airdispat.ch/identity"
+	"airdispat.ch/routing"
+)
+
+func TestForwarding(t *testing.T) {
+	ports := []string{"9104", "9105", "9106", "9107"}
+	trackers := make([]*Tracker, len(ports))
+	peers := make([]*Peer, len(ports))
+	for i, port := range ports {
+		key, err := identity.CreateIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		trackers[i] = &Tracker{
+			Key:        key,
+			Delegate:   newTestingTracker(),
+			Metrics:    NewMetrics(),
+			Forwarding: &Forwarding{MaxHops: 5},
+		}
+		peers[i] = &Peer{URL: "localhost:" + port, Address: key.Address.String()}
+	}
+
+	// The first three trackers forward to each other in a ring. The last
+	// only lets its queries be forwarded once.
+	trackers[0].Forwarding.Peers = []*Peer{peers[1]}
+	trackers[0].Forwarding.Cache = NewRecordCache(0, 0)
+	trackers[1].Forwarding.Peers = []*Peer{peers[2]}
+	trackers[2].Forwarding.Peers = []*Peer{{URL: peers[0].URL}}
+	trackers[3].Forwarding.Peers = []*Peer{peers[1]}
+	trackers[3].Forwarding.MaxHops = 1
+
+	for i, port := range ports {
+		go trackers[i].StartServer(port)
+	}
+
+	// Wait for Server to Startup
+	time.Sleep(1 * time.Second)
+
+	toLog, err := identity.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	toLog.SetLocation("example.com")
+
+	err = (&Router{URL: peers[2].URL, Origin: toLog}).Register(toLog, "hunter", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first tracker finds the record two hops away.
+	router := &Router{URL: peers[0].URL, Origin: toLog}
+	for i := 0; i < 2; i++ {
+		addr, err := router.LookupAlias("hunter", routing.LookupTypeDEFAULT)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.String() != toLog.Address.String() {
+			t.Error("Expected the forwarded record to answer for the alias.")
+		}
+	}
+
+	if v := trackers[0].Metrics.Value("tracker_forwarded_queries_total", "found"); v != 1 {
+		t.Errorf("Expected one forwarded query to be found, got %v.", v)
+	}
+	if v := trackers[0].Metrics.Value("tracker_forwarded_queries_total", "cached"); v != 1 {
+		t.Errorf("Expected the second query to be answered from the cache, got %v.", v)
+	}
+	if trackers[0].records().GetRecordByAlias("hunter") != nil {
+		t.Error("Expected forwarded records not to be stored.")
+	}
+
+	// A query for a missing record comes back to the first tracker, which
+	// recognises it.
+	_, err = router.LookupAlias("nobody", routing.LookupTypeDEFAULT)
+	if e, ok := err.(*adErrors.Error); !ok || e.Code != adErrors.AddressNotFound {
+		t.Fatal("Expected the missing alias not to be found, got", err)
+	}
+	if trackers[0].Metrics.Value("tracker_forwarded_queries_total", "loop") != 1 {
+		t.Error("Expected the first tracker to refuse the query that it forwarded.")
+	}
+
+	// Queries are not forwarded past the hop limit.
+	_, err = (&Router{URL: peers[3].URL, Origin: toLog}).Lookup(toLog.Address.String(), routing.LookupTypeDEFAULT)
+	if err == nil {
+		t.Error("Expected the query to run out of hops.")
+	}
+	if trackers[1].Metrics.Value("tracker_forwarded_queries_total", "hop_limit") != 1 {
+		t.Error("Expected the second tracker to stop forwarding at the hop limit.")
+	}
+}
@@ -0,0 +1,252 @@
+package tracker
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	adErrors "airdispat.ch/errors"
+	"airdispat.ch/identity"
+	"airdispat.ch/routing"
+	"airdispat.ch/tracker/wire"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// DefaultHistoryLimit is the number of past records kept for each address
+// and alias if no other limit is given.
+const DefaultHistoryLimit = 16
+
+// ErrNoHistory is returned when no record was current at the requested
+// time.
+var ErrNoHistory = errors.New("No record was current at that time.")
+
+// HistoricalRecord is a record along with the time that it was current.
+type HistoricalRecord struct {
+	StoredRecord
+
+	// Saved is when the tracker accepted the record.
+	Saved time.Time
+
+	// Replaced is when the record was replaced or deleted. It is zero if
+	// the record is still current.
+	Replaced time.Time
+}
+
+// CurrentAt will return true if the record was held, and had not lapsed,
+// at the given time. Saved and Replaced are only compared to the second, as
+// history queries only carry the time to the second.
+func (h *HistoricalRecord) CurrentAt(when time.Time) bool {
+	if when.Before(h.Saved.Truncate(time.Second)) {
+		return false
+	}
+	if !h.Replaced.IsZero() && !when.Before(h.Replaced.Truncate(time.Second)) {
+		return false
+	}
+	return !h.Expired(when)
+}
+
+// RecordHistory may be implemented by a RecordStore that keeps a bounded
+// history of the records it has held. Both methods return the newest record
+// first, and AddressHistory includes the current record.
+type RecordHistory interface {
+	AddressHistory(address string) ([]*HistoricalRecord, error)
+	AliasHistory(alias string) ([]*HistoricalRecord, error)
+}
+
+// RecordAt will find the record that was current at the given time in a
+// history returned by a RecordHistory. When several records claimed an
+// alias at once, the one saved last wins, as it does in the stores.
+func RecordAt(history []*HistoricalRecord, when time.Time) *HistoricalRecord {
+	var found *HistoricalRecord
+	for _, h := range history {
+		if h.CurrentAt(when) && (found == nil || h.Saved.After(found.Saved)) {
+			found = h
+		}
+	}
+	return found
+}
+
+// handleHistory will return the past records of an address or alias to the
+// requester.
+func (t *Tracker) handleHistory(theAddress *identity.Address, req *wire.TrackerHistoryQuery, conn net.Conn) {
+	store, ok := t.records().(RecordHistory)
+	if !ok {
+		adErrors.CreateError(adErrors.UnexpectedError, "This tracker does not keep history.", t.Key.Address).Send(t.Key, conn)
+		return
+	}
+
+	var (
+		history []*HistoricalRecord
+		err     error
+	)
+	if req.GetUsername() != "" {
+		history, err = store.AliasHistory(req.GetUsername())
+	} else if req.GetAddress() != "" {
+		history, err = store.AddressHistory(req.GetAddress())
+	} else {
+		adErrors.CreateError(adErrors.UnexpectedError, "History query needs an address or username.", t.Key.Address).Send(t.Key, conn)
+		return
+	}
+
+	if err != nil {
+		t.handleError("Handle History (Reading History)", err)
+		adErrors.CreateError(adErrors.InternalError, "Couldn't read the history.", t.Key.Address).Send(t.Key, conn)
+		return
+	}
+
+	if req.At != nil {
+		h := RecordAt(history, time.Unix(int64(req.GetAt()), 0))
+
+		history = nil
+		if h != nil {
+			history = []*HistoricalRecord{h}
+		}
+	}
+
+	if len(history) == 0 {
+		adErrors.CreateError(adErrors.AddressNotFound, "Couldn't find any history.", t.Key.Address).Send(t.Key, conn)
+		return
+	}
+
+	response := &wire.TrackerHistory{}
+	for _, h := range history {
+		entry, err := historyToWire(h)
+		if err != nil {
+			t.handleError("Handle History (Packing Record)", err)
+			adErrors.CreateError(adErrors.InternalError, "Couldn't pack the history.", t.Key.Address).Send(t.Key, conn)
+			return
+		}
+		response.Entry = append(response.Entry, entry)
+	}
+
+	err = t.reply(theAddress, wire.HistoryCode, response, conn)
+	if err != nil {
+		t.handleError("Handle History (Sending Response)", err)
+	}
+}
+
+func historyToWire(h *HistoricalRecord) (*wire.HistoryEntry, error) {
+	data, err := MarshalRecord(h.Record)
+	if err != nil {
+		return nil, err
+	}
+
+	address := h.Address
+	alias := h.Alias
+	saved := uint64(h.Saved.Unix())
+
+	entry := &wire.HistoryEntry{
+		Address:  &address,
+		Username: &alias,
+		Saved:    &saved,
+		Record:   data,
+	}
+
+	if !h.Replaced.IsZero() {
+		replaced := uint64(h.Replaced.Unix())
+		entry.Replaced = &replaced
+	}
+
+	return entry, nil
+}
+
+// historyFromWire will unpack a past record sent by a tracker, making sure
+// that it is correctly signed by the address it describes.
+func historyFromWire(entry *wire.HistoryEntry) (*HistoricalRecord, error) {
+	record, err := UnmarshalRecord(entry.GetRecord())
+	if err != nil {
+		return nil, err
+	}
+
+	err = VerifyRecord(entry.GetAddress(), record)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &HistoricalRecord{
+		StoredRecord: *NewStoredRecord(identity.CreateAddressFromString(entry.GetAddress()), record, entry.GetUsername()),
+		Saved:        time.Unix(int64(entry.GetSaved()), 0),
+	}
+	if entry.Replaced != nil {
+		h.Replaced = time.Unix(int64(entry.GetReplaced()), 0)
+	}
+
+	return h, nil
+}
+
+// AddressHistory will fetch the records that an address has held, newest
+// first.
+func (a *Router) AddressHistory(addr string) (history []*HistoricalRecord, err error) {
+	defer func(start time.Time) { a.observe("history", start, err) }(time.Now())
+	return a.history(&HistoryQueryMessage{From: a.Origin, Address: addr})
+}
+
+// AliasHistory will fetch the records that have claimed an alias, newest
+// first.
+func (a *Router) AliasHistory(alias string) (history []*HistoricalRecord, err error) {
+	defer func(start time.Time) { a.observe("history", start, err) }(time.Now())
+	return a.history(&HistoryQueryMessage{From: a.Origin, Alias: alias})
+}
+
+// LookupAt will perform a Router lookup on an address as it was registered
+// at the given time.
+func (a *Router) LookupAt(addrString string, when time.Time, name routing.LookupType) (addr *identity.Address, err error) {
+	defer func(start time.Time) { a.observe("lookup_at", start, err) }(time.Now())
+	return a.lookupAt(&HistoryQueryMessage{From: a.Origin, Address: addrString, At: when}, "", name)
+}
+
+// LookupAliasAt will perform a Router lookup on an alias as it was
+// registered at the given time.
+func (a *Router) LookupAliasAt(alias string, when time.Time, name routing.LookupType) (addr *identity.Address, err error) {
+	defer func(start time.Time) { a.observe("lookup_at", start, err) }(time.Now())
+	return a.lookupAt(&HistoryQueryMessage{From: a.Origin, Alias: alias, At: when}, alias, name)
+}
+
+func (a *Router) lookupAt(q *HistoryQueryMessage, alias string, name routing.LookupType) (*identity.Address, error) {
+	history, err := a.history(q)
+	if err != nil {
+		return nil, err
+	}
+
+	// The tracker only returns the record that was current at the time.
+	if len(history) == 0 {
+		return nil, ErrNoHistory
+	}
+
+	reg := registrationFromRecord(history[0].Record)
+	if reg == nil {
+		return nil, errors.New("Unable to unpack registration.")
+	}
+
+	return a.resolve(reg, alias, name)
+}
+
+func (a *Router) history(q *HistoryQueryMessage) ([]*HistoricalRecord, error) {
+	conn, err := a.send(q, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	_, d, _, err := readResponse(conn, wire.HistoryCode)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &wire.TrackerHistory{}
+	err = proto.Unmarshal(d, response)
+	if err != nil {
+		return nil, err
+	}
+
+	var history []*HistoricalRecord
+	for _, v := range response.GetEntry() {
+		h, err := historyFromWire(v)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, h)
+	}
+
+	return history, nil
+}
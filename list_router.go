@@ -2,6 +2,7 @@ package tracker
 
 import (
 	"errors"
+	"sync"
 	"time"
 
 	"airdispat.ch/identity"
@@ -12,6 +13,34 @@ import (
 // group of Trackers.
 type ListRouter struct {
 	trackers []routing.Router
+
+	// Metrics is optional. If it is set, the ListRouter will record the
+	// outcome of every lookup that it fans out.
+	Metrics *Metrics
+
+	// OnMigrate is optional. If it is set, it is called whenever a tracker
+	// in the list has been decommissioned and replaced by its successor,
+	// so that the new list can be saved. The ListRouter sets the
+	// OnMigrate of each tracker Router that it contains.
+	OnMigrate func(from string, to *Peer)
+
+	lock sync.RWMutex
+
+	// Set when the ListRouter is created from a Directory.
+	directory *Directory
+	reload    func() error
+	stop      chan bool
+}
+
+// SetMetrics will attach metrics to the ListRouter and to every tracker
+// Router that it contains.
+func (a *ListRouter) SetMetrics(m *Metrics) {
+	a.Metrics = m
+	for _, v := range a.routers() {
+		if r, ok := v.(*Router); ok {
+			r.Metrics = m
+		}
+	}
 }
 
 // CreateListRouter will return a ListRouter for a slice of currently functioning
@@ -24,6 +53,7 @@ func CreateListRouter(redirect RedirectHandler, trackers ...routing.Router) *Lis
 	}
 
 	output.trackers = trackers
+	output.followMigrations()
 	return output
 }
 
@@ -42,12 +72,65 @@ func CreateListRouterWithStrings(redirect RedirectHandler, currentIdentity *iden
 	}
 
 	output.trackers = trackerList
+	output.followMigrations()
 	return output
 }
 
+// routers will return the current list of trackers.
+func (a *ListRouter) routers() []routing.Router {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return a.trackers
+}
+
+// followMigrations will have every tracker Router in the list replace
+// itself with its successor once it has been decommissioned.
+func (a *ListRouter) followMigrations() {
+	for _, v := range a.trackers {
+		if r, ok := v.(*Router); ok {
+			a.watchMigration(r)
+		}
+	}
+}
+
+func (a *ListRouter) watchMigration(r *Router) {
+	r.OnMigrate = func(from string, to *Peer) {
+		a.replace(r, to)
+	}
+}
+
+// replace will swap a decommissioned tracker for its successor.
+func (a *ListRouter) replace(old *Router, to *Peer) {
+	a.lock.Lock()
+	found := false
+	trackers := make([]routing.Router, len(a.trackers))
+	for i, v := range a.trackers {
+		trackers[i] = v
+		if v == routing.Router(old) {
+			next := *old
+			next.URL, next.Address, next.Key = to.URL, to.Address, nil
+			a.watchMigration(&next)
+			trackers[i] = &next
+			found = true
+		}
+	}
+	a.trackers = trackers
+	a.lock.Unlock()
+
+	if found && a.OnMigrate != nil {
+		a.OnMigrate(old.URL, to)
+	}
+}
+
 type queryFunc func(routing.Router) (*identity.Address, error)
 
 func (a *ListRouter) lookup(query queryFunc) (*identity.Address, error) {
+	if err := a.expired(); err != nil {
+		a.Metrics.inc("tracker_client_list_lookups_total", "error")
+		return nil, err
+	}
+
 	data := make(chan *identity.Address)
 	errChan := make(chan error)
 	timeout := make(chan bool)
@@ -67,22 +150,26 @@ func (a *ListRouter) lookup(query queryFunc) (*identity.Address, error) {
 		c <- response
 	}
 
-	for _, tracker := range a.trackers {
+	trackers := a.routers()
+	for _, tracker := range trackers {
 		go queryFunction(data, tracker)
 	}
 
 	errorCount := 0
 
-	for errorCount < len(a.trackers) {
+	for errorCount < len(trackers) {
 		select {
 		case d := <-data:
+			a.Metrics.inc("tracker_client_list_lookups_total", "ok")
 			return d, nil
 		case <-errChan:
 			errorCount++
 		case <-timeout:
+			a.Metrics.inc("tracker_client_list_lookups_total", "timeout")
 			return nil, errors.New("All trackers timed out.")
 		}
 	}
+	a.Metrics.inc("tracker_client_list_lookups_total", "error")
 	return nil, errors.New("Unable to find address in trackers.")
 }
 
@@ -102,7 +189,11 @@ func (a *ListRouter) LookupAlias(alias string, name routing.LookupType) (*identi
 
 // Register will register an address with a list of trackers.
 func (a *ListRouter) Register(key *identity.Identity, alias string, redirects map[string]routing.Redirect) error {
-	for _, tracker := range a.trackers {
+	if err := a.expired(); err != nil {
+		return err
+	}
+
+	for _, tracker := range a.routers() {
 		go tracker.Register(key, alias, redirects)
 	}
 	return nil
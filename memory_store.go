@@ -0,0 +1,292 @@
+package tracker
+
+import (
+	"sync"
+	"time"
+
+	"airdispat.ch/identity"
+	"airdispat.ch/message"
+)
+
+// MemoryStore is a RecordStore that keeps every record in memory. It is safe
+// for concurrent use, hides records once they expire, keeps each alias
+// pointed at a single owner, publishes a change feed and remembers the
+// records that each address and alias has held.
+type MemoryStore struct {
+	// HistoryLimit is the number of past records kept for each address
+	// and each alias. If it is zero, DefaultHistoryLimit is used.
+	HistoryLimit int
+
+	lock      sync.RWMutex
+	addresses map[string]*StoredRecord
+	aliases   map[string]string
+
+	current      map[string]*HistoricalRecord
+	history      map[string][]*HistoricalRecord
+	aliasHistory map[string][]*HistoricalRecord
+
+	feed ChangeLog
+}
+
+// NewMemoryStore will create an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		addresses:    make(map[string]*StoredRecord),
+		aliases:      make(map[string]string),
+		current:      make(map[string]*HistoricalRecord),
+		history:      make(map[string][]*HistoricalRecord),
+		aliasHistory: make(map[string][]*HistoricalRecord),
+	}
+}
+
+// appendHistory adds to a list of past records, oldest first, dropping the
+// oldest once there are more than limit.
+func appendHistory(list []*HistoricalRecord, h *HistoricalRecord, limit int) []*HistoricalRecord {
+	list = append(list, h)
+	if over := len(list) - limit; over > 0 {
+		list = append([]*HistoricalRecord(nil), list[over:]...)
+	}
+	return list
+}
+
+func (m *MemoryStore) historyLimit() int {
+	if m.HistoryLimit <= 0 {
+		return DefaultHistoryLimit
+	}
+	return m.HistoryLimit
+}
+
+// put must be called with the lock held.
+func (m *MemoryStore) put(r *StoredRecord) {
+	now := time.Now()
+
+	// Release the alias that this address used to hold, unless it has been
+	// claimed by someone else since.
+	if old, ok := m.addresses[r.Address]; ok && old.Alias != "" && old.Alias != r.Alias {
+		if m.aliases[old.Alias] == r.Address {
+			delete(m.aliases, old.Alias)
+		}
+	}
+	m.retire(r.Address, now)
+
+	// Take the alias from the address that held it before, so that only
+	// its current owner's record carries it. Snapshots may then be
+	// restored in any order.
+	if owner := m.aliases[r.Alias]; r.Alias != "" && owner != "" && owner != r.Address {
+		if displaced, ok := m.addresses[owner]; ok {
+			c := *displaced
+			c.Alias = ""
+			m.addresses[owner] = &c
+		}
+	}
+
+	m.addresses[r.Address] = r
+	if r.Alias != "" {
+		m.aliases[r.Alias] = r.Address
+	}
+
+	h := &HistoricalRecord{StoredRecord: *r, Saved: now}
+	m.current[r.Address] = h
+	if r.Alias != "" {
+		m.aliasHistory[r.Alias] = appendHistory(m.aliasHistory[r.Alias], h, m.historyLimit())
+	}
+}
+
+// retire will move the current record of an address into its history. It
+// must be called with the lock held.
+func (m *MemoryStore) retire(address string, now time.Time) {
+	h, ok := m.current[address]
+	if !ok {
+		return
+	}
+
+	delete(m.current, address)
+	h.Replaced = now
+	m.history[address] = appendHistory(m.history[address], h, m.historyLimit())
+}
+
+// remove must be called with the lock held.
+func (m *MemoryStore) remove(address string) *StoredRecord {
+	old, ok := m.addresses[address]
+	if !ok {
+		return nil
+	}
+
+	delete(m.addresses, address)
+	if old.Alias != "" && m.aliases[old.Alias] == address {
+		delete(m.aliases, old.Alias)
+	}
+	m.retire(address, time.Now())
+	return old
+}
+
+// SaveRecord will store a record, replacing any earlier record for the same
+// address. Claiming an alias takes it away from its previous owner.
+func (m *MemoryStore) SaveRecord(address *identity.Address, record *message.SignedMessage, alias string) {
+	r := NewStoredRecord(address, record, alias)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.put(r)
+	m.feed.Append(ChangeUpdate, r.Address, r.Alias, r.Record)
+}
+
+// GetRecordByAddress will return the current record for an address.
+func (m *MemoryStore) GetRecordByAddress(address *identity.Address) *message.SignedMessage {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	r, ok := m.addresses[address.String()]
+	if !ok || r.Expired(time.Now()) {
+		return nil
+	}
+	return r.Record
+}
+
+// GetRecordByAlias will return the current record of the owner of an alias.
+func (m *MemoryStore) GetRecordByAlias(alias string) *message.SignedMessage {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	r, ok := m.addresses[m.aliases[alias]]
+	if !ok || r.Alias != alias || r.Expired(time.Now()) {
+		return nil
+	}
+	return r.Record
+}
+
+// AliasOwner will return the address that currently owns an alias, or the
+// empty string if it is free.
+func (m *MemoryStore) AliasOwner(alias string) string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	address := m.aliases[alias]
+	if r, ok := m.addresses[address]; !ok || r.Expired(time.Now()) {
+		return ""
+	}
+	return address
+}
+
+// DeleteRecord implements RecordDeleter.
+func (m *MemoryStore) DeleteRecord(address *identity.Address) {
+	m.delete(address, ChangeDelete)
+}
+
+// ExpireRecord implements RecordExpirer.
+func (m *MemoryStore) ExpireRecord(address *identity.Address) {
+	m.delete(address, ChangeExpire)
+}
+
+func (m *MemoryStore) delete(address *identity.Address, kind ChangeKind) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if old := m.remove(address.String()); old != nil {
+		m.feed.Append(kind, old.Address, old.Alias, nil)
+	}
+}
+
+// ForEachRecord implements RecordIterator. The store is locked for reading
+// during iteration, so fn must not modify it.
+func (m *MemoryStore) ForEachRecord(fn func(record *StoredRecord) error) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for _, r := range m.addresses {
+		err := fn(r)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CountRecords implements RecordCounter.
+func (m *MemoryStore) CountRecords() (int, int) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return len(m.addresses), len(m.aliases)
+}
+
+// AddressHistory implements RecordHistory.
+func (m *MemoryStore) AddressHistory(address string) ([]*HistoricalRecord, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	past := m.history[address]
+	out := make([]*HistoricalRecord, 0, len(past)+1)
+	if h, ok := m.current[address]; ok {
+		c := *h
+		out = append(out, &c)
+	}
+	for i := len(past) - 1; i >= 0; i-- {
+		c := *past[i]
+		out = append(out, &c)
+	}
+	return out, nil
+}
+
+// AliasHistory implements RecordHistory.
+func (m *MemoryStore) AliasHistory(alias string) ([]*HistoricalRecord, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	past := m.aliasHistory[alias]
+	out := make([]*HistoricalRecord, 0, len(past))
+	for i := len(past) - 1; i >= 0; i-- {
+		c := *past[i]
+		out = append(out, &c)
+	}
+	return out, nil
+}
+
+// ChangesSince implements ChangeFeed.
+func (m *MemoryStore) ChangesSince(cursor uint64, limit int) ([]*Change, error) {
+	return m.feed.ChangesSince(cursor, limit)
+}
+
+// LastSequence implements ChangeFeed.
+func (m *MemoryStore) LastSequence() uint64 {
+	return m.feed.LastSequence()
+}
+
+// ResetFeed will discard the change feed and carry on numbering changes
+// after seq. Stores that rebuild a MemoryStore from disk use it to keep
+// their sequence numbers across restarts.
+func (m *MemoryStore) ResetFeed(seq uint64) {
+	m.feed.Reset(seq)
+}
+
+// Snapshot will return a consistent copy of every record in the store.
+func (m *MemoryStore) Snapshot() []*StoredRecord {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	out := make([]*StoredRecord, 0, len(m.addresses))
+	for _, r := range m.addresses {
+		c := *r
+		out = append(out, &c)
+	}
+	return out
+}
+
+// Restore will replace the contents of the store with a snapshot. Every
+// restored record is published to the change feed.
+func (m *MemoryStore) Restore(records []*StoredRecord) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for address := range m.addresses {
+		old := m.remove(address)
+		m.feed.Append(ChangeDelete, old.Address, old.Alias, nil)
+	}
+
+	for _, r := range records {
+		c := *r
+		m.put(&c)
+		m.feed.Append(ChangeUpdate, c.Address, c.Alias, c.Record)
+	}
+}
@@ -0,0 +1,14 @@
+package tracker_test
+
+import (
+	"testing"
+
+	"airdispat.ch/tracker"
+	"airdispat.ch/tracker/storetest"
+)
+
+func TestMemoryStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (tracker.RecordStore, func()) {
+		return tracker.NewMemoryStore(), func() {}
+	})
+}
@@ -0,0 +1,54 @@
+package tracker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreSnapshotExpired(t *testing.T) {
+	store := NewMemoryStore()
+
+	id, record := createTestRecord(t, "hunter", time.Now().Add(-time.Minute))
+	store.SaveRecord(id.Address, record, "hunter")
+
+	snapshot := store.Snapshot()
+	if len(snapshot) != 1 || !snapshot[0].Expired(time.Now()) {
+		t.Error("Expected the expired record to be included in snapshots.")
+	}
+
+	restored := NewMemoryStore()
+	restored.Restore(snapshot)
+	if a, _ := restored.CountRecords(); a != 1 {
+		t.Error("Expected the snapshot to be restored.")
+	}
+}
+
+func TestMemoryStoreSnapshotAliases(t *testing.T) {
+	store := NewMemoryStore()
+	future := time.Now().Add(time.Hour)
+
+	first, firstRecord := createTestRecord(t, "hunter", future)
+	store.SaveRecord(first.Address, firstRecord, "hunter")
+	second, secondRecord := createTestRecord(t, "hunter", future)
+	store.SaveRecord(second.Address, secondRecord, "hunter")
+
+	snapshot := store.Snapshot()
+	for _, r := range snapshot {
+		if r.Address == first.Address.String() && r.Alias != "" {
+			t.Error("Expected the displaced record to lose its alias.")
+		}
+	}
+
+	// Restoring the snapshot in either order keeps the current owner.
+	reversed := []*StoredRecord{snapshot[1], snapshot[0]}
+	for _, records := range [][]*StoredRecord{snapshot, reversed} {
+		restored := NewMemoryStore()
+		restored.Restore(records)
+		if restored.AliasOwner("hunter") != second.Address.String() {
+			t.Error("Expected the restored alias to belong to its current owner.")
+		}
+		if restored.GetRecordByAddress(first.Address) != firstRecord {
+			t.Error("Expected the displaced address to keep its record.")
+		}
+	}
+}
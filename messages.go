@@ -16,6 +16,12 @@ type QueryMessage struct {
 	From    *identity.Identity
 	Address string
 	Alias   string
+
+	// Hops and Via are only set when a tracker forwards a query. Hops is
+	// how many more times it may be forwarded, and Via holds the address
+	// of every tracker that has forwarded it.
+	Hops int
+	Via  []string
 }
 
 // ToBytes will serialize a QueryMessage to be sent over the wire.
@@ -24,6 +30,11 @@ func (b *QueryMessage) ToBytes() []byte {
 		Address:  &b.Address,
 		Username: &b.Alias,
 	}
+	if len(b.Via) > 0 {
+		hops := uint32(b.Hops)
+		q.Hops = &hops
+		q.Via = b.Via
+	}
 	bytes, err := proto.Marshal(q)
 	if err != nil {
 		return nil
@@ -43,6 +54,222 @@ func (b *QueryMessage) Header() message.Header {
 	}
 }
 
+// FeedQueryMessage is a struct that represents the protocol buffers
+// representation of requesting a page of a tracker's change feed.
+type FeedQueryMessage struct {
+	From   *identity.Identity
+	Cursor uint64
+	Limit  int
+}
+
+// ToBytes will serialize a FeedQueryMessage to be sent over the wire.
+func (b *FeedQueryMessage) ToBytes() []byte {
+	limit := uint32(b.Limit)
+	q := &wire.TrackerFeedQuery{
+		Cursor: &b.Cursor,
+		Limit:  &limit,
+	}
+	bytes, err := proto.Marshal(q)
+	if err != nil {
+		return nil
+	}
+	return bytes
+}
+
+// Type will return the FeedQueryCode type for this message.
+func (b *FeedQueryMessage) Type() string { return wire.FeedQueryCode }
+
+// Header will return the message header.
+func (b *FeedQueryMessage) Header() message.Header {
+	return message.Header{
+		From:      b.From.Address,
+		To:        nil,
+		Timestamp: time.Now().Unix(),
+	}
+}
+
+// HistoryQueryMessage is a struct that represents the protocol buffers
+// representation of requesting the past records of an address or alias.
+type HistoryQueryMessage struct {
+	From    *identity.Identity
+	Address string
+	Alias   string
+
+	// At is optional. If it is set, only the record current at that time
+	// is requested.
+	At time.Time
+}
+
+// ToBytes will serialize a HistoryQueryMessage to be sent over the wire.
+func (b *HistoryQueryMessage) ToBytes() []byte {
+	q := &wire.TrackerHistoryQuery{}
+	if b.Address != "" {
+		q.Address = &b.Address
+	}
+	if b.Alias != "" {
+		q.Username = &b.Alias
+	}
+	if !b.At.IsZero() {
+		at := uint64(b.At.Unix())
+		q.At = &at
+	}
+
+	bytes, err := proto.Marshal(q)
+	if err != nil {
+		return nil
+	}
+	return bytes
+}
+
+// Type will return the HistoryQueryCode type for this message.
+func (b *HistoryQueryMessage) Type() string { return wire.HistoryQueryCode }
+
+// Header will return the message header.
+func (b *HistoryQueryMessage) Header() message.Header {
+	return message.Header{
+		From:      b.From.Address,
+		To:        nil,
+		Timestamp: time.Now().Unix(),
+	}
+}
+
+// ReplicateMessage is a struct that represents the protocol buffers
+// representation of a tracker passing registrations on to a peer.
+type ReplicateMessage struct {
+	From    *identity.Identity
+	Records []*StoredRecord
+}
+
+// ToBytes will serialize a ReplicateMessage to be sent over the wire.
+func (b *ReplicateMessage) ToBytes() []byte {
+	q := &wire.TrackerReplicate{}
+	for _, v := range b.Records {
+		data, err := MarshalRecord(v.Record)
+		if err != nil {
+			return nil
+		}
+
+		address := v.Address
+		q.Record = append(q.Record, &wire.ReplicatedRecord{
+			Address: &address,
+			Record:  data,
+		})
+	}
+
+	bytes, err := proto.Marshal(q)
+	if err != nil {
+		return nil
+	}
+	return bytes
+}
+
+// Type will return the ReplicateCode type for this message.
+func (b *ReplicateMessage) Type() string { return wire.ReplicateCode }
+
+// Header will return the message header.
+func (b *ReplicateMessage) Header() message.Header {
+	return message.Header{
+		From:      b.From.Address,
+		To:        nil,
+		Timestamp: time.Now().Unix(),
+	}
+}
+
+// DigestQueryMessage is a struct that represents the protocol buffers
+// representation of a tracker comparing its records with a peer.
+type DigestQueryMessage struct {
+	From    *identity.Identity
+	Buckets []string
+	Fetch   []string
+}
+
+// ToBytes will serialize a DigestQueryMessage to be sent over the wire.
+func (b *DigestQueryMessage) ToBytes() []byte {
+	q := &wire.TrackerDigestQuery{
+		Bucket: b.Buckets,
+		Fetch:  b.Fetch,
+	}
+	bytes, err := proto.Marshal(q)
+	if err != nil {
+		return nil
+	}
+	return bytes
+}
+
+// Type will return the DigestQueryCode type for this message.
+func (b *DigestQueryMessage) Type() string { return wire.DigestQueryCode }
+
+// Header will return the message header.
+func (b *DigestQueryMessage) Header() message.Header {
+	return message.Header{
+		From:      b.From.Address,
+		To:        nil,
+		Timestamp: time.Now().Unix(),
+	}
+}
+
+// wireMessage wraps a protocol buffer built by the tracker so that it can be
+// signed and sent as a response.
+type wireMessage struct {
+	from *identity.Address
+	code string
+	body proto.Message
+}
+
+// ToBytes will serialize the wrapped protocol buffer.
+func (b *wireMessage) ToBytes() []byte {
+	bytes, err := proto.Marshal(b.body)
+	if err != nil {
+		return nil
+	}
+	return bytes
+}
+
+// Type will return the code that the message was created with.
+func (b *wireMessage) Type() string { return b.code }
+
+// Header will return the message header.
+func (b *wireMessage) Header() message.Header {
+	return message.Header{
+		From:      b.from,
+		To:        nil,
+		Timestamp: time.Now().Unix(),
+	}
+}
+
+// WatchMessage is a struct that represents the protocol buffers representation
+// of subscribing to changes from a tracker.
+type WatchMessage struct {
+	From      *identity.Identity
+	Addresses []string
+	Aliases   []string
+}
+
+// ToBytes will serialize a WatchMessage to be sent over the wire.
+func (b *WatchMessage) ToBytes() []byte {
+	q := &wire.TrackerWatch{
+		Address:  b.Addresses,
+		Username: b.Aliases,
+	}
+	bytes, err := proto.Marshal(q)
+	if err != nil {
+		return nil
+	}
+	return bytes
+}
+
+// Type will return the WatchCode type for this message.
+func (b *WatchMessage) Type() string { return wire.WatchCode }
+
+// Header will return the message header.
+func (b *WatchMessage) Header() message.Header {
+	return message.Header{
+		From:      b.From.Address,
+		To:        nil,
+		Timestamp: time.Now().Unix(),
+	}
+}
+
 // RegistrationMessage is the record that is sent to the Tracker to allow
 // setting up a new record.
 type RegistrationMessage struct {
@@ -51,8 +278,20 @@ type RegistrationMessage struct {
 	Alias    string
 	Redirect map[string]routing.Redirect
 	Key      []byte
+
+	// Expires is the time at which the registration lapses. If it is not
+	// set, registrations are valid for DefaultRegistrationLifetime.
+	Expires time.Time
+
+	// Delegation is the namespace admin's permission to register an alias
+	// in a namespace, as created by CreateDelegation.
+	Delegation *message.SignedMessage
 }
 
+// DefaultRegistrationLifetime is how long a registration is valid for when
+// the RegistrationMessage does not say otherwise.
+const DefaultRegistrationLifetime = time.Hour * 24 * 7
+
 // RegistrationMessageFromBytes will deserialize a registration message into
 // an easy to use struct.
 func RegistrationMessageFromBytes(b []byte) *RegistrationMessage {
@@ -71,18 +310,52 @@ func RegistrationMessageFromBytes(b []byte) *RegistrationMessage {
 		}
 	}
 
+	var expires time.Time
+	if q.GetExpires() != 0 {
+		expires = time.Unix(int64(q.GetExpires()), 0)
+	}
+
+	// A delegation that can not be read is left out, and will be refused
+	// by trackers that check namespaces.
+	var delegation *message.SignedMessage
+	if len(q.GetDelegation()) > 0 {
+		delegation, _ = UnmarshalRecord(q.GetDelegation())
+	}
+
 	return &RegistrationMessage{
-		Address:  q.GetAddress(),
-		Location: q.GetLocation(),
-		Key:      q.GetEncryptionKey(),
-		Alias:    q.GetUsername(),
-		Redirect: redirect,
+		Address:    q.GetAddress(),
+		Location:   q.GetLocation(),
+		Key:        q.GetEncryptionKey(),
+		Alias:      q.GetUsername(),
+		Redirect:   redirect,
+		Expires:    expires,
+		Delegation: delegation,
+	}
+}
+
+// registrationFromRecord will unpack a stored registration record, returning
+// nil if the record is missing or is not a registration.
+func registrationFromRecord(record *message.SignedMessage) *RegistrationMessage {
+	if record == nil {
+		return nil
 	}
+
+	d, typ, _, err := record.ReconstructMessage()
+	if err != nil || typ != wire.RegistrationCode {
+		return nil
+	}
+
+	return RegistrationMessageFromBytes(d)
 }
 
 // ToBytes will serialize a RegistrationMessage to be sent over the wire.
 func (b *RegistrationMessage) ToBytes() []byte {
-	expirationTime := uint64(time.Now().Add(time.Hour * 24 * 7).Unix())
+	expires := b.Expires
+	if expires.IsZero() {
+		expires = time.Now().Add(DefaultRegistrationLifetime)
+	}
+
+	expirationTime := uint64(expires.Unix())
 	q := &wire.TrackerRegister{
 		Address:       &b.Address,
 		Location:      &b.Location,
@@ -103,6 +376,14 @@ func (b *RegistrationMessage) ToBytes() []byte {
 
 	q.Redirect = redirects
 
+	if b.Delegation != nil {
+		delegation, err := MarshalRecord(b.Delegation)
+		if err != nil {
+			return nil
+		}
+		q.Delegation = delegation
+	}
+
 	bytes, err := proto.Marshal(q)
 	if err != nil {
 		return nil
@@ -0,0 +1,280 @@
+package tracker
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metric types understood by the Prometheus text exposition format.
+const (
+	counterMetric   = "counter"
+	gaugeMetric     = "gauge"
+	histogramMetric = "histogram"
+)
+
+// defaultBuckets are the upper bounds (in seconds) used for every latency
+// histogram.
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metricDesc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+// metricDescs lists every metric that the tracker framework knows how to
+// report, in the order that they are exposed.
+var metricDescs = []metricDesc{
+	// Server Side
+	{"tracker_connections_total", "Connections accepted by the tracker.", counterMetric, nil},
+	{"tracker_active_connections", "Connections currently being served by the tracker.", gaugeMetric, nil},
+	{"tracker_registrations_total", "Registration (TRG) messages handled, by outcome.", counterMetric, []string{"outcome"}},
+	{"tracker_queries_total", "Query (TQE) messages handled, by kind and result.", counterMetric, []string{"kind", "result"}},
+	{"tracker_verify_failures_total", "Messages rejected because their signature could not be verified.", counterMetric, nil},
+	{"tracker_errors_total", "Errors reported to the tracker delegate.", counterMetric, nil},
+	{"tracker_handler_duration_seconds", "Time spent serving a single connection, by message type.", histogramMetric, []string{"type"}},
+	{"tracker_sweeps_total", "Sweeps of expired registrations run by the tracker.", counterMetric, nil},
+	{"tracker_swept_records_total", "Expired registrations handled by the sweeper, by action.", counterMetric, []string{"action"}},
+	{"tracker_cache_requests_total", "Lookups answered by the tracker's record cache, by result.", counterMetric, []string{"result"}},
+	{"tracker_replicated_records_total", "Registrations sent to replication peers, by result.", counterMetric, []string{"result"}},
+	{"tracker_replication_received_total", "Registrations received from replication peers, by outcome.", counterMetric, []string{"outcome"}},
+	{"tracker_syncs_total", "Anti-entropy exchanges with replication peers, by result.", counterMetric, []string{"result"}},
+	{"tracker_mirror_pulls_total", "Attempts by a mirror to catch up with its primary, by result.", counterMetric, []string{"result"}},
+	{"tracker_mirror_changes_total", "Changes copied by a mirror from its primary, by kind.", counterMetric, []string{"kind"}},
+	{"tracker_mirror_pending_changes", "Changes that the primary reported and a mirror has not yet copied.", gaugeMetric, nil},
+	{"tracker_mirror_lag_seconds", "Time since a mirror last held every change of its primary.", gaugeMetric, nil},
+	{"tracker_rebalanced_records_total", "Records handled while rebalancing a partitioned tracker, by action.", counterMetric, []string{"action"}},
+	{"tracker_migrated_requests_total", "Requests refused by a decommissioned tracker and sent to its successor, by type.", counterMetric, []string{"type"}},
+	{"tracker_forwarded_queries_total", "Queries for missing records passed on to forwarding peers, by result.", counterMetric, []string{"result"}},
+
+	// Client Side
+	{"tracker_client_requests_total", "Requests made by tracker routers, by operation and result.", counterMetric, []string{"op", "result"}},
+	{"tracker_client_request_duration_seconds", "Latency of requests made by tracker routers, by operation.", histogramMetric, []string{"op"}},
+	{"tracker_client_list_lookups_total", "Lookups fanned out by a ListRouter, by result.", counterMetric, []string{"result"}},
+	{"tracker_client_directory_refreshes_total", "Reloads of a ListRouter's tracker directory, by result.", counterMetric, []string{"result"}},
+	{"tracker_client_federated_lookups_total", "Alias lookups made by a FederatedRouter, by where the tracker was found.", counterMetric, []string{"result"}},
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Metrics collects counters, gauges and latency histograms from a Tracker
+// and from the Routers that talk to trackers. A nil *Metrics is valid and
+// simply discards everything, so instrumentation is always optional.
+type Metrics struct {
+	lock       sync.Mutex
+	values     map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}
+
+// NewMetrics will create an empty set of metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		values:     make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+	}
+}
+
+// seriesKey joins label values into a single map key.
+func seriesKey(labels []string) string {
+	return strings.Join(labels, "\xff")
+}
+
+// add will increase a counter or gauge by delta.
+func (m *Metrics) add(name string, delta float64, labels ...string) {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	series, ok := m.values[name]
+	if !ok {
+		series = make(map[string]float64)
+		m.values[name] = series
+	}
+	series[seriesKey(labels)] += delta
+}
+
+// inc will increase a counter by one.
+func (m *Metrics) inc(name string, labels ...string) {
+	m.add(name, 1, labels...)
+}
+
+// set will set a gauge to a specific value.
+func (m *Metrics) set(name string, value float64, labels ...string) {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	series, ok := m.values[name]
+	if !ok {
+		series = make(map[string]float64)
+		m.values[name] = series
+	}
+	series[seriesKey(labels)] = value
+}
+
+// observe will record a single sample in a histogram.
+func (m *Metrics) observe(name string, value float64, labels ...string) {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	series, ok := m.histograms[name]
+	if !ok {
+		series = make(map[string]*histogram)
+		m.histograms[name] = series
+	}
+
+	key := seriesKey(labels)
+	h, ok := series[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(defaultBuckets))}
+		series[key] = h
+	}
+
+	for i, bound := range defaultBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// Value will return the current value of a counter or gauge series. It is
+// mostly useful for tests and status pages.
+func (m *Metrics) Value(name string, labels ...string) float64 {
+	if m == nil {
+		return 0
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.values[name][seriesKey(labels)]
+}
+
+// WriteTo will write every metric to w in the Prometheus text exposition
+// format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	buf := &bytes.Buffer{}
+
+	if m != nil {
+		m.lock.Lock()
+		for _, d := range metricDescs {
+			if d.kind == histogramMetric {
+				writeHistogram(buf, d, m.histograms[d.name])
+			} else {
+				writeValues(buf, d, m.values[d.name])
+			}
+		}
+		m.lock.Unlock()
+	}
+
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP allows Metrics to be mounted directly as a /metrics handler.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+func writeHeader(buf *bytes.Buffer, d metricDesc) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", d.name, d.help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+func writeValues(buf *bytes.Buffer, d metricDesc, series map[string]float64) {
+	writeHeader(buf, d)
+
+	// Unlabelled series are always present so that alerts have something
+	// to evaluate against before the first event.
+	if len(series) == 0 && len(d.labels) == 0 {
+		fmt.Fprintf(buf, "%s 0\n", d.name)
+		return
+	}
+
+	for _, key := range sortedKeys(series) {
+		fmt.Fprintf(buf, "%s%s %s\n", d.name, formatLabels(d.labels, key, ""), formatFloat(series[key]))
+	}
+}
+
+func writeHistogram(buf *bytes.Buffer, d metricDesc, series map[string]*histogram) {
+	writeHeader(buf, d)
+
+	keys := make([]string, 0, len(series))
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		h := series[key]
+		for i, bound := range defaultBuckets {
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", d.name, formatLabels(d.labels, key, formatFloat(bound)), h.counts[i])
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", d.name, formatLabels(d.labels, key, "+Inf"), h.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", d.name, formatLabels(d.labels, key, ""), formatFloat(h.sum))
+		fmt.Fprintf(buf, "%s_count%s %d\n", d.name, formatLabels(d.labels, key, ""), h.count)
+	}
+}
+
+func sortedKeys(series map[string]float64) []string {
+	keys := make([]string, 0, len(series))
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels will render the label set for a series. If le is not empty,
+// it is appended as the histogram bucket bound.
+func formatLabels(names []string, key string, le string) string {
+	var pairs []string
+	if len(names) > 0 {
+		values := strings.Split(key, "\xff")
+		for i, name := range names {
+			value := ""
+			if i < len(values) {
+				value = values[i]
+			}
+			pairs = append(pairs, fmt.Sprintf("%s=%q", name, value))
+		}
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=%q", le))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", f)
+}
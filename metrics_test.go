@@ -0,0 +1,47 @@
+package tracker
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	m := NewMetrics()
+	m.inc("tracker_registrations_total", "accepted")
+	m.inc("tracker_registrations_total", "accepted")
+	m.inc("tracker_queries_total", "alias", "not_found")
+	m.add("tracker_active_connections", 1)
+	m.observe("tracker_handler_duration_seconds", 0.02, "TQE")
+
+	if v := m.Value("tracker_registrations_total", "accepted"); v != 2 {
+		t.Errorf("Expected 2 accepted registrations, got %v.", v)
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := m.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	for _, line := range []string{
+		"# TYPE tracker_registrations_total counter",
+		`tracker_registrations_total{outcome="accepted"} 2`,
+		`tracker_queries_total{kind="alias",result="not_found"} 1`,
+		"tracker_active_connections 1",
+		"tracker_verify_failures_total 0",
+		`tracker_handler_duration_seconds_bucket{type="TQE",le="0.01"} 0`,
+		`tracker_handler_duration_seconds_bucket{type="TQE",le="0.025"} 1`,
+		`tracker_handler_duration_seconds_bucket{type="TQE",le="+Inf"} 1`,
+		`tracker_handler_duration_seconds_count{type="TQE"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Exposition is missing %q.", line)
+		}
+	}
+
+	// A nil *Metrics must be safe to use.
+	var empty *Metrics
+	empty.inc("tracker_errors_total")
+	empty.observe("tracker_handler_duration_seconds", 1, "TRG")
+}
@@ -0,0 +1,148 @@
+package tracker
+
+import (
+	"errors"
+	"net"
+
+	adErrors "airdispat.ch/errors"
+	"airdispat.ch/identity"
+	"airdispat.ch/tracker/wire"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// DefaultMigrationHops is how many decommissioned trackers a Router will
+// pass through to reach a successor if no other limit is given.
+const DefaultMigrationHops = 3
+
+// Migration marks a tracker as decommissioned. Instead of answering
+// queries and registrations, the tracker refuses them and sends a signed
+// pointer to its successor, which Routers follow on their own.
+//
+// Other trackers may still copy the tracker's records with its change feed
+// or anti-entropy, so the successor can take them over.
+type Migration struct {
+	// Successor is the tracker that has taken this tracker's place. Its
+	// Address should be set, so that clients can check any pointer that
+	// it sends on in turn.
+	Successor *Peer
+}
+
+// refuseMigrated will point a client at the tracker's successor.
+func (t *Tracker) refuseMigrated(theAddress *identity.Address, typ string, conn net.Conn) {
+	t.Metrics.inc("tracker_migrated_requests_total", typ)
+
+	desc := "This tracker has been decommissioned. Use " + t.Migration.Successor.URL + " instead."
+	adErrors.CreateError(adErrors.UnexpectedError, desc, t.Key.Address).Send(t.Key, conn)
+
+	err := t.reply(theAddress, wire.MigrationCode, &wire.TrackerMigration{
+		Successor:    &t.Migration.Successor.Address,
+		SuccessorUrl: &t.Migration.Successor.URL,
+	}, conn)
+	if err != nil {
+		t.handleError("Refuse Request (Sending Migration)", err)
+	}
+}
+
+// migration is a pointer from a decommissioned tracker to its successor,
+// as followed by a Router.
+type migration struct {
+	successor *Peer
+
+	// The address of the tracker that signed the pointer.
+	signer string
+
+	// How many pointers have been followed to get here.
+	hops int
+}
+
+// refusal describes where a tracker that has refused a request sends the
+// client instead.
+type refusal struct {
+	// The URL of a mirror's primary.
+	primary string
+
+	// The successor of a decommissioned tracker.
+	successor *migration
+}
+
+// readRefusal will read the message that follows an error from a mirror or
+// a decommissioned tracker. It returns nil if there is none, or if trusted
+// refuses its signer.
+func readRefusal(conn net.Conn, trusted func(from *identity.Address) bool) *refusal {
+	_, body, typ, h, err := readMessage(conn)
+	if err != nil {
+		return nil
+	}
+
+	if !trusted(h.From) {
+		return nil
+	}
+
+	switch typ {
+	case wire.MirrorCode:
+		info, err := mirrorInfoFromWire(body, h, nil)
+		if err != nil || info.PrimaryURL == "" {
+			return nil
+		}
+		return &refusal{primary: info.PrimaryURL}
+
+	case wire.MigrationCode:
+		response := &wire.TrackerMigration{}
+		err := proto.Unmarshal(body, response)
+		if err != nil || response.GetSuccessorUrl() == "" || h.From == nil {
+			return nil
+		}
+		return &refusal{successor: &migration{
+			successor: &Peer{URL: response.GetSuccessorUrl(), Address: response.GetSuccessor()},
+			signer:    h.From.String(),
+		}}
+	}
+	return nil
+}
+
+func (a *Router) maxMigrationHops() int {
+	if a.MaxMigrationHops <= 0 {
+		return DefaultMigrationHops
+	}
+	return a.MaxMigrationHops
+}
+
+// follow will check that the pointer next may be followed after prev, which
+// is nil for the first pointer. After the first, each pointer must be
+// signed by the successor that the one before it named.
+func (a *Router) follow(prev *migration, next *migration) (*migration, error) {
+	next.hops = 1
+	if prev != nil {
+		if prev.successor.Address != "" && prev.successor.Address != next.signer {
+			return nil, errors.New("Migration is not signed by the successor tracker.")
+		}
+		next.hops = prev.hops + 1
+	}
+
+	if next.hops > a.maxMigrationHops() {
+		return nil, errors.New("Followed too many tracker migrations.")
+	}
+	return next, nil
+}
+
+// successor will return a Router for the tracker that a migration points
+// to.
+func (a *Router) successor(m *migration) *Router {
+	return &Router{
+		URL:         m.successor.URL,
+		Address:     m.successor.Address,
+		Origin:      a.Origin,
+		Redirector:  a.Redirector,
+		Metrics:     a.Metrics,
+		CheckMirror: a.CheckMirror,
+		Delegations: a.Delegations,
+	}
+}
+
+// migrated will let OnMigrate know that a request only succeeded after
+// following a migration.
+func (a *Router) migrated(m *migration) {
+	if m != nil && a.OnMigrate != nil {
+		a.OnMigrate(a.URL, m.successor)
+	}
+}
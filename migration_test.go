@@ -0,0 +1,139 @@
+package tracker
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"airdispat.ch/crypto"
+	"airdispat.ch/identity"
+	"airdispat.ch/routing"
+)
+
+func TestMigration(t *testing.T) {
+	ports := []string{"9111", "9112", "9113"}
+	trackers := make([]*Tracker, len(ports))
+	peers := make([]*Peer, len(ports))
+	for i, port := range ports {
+		key, err := identity.CreateIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		trackers[i] = &Tracker{
+			Key:      key,
+			Delegate: newTestingTracker(),
+			Metrics:  NewMetrics(),
+		}
+		peers[i] = &Peer{URL: "localhost:" + port, Address: key.Address.String()}
+	}
+
+	// The first tracker moved to the second, which then moved to the third.
+	trackers[0].Migration = &Migration{Successor: peers[1]}
+	trackers[1].Migration = &Migration{Successor: peers[2]}
+	for i, port := range ports {
+		go trackers[i].StartServer(port)
+	}
+
+	// Wait for Server to Startup
+	time.Sleep(1 * time.Second)
+
+	toLog, err := identity.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	toLog.SetLocation("example.com")
+
+	var lock sync.Mutex
+	var moved []string
+	router := &Router{
+		URL:    peers[0].URL,
+		Origin: toLog,
+		OnMigrate: func(from string, to *Peer) {
+			lock.Lock()
+			defer lock.Unlock()
+			moved = append(moved, from+" "+to.URL)
+		},
+	}
+
+	err = router.Register(toLog, "hunter", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trackers[2].records().GetRecordByAlias("hunter") == nil {
+		t.Error("Expected the registration to reach the last successor.")
+	}
+
+	addr, err := router.LookupAlias("hunter", routing.LookupTypeDEFAULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != toLog.Address.String() {
+		t.Error("Expected the successor to answer for the alias.")
+	}
+
+	if len(moved) != 2 || moved[0] != peers[0].URL+" "+peers[2].URL {
+		t.Errorf("Expected the router to report the successor twice, got %v.", moved)
+	}
+	if trackers[0].Metrics.Value("tracker_migrated_requests_total", "query") != 1 {
+		t.Error("Expected the decommissioned tracker to count the refused query.")
+	}
+
+	// Routers give up after too many migrations.
+	router.MaxMigrationHops = 1
+	_, err = router.LookupAlias("hunter", routing.LookupTypeDEFAULT)
+	if err == nil {
+		t.Error("Expected the router to stop following migrations.")
+	}
+
+	// A ListRouter replaces decommissioned trackers with their successors.
+	list := CreateListRouterWithStrings(nil, toLog, peers[0].URL)
+	var replaced *Peer
+	list.OnMigrate = func(from string, to *Peer) {
+		lock.Lock()
+		defer lock.Unlock()
+		replaced = to
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err = list.LookupAlias("hunter", routing.LookupTypeDEFAULT)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lock.Lock()
+	if replaced == nil || replaced.URL != peers[2].URL {
+		t.Errorf("Expected the list to report the successor, got %v.", replaced)
+	}
+	lock.Unlock()
+
+	if r, ok := list.routers()[0].(*Router); !ok || r.URL != peers[2].URL {
+		t.Error("Expected the list to hold the successor.")
+	}
+	if v := trackers[0].Metrics.Value("tracker_migrated_requests_total", "query"); v != 3 {
+		t.Errorf("Expected the second lookup to go straight to the successor, got %v refused queries.", v)
+	}
+
+	// Pointers to a successor are only followed if they are signed by the
+	// tracker that the router expects.
+	pinned := &Router{URL: peers[0].URL, Address: peers[2].Address, Origin: toLog}
+	_, err = pinned.LookupAlias("hunter", routing.LookupTypeDEFAULT)
+	if err == nil {
+		t.Error("Expected a pointer from another tracker to be refused.")
+	}
+
+	// The tracker's key must match too, if the router knows it.
+	pinned.Address = peers[0].Address
+	pinned.Key = crypto.RSAToBytes(trackers[2].Key.Address.EncryptionKey)
+	_, err = pinned.LookupAlias("hunter", routing.LookupTypeDEFAULT)
+	if err == nil {
+		t.Error("Expected a pointer signed with another key to be refused.")
+	}
+
+	pinned.Key = crypto.RSAToBytes(trackers[0].Key.Address.EncryptionKey)
+	_, err = pinned.LookupAlias("hunter", routing.LookupTypeDEFAULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,404 @@
+package tracker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	adErrors "airdispat.ch/errors"
+	"airdispat.ch/identity"
+	"airdispat.ch/message"
+	"airdispat.ch/tracker/wire"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// DefaultMirrorInterval is how often a mirror asks its primary for new
+// changes if no other interval is given.
+const DefaultMirrorInterval = time.Second
+
+// Mirror makes a tracker a read-only copy of a primary tracker. The mirror
+// follows the primary's change feed, so the primary's store must implement
+// ChangeFeed, and answers queries from its own store. Registrations are
+// refused with a pointer to the primary.
+//
+// If the primary no longer holds the changes that the mirror needs, such as
+// when the mirror first starts, the mirror copies every record instead,
+// which the primary only allows for the addresses in its
+// Replication.Mirrors.
+//
+// Every answer that a mirror serves is followed by a signed MirrorInfo, so
+// that clients can tell how stale it may be.
+type Mirror struct {
+	// Primary is the tracker that is mirrored. Its Address is required.
+	Primary *Peer
+
+	// Interval is how often the primary is asked for new changes once the
+	// mirror has caught up.
+	Interval time.Duration
+
+	// BatchSize is the most changes that are requested at once.
+	BatchSize int
+
+	lock   sync.RWMutex
+	cursor uint64
+	latest uint64
+	synced time.Time
+}
+
+// MirrorInfo describes how far a mirror's copy of its primary's records is
+// behind the primary.
+type MirrorInfo struct {
+	// Mirror is the address of the mirror tracker. It is only set on the
+	// information that clients receive.
+	Mirror string `json:"mirror,omitempty"`
+
+	Primary    string `json:"primary"`
+	PrimaryURL string `json:"primary_url,omitempty"`
+
+	// Cursor is the last change from the primary that the mirror holds,
+	// and Latest is the newest change that the primary last reported.
+	Cursor uint64 `json:"cursor"`
+	Latest uint64 `json:"latest"`
+
+	// Synced is when the mirror last held every change of the primary, and
+	// is zero if it never has. Lag is the time since then.
+	Synced time.Time     `json:"synced,omitempty"`
+	Lag    time.Duration `json:"lag_ns"`
+}
+
+// MaxMirrorLag will return a check for Router.CheckMirror that refuses
+// answers from mirrors that are more than max behind their primary.
+func MaxMirrorLag(max time.Duration) func(info *MirrorInfo) error {
+	return func(info *MirrorInfo) error {
+		if info.Synced.IsZero() || info.Lag > max {
+			return fmt.Errorf("Mirror of %s is %s behind its primary.", info.Primary, info.Lag)
+		}
+		return nil
+	}
+}
+
+func (m *Mirror) interval() time.Duration {
+	if m.Interval <= 0 {
+		return DefaultMirrorInterval
+	}
+	return m.Interval
+}
+
+func (m *Mirror) batchSize() int {
+	if m.BatchSize <= 0 {
+		return DefaultFeedLimit
+	}
+	return m.BatchSize
+}
+
+// Info will describe how far the mirror is behind its primary.
+func (m *Mirror) Info() *MirrorInfo {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	info := &MirrorInfo{
+		Primary:    m.Primary.Address,
+		PrimaryURL: m.Primary.URL,
+		Cursor:     m.cursor,
+		Latest:     m.latest,
+		Synced:     m.synced,
+	}
+	if !m.synced.IsZero() {
+		info.Lag = time.Since(m.synced)
+	}
+	return info
+}
+
+func (m *Mirror) advance(cursor uint64, latest uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.cursor, m.latest = cursor, latest
+	if cursor >= latest {
+		m.synced = time.Now()
+	}
+}
+
+// toWire will describe the mirror to a client. If record is set, the
+// description is tied to it, so that it can not be replayed alongside a
+// different answer.
+func (m *Mirror) toWire(record *message.SignedMessage) (*wire.TrackerMirror, error) {
+	info := m.Info()
+	response := &wire.TrackerMirror{
+		Primary:    &info.Primary,
+		PrimaryUrl: &info.PrimaryURL,
+		Cursor:     &info.Cursor,
+		Latest:     &info.Latest,
+	}
+
+	if !info.Synced.IsZero() {
+		synced := uint64(info.Synced.Unix())
+		lag := uint64(info.Lag / time.Millisecond)
+		response.Synced = &synced
+		response.Lag = &lag
+	}
+
+	if record != nil {
+		d, _, _, err := record.ReconstructMessage()
+		if err != nil {
+			return nil, err
+		}
+		hash := sha256.Sum256(d)
+		response.RecordHash = hash[:]
+	}
+
+	return response, nil
+}
+
+// sendMirrorInfo will follow an answer, or a refusal if record is nil, with
+// a description of the mirror.
+func (t *Tracker) sendMirrorInfo(to *identity.Address, record *message.SignedMessage, conn net.Conn) error {
+	response, err := t.Mirror.toWire(record)
+	if err != nil {
+		return err
+	}
+	return t.reply(to, wire.MirrorCode, response, conn)
+}
+
+// refuseRegistration will point a client that tried to register with a
+// mirror to its primary.
+func (t *Tracker) refuseRegistration(theAddress *identity.Address, conn net.Conn) {
+	t.Metrics.inc("tracker_registrations_total", "redirected")
+
+	desc := "This tracker is a read-only mirror. Register with " + t.Mirror.Primary.URL + " instead."
+	adErrors.CreateError(adErrors.UnexpectedError, desc, t.Key.Address).Send(t.Key, conn)
+
+	err := t.sendMirrorInfo(theAddress, nil, conn)
+	if err != nil {
+		t.handleError("Refuse Registration (Sending Mirror Info)", err)
+	}
+}
+
+// StartMirror will copy every change that the primary makes. It blocks like
+// StartServer, and Mirror must be set before it is called.
+func (t *Tracker) StartMirror() {
+	t.Delegate.LogMessage("Mirroring " + t.Mirror.Primary.URL)
+
+	for {
+		err := t.pullMirror()
+		if err != nil {
+			t.Metrics.inc("tracker_mirror_pulls_total", "error")
+			t.handleError("Mirror "+t.Mirror.Primary.URL, err)
+		} else {
+			t.Metrics.inc("tracker_mirror_pulls_total", "ok")
+		}
+
+		info := t.Mirror.Info()
+		t.Metrics.set("tracker_mirror_pending_changes", float64(info.Latest-info.Cursor))
+		t.Metrics.set("tracker_mirror_lag_seconds", info.Lag.Seconds())
+
+		time.Sleep(t.Mirror.interval())
+	}
+}
+
+// pullMirror will apply the primary's changes until the mirror has caught
+// up.
+func (t *Tracker) pullMirror() error {
+	router := &Router{
+		URL:    t.Mirror.Primary.URL,
+		Origin: t.Key,
+	}
+
+	for {
+		cursor := t.Mirror.Info().Cursor
+		page, err := router.Changes(cursor, t.Mirror.batchSize())
+		if err == ErrFeedTruncated {
+			return t.reseedMirror(router, page.Latest)
+		} else if err != nil {
+			return err
+		}
+
+		for _, c := range page.Changes {
+			t.applyChange(c)
+		}
+
+		t.Mirror.advance(page.Cursor, page.Latest)
+		if !page.More {
+			return nil
+		}
+	}
+}
+
+func (t *Tracker) applyChange(c *Change) {
+	t.Metrics.inc("tracker_mirror_changes_total", string(c.Kind))
+
+	address := identity.CreateAddressFromString(c.Address)
+	if address == nil {
+		t.handleError("Apply Change", errors.New("Change has an invalid address."))
+		return
+	}
+
+	if c.Kind == ChangeUpdate {
+		err := t.verifyNamespace(c.Record, time.Now())
+		if err != nil {
+			t.handleError("Apply Change (Verifying Namespace)", err)
+			return
+		}
+
+		err = t.saveRecord(address, c.Record, c.Alias)
+		if err != nil {
+			t.handleError("Apply Change (Saving Record)", err)
+		}
+		return
+	}
+	t.mirrorDelete(address, c.Alias)
+}
+
+func (t *Tracker) mirrorDelete(address *identity.Address, alias string) {
+	d, ok := t.records().(RecordDeleter)
+	if !ok {
+		t.handleError("Mirror Delete", errors.New("Store does not support deleting records."))
+		return
+	}
+
+	d.DeleteRecord(address)
+	t.Cache.Invalidate(address.String(), alias)
+}
+
+// reseedMirror will make the mirror's records match the primary's, and
+// continue following the primary's changes from latest.
+func (t *Tracker) reseedMirror(router *Router, latest uint64) error {
+	t.Delegate.LogMessage("Copying every record from " + router.URL)
+
+	local, err := t.Digest()
+	if err != nil {
+		return err
+	}
+
+	remote, err := router.Digest()
+	if err != nil {
+		return err
+	}
+
+	differing := local.Diff(remote)
+	prefixes := make(map[string]bool)
+	for _, v := range differing {
+		prefixes[v] = true
+	}
+
+	if len(differing) > 0 {
+		localRecords, err := t.liveRecords(prefixes)
+		if err != nil {
+			return err
+		}
+
+		remoteEntries, err := router.DigestEntries(differing)
+		if err != nil {
+			return err
+		}
+
+		var fetch []string
+		for address, theirs := range remoteEntries {
+			mine, ok := localRecords[address]
+			if ok {
+				entry, err := newDigestEntry(mine)
+				if err != nil {
+					return err
+				}
+				if bytes.Equal(entry.Hash, theirs.Hash) {
+					continue
+				}
+			}
+			fetch = append(fetch, address)
+		}
+
+		for address, mine := range localRecords {
+			if _, ok := remoteEntries[address]; !ok {
+				t.mirrorDelete(identity.CreateAddressFromString(address), mine.Alias)
+			}
+		}
+
+		for len(fetch) > 0 {
+			n := t.Mirror.batchSize()
+			if n > len(fetch) {
+				n = len(fetch)
+			}
+
+			records, err := router.Fetch(fetch[:n])
+			if err != nil {
+				return err
+			}
+			fetch = fetch[n:]
+
+			for _, r := range records {
+				err := t.verifyNamespace(r.Record, time.Now())
+				if err != nil {
+					t.handleError("Reseed Mirror (Verifying Namespace)", err)
+					continue
+				}
+
+				err = t.saveRecord(identity.CreateAddressFromString(r.Address), r.Record, r.Alias)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// Changes made while the records were being copied are applied again
+	// from the feed, which leaves each record as the primary has it.
+	t.Mirror.lock.Lock()
+	t.Mirror.cursor, t.Mirror.latest = latest, latest
+	t.Mirror.lock.Unlock()
+	return nil
+}
+
+// readMirrorInfo will read the description that a mirror sends after an
+// answer, checking that it is tied to the registration data d and that
+// trusted accepts its signer. It returns nil if the tracker is not a mirror.
+func readMirrorInfo(conn net.Conn, d []byte, trusted func(from *identity.Address) bool) (*MirrorInfo, error) {
+	_, body, h, err := readResponse(conn, wire.MirrorCode)
+	if err != nil {
+		if _, ok := err.(*adErrors.Error); ok {
+			return nil, err
+		}
+		// Trackers that are not mirrors hang up after answering.
+		return nil, nil
+	}
+
+	if !trusted(h.From) {
+		return nil, errors.New("Mirror information is not signed by the tracker.")
+	}
+	return mirrorInfoFromWire(body, h, d)
+}
+
+// mirrorInfoFromWire will unpack the body of a TMI, checking that it is tied
+// to the registration data d if it is given.
+func mirrorInfoFromWire(body []byte, h message.Header, d []byte) (*MirrorInfo, error) {
+	response := &wire.TrackerMirror{}
+	err := proto.Unmarshal(body, response)
+	if err != nil {
+		return nil, errors.New("Unable to unpack mirror information.")
+	}
+
+	if d != nil {
+		hash := sha256.Sum256(d)
+		if !bytes.Equal(hash[:], response.GetRecordHash()) {
+			return nil, errors.New("Mirror information does not match its answer.")
+		}
+	}
+
+	info := &MirrorInfo{
+		Primary:    response.GetPrimary(),
+		PrimaryURL: response.GetPrimaryUrl(),
+		Cursor:     response.GetCursor(),
+		Latest:     response.GetLatest(),
+	}
+	if h.From != nil {
+		info.Mirror = h.From.String()
+	}
+	if response.Synced != nil {
+		info.Synced = time.Unix(int64(response.GetSynced()), 0)
+		info.Lag = time.Duration(response.GetLag()) * time.Millisecond
+	}
+	return info, nil
+}
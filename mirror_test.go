@@ -0,0 +1,143 @@
+package tracker
+
+import (
+	"testing"
+	"time"
+
+	"airdispat.ch/identity"
+	"airdispat.ch/routing"
+)
+
+func TestMirror(t *testing.T) {
+	keys := make([]*identity.Identity, 2)
+	for i := range keys {
+		key, err := identity.CreateIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+	}
+
+	// The primary only keeps one change, so the mirror has to start with
+	// a full copy.
+	store := &feedTestingTracker{
+		testingTracker: newTestingTracker(),
+		ChangeLog:      &ChangeLog{Capacity: 1},
+	}
+	primary := &Tracker{
+		Key:         keys[0],
+		Delegate:    store,
+		Replication: &Replication{Mirrors: []string{keys[1].Address.String()}},
+	}
+	go primary.StartServer("9098")
+
+	// Wait for Server to Startup
+	time.Sleep(1 * time.Second)
+
+	var registered []*identity.Identity
+	for _, alias := range []string{"first", "second", "third"} {
+		toLog, err := identity.CreateIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		toLog.SetLocation("example.com")
+
+		err = (&Router{URL: "localhost:9098", Origin: toLog}).Register(toLog, alias, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		registered = append(registered, toLog)
+	}
+
+	mirror := &Tracker{
+		Key:      keys[1],
+		Delegate: newTestingTracker(),
+		Metrics:  NewMetrics(),
+		Mirror: &Mirror{
+			Primary:  &Peer{URL: "localhost:9098", Address: keys[0].Address.String()},
+			Interval: 100 * time.Millisecond,
+		},
+	}
+	go mirror.StartServer("9099")
+	go mirror.StartMirror()
+
+	// Wait for the Mirror to Catch Up
+	time.Sleep(1 * time.Second)
+
+	var served *MirrorInfo
+	router := &Router{
+		URL:    "localhost:9099",
+		Origin: registered[0],
+		CheckMirror: func(info *MirrorInfo) error {
+			served = info
+			return nil
+		},
+	}
+
+	for i, alias := range []string{"first", "second", "third"} {
+		addr, err := router.LookupAlias(alias, routing.LookupTypeDEFAULT)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.String() != registered[i].Address.String() {
+			t.Errorf("Expected the mirror to answer for %s.", alias)
+		}
+	}
+
+	if served == nil || served.Primary != keys[0].Address.String() || served.Mirror != keys[1].Address.String() {
+		t.Fatalf("Expected the answer to name the mirror and its primary, got %+v.", served)
+	}
+	if served.Synced.IsZero() || served.Cursor != served.Latest {
+		t.Errorf("Expected the mirror to have caught up, got %+v.", served)
+	}
+
+	// Registrations sent to the mirror are passed on to the primary, and
+	// the mirror follows the primary's changes from then on.
+	toLog, err := identity.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	toLog.SetLocation("example.com")
+
+	err = (&Router{URL: "localhost:9099", Origin: toLog}).Register(toLog, "fourth", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if primary.records().GetRecordByAlias("fourth") == nil {
+		t.Error("Expected the registration to reach the primary.")
+	}
+	if mirror.Metrics.Value("tracker_registrations_total", "redirected") != 1 {
+		t.Error("Expected the mirror to count the redirected registration.")
+	}
+
+	store.DeleteRecord(registered[0].Address)
+	store.Append(ChangeDelete, registered[0].Address.String(), "first", nil)
+
+	// Wait for the Mirror to Catch Up
+	time.Sleep(500 * time.Millisecond)
+
+	if mirror.records().GetRecordByAlias("fourth") == nil {
+		t.Error("Expected the mirror to copy the new registration.")
+	}
+	if mirror.records().GetRecordByAlias("first") != nil {
+		t.Error("Expected the mirror to copy the deletion.")
+	}
+
+	if status := mirror.Status(); status.Mirror == nil || status.Mirror.Cursor != 5 {
+		t.Errorf("Expected the status to report the mirror's cursor, got %+v.", status.Mirror)
+	}
+
+	// Clients may refuse answers from mirrors that are too far behind.
+	router.CheckMirror = MaxMirrorLag(time.Minute)
+	_, err = router.LookupAlias("second", routing.LookupTypeDEFAULT)
+	if err != nil {
+		t.Error("Expected an up to date mirror to be trusted, got", err)
+	}
+
+	if MaxMirrorLag(time.Minute)(&MirrorInfo{Lag: time.Hour, Synced: time.Now()}) == nil {
+		t.Error("Expected a lagging mirror to be refused.")
+	}
+	if MaxMirrorLag(time.Minute)(&MirrorInfo{}) == nil {
+		t.Error("Expected a mirror that has never caught up to be refused.")
+	}
+}
@@ -0,0 +1,219 @@
+package tracker
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"airdispat.ch/identity"
+	"airdispat.ch/message"
+	"airdispat.ch/tracker/wire"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// DefaultNamespaceTTL is how long the admin keys of a namespace are
+// remembered if no other time is given.
+const DefaultNamespaceTTL = time.Hour
+
+// NamespaceRecordPrefix begins each DNS TXT record that names an admin key
+// of a namespace, such as "airdispatch-admin=<address>".
+const NamespaceRecordPrefix = "airdispatch-admin="
+
+// NamespaceRecordName will return the DNS name whose TXT records hold the
+// admin keys of a namespace.
+func NamespaceRecordName(domain string) string {
+	return "_airdispatch." + domain
+}
+
+// Namespaces lets a tracker hold aliases such as "alice@corp.example" that
+// only the members of an organization may register. The owner of the
+// domain proves control of it by publishing the address of an admin key in
+// a TXT record at NamespaceRecordName, and signs a delegation with that key
+// for each member, which is sent along with the member's registration.
+//
+// Registrations from peers and primaries are checked in the same way, so a
+// member's delegation must be carried by the signed registration itself.
+// Clients that also follow federated aliases should list the namespaces in
+// FederatedRouter.Namespaces, so that they are not sent to the tracker for
+// the namespace's domain.
+type Namespaces struct {
+	// LookupTXT is optional. If it is set, it is used to find the TXT
+	// records of a domain instead of net.LookupTXT.
+	LookupTXT func(name string) ([]string, error)
+
+	// TTL is how long the admin keys of a namespace are remembered before
+	// they are looked up again.
+	TTL time.Duration
+
+	lock   sync.Mutex
+	admins map[string]namespaceAdmins
+}
+
+type namespaceAdmins struct {
+	addresses []string
+	expires   time.Time
+}
+
+func (n *Namespaces) ttl() time.Duration {
+	if n.TTL <= 0 {
+		return DefaultNamespaceTTL
+	}
+	return n.TTL
+}
+
+// Admins will return the addresses of the admin keys of a namespace.
+func (n *Namespaces) Admins(domain string) ([]string, error) {
+	domain = strings.ToLower(domain)
+	now := time.Now()
+
+	n.lock.Lock()
+	cached, ok := n.admins[domain]
+	n.lock.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.addresses, nil
+	}
+
+	lookup := n.LookupTXT
+	if lookup == nil {
+		lookup = net.LookupTXT
+	}
+
+	records, err := lookup(NamespaceRecordName(domain))
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []string
+	for _, v := range records {
+		if strings.HasPrefix(v, NamespaceRecordPrefix) {
+			addresses = append(addresses, strings.TrimSpace(v[len(NamespaceRecordPrefix):]))
+		}
+	}
+	if len(addresses) == 0 {
+		return nil, errors.New("No admin key is published for " + domain + ".")
+	}
+
+	n.lock.Lock()
+	if n.admins == nil {
+		n.admins = make(map[string]namespaceAdmins)
+	}
+	n.admins[domain] = namespaceAdmins{addresses, now.Add(n.ttl())}
+	n.lock.Unlock()
+
+	return addresses, nil
+}
+
+// CreateDelegation will sign a delegation with the admin key of a
+// namespace, allowing member to register a qualified alias such as
+// "alice@corp.example" until expires.
+func CreateDelegation(admin *identity.Identity, alias string, member *identity.Address, expires time.Time) (*message.SignedMessage, error) {
+	name, domain := ParseQualifiedAlias(alias)
+	if domain == "" {
+		return nil, errors.New("Alias is not in a namespace.")
+	}
+
+	address := member.String()
+	expirationTime := uint64(expires.Unix())
+	return message.SignMessage(&wireMessage{
+		from: admin.Address,
+		code: wire.DelegationCode,
+		body: &wire.TrackerDelegation{
+			Namespace: &domain,
+			Alias:     &name,
+			Address:   &address,
+			Expires:   &expirationTime,
+		},
+	}, admin)
+}
+
+// delegationExpiry will return when a delegation runs out, or the zero time
+// if it can not be read.
+func delegationExpiry(d *message.SignedMessage) time.Time {
+	if d == nil {
+		return time.Time{}
+	}
+
+	data, typ, _, err := d.ReconstructMessage()
+	if err != nil || typ != wire.DelegationCode {
+		return time.Time{}
+	}
+
+	delegation := &wire.TrackerDelegation{}
+	err = proto.Unmarshal(data, delegation)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(int64(delegation.GetExpires()), 0)
+}
+
+// verifyNamespace will check the delegation of a registration that was
+// received from a peer or a primary, if the tracker checks namespaces.
+func (t *Tracker) verifyNamespace(record *message.SignedMessage, now time.Time) error {
+	if t.Namespaces == nil {
+		return nil
+	}
+
+	reg := registrationFromRecord(record)
+	if reg == nil {
+		return errors.New("Record is not a registration.")
+	}
+	return t.Namespaces.VerifyRegistration(reg, now)
+}
+
+// VerifyRegistration will check that a registration for an alias in a
+// namespace carries a current delegation signed by one of the namespace's
+// admin keys. Registrations for other aliases are always allowed.
+func (n *Namespaces) VerifyRegistration(reg *RegistrationMessage, now time.Time) error {
+	name, domain := ParseQualifiedAlias(reg.Alias)
+	if domain == "" {
+		return nil
+	}
+
+	if reg.Delegation == nil {
+		return errors.New("Alias is in a namespace and has no delegation.")
+	}
+
+	if !reg.Delegation.Verify() {
+		return errors.New("Unable to verify delegation.")
+	}
+
+	d, typ, h, err := reg.Delegation.ReconstructMessage()
+	if err != nil || typ != wire.DelegationCode {
+		return errors.New("Delegation is not valid.")
+	}
+
+	delegation := &wire.TrackerDelegation{}
+	err = proto.Unmarshal(d, delegation)
+	if err != nil {
+		return errors.New("Delegation is not valid.")
+	}
+
+	if strings.ToLower(delegation.GetNamespace()) != domain || delegation.GetAlias() != name ||
+		delegation.GetAddress() != reg.Address {
+		return errors.New("Delegation is for another alias or address.")
+	}
+
+	expires := time.Unix(int64(delegation.GetExpires()), 0)
+	if !now.Before(expires) {
+		return errors.New("Delegation has expired.")
+	}
+
+	// Otherwise the alias would be kept after the delegation runs out.
+	if reg.Expires.IsZero() || reg.Expires.After(expires) {
+		return errors.New("Registration outlasts its delegation.")
+	}
+
+	admins, err := n.Admins(domain)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range admins {
+		if v == h.From.String() {
+			return nil
+		}
+	}
+	return errors.New("Delegation is not signed by an admin of " + domain + ".")
+}
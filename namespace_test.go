@@ -0,0 +1,126 @@
+package tracker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"airdispat.ch/identity"
+	"airdispat.ch/message"
+	"airdispat.ch/routing"
+)
+
+func TestNamespaces(t *testing.T) {
+	keys := make([]*identity.Identity, 4)
+	for i := range keys {
+		key, err := identity.CreateIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key.SetLocation("example.com")
+		keys[i] = key
+	}
+	admin, member, other, trackerKey := keys[0], keys[1], keys[2], keys[3]
+
+	lookups := 0
+	namespaces := &Namespaces{
+		LookupTXT: func(name string) ([]string, error) {
+			lookups++
+			if name != NamespaceRecordName("corp.example") {
+				return nil, errors.New("No such host.")
+			}
+			return []string{"v=spf1 -all", NamespaceRecordPrefix + admin.Address.String()}, nil
+		},
+	}
+
+	now := time.Now()
+	delegate := func(signer *identity.Identity, alias string, to *identity.Identity, expires time.Time) *message.SignedMessage {
+		d, err := CreateDelegation(signer, alias, to.Address, expires)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	valid := delegate(admin, "alice@corp.example", member, now.Add(time.Hour))
+	soon := now.Add(time.Minute)
+	tests := []struct {
+		desc    string
+		alias   string
+		from    *identity.Identity
+		d       *message.SignedMessage
+		expires time.Time
+		allows  bool
+	}{
+		{"a delegated member", "alice@corp.example", member, valid, soon, true},
+		{"an alias outside of a namespace", "alice", other, nil, soon, true},
+		{"a registration without a delegation", "alice@corp.example", member, nil, soon, false},
+		{"another address", "alice@corp.example", other, valid, soon, false},
+		{"another alias", "bob@corp.example", member, valid, soon, false},
+		{"a delegation from someone else", "alice@corp.example", member, delegate(other, "alice@corp.example", member, now.Add(time.Hour)), soon, false},
+		{"an expired delegation", "alice@corp.example", member, delegate(admin, "alice@corp.example", member, now.Add(-time.Hour)), soon, false},
+		{"a registration that outlasts its delegation", "alice@corp.example", member, valid, now.Add(2 * time.Hour), false},
+		{"a registration that never expires", "alice@corp.example", member, valid, time.Time{}, false},
+		{"a domain without an admin key", "alice@other.example", member, delegate(admin, "alice@other.example", member, now.Add(time.Hour)), soon, false},
+	}
+
+	for _, v := range tests {
+		err := namespaces.VerifyRegistration(&RegistrationMessage{
+			Address:    v.from.Address.String(),
+			Alias:      v.alias,
+			Delegation: v.d,
+			Expires:    v.expires,
+		}, now)
+		if v.allows && err != nil {
+			t.Errorf("Expected %s to be allowed, got %v.", v.desc, err)
+		} else if !v.allows && err == nil {
+			t.Errorf("Expected %s to be refused.", v.desc)
+		}
+	}
+	if lookups != 2 {
+		t.Errorf("Expected the admin keys of each namespace to be looked up once, got %d lookups.", lookups)
+	}
+
+	// Delegations are carried to the tracker with the registration.
+	tracker := &Tracker{
+		Key:        trackerKey,
+		Delegate:   newTestingTracker(),
+		Namespaces: namespaces,
+	}
+	go tracker.StartServer("9110")
+
+	// Wait for Server to Startup
+	time.Sleep(1 * time.Second)
+
+	err := (&Router{URL: "localhost:9110", Origin: other}).Register(other, "alice@corp.example", nil)
+	if err == nil {
+		t.Error("Expected a registration without a delegation to be refused.")
+	}
+
+	router := &Router{
+		URL:         "localhost:9110",
+		Origin:      member,
+		Delegations: map[string]*message.SignedMessage{"alice@corp.example": valid},
+	}
+	err = router.Register(member, "alice@corp.example", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := router.LookupAlias("alice@corp.example", routing.LookupTypeDEFAULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != member.Address.String() {
+		t.Error("Expected the namespaced alias to belong to the member.")
+	}
+
+	// Peers can not skip the delegation either.
+	forged, record := createTestRecord(t, "bob@corp.example", now.Add(time.Hour))
+	if tracker.acceptReplica(NewStoredRecord(forged.Address, record, "bob@corp.example"), "") {
+		t.Error("Expected a replicated registration without a delegation to be refused.")
+	}
+	if tracker.records().GetRecordByAlias("bob@corp.example") != nil {
+		t.Error("Expected the replicated registration not to be saved.")
+	}
+}
@@ -0,0 +1,275 @@
+package tracker
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"airdispat.ch/identity"
+)
+
+// DefaultRebalanceInterval is how often a partitioned tracker hands off
+// records that it should not hold if no other interval is given.
+const DefaultRebalanceInterval = 10 * time.Minute
+
+// Partition makes a tracker one of a group of trackers that divide their
+// records between them on a Ring. The tracker must be on the ring under its
+// own address.
+//
+// The tracker only accepts registrations for addresses or aliases that it
+// owns. Other members of the ring may hand records to it with Replicate,
+// and Rebalance moves the tracker's records to their owners after the ring
+// has changed. Members of the ring may also read the tracker's digest, so
+// that they can check which records it holds.
+type Partition struct {
+	// Replicas is how many trackers hold each record.
+	Replicas int
+
+	// BatchSize is the most records handed to another tracker at once.
+	BatchSize int
+
+	// RebalanceInterval is how often StartRebalancing hands off records.
+	RebalanceInterval time.Duration
+
+	lock sync.RWMutex
+	ring *Ring
+}
+
+// NewPartition will create a partition on a ring.
+func NewPartition(ring *Ring, replicas int) *Partition {
+	return &Partition{
+		Replicas: replicas,
+		ring:     ring,
+	}
+}
+
+// RebalanceResult counts what a single Rebalance did.
+type RebalanceResult struct {
+	// Sent is the number of records handed to other owners.
+	Sent int
+	// Dropped is the number of records removed because the tracker no
+	// longer owns them.
+	Dropped int
+	// Failed is the number of records that could not be handed off,
+	// either because an owner could not be reached or because it did not
+	// keep them, and are kept until the next Rebalance.
+	Failed int
+}
+
+func (p *Partition) replicas() int {
+	if p.Replicas <= 0 {
+		return DefaultReplicas
+	}
+	return p.Replicas
+}
+
+func (p *Partition) batchSize() int {
+	if p.BatchSize <= 0 {
+		return DefaultReplicationBatch
+	}
+	return p.BatchSize
+}
+
+// Ring will return the current ring.
+func (p *Partition) Ring() *Ring {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.ring
+}
+
+// owners will return every tracker that should hold a record.
+func (p *Partition) owners(address string, alias string) []*Peer {
+	ring := p.Ring()
+	owners := ring.AddressOwners(address, p.replicas())
+	if alias == "" {
+		return owners
+	}
+
+	for _, o := range ring.AliasOwners(alias, p.replicas()) {
+		found := false
+		for _, v := range owners {
+			found = found || v == o
+		}
+		if !found {
+			owners = append(owners, o)
+		}
+	}
+	return owners
+}
+
+// owns will return true if self should hold a record. A nil Partition owns
+// every record.
+func (p *Partition) owns(self string, address string, alias string) bool {
+	if p == nil {
+		return true
+	}
+
+	for _, o := range p.owners(address, alias) {
+		if o.Address == self {
+			return true
+		}
+	}
+	return false
+}
+
+// member will return true if the address belongs to a tracker on the ring.
+// A nil Partition has no members.
+func (p *Partition) member(address string) bool {
+	if p == nil {
+		return false
+	}
+	return p.Ring().Member(address) != nil
+}
+
+// SetRing will replace the tracker's ring, such as when a tracker joins or
+// leaves the group, and hand off the records that have changed owner.
+func (t *Tracker) SetRing(ring *Ring) (*RebalanceResult, error) {
+	t.Partition.lock.Lock()
+	t.Partition.ring = ring
+	t.Partition.lock.Unlock()
+
+	return t.Rebalance()
+}
+
+// Rebalance will hand every record that the tracker holds to the other
+// trackers that own it, and remove the records that the tracker no longer
+// owns once every owner holds them or a newer record for their address.
+func (t *Tracker) Rebalance() (*RebalanceResult, error) {
+	records, err := t.liveRecords(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	self := t.Key.Address.String()
+	batches := make(map[*Peer][]*StoredRecord)
+	owners := make(map[string][]*Peer)
+	for address, r := range records {
+		owners[address] = t.Partition.owners(address, r.Alias)
+		for _, o := range owners[address] {
+			if o.Address != self {
+				batches[o] = append(batches[o], r)
+			}
+		}
+	}
+
+	result := &RebalanceResult{}
+	held := make(map[*Peer]map[string]*DigestEntry)
+	for p, batch := range batches {
+		router := &Router{
+			URL:    p.URL,
+			Origin: t.Key,
+		}
+
+		buckets := make(map[string]bool)
+		for _, r := range batch {
+			buckets[digestPrefix(r.Address)] = true
+		}
+
+		failed := false
+		for len(batch) > 0 {
+			n := t.Partition.batchSize()
+			if n > len(batch) {
+				n = len(batch)
+			}
+
+			_, err := router.Replicate(batch[:n])
+			if err != nil {
+				t.handleError("Rebalance To "+p.URL, err)
+				failed = true
+				break
+			}
+
+			result.Sent += n
+			batch = batch[n:]
+		}
+		if failed {
+			continue
+		}
+
+		// An owner may refuse a record that it was sent, so records are
+		// only dropped once the owner is seen to hold them.
+		var prefixes []string
+		for v := range buckets {
+			prefixes = append(prefixes, v)
+		}
+
+		entries, err := router.DigestEntries(prefixes)
+		if err != nil {
+			t.handleError("Rebalance To "+p.URL+" (Checking Records)", err)
+			continue
+		}
+		held[p] = entries
+	}
+
+	for address, r := range records {
+		keep, refused := false, false
+		for _, o := range owners[address] {
+			if o.Address == self {
+				keep = true
+			} else if !holdsRecord(held[o], r) {
+				keep, refused = true, true
+			}
+		}
+		if refused {
+			result.Failed++
+		}
+		if keep {
+			continue
+		}
+
+		d, ok := t.records().(RecordDeleter)
+		if !ok {
+			break
+		}
+		d.DeleteRecord(identity.CreateAddressFromString(address))
+		t.Cache.Invalidate(address, r.Alias)
+		result.Dropped++
+	}
+
+	t.Metrics.add("tracker_rebalanced_records_total", float64(result.Sent), "sent")
+	t.Metrics.add("tracker_rebalanced_records_total", float64(result.Dropped), "dropped")
+	t.Metrics.add("tracker_rebalanced_records_total", float64(result.Failed), "failed")
+	return result, nil
+}
+
+// holdsRecord will return true if a tracker's digest entries show that it
+// holds a record, or a newer record for the same address.
+func holdsRecord(entries map[string]*DigestEntry, r *StoredRecord) bool {
+	theirs, ok := entries[r.Address]
+	if !ok {
+		return false
+	}
+
+	mine, err := newDigestEntry(r)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(theirs.Hash, mine.Hash) || theirs.newerThan(mine)
+}
+
+// StartRebalancing will Rebalance straight away, and then every
+// Partition.RebalanceInterval, so that records handed off while an owner
+// could not be reached get there in the end. It blocks like StartServer,
+// and Partition must be set before it is called.
+func (t *Tracker) StartRebalancing() {
+	interval := t.Partition.RebalanceInterval
+	if interval <= 0 {
+		interval = DefaultRebalanceInterval
+	}
+
+	t.Delegate.LogMessage("Rebalancing Records every " + interval.String())
+
+	for {
+		result, err := t.Rebalance()
+		if err != nil {
+			t.handleError("Rebalance", err)
+		} else if result.Sent > 0 || result.Dropped > 0 || result.Failed > 0 {
+			t.Delegate.LogMessage(fmt.Sprintf("Rebalanced records: %d sent, %d dropped, %d failed.",
+				result.Sent, result.Dropped, result.Failed))
+		}
+
+		time.Sleep(interval)
+	}
+}
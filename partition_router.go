@@ -0,0 +1,159 @@
+package tracker
+
+import (
+	"errors"
+	"sync"
+
+	"airdispat.ch/identity"
+	"airdispat.ch/routing"
+)
+
+// PartitionRouter implements the AirDispatch routing.Router interface for a
+// group of trackers that divide their records on a Ring. Lookups are sent
+// to the owners of the address or alias in turn, and registrations are sent
+// to every owner.
+type PartitionRouter struct {
+	Origin     *identity.Identity
+	Redirector RedirectHandler
+
+	// Replicas is how many trackers hold each record. It must match the
+	// trackers' own Partition.Replicas.
+	Replicas int
+
+	// Metrics is optional. If it is set, the PartitionRouter will record
+	// the outcome and latency of every request that it makes.
+	Metrics *Metrics
+
+	lock sync.RWMutex
+	ring *Ring
+}
+
+// CreatePartitionRouter will return a PartitionRouter for a ring of
+// trackers.
+func CreatePartitionRouter(redirect RedirectHandler, currentIdentity *identity.Identity, replicas int, ring *Ring) *PartitionRouter {
+	return &PartitionRouter{
+		Origin:     currentIdentity,
+		Redirector: redirect,
+		Replicas:   replicas,
+		ring:       ring,
+	}
+}
+
+// SetRing will replace the ring, such as when a tracker joins or leaves
+// the group.
+func (a *PartitionRouter) SetRing(ring *Ring) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.ring = ring
+}
+
+// Ring will return the current ring.
+func (a *PartitionRouter) Ring() *Ring {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return a.ring
+}
+
+func (a *PartitionRouter) replicas() int {
+	if a.Replicas <= 0 {
+		return DefaultReplicas
+	}
+	return a.Replicas
+}
+
+func (a *PartitionRouter) router(p *Peer) *Router {
+	return &Router{
+		URL:        p.URL,
+		Origin:     a.Origin,
+		Redirector: a.Redirector,
+		Metrics:    a.Metrics,
+	}
+}
+
+// first will return the first answer from the owners, asked in order.
+func (a *PartitionRouter) first(owners []*Peer, query queryFunc) (*identity.Address, error) {
+	err := errors.New("No trackers own that record.")
+	for _, p := range owners {
+		var addr *identity.Address
+		addr, err = query(a.router(p))
+		if err == nil {
+			return addr, nil
+		}
+	}
+	return nil, err
+}
+
+// Lookup will return a new identity.Address for an address fingerprint.
+func (a *PartitionRouter) Lookup(addr string, name routing.LookupType) (*identity.Address, error) {
+	return a.first(a.Ring().AddressOwners(addr, a.replicas()), func(r routing.Router) (*identity.Address, error) {
+		return r.Lookup(addr, name)
+	})
+}
+
+// LookupAlias will return a new identity.Address for an alias.
+func (a *PartitionRouter) LookupAlias(alias string, name routing.LookupType) (*identity.Address, error) {
+	return a.first(a.Ring().AliasOwners(alias, a.replicas()), func(r routing.Router) (*identity.Address, error) {
+		return r.LookupAlias(alias, name)
+	})
+}
+
+// Register will register an address with every tracker that owns it or its
+// alias. It succeeds once a majority of the owners of the address, and of
+// the alias, have accepted the registration.
+func (a *PartitionRouter) Register(key *identity.Identity, alias string, redirects map[string]routing.Redirect) error {
+	ring := a.Ring()
+	groups := [][]*Peer{ring.AddressOwners(key.Address.String(), a.replicas())}
+	if alias != "" {
+		groups = append(groups, ring.AliasOwners(alias, a.replicas()))
+	}
+
+	type outcome struct {
+		peer *Peer
+		err  error
+	}
+
+	sent := make(map[*Peer]bool)
+	results := make(chan outcome)
+	for _, g := range groups {
+		for _, p := range g {
+			if sent[p] {
+				continue
+			}
+			sent[p] = true
+
+			go func(p *Peer) {
+				results <- outcome{p, a.router(p).Register(key, alias, redirects)}
+			}(p)
+		}
+	}
+
+	var lastErr error
+	accepted := make(map[*Peer]bool)
+	for range sent {
+		o := <-results
+		if o.err != nil {
+			lastErr = o.err
+			continue
+		}
+		accepted[o.peer] = true
+	}
+
+	for _, g := range groups {
+		count := 0
+		for _, p := range g {
+			if accepted[p] {
+				count++
+			}
+		}
+
+		if count < len(g)/2+1 {
+			if lastErr == nil {
+				lastErr = errors.New("No trackers own that record.")
+			}
+			return lastErr
+		}
+	}
+	return nil
+}
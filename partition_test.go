@@ -0,0 +1,273 @@
+package tracker
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"airdispat.ch/identity"
+	"airdispat.ch/message"
+	"airdispat.ch/routing"
+)
+
+func TestRing(t *testing.T) {
+	var nodes []*Peer
+	for i := 0; i < 4; i++ {
+		nodes = append(nodes, &Peer{URL: fmt.Sprintf("tracker%d:2048", i), Address: fmt.Sprintf("%02x", i)})
+	}
+	ring := NewRing(0, nodes...)
+
+	counts := make(map[*Peer]int)
+	owners := make(map[string]*Peer)
+	for i := 0; i < 4000; i++ {
+		address := fmt.Sprintf("%040x", i)
+		o := ring.AddressOwners(address, 2)
+		if len(o) != 2 || o[0] == o[1] {
+			t.Fatal("Expected two different owners, got", o)
+		}
+		counts[o[0]]++
+		owners[address] = o[0]
+	}
+
+	for _, p := range nodes {
+		if counts[p] < 500 || counts[p] > 1500 {
+			t.Errorf("Expected records to be spread evenly, %s owns %d.", p.URL, counts[p])
+		}
+	}
+
+	// Only the records taken by a new tracker change owner.
+	joined := ring.Join(&Peer{URL: "tracker4:2048", Address: "04"})
+	moved := 0
+	for address, before := range owners {
+		after := joined.AddressOwners(address, 1)[0]
+		if after != before {
+			if after.Address != "04" {
+				t.Fatal("Expected records only to move to the new tracker.")
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 1600 {
+		t.Errorf("Expected about a fifth of the records to move, got %d.", moved)
+	}
+
+	if left := joined.Leave("04"); len(left.Nodes()) != 4 || left.AddressOwners("00", 1)[0] != ring.AddressOwners("00", 1)[0] {
+		t.Error("Expected leaving to undo joining.")
+	}
+	if len(ring.AddressOwners("00", 10)) != 4 {
+		t.Error("Expected no more owners than trackers.")
+	}
+}
+
+func TestPartition(t *testing.T) {
+	ports := []string{"9100", "9101", "9102", "9103"}
+	trackers := make([]*Tracker, len(ports))
+	peers := make([]*Peer, len(ports))
+	for i, port := range ports {
+		key, err := identity.CreateIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		trackers[i] = &Tracker{
+			Key:      key,
+			Delegate: newTestingTracker(),
+			Metrics:  NewMetrics(),
+		}
+		peers[i] = &Peer{URL: "localhost:" + port, Address: key.Address.String()}
+		go trackers[i].StartServer(port)
+	}
+
+	// The last tracker joins later.
+	ring := NewRing(0, peers[:3]...)
+	for _, v := range trackers {
+		v.Partition = NewPartition(ring, 2)
+	}
+
+	// Wait for Server to Startup
+	time.Sleep(1 * time.Second)
+
+	toLog, err := identity.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := CreatePartitionRouter(nil, toLog, 2, ring)
+
+	var registered []*identity.Identity
+	for i := 0; i < 12; i++ {
+		id, err := identity.CreateIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id.SetLocation("example.com")
+
+		err = router.Register(id, fmt.Sprint("user", i), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		registered = append(registered, id)
+	}
+
+	// holders will return the trackers that hold a record.
+	holders := func(id *identity.Identity) map[string]bool {
+		out := make(map[string]bool)
+		for _, v := range trackers {
+			if v.records().GetRecordByAddress(id.Address) != nil {
+				out[v.Key.Address.String()] = true
+			}
+		}
+		return out
+	}
+
+	for i, id := range registered {
+		held := holders(id)
+		for _, o := range ring.AddressOwners(id.Address.String(), 2) {
+			if !held[o.Address] {
+				t.Errorf("Expected %s to hold the record of its address.", o.URL)
+			}
+		}
+		for _, o := range ring.AliasOwners(fmt.Sprint("user", i), 2) {
+			if !held[o.Address] {
+				t.Errorf("Expected %s to hold the record of its alias.", o.URL)
+			}
+		}
+
+		addr, err := router.LookupAlias(fmt.Sprint("user", i), routing.LookupTypeDEFAULT)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.String() != id.Address.String() {
+			t.Error("Expected the owners to answer for the alias.")
+		}
+	}
+
+	// Trackers refuse registrations that they do not own.
+	refused := false
+	for i, v := range trackers[:3] {
+		id := registered[0]
+		if v.Partition.owns(v.Key.Address.String(), id.Address.String(), "") {
+			continue
+		}
+
+		err := (&Router{URL: peers[i].URL, Origin: id}).Register(id, "", nil)
+		if err == nil {
+			t.Error("Expected the registration to be refused.")
+		}
+		refused = true
+	}
+	if !refused {
+		t.Error("Expected one tracker not to own the address.")
+	}
+
+	// A new tracker joins, and the records that it owns are moved to it.
+	joined := ring.Join(peers[3])
+	for _, v := range trackers {
+		_, err := v.SetRing(joined)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	router.SetRing(joined)
+
+	for i, id := range registered {
+		owners := make(map[string]bool)
+		for _, o := range joined.AddressOwners(id.Address.String(), 2) {
+			owners[o.Address] = true
+		}
+		for _, o := range joined.AliasOwners(fmt.Sprint("user", i), 2) {
+			owners[o.Address] = true
+		}
+
+		held := holders(id)
+		if len(held) != len(owners) {
+			t.Errorf("Expected %d trackers to hold the record, got %d.", len(owners), len(held))
+		}
+		for address := range owners {
+			if !held[address] {
+				t.Error("Expected every owner to hold the record after rebalancing.")
+			}
+		}
+
+		_, err := router.Lookup(id.Address.String(), routing.LookupTypeDEFAULT)
+		if err != nil {
+			t.Error("Expected the record to be found after rebalancing, got", err)
+		}
+	}
+
+	if trackers[3].Metrics.Value("tracker_rebalanced_records_total", "dropped") != 0 {
+		t.Error("Expected the new tracker not to drop anything.")
+	}
+}
+
+func TestRebalanceRefused(t *testing.T) {
+	ports := []string{"9120", "9121"}
+	trackers := make([]*Tracker, len(ports))
+	peers := make([]*Peer, len(ports))
+	for i, port := range ports {
+		key, err := identity.CreateIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		trackers[i] = &Tracker{
+			Key:      key,
+			Delegate: newTestingTracker(),
+		}
+		peers[i] = &Peer{URL: "localhost:" + port, Address: key.Address.String()}
+	}
+
+	// The second tracker refuses aliases in namespaces, as it can not find
+	// their admin keys.
+	trackers[1].Namespaces = &Namespaces{
+		LookupTXT: func(name string) ([]string, error) {
+			return nil, errors.New("No such host.")
+		},
+	}
+
+	ring := NewRing(0, peers...)
+	for i, v := range trackers {
+		v.Partition = NewPartition(ring, 1)
+		go v.StartServer(ports[i])
+	}
+
+	// Wait for Server to Startup
+	time.Sleep(1 * time.Second)
+
+	// owned will create a record that only the second tracker owns, with
+	// an alias in a namespace if it is set.
+	owned := func(namespaced bool) (*identity.Identity, *message.SignedMessage, string) {
+		for i := 0; ; i++ {
+			alias := ""
+			if namespaced {
+				alias = fmt.Sprintf("user%d@corp.example", i)
+			}
+
+			id, record := createTestRecord(t, alias, time.Now().Add(time.Hour))
+			if !trackers[0].Partition.owns(peers[0].Address, id.Address.String(), alias) {
+				return id, record, alias
+			}
+		}
+	}
+
+	store := trackers[0].records().(*testingTracker)
+	accepted, acceptedRecord, _ := owned(false)
+	refused, refusedRecord, alias := owned(true)
+	store.SaveRecord(accepted.Address, acceptedRecord, "")
+	store.SaveRecord(refused.Address, refusedRecord, alias)
+
+	result, err := trackers[0].Rebalance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Sent != 2 || result.Dropped != 1 || result.Failed != 1 {
+		t.Errorf("Expected one record to be handed off and one to be refused, got %+v.", result)
+	}
+
+	if store.GetRecordByAddress(accepted.Address) != nil {
+		t.Error("Expected the record that the owner accepted to be dropped.")
+	}
+	if store.GetRecordByAddress(refused.Address) == nil {
+		t.Error("Expected the record that the owner refused to be kept.")
+	}
+}
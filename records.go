@@ -0,0 +1,89 @@
+package tracker
+
+import (
+	"errors"
+
+	"airdispat.ch/identity"
+	"airdispat.ch/message"
+	"airdispat.ch/tracker/wire"
+)
+
+// MarshalRecord will serialize a stored record so that it can be written to
+// disk or sent inside of another message.
+func MarshalRecord(record *message.SignedMessage) ([]byte, error) {
+	return record.Marshal()
+}
+
+// UnmarshalRecord will deserialize a record created by MarshalRecord.
+func UnmarshalRecord(data []byte) (*message.SignedMessage, error) {
+	return message.CreateSignedMessageFromBytes(data)
+}
+
+// VerifyRecord will check that a record carries a valid signature and is a
+// registration for the given address. Stores use it to detect records that
+// have been tampered with on disk.
+func VerifyRecord(address string, record *message.SignedMessage) error {
+	if !record.Verify() {
+		return errors.New("Unable to verify record.")
+	}
+
+	d, typ, h, err := record.ReconstructMessage()
+	if err != nil || typ != wire.RegistrationCode {
+		return errors.New("Record is not a registration.")
+	}
+
+	reg, err := registrationFromResponse(d, h)
+	if err != nil {
+		return err
+	}
+
+	if reg.Address != address {
+		return errors.New("Record does not match its address.")
+	}
+
+	return nil
+}
+
+// VerifyRecordAlias will check a record like VerifyRecord, and also that
+// alias is either empty or the alias that the registration was signed
+// with. Stores that keep an alias beside each record use it so that the
+// alias can not be changed without the record's signature.
+func VerifyRecordAlias(address string, alias string, record *message.SignedMessage) error {
+	err := VerifyRecord(address, record)
+	if err != nil {
+		return err
+	}
+
+	if alias != "" {
+		if reg := registrationFromRecord(record); reg == nil || reg.Alias != alias {
+			return errors.New("Record does not match its alias.")
+		}
+	}
+	return nil
+}
+
+// cloneRecord will return a deep copy of a record, so that the copy can be
+// countersigned without modifying the record held by the store.
+func cloneRecord(record *message.SignedMessage) (*message.SignedMessage, error) {
+	data, err := MarshalRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	return UnmarshalRecord(data)
+}
+
+// countersign will prepare a copy of a stored record, signed by the tracker,
+// to be sent to the requester.
+func (t *Tracker) countersign(record *message.SignedMessage, to *identity.Address) (*message.EncryptedMessage, error) {
+	info, err := cloneRecord(record)
+	if err != nil {
+		return nil, err
+	}
+
+	err = info.AddSignature(t.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return info.UnencryptedMessage(to)
+}
@@ -0,0 +1,442 @@
+package tracker
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	adErrors "airdispat.ch/errors"
+	"airdispat.ch/identity"
+	"airdispat.ch/tracker/wire"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+const (
+	// DefaultReplicationBatch is the most records sent to a peer at once
+	// if no other size is given.
+	DefaultReplicationBatch = 100
+
+	// DefaultReplicationRetry is how long to wait before sending to a peer
+	// again after it could not be reached, if no other interval is given.
+	DefaultReplicationRetry = 10 * time.Second
+)
+
+// Peer is another tracker that registrations are replicated with.
+type Peer struct {
+	// URL is where the peer's tracker is listening.
+	URL string
+
+	// Address is the peer's tracker address. Registrations are only
+	// accepted from peers whose address is known, but they are sent to
+	// every peer.
+	Address string
+}
+
+// Replication controls how a tracker shares the registrations that it
+// accepts with its peers. Every registration that is accepted, whether
+// from a client or from a peer, is passed on to every peer except the one
+// that it came from.
+//
+// Registrations that could not be delivered are kept until the peer can be
+// reached again. Only the newest registration for each address is kept, so
+// a peer that has been down for a long time is sent each address once.
+//
+// Peers re-verify every registration that they receive, and when two
+// registrations for the same address meet, the one that expires last wins.
+// The same rule decides which of two addresses owns an alias that they
+// both claim.
+// Registrations that are missed altogether, such as while two trackers
+// can not reach each other, are found by StartAntiEntropy.
+type Replication struct {
+	Peers []*Peer
+
+	// BatchSize is the most registrations that are sent to a peer in a
+	// single message.
+	BatchSize int
+
+	// RetryInterval is how long to wait before trying a peer again after
+	// it could not be reached.
+	RetryInterval time.Duration
+
+	// SyncInterval is how often StartAntiEntropy compares the tracker's
+	// records with each peer.
+	SyncInterval time.Duration
+
+	// Mirrors are the addresses of mirror trackers, which may copy every
+	// record like a peer but are not sent registrations.
+	Mirrors []string
+
+	lock   sync.Mutex
+	queues map[*Peer]*peerQueue
+}
+
+// ReplicationResult counts what a peer did with the registrations that it
+// was sent.
+type ReplicationResult struct {
+	Accepted int
+	Stale    int
+	Invalid  int
+}
+
+// peerQueue holds the registrations waiting to be sent to a single peer.
+type peerQueue struct {
+	lock    sync.Mutex
+	pending map[string]*StoredRecord
+	wake    chan bool
+}
+
+func (r *Replication) batchSize() int {
+	if r.BatchSize <= 0 {
+		return DefaultReplicationBatch
+	}
+	return r.BatchSize
+}
+
+func (r *Replication) retryInterval() time.Duration {
+	if r.RetryInterval <= 0 {
+		return DefaultReplicationRetry
+	}
+	return r.RetryInterval
+}
+
+func (r *Replication) queue(p *Peer) *peerQueue {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.queues == nil {
+		r.queues = make(map[*Peer]*peerQueue)
+	}
+
+	q, ok := r.queues[p]
+	if !ok {
+		q = &peerQueue{
+			pending: make(map[string]*StoredRecord),
+			wake:    make(chan bool, 1),
+		}
+		r.queues[p] = q
+	}
+	return q
+}
+
+// trusts will return true if registrations may be accepted from the
+// address. A nil Replication trusts no one.
+func (r *Replication) trusts(address string) bool {
+	if r == nil {
+		return false
+	}
+
+	for _, p := range r.Peers {
+		if p.Address != "" && p.Address == address {
+			return true
+		}
+	}
+	return false
+}
+
+// mayCopy will return true if the address may read every record. A nil
+// Replication allows no one.
+func (r *Replication) mayCopy(address string) bool {
+	if r.trusts(address) {
+		return true
+	}
+
+	if r != nil {
+		for _, m := range r.Mirrors {
+			if m == address {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Pending will return the number of registrations waiting to be sent to
+// each peer, by URL.
+func (r *Replication) Pending() map[string]int {
+	out := make(map[string]int)
+	for _, p := range r.Peers {
+		q := r.queue(p)
+
+		q.lock.Lock()
+		out[p.URL] = len(q.pending)
+		q.lock.Unlock()
+	}
+	return out
+}
+
+// add will queue a registration, replacing any older one for the same
+// address.
+func (q *peerQueue) add(record *StoredRecord) {
+	q.lock.Lock()
+	if old, ok := q.pending[record.Address]; !ok || !old.Expires.After(record.Expires) {
+		q.pending[record.Address] = record
+	}
+	q.lock.Unlock()
+
+	select {
+	case q.wake <- true:
+	default:
+	}
+}
+
+// take will remove up to n registrations from the queue.
+func (q *peerQueue) take(n int) []*StoredRecord {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var out []*StoredRecord
+	for address, record := range q.pending {
+		if len(out) == n {
+			break
+		}
+		out = append(out, record)
+		delete(q.pending, address)
+	}
+	return out
+}
+
+// replicate will queue a registration for every peer except the one that
+// it was received from.
+func (t *Tracker) replicate(record *StoredRecord, from string) {
+	if t.Replication == nil {
+		return
+	}
+
+	for _, p := range t.Replication.Peers {
+		if p.Address != "" && p.Address == from {
+			continue
+		}
+		t.Replication.queue(p).add(record)
+	}
+}
+
+// StartReplication will send accepted registrations to every peer as they
+// arrive. It blocks like StartServer, and Replication must be set before
+// it is called.
+func (t *Tracker) StartReplication() {
+	var wg sync.WaitGroup
+	for _, p := range t.Replication.Peers {
+		t.Delegate.LogMessage("Replicating Registrations to " + p.URL)
+
+		wg.Add(1)
+		go func(p *Peer) {
+			defer wg.Done()
+			t.replicateTo(p)
+		}(p)
+	}
+	wg.Wait()
+}
+
+func (t *Tracker) replicateTo(p *Peer) {
+	q := t.Replication.queue(p)
+	router := &Router{
+		URL:    p.URL,
+		Origin: t.Key,
+	}
+
+	for range q.wake {
+		for {
+			batch := q.take(t.Replication.batchSize())
+			if len(batch) == 0 {
+				break
+			}
+
+			_, err := router.Replicate(batch)
+			if err != nil {
+				t.Metrics.add("tracker_replicated_records_total", float64(len(batch)), "failed")
+				t.handleError("Replicate To "+p.URL, err)
+
+				// Put the batch back, unless newer records have
+				// been queued since, and wait for the peer.
+				for _, r := range batch {
+					q.add(r)
+				}
+				time.Sleep(t.Replication.retryInterval())
+				continue
+			}
+
+			t.Metrics.add("tracker_replicated_records_total", float64(len(batch)), "sent")
+		}
+	}
+}
+
+// handleReplicate will save the registrations sent by a peer that are
+// newer than the ones that the tracker holds.
+func (t *Tracker) handleReplicate(theAddress *identity.Address, req *wire.TrackerReplicate, conn net.Conn) {
+	if !t.Replication.trusts(theAddress.String()) && !t.Partition.member(theAddress.String()) {
+		adErrors.CreateError(adErrors.UnexpectedError, "Not a replication peer.", t.Key.Address).Send(t.Key, conn)
+		return
+	}
+
+	result := &ReplicationResult{}
+	for _, v := range req.GetRecord() {
+		record, err := UnmarshalRecord(v.GetRecord())
+		if err == nil {
+			err = VerifyRecord(v.GetAddress(), record)
+		}
+		if err != nil {
+			result.Invalid++
+			t.handleError("Handle Replicate (Verifying Record)", err)
+			continue
+		}
+
+		address := identity.CreateAddressFromString(v.GetAddress())
+		if t.acceptReplica(NewStoredRecord(address, record, registrationFromRecord(record).Alias), theAddress.String()) {
+			result.Accepted++
+		} else {
+			result.Stale++
+		}
+	}
+
+	t.Metrics.add("tracker_replication_received_total", float64(result.Accepted), "accepted")
+	t.Metrics.add("tracker_replication_received_total", float64(result.Stale), "stale")
+	t.Metrics.add("tracker_replication_received_total", float64(result.Invalid), "invalid")
+
+	accepted, stale, invalid := uint32(result.Accepted), uint32(result.Stale), uint32(result.Invalid)
+	err := t.reply(theAddress, wire.ReplicateAckCode, &wire.TrackerReplicateAck{
+		Accepted: &accepted,
+		Stale:    &stale,
+		Invalid:  &invalid,
+	}, conn)
+	if err != nil {
+		t.handleError("Handle Replicate (Sending Response)", err)
+	}
+}
+
+// acceptReplica will save a verified registration from a peer if it is
+// newer than the one that the tracker holds, returning true if it was
+// saved.
+func (t *Tracker) acceptReplica(r *StoredRecord, from string) bool {
+	now := time.Now()
+	if r.Expired(now) || !t.Sweeper.mayClaim(r.Alias, r.Address, now) {
+		return false
+	}
+
+	err := t.verifyNamespace(r.Record, now)
+	if err != nil {
+		t.handleError("Accept Replica (Verifying Namespace)", err)
+		return false
+	}
+
+	t.replicaLock.Lock()
+	defer t.replicaLock.Unlock()
+
+	address := identity.CreateAddressFromString(r.Address)
+	if current := t.records().GetRecordByAddress(address); current != nil {
+		theirs, err := newDigestEntry(r)
+		if err != nil {
+			return false
+		}
+
+		mine, err := newDigestEntry(NewStoredRecord(address, current, ""))
+		if err != nil {
+			return false
+		}
+
+		// A peer may send a record that the tracker already holds to
+		// settle which address owns its alias.
+		if bytes.Equal(theirs.Hash, mine.Hash) {
+			return t.settleAlias(r)
+		}
+		if !theirs.newerThan(mine) {
+			return false
+		}
+	}
+
+	// A registration that loses its alias to a newer claim is still kept
+	// for its address.
+	alias := r.Alias
+	if !t.claimsAlias(r) {
+		alias = ""
+	}
+
+	err = t.saveRecord(address, r.Record, alias)
+	if err != nil {
+		t.handleError("Accept Replica (Saving Record)", err)
+		return false
+	}
+
+	t.replicate(r, from)
+	return true
+}
+
+// settleAlias will give a record that the tracker already holds the alias
+// that it claims, if it wins the alias from its current owner. It returns
+// true if the alias was taken, and must be called with replicaLock held.
+func (t *Tracker) settleAlias(r *StoredRecord) bool {
+	if r.Alias == "" || t.holdsAlias(r.Alias, r.Address) || !t.claimsAlias(r) {
+		return false
+	}
+
+	err := t.saveRecord(identity.CreateAddressFromString(r.Address), r.Record, r.Alias)
+	if err != nil {
+		t.handleError("Settle Alias (Saving Record)", err)
+		return false
+	}
+	return true
+}
+
+// holdsAlias will return true if the address owns the alias.
+func (t *Tracker) holdsAlias(alias string, address string) bool {
+	owner := registrationFromRecord(t.records().GetRecordByAlias(alias))
+	return owner != nil && owner.Address == address
+}
+
+// claimsAlias will return true if a registration may take its alias from
+// the alias's current owner. Like two registrations for the same address,
+// the claim that expires last wins and ties are broken by hash, so that
+// every tracker gives the alias to the same owner whatever order the
+// claims arrive in. It must be called with replicaLock held.
+func (t *Tracker) claimsAlias(r *StoredRecord) bool {
+	if r.Alias == "" {
+		return true
+	}
+
+	current := t.records().GetRecordByAlias(r.Alias)
+	owner := registrationFromRecord(current)
+	if owner == nil || owner.Address == r.Address {
+		return true
+	}
+
+	theirs, err := newDigestEntry(r)
+	if err != nil {
+		return false
+	}
+
+	mine, err := newDigestEntry(NewStoredRecord(identity.CreateAddressFromString(owner.Address), current, r.Alias))
+	if err != nil {
+		return true
+	}
+	return theirs.newerThan(mine)
+}
+
+// Replicate will send registrations to a peer tracker. The router's Origin
+// must be the identity of a tracker that the peer replicates with.
+func (a *Router) Replicate(records []*StoredRecord) (result *ReplicationResult, err error) {
+	defer func(start time.Time) { a.observe("replicate", start, err) }(time.Now())
+
+	conn, err := a.send(&ReplicateMessage{From: a.Origin, Records: records}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	_, d, _, err := readResponse(conn, wire.ReplicateAckCode)
+	if err != nil {
+		return nil, err
+	}
+
+	ack := &wire.TrackerReplicateAck{}
+	err = proto.Unmarshal(d, ack)
+	if err != nil {
+		return nil, errors.New("Unable to unpack replication response.")
+	}
+
+	return &ReplicationResult{
+		Accepted: int(ack.GetAccepted()),
+		Stale:    int(ack.GetStale()),
+		Invalid:  int(ack.GetInvalid()),
+	}, nil
+}
@@ -0,0 +1,172 @@
+package tracker
+
+import (
+	"testing"
+	"time"
+
+	"airdispat.ch/identity"
+	"airdispat.ch/routing"
+)
+
+func TestReplication(t *testing.T) {
+	keys := make([]*identity.Identity, 2)
+	for i := range keys {
+		key, err := identity.CreateIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+	}
+
+	first := &Tracker{
+		Key:      keys[0],
+		Delegate: newTestingTracker(),
+		Replication: &Replication{
+			Peers: []*Peer{{URL: "localhost:9095", Address: keys[1].Address.String()}},
+		},
+	}
+	second := &Tracker{
+		Key:      keys[1],
+		Delegate: newTestingTracker(),
+		Metrics:  NewMetrics(),
+		Replication: &Replication{
+			Peers: []*Peer{{URL: "localhost:9094", Address: keys[0].Address.String()}},
+		},
+	}
+
+	for port, tracker := range map[string]*Tracker{"9094": first, "9095": second} {
+		go tracker.StartServer(port)
+		go tracker.StartReplication()
+	}
+
+	// Wait for Server to Startup
+	time.Sleep(1 * time.Second)
+
+	toLog, err := identity.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	toLog.SetLocation("example.com")
+
+	err = (&Router{URL: "localhost:9094", Origin: toLog}).Register(toLog, "hunter", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the Registration to be Replicated
+	time.Sleep(1 * time.Second)
+
+	addr, err := (&Router{URL: "localhost:9095", Origin: toLog}).LookupAlias("hunter", routing.LookupTypeDEFAULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != toLog.Address.String() {
+		t.Error("Expected the second tracker to answer for the registration.")
+	}
+	if second.Metrics.Value("tracker_replication_received_total", "accepted") != 1 {
+		t.Error("Expected the replicated registration to be counted.")
+	}
+
+	// The registration is not sent back to the tracker that it came from.
+	if pending := first.Replication.Pending()["localhost:9095"]; pending != 0 {
+		t.Errorf("Expected nothing left to replicate, got %d.", pending)
+	}
+
+	// An older registration does not replace a newer one.
+	_, older := createTestRecord(t, "older", time.Now().Add(time.Minute))
+	current := first.records().GetRecordByAddress(toLog.Address)
+	peer := &Router{URL: "localhost:9095", Origin: keys[0]}
+
+	stale := NewStoredRecord(toLog.Address, current, "hunter")
+	result, err := peer.Replicate([]*StoredRecord{stale, {Address: toLog.Address.String(), Record: older}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Stale != 1 || result.Invalid != 1 {
+		t.Errorf("Expected one stale and one invalid registration, got %+v.", result)
+	}
+
+	// Only peers may replicate.
+	stranger := &Router{URL: "localhost:9095", Origin: toLog}
+	_, err = stranger.Replicate([]*StoredRecord{stale})
+	if err == nil {
+		t.Error("Expected registrations from strangers to be refused.")
+	}
+}
+
+func TestReplicationAliasConflict(t *testing.T) {
+	keys := make([]*identity.Identity, 2)
+	for i := range keys {
+		key, err := identity.CreateIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+	}
+
+	ports := []string{"9116", "9117"}
+	trackers := make([]*Tracker, len(ports))
+	for i := range ports {
+		other := 1 - i
+		trackers[i] = &Tracker{
+			Key:      keys[i],
+			Delegate: newTestingTracker(),
+			Replication: &Replication{
+				Peers: []*Peer{{URL: "localhost:" + ports[other], Address: keys[other].Address.String()}},
+			},
+		}
+	}
+	for i, port := range ports {
+		go trackers[i].StartServer(port)
+		go trackers[i].StartReplication()
+	}
+
+	// Wait for Server to Startup
+	time.Sleep(1 * time.Second)
+
+	// Both addresses claim the alias, and the claim that expires last
+	// should win on both trackers whichever order they arrive in.
+	winner, winning := createTestRecord(t, "bob", time.Now().Add(2*DefaultRegistrationLifetime))
+	loser, losing := createTestRecord(t, "bob", time.Now().Add(time.Hour))
+	claims := []*StoredRecord{
+		NewStoredRecord(winner.Address, winning, "bob"),
+		NewStoredRecord(loser.Address, losing, "bob"),
+	}
+
+	for i, order := range [][]*StoredRecord{claims, {claims[1], claims[0]}} {
+		peer := &Router{URL: "localhost:" + ports[i], Origin: keys[1-i]}
+		for _, r := range order {
+			_, err := peer.Replicate([]*StoredRecord{r})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Wait for the Registrations to be Replicated
+	time.Sleep(1 * time.Second)
+
+	for i, tracker := range trackers {
+		if owner := tracker.records().(*testingTracker).AliasOwner("bob"); owner != winner.Address.String() {
+			t.Errorf("Expected tracker %d to give the alias to the newer claim, got %s.", i, owner)
+		}
+		if tracker.records().GetRecordByAddress(loser.Address) == nil {
+			t.Errorf("Expected tracker %d to keep the losing address's record.", i)
+		}
+	}
+
+	// Clients still take the alias from whoever held it last.
+	toLog, err := identity.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	toLog.SetLocation("example.com")
+
+	err = (&Router{URL: "localhost:" + ports[0], Origin: toLog}).Register(toLog, "bob", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := trackers[0].records().(*testingTracker).AliasOwner("bob"); owner != toLog.Address.String() {
+		t.Errorf("Expected the client to take the alias, got %s.", owner)
+	}
+}
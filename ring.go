@@ -0,0 +1,161 @@
+package tracker
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+const (
+	// DefaultVirtualNodes is how many points each tracker is given on a
+	// ring if no other number is given. More points spread the records
+	// more evenly.
+	DefaultVirtualNodes = 64
+
+	// DefaultReplicas is how many trackers hold each record in a
+	// partitioned group if no other number is given.
+	DefaultReplicas = 3
+)
+
+// Ring is a consistent hash ring that divides the records of a group of
+// trackers between them. Each tracker is placed at many points on the
+// ring, and a record is owned by the first trackers found after the point
+// of its address. When a tracker joins or leaves, only the records next to
+// its points change owner.
+//
+// Records are placed by address for address lookups, and separately by
+// alias for alias lookups, so a record with an alias is owned by the
+// owners of both.
+//
+// A Ring is never modified once it is created, so it may be shared freely.
+type Ring struct {
+	nodes  map[string]*Peer
+	points []ringPoint
+	vnodes int
+}
+
+type ringPoint struct {
+	hash uint64
+	node *Peer
+}
+
+// NewRing will create a ring of trackers, each placed at vnodes points.
+// Trackers are placed by Address, or by URL if they have no Address.
+func NewRing(vnodes int, nodes ...*Peer) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+
+	r := &Ring{
+		nodes:  make(map[string]*Peer),
+		vnodes: vnodes,
+	}
+	for _, p := range nodes {
+		r.nodes[ringName(p)] = p
+	}
+
+	for name, p := range r.nodes {
+		for i := 0; i < vnodes; i++ {
+			r.points = append(r.points, ringPoint{
+				hash: ringHash(name + "#" + strconv.Itoa(i)),
+				node: p,
+			})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return ringName(r.points[i].node) < ringName(r.points[j].node)
+	})
+
+	return r
+}
+
+func ringName(p *Peer) string {
+	if p.Address != "" {
+		return p.Address
+	}
+	return p.URL
+}
+
+func ringHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Join will return a new ring that also holds p.
+func (r *Ring) Join(p *Peer) *Ring {
+	return NewRing(r.vnodes, append(r.Nodes(), p)...)
+}
+
+// Leave will return a new ring without the tracker with the given Address
+// (or URL).
+func (r *Ring) Leave(name string) *Ring {
+	var nodes []*Peer
+	for _, p := range r.Nodes() {
+		if ringName(p) != name {
+			nodes = append(nodes, p)
+		}
+	}
+	return NewRing(r.vnodes, nodes...)
+}
+
+// Nodes will return every tracker on the ring.
+func (r *Ring) Nodes() []*Peer {
+	names := make([]string, 0, len(r.nodes))
+	for name := range r.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := make([]*Peer, len(names))
+	for i, name := range names {
+		out[i] = r.nodes[name]
+	}
+	return out
+}
+
+// Member will return the tracker with the given Address (or URL), or nil
+// if it is not on the ring.
+func (r *Ring) Member(name string) *Peer {
+	return r.nodes[name]
+}
+
+// AddressOwners will return the n trackers that hold the record of an
+// address, in the order that they should be asked for it.
+func (r *Ring) AddressOwners(address string, n int) []*Peer {
+	return r.owners("address:"+address, n)
+}
+
+// AliasOwners will return the n trackers that hold the record of an alias,
+// in the order that they should be asked for it.
+func (r *Ring) AliasOwners(alias string, n int) []*Peer {
+	return r.owners("alias:"+alias, n)
+}
+
+func (r *Ring) owners(key string, n int) []*Peer {
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	h := ringHash(key)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+
+	out := make([]*Peer, 0, n)
+	seen := make(map[*Peer]bool)
+	for i := 0; len(out) < n; i++ {
+		p := r.points[(start+i)%len(r.points)].node
+		if !seen[p] {
+			seen[p] = true
+			out = append(out, p)
+		}
+	}
+	return out
+}
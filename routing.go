@@ -1,9 +1,11 @@
 package tracker
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"net"
+	"time"
 
 	"airdispat.ch/crypto"
 	adErrors "airdispat.ch/errors"
@@ -40,34 +42,158 @@ type Router struct {
 	URL        string
 	Origin     *identity.Identity
 	Redirector RedirectHandler
+
+	// Address is optional. If it is set, it is the tracker's address, and
+	// the messages that the tracker signs itself, such as the information
+	// that a mirror sends with each answer and pointers to a primary or a
+	// successor, are refused unless they are signed by it.
+	Address string
+
+	// Key is optional. If it is set along with Address, it is the
+	// tracker's public encryption key, and the messages that the tracker
+	// signs itself are also refused unless they carry it.
+	Key []byte
+
+	// Metrics is optional. If it is set, the Router will record the
+	// outcome and latency of every request that it makes.
+	Metrics *Metrics
+
+	// CheckMirror is optional. If it is set, it is called with the signed
+	// MirrorInfo that a mirror tracker sends with each answer, and the
+	// answer is refused if it returns an error. MaxMirrorLag returns a
+	// common check. Answers from mirrors are accepted without it.
+	CheckMirror func(info *MirrorInfo) error
+
+	// Delegations is optional. It holds delegations created by
+	// CreateDelegation, by alias, which are sent with registrations for
+	// aliases in a namespace.
+	Delegations map[string]*message.SignedMessage
+
+	// MaxMigrationHops is the most decommissioned trackers that a request
+	// will pass through to reach a successor. If it is not set,
+	// DefaultMigrationHops is used.
+	MaxMigrationHops int
+
+	// OnMigrate is optional. If it is set, it is called with the Router's
+	// URL and the tracker that answered instead whenever a request has
+	// followed a migration, so that the configuration can be updated.
+	OnMigrate func(from string, to *Peer)
+}
+
+// observe records the outcome of a single client request.
+func (a *Router) observe(op string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	a.Metrics.inc("tracker_client_requests_total", op, result)
+	a.Metrics.observe("tracker_client_request_duration_seconds", time.Since(start).Seconds(), op)
 }
 
 // Lookup will perform a Router lookup on an address, and return a
 // new (*identity).Address.
-func (a *Router) Lookup(addrString string, name routing.LookupType) (*identity.Address, error) {
+func (a *Router) Lookup(addrString string, name routing.LookupType) (addr *identity.Address, err error) {
+	defer func(start time.Time) { a.observe("lookup", start, err) }(time.Now())
 	return a.lookup(addrString, "", name)
 }
 
 // LookupAlias will perform a Router lookup on a certain alias, and return a
 // new (*identity).Address.
-func (a *Router) LookupAlias(alias string, name routing.LookupType) (*identity.Address, error) {
+func (a *Router) LookupAlias(alias string, name routing.LookupType) (addr *identity.Address, err error) {
+	defer func(start time.Time) { a.observe("lookup_alias", start, err) }(time.Now())
 	return a.lookup("", alias, name)
 }
 
 func (a *Router) lookup(addrString string, alias string, name routing.LookupType) (*identity.Address, error) {
+	router := a
+	var moved *migration
+	for {
+		reg, next, err := router.query(addrString, alias)
+		if next == nil {
+			if err != nil {
+				return nil, err
+			}
+			a.migrated(moved)
+			return router.resolve(reg, alias, name)
+		}
+
+		moved, err = a.follow(moved, next)
+		if err != nil {
+			return nil, err
+		}
+		router = a.successor(moved)
+	}
+}
+
+// query will ask the tracker for a registration. If the tracker has been
+// decommissioned, the pointer to its successor is returned instead.
+func (a *Router) query(addrString string, alias string) (*RegistrationMessage, *migration, error) {
 	q := &QueryMessage{
 		From:    a.Origin,
 		Address: addrString,
 		Alias:   alias,
 	}
 
+	conn, err := a.send(q, identity.CreateAddressFromString(addrString))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	_, d, h, err := readResponse(conn, wire.RegistrationCode)
+	if err != nil {
+		if _, ok := err.(*adErrors.Error); ok {
+			if r := readRefusal(conn, a.signedByTracker); r != nil && r.successor != nil {
+				return nil, r.successor, err
+			}
+		}
+		return nil, nil, err
+	}
+
+	reg, err := registrationFromResponse(d, h)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if a.CheckMirror != nil {
+		info, err := readMirrorInfo(conn, d, a.signedByTracker)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if info != nil {
+			err = a.CheckMirror(info)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	return reg, nil, nil
+}
+
+// signedByTracker will return true if a message from the given address may
+// speak for the tracker, which is always the case unless the Router pins
+// the tracker's Address.
+func (a *Router) signedByTracker(from *identity.Address) bool {
+	if a.Address == "" {
+		return true
+	}
+	if from == nil || from.String() != a.Address {
+		return false
+	}
+	return len(a.Key) == 0 || (from.EncryptionKey != nil && bytes.Equal(crypto.RSAToBytes(from.EncryptionKey), a.Key))
+}
+
+// send will sign a message and deliver it to the tracker, returning the
+// open connection so that the response may be read.
+func (a *Router) send(q message.Message, to *identity.Address) (net.Conn, error) {
 	signed, err := message.SignMessage(q, a.Origin)
 	if err != nil {
 		return nil, err
 	}
 
-	addr := identity.CreateAddressFromString(addrString)
-	enc, err := signed.UnencryptedMessage(addr)
+	enc, err := signed.UnencryptedMessage(to)
 	if err != nil {
 		return nil, err
 	}
@@ -76,41 +202,78 @@ func (a *Router) lookup(addrString string, alias string, name routing.LookupType
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
 
 	err = enc.SendMessageToConnection(conn)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
+	return conn, nil
+}
+
+// readResponse will read a single verified message of the expected type from
+// a tracker connection. Error messages from the tracker are returned as
+// errors.
+func readResponse(conn net.Conn, expected string) (*message.SignedMessage, []byte, message.Header, error) {
+	sin, d, mType, h, err := readMessage(conn)
+	if err != nil {
+		return nil, nil, message.Header{}, err
+	}
+
+	if mType == w.ErrorCode {
+		// Something occured on the other side.
+		return nil, nil, h, adErrors.CreateErrorFromBytes(d, h)
+	} else if mType != expected {
+		return nil, nil, h, errors.New("Got the wrong response.")
+	}
+
+	return sin, d, h, nil
+}
+
+// readMessage will read a single verified message of any type from a
+// tracker connection.
+func readMessage(conn net.Conn) (*message.SignedMessage, []byte, string, message.Header, error) {
 	m, err := message.ReadMessageFromConnection(conn)
 	if err != nil {
-		return nil, err
+		return nil, nil, "", message.Header{}, err
 	}
 
 	sin, err := m.UnencryptedMessage()
 	if err != nil {
-		return nil, err
+		return nil, nil, "", message.Header{}, err
 	}
 
 	if !sin.Verify() {
-		return nil, errors.New("Unable to verify message.")
+		return nil, nil, "", message.Header{}, errors.New("Unable to verify message.")
 	}
 
 	d, mType, h, err := sin.ReconstructMessage()
 	if err != nil {
-		return nil, err
+		return nil, nil, "", message.Header{}, err
 	}
 
-	if mType == w.ErrorCode {
-		// Something occured on the other side.
-		return nil, adErrors.CreateErrorFromBytes(d, h)
-	} else if mType != wire.RegistrationCode {
-		return nil, errors.New("Got the wrong response.")
-	}
+	return sin, d, mType, h, nil
+}
 
+// registrationFromResponse will unpack a registration returned by a tracker
+// and make sure that it was signed by the address that it describes.
+func registrationFromResponse(d []byte, h message.Header) (*RegistrationMessage, error) {
 	reg := RegistrationMessageFromBytes(d)
+	if reg == nil {
+		return nil, errors.New("Unable to unpack registration.")
+	}
 
+	if reg.Address != h.From.String() {
+		return nil, errors.New("Registration is not signed by its address.")
+	}
+
+	return reg, nil
+}
+
+// resolve will turn a registration into an address, following any redirect
+// that the registration specifies for the lookup type.
+func (a *Router) resolve(reg *RegistrationMessage, alias string, name routing.LookupType) (*identity.Address, error) {
 	data, ok := reg.Redirect[string(name)]
 	if ok {
 		addr, err := a.Redirector.HandleRedirect(name, data)
@@ -149,16 +312,118 @@ func (a *Router) lookup(addrString string, alias string, name routing.LookupType
 	return i, nil
 }
 
-// Register will register an identity (and alias) with a tracker.
+// Watch will subscribe to changes to a set of addresses and aliases. The
+// current record for each of them is delivered first, followed by every
+// update that the tracker accepts. The returned channel is closed once the
+// tracker hangs up or stop is closed.
+func (a *Router) Watch(addresses []string, aliases []string, stop <-chan bool) (<-chan *identity.Address, error) {
+	q := &WatchMessage{
+		From:      a.Origin,
+		Addresses: addresses,
+		Aliases:   aliases,
+	}
+
+	conn, err := a.send(q, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	updates := make(chan *identity.Address)
+	done := make(chan bool)
+
+	go func() {
+		select {
+		case <-stop:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	go func() {
+		defer close(updates)
+		defer close(done)
+		defer conn.Close()
+
+		for {
+			_, d, h, err := readResponse(conn, wire.RegistrationCode)
+			if err != nil {
+				return
+			}
+
+			reg, err := registrationFromResponse(d, h)
+			if err != nil {
+				continue
+			}
+
+			addr, err := a.resolve(reg, reg.Alias, routing.LookupTypeDEFAULT)
+			if err != nil {
+				continue
+			}
+
+			select {
+			case updates <- addr:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return updates, nil
+}
+
+// Register will register an identity (and alias) with a tracker. If the
+// tracker is a mirror, the registration is sent on to its primary, and if
+// the tracker has been decommissioned it is sent to its successor.
 func (a *Router) Register(key *identity.Identity, alias string, redirects map[string]routing.Redirect) (err error) {
+	defer func(start time.Time) { a.observe("register", start, err) }(time.Now())
+
+	router := a
+	var moved *migration
+	for {
+		var r *refusal
+		r, err = router.register(key, alias, redirects)
+		if err == nil || r == nil {
+			break
+		}
+
+		if r.primary != "" {
+			// Only one redirect is followed, so that two mirrors can not
+			// send a registration back and forth.
+			_, err = (&Router{URL: r.primary, Origin: a.Origin, Delegations: a.Delegations}).register(key, alias, redirects)
+			break
+		}
+
+		moved, err = a.follow(moved, r.successor)
+		if err != nil {
+			return
+		}
+		router = a.successor(moved)
+	}
+
+	if err == nil {
+		a.migrated(moved)
+	}
+	return
+}
+
+// register will send a registration to the tracker. If the tracker refuses
+// it because it is a mirror or has been decommissioned, where to send it
+// instead is returned along with the error.
+func (a *Router) register(key *identity.Identity, alias string, redirects map[string]routing.Redirect) (refused *refusal, err error) {
 	byteKey := crypto.RSAToBytes(key.Address.EncryptionKey)
 
 	q := &RegistrationMessage{
-		Address:  key.Address.String(),
-		Location: key.Address.Location,
-		Alias:    alias,
-		Redirect: redirects,
-		Key:      byteKey,
+		Address:    key.Address.String(),
+		Location:   key.Address.Location,
+		Alias:      alias,
+		Redirect:   redirects,
+		Key:        byteKey,
+		Delegation: a.Delegations[alias],
+	}
+
+	// Trackers refuse registrations that outlast their delegation.
+	if expires := delegationExpiry(q.Delegation); !expires.IsZero() && expires.Before(time.Now().Add(DefaultRegistrationLifetime)) {
+		q.Expires = expires
 	}
 
 	signed, err := message.SignMessage(q, key)
@@ -183,5 +448,8 @@ func (a *Router) Register(key *identity.Identity, alias string, redirects map[st
 	}
 
 	err = adErrors.CheckConnectionForError(conn)
+	if err != nil {
+		refused = readRefusal(conn, a.signedByTracker)
+	}
 	return
 }
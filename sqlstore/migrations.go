@@ -0,0 +1,120 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrSchemaTooNew is returned when a database was written by a newer version
+// of this package.
+var ErrSchemaTooNew = errors.New("Database schema is newer than this tracker understands.")
+
+// migrations holds the statements that bring the schema from one version to
+// the next. The version of a migration is its index plus one. Migrations
+// that have been released must never be edited; add a new one instead.
+var migrations = [][]string{
+	// 1: Current records, the alias index and the change feed.
+	{
+		`CREATE TABLE records (
+			address TEXT PRIMARY KEY,
+			alias   TEXT,
+			expires INTEGER NOT NULL DEFAULT 0,
+			updated INTEGER NOT NULL,
+			record  BLOB NOT NULL
+		)`,
+		`CREATE INDEX records_alias ON records (alias)`,
+		`CREATE INDEX records_expires ON records (expires)`,
+		`CREATE TABLE aliases (
+			alias   TEXT PRIMARY KEY,
+			address TEXT NOT NULL
+		)`,
+		`CREATE TABLE changes (
+			sequence INTEGER PRIMARY KEY AUTOINCREMENT,
+			kind     TEXT NOT NULL,
+			address  TEXT NOT NULL,
+			alias    TEXT,
+			time     INTEGER NOT NULL,
+			record   BLOB
+		)`,
+	},
+
+	// 2: Every record that has been replaced or deleted.
+	{
+		`CREATE TABLE record_history (
+			id       INTEGER PRIMARY KEY AUTOINCREMENT,
+			address  TEXT NOT NULL,
+			alias    TEXT,
+			expires  INTEGER NOT NULL DEFAULT 0,
+			replaced INTEGER NOT NULL,
+			record   BLOB NOT NULL
+		)`,
+		`CREATE INDEX record_history_address ON record_history (address, id)`,
+		`CREATE INDEX record_history_alias ON record_history (alias, id)`,
+	},
+
+	// 3: When each replaced record was saved, for point in time lookups.
+	{
+		`ALTER TABLE record_history ADD COLUMN saved INTEGER NOT NULL DEFAULT 0`,
+	},
+}
+
+// SchemaVersion is the version of the schema that this package creates.
+var SchemaVersion = len(migrations)
+
+// version will return the newest migration applied to the database.
+func version(db *sql.DB) (int, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return 0, err
+	}
+
+	var v int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&v)
+	return v, err
+}
+
+// migrate will apply every migration that the database is missing, each in
+// its own transaction.
+func migrate(db *sql.DB) error {
+	current, err := version(db)
+	if err != nil {
+		return err
+	}
+
+	if current > len(migrations) {
+		return ErrSchemaTooNew
+	}
+
+	for v := current + 1; v <= len(migrations); v++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		for _, stmt := range migrations[v-1] {
+			_, err = tx.Exec(stmt)
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("Unable to apply migration %d: %v", v, err)
+			}
+		}
+
+		_, err = tx.Exec("INSERT INTO schema_migrations (version, applied) VALUES (?, ?)", v, time.Now().Unix())
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Unable to apply migration %d: %v", v, err)
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("Unable to apply migration %d: %v", v, err)
+		}
+	}
+
+	return nil
+}
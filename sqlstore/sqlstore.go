@@ -0,0 +1,558 @@
+// Package sqlstore implements a tracker.RecordStore on top of SQLite, so that
+// operators can inspect and query registrations with SQL.
+//
+// It uses a pure Go SQLite driver, so it builds without cgo. The schema is
+// created and upgraded by a list of numbered migrations, and every record
+// that is replaced is kept in the record_history table.
+package sqlstore
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"airdispat.ch/identity"
+	"airdispat.ch/message"
+	"airdispat.ch/tracker"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// DefaultHistoryLimit is the number of replaced records kept for each
+	// address if no other limit is given.
+	DefaultHistoryLimit = 16
+
+	// DefaultFeedRetention is the number of changes kept in the change
+	// feed if no other retention is given.
+	DefaultFeedRetention = 100000
+)
+
+// Options configures how the database is opened.
+type Options struct {
+	// HistoryLimit is the number of replaced records kept per address.
+	HistoryLimit int
+
+	// FeedRetention is the number of changes kept in the change feed.
+	FeedRetention int
+}
+
+// Store is a tracker.RecordStore backed by a SQLite database.
+type Store struct {
+	// ErrorHandler is called when the database fails. If it is not set,
+	// errors are logged.
+	ErrorHandler func(err *tracker.TrackerError)
+
+	db           *sql.DB
+	historyLimit int
+	retention    int
+}
+
+// Open will open (or create) a database at path and bring its schema up to
+// date.
+func Open(path string, opts *Options) (*Store, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite only allows a single writer, so serialize everything through
+	// one connection rather than fighting over the lock.
+	db.SetMaxOpenConns(1)
+
+	for _, pragma := range []string{
+		"PRAGMA journal_mode = WAL",
+		"PRAGMA synchronous = FULL",
+		"PRAGMA foreign_keys = ON",
+	} {
+		_, err = db.Exec(pragma)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	err = migrate(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &Store{
+		db:           db,
+		historyLimit: opts.HistoryLimit,
+		retention:    opts.FeedRetention,
+	}
+	if s.historyLimit == 0 {
+		s.historyLimit = DefaultHistoryLimit
+	}
+	if s.retention == 0 {
+		s.retention = DefaultFeedRetention
+	}
+	return s, nil
+}
+
+// Close will close the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func (s *Store) handleError(location string, err error) {
+	if s.ErrorHandler != nil {
+		s.ErrorHandler(&tracker.TrackerError{
+			Location: location,
+			Error:    err,
+		})
+		return
+	}
+	log.Println("SQL Store Error At:", location, "-", err)
+}
+
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func fromUnix(v int64) time.Time {
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(v, 0)
+}
+
+// scanner is satisfied by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanRecord reads the address, alias, expires and record columns.
+func scanRecord(row scanner) (*tracker.StoredRecord, error) {
+	var (
+		address string
+		alias   sql.NullString
+		expires int64
+		data    []byte
+	)
+
+	err := row.Scan(&address, &alias, &expires, &data)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := tracker.UnmarshalRecord(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tracker.StoredRecord{
+		Address: address,
+		Alias:   alias.String,
+		Expires: fromUnix(expires),
+		Record:  record,
+	}, nil
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// appendChange will add to the change feed and trim it to the retention.
+func (s *Store) appendChange(tx *sql.Tx, kind tracker.ChangeKind, address string, alias string, record []byte) error {
+	res, err := tx.Exec(
+		"INSERT INTO changes (kind, address, alias, time, record) VALUES (?, ?, ?, ?, ?)",
+		string(kind), address, nullString(alias), time.Now().Unix(), record,
+	)
+	if err != nil {
+		return err
+	}
+
+	seq, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM changes WHERE sequence <= ?", seq-int64(s.retention))
+	return err
+}
+
+// remove will delete a record, moving it into the history table and
+// releasing its alias. It returns the removed record, or nil.
+func (s *Store) remove(tx *sql.Tx, address string) (*tracker.StoredRecord, error) {
+	old, err := scanRecord(tx.QueryRow(
+		"SELECT address, alias, expires, record FROM records WHERE address = ?", address,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`INSERT INTO record_history (address, alias, expires, saved, replaced, record)
+		SELECT address, alias, expires, updated, ?, record FROM records WHERE address = ?`,
+		time.Now().Unix(), address,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`DELETE FROM record_history WHERE address = ? AND id NOT IN (
+		SELECT id FROM record_history WHERE address = ? ORDER BY id DESC LIMIT ?
+	)`, address, address, s.historyLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("DELETE FROM records WHERE address = ?", address)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("DELETE FROM aliases WHERE alias = ? AND address = ?", old.Alias, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return old, nil
+}
+
+func (s *Store) update(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) put(tx *sql.Tx, r *tracker.StoredRecord) error {
+	data, err := tracker.MarshalRecord(r.Record)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.remove(tx, r.Address)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO records (address, alias, expires, updated, record) VALUES (?, ?, ?, ?, ?)",
+		r.Address, nullString(r.Alias), unixTime(r.Expires), time.Now().Unix(), data,
+	)
+	if err != nil {
+		return err
+	}
+
+	if r.Alias != "" {
+		_, err = tx.Exec("INSERT OR REPLACE INTO aliases (alias, address) VALUES (?, ?)", r.Alias, r.Address)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.appendChange(tx, tracker.ChangeUpdate, r.Address, r.Alias, data)
+}
+
+// SaveRecord will store a record, replacing any earlier record for the same
+// address. Claiming an alias takes it away from its previous owner.
+func (s *Store) SaveRecord(address *identity.Address, record *message.SignedMessage, alias string) {
+	r := tracker.NewStoredRecord(address, record, alias)
+
+	err := s.update(func(tx *sql.Tx) error {
+		return s.put(tx, r)
+	})
+	if err != nil {
+		s.handleError("Save Record", err)
+	}
+}
+
+// current returns a record from a query if it exists and has not expired.
+func (s *Store) current(location string, row *sql.Row) *tracker.StoredRecord {
+	r, err := scanRecord(row)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		s.handleError(location, err)
+		return nil
+	}
+
+	if r.Expired(time.Now()) {
+		return nil
+	}
+	return r
+}
+
+// GetRecordByAddress will return the current record for an address.
+func (s *Store) GetRecordByAddress(address *identity.Address) *message.SignedMessage {
+	r := s.current("Get Record By Address", s.db.QueryRow(
+		"SELECT address, alias, expires, record FROM records WHERE address = ?", address.String(),
+	))
+	if r == nil {
+		return nil
+	}
+	return r.Record
+}
+
+// byAlias joins the alias index to the record of its owner.
+const byAlias = `SELECT r.address, r.alias, r.expires, r.record FROM aliases a
+	JOIN records r ON r.address = a.address AND r.alias = a.alias
+	WHERE a.alias = ?`
+
+// GetRecordByAlias will return the current record of the owner of an alias.
+func (s *Store) GetRecordByAlias(alias string) *message.SignedMessage {
+	r := s.current("Get Record By Alias", s.db.QueryRow(byAlias, alias))
+	if r == nil {
+		return nil
+	}
+	return r.Record
+}
+
+// AliasOwner will return the address that currently owns an alias, or the
+// empty string if it is free.
+func (s *Store) AliasOwner(alias string) string {
+	r := s.current("Alias Owner", s.db.QueryRow(byAlias, alias))
+	if r == nil {
+		return ""
+	}
+	return r.Address
+}
+
+// DeleteRecord implements tracker.RecordDeleter. The deleted record is kept
+// in the history table.
+func (s *Store) DeleteRecord(address *identity.Address) {
+	s.delete(address, tracker.ChangeDelete)
+}
+
+// ExpireRecord implements tracker.RecordExpirer. Like a deleted record, the
+// lapsed record is kept in the history table.
+func (s *Store) ExpireRecord(address *identity.Address) {
+	s.delete(address, tracker.ChangeExpire)
+}
+
+func (s *Store) delete(address *identity.Address, kind tracker.ChangeKind) {
+	err := s.update(func(tx *sql.Tx) error {
+		old, err := s.remove(tx, address.String())
+		if err != nil || old == nil {
+			return err
+		}
+		return s.appendChange(tx, kind, old.Address, old.Alias, nil)
+	})
+	if err != nil {
+		s.handleError("Delete Record", err)
+	}
+}
+
+func (s *Store) forEach(fn func(record *tracker.StoredRecord) error, query string, args ...interface{}) error {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+
+	// Read everything before calling fn, as the single connection is held
+	// until the rows are closed.
+	var records []*tracker.StoredRecord
+	for rows.Next() {
+		r, err := scanRecord(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		records = append(records, r)
+	}
+	rows.Close()
+
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		err = fn(r)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForEachRecord implements tracker.RecordIterator.
+func (s *Store) ForEachRecord(fn func(record *tracker.StoredRecord) error) error {
+	return s.forEach(fn, "SELECT address, alias, expires, record FROM records ORDER BY address")
+}
+
+// ForEachExpired will call fn for every record that expires before the
+// given time, soonest first, using the expiry index.
+func (s *Store) ForEachExpired(before time.Time, fn func(record *tracker.StoredRecord) error) error {
+	return s.forEach(fn,
+		"SELECT address, alias, expires, record FROM records WHERE expires > 0 AND expires < ? ORDER BY expires",
+		before.Unix(),
+	)
+}
+
+// History will return the records that an address has replaced, newest
+// first.
+func (s *Store) History(address string) ([]*tracker.StoredRecord, error) {
+	var out []*tracker.StoredRecord
+	err := s.forEach(func(r *tracker.StoredRecord) error {
+		out = append(out, r)
+		return nil
+	}, "SELECT address, alias, expires, record FROM record_history WHERE address = ? ORDER BY id DESC", address)
+	return out, err
+}
+
+// historyQuery lists the current record alongside the replaced ones, so
+// that both can be searched together.
+const historyQuery = `SELECT address, alias, expires, record, saved, replaced FROM (
+		SELECT address, alias, expires, record, updated AS saved, 0 AS replaced FROM records WHERE %[1]s = ?
+		UNION ALL
+		SELECT address, alias, expires, record, saved, replaced FROM record_history WHERE %[1]s = ?
+	) ORDER BY saved DESC, replaced = 0 DESC, replaced DESC LIMIT ?`
+
+func (s *Store) historical(column string, key string) ([]*tracker.HistoricalRecord, error) {
+	rows, err := s.db.Query(fmt.Sprintf(historyQuery, column), key, key, s.historyLimit+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*tracker.HistoricalRecord
+	for rows.Next() {
+		var (
+			address  string
+			alias    sql.NullString
+			expires  int64
+			data     []byte
+			saved    int64
+			replaced int64
+		)
+
+		err = rows.Scan(&address, &alias, &expires, &data, &saved, &replaced)
+		if err != nil {
+			return nil, err
+		}
+
+		record, err := tracker.UnmarshalRecord(data)
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, &tracker.HistoricalRecord{
+			StoredRecord: tracker.StoredRecord{
+				Address: address,
+				Alias:   alias.String,
+				Expires: fromUnix(expires),
+				Record:  record,
+			},
+			Saved:    fromUnix(saved),
+			Replaced: fromUnix(replaced),
+		})
+	}
+
+	return out, rows.Err()
+}
+
+// AddressHistory implements tracker.RecordHistory.
+func (s *Store) AddressHistory(address string) ([]*tracker.HistoricalRecord, error) {
+	return s.historical("address", address)
+}
+
+// AliasHistory implements tracker.RecordHistory.
+func (s *Store) AliasHistory(alias string) ([]*tracker.HistoricalRecord, error) {
+	return s.historical("alias", alias)
+}
+
+// CountRecords implements tracker.RecordCounter.
+func (s *Store) CountRecords() (addresses int, aliases int) {
+	err := s.db.QueryRow("SELECT (SELECT COUNT(*) FROM records), (SELECT COUNT(*) FROM aliases)").Scan(&addresses, &aliases)
+	if err != nil {
+		s.handleError("Count Records", err)
+	}
+	return
+}
+
+// CheckHealth implements tracker.HealthChecker.
+func (s *Store) CheckHealth() error {
+	return s.db.Ping()
+}
+
+// ChangesSince implements tracker.ChangeFeed.
+func (s *Store) ChangesSince(cursor uint64, limit int) ([]*tracker.Change, error) {
+	if cursor > s.LastSequence() {
+		return nil, tracker.ErrFeedTruncated
+	}
+
+	var first sql.NullInt64
+	err := s.db.QueryRow("SELECT MIN(sequence) FROM changes").Scan(&first)
+	if err != nil {
+		return nil, err
+	}
+	if first.Valid && int64(cursor)+1 < first.Int64 {
+		return nil, tracker.ErrFeedTruncated
+	}
+
+	if limit <= 0 {
+		limit = -1
+	}
+
+	rows, err := s.db.Query(
+		"SELECT sequence, kind, address, alias, time, record FROM changes WHERE sequence > ? ORDER BY sequence LIMIT ?",
+		int64(cursor), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []*tracker.Change
+	for rows.Next() {
+		var (
+			c     = &tracker.Change{}
+			kind  string
+			alias sql.NullString
+			when  int64
+			data  []byte
+		)
+
+		err = rows.Scan(&c.Sequence, &kind, &c.Address, &alias, &when, &data)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Kind = tracker.ChangeKind(kind)
+		c.Alias = alias.String
+		c.Time = time.Unix(when, 0)
+
+		if data != nil {
+			c.Record, err = tracker.UnmarshalRecord(data)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		changes = append(changes, c)
+	}
+
+	return changes, rows.Err()
+}
+
+// LastSequence implements tracker.ChangeFeed.
+func (s *Store) LastSequence() uint64 {
+	var seq int64
+	err := s.db.QueryRow("SELECT COALESCE((SELECT seq FROM sqlite_sequence WHERE name = 'changes'), 0)").Scan(&seq)
+	if err != nil {
+		s.handleError("Last Sequence", err)
+	}
+	return uint64(seq)
+}
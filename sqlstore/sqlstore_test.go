@@ -0,0 +1,90 @@
+package sqlstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"airdispat.ch/tracker"
+	"airdispat.ch/tracker/storetest"
+)
+
+func openTestStore(t *testing.T) (*Store, string, func()) {
+	dir, err := ioutil.TempDir("", "sqlstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "records.sqlite")
+
+	store, err := Open(path, &Options{HistoryLimit: 2})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return store, path, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSQLStoreMigrations(t *testing.T) {
+	store, path, done := openTestStore(t)
+	defer done()
+
+	v, err := version(store.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != SchemaVersion {
+		t.Errorf("Expected schema version %d, got %d.", SchemaVersion, v)
+	}
+
+	// Reopening an up to date database must not apply anything twice.
+	store.Close()
+	store, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.db.Exec("INSERT INTO schema_migrations (version, applied) VALUES (?, 0)", SchemaVersion+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	_, err = Open(path, nil)
+	if err != ErrSchemaTooNew {
+		t.Errorf("Expected a newer schema to be refused, got %v.", err)
+	}
+}
+
+func TestSQLStoreHistory(t *testing.T) {
+	store, _, done := openTestStore(t)
+	defer done()
+	future := time.Now().Add(time.Hour)
+
+	id, _ := storetest.CreateRecord(t, "", future)
+	for _, alias := range []string{"first", "second", "third", "fourth"} {
+		store.SaveRecord(id.Address, storetest.SignRecord(t, id, alias, future), alias)
+	}
+
+	history, err := store.History(id.Address.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The limit is two, and the newest replacement comes first.
+	if len(history) != 2 || history[0].Alias != "third" || history[1].Alias != "second" {
+		t.Error("Expected the two most recent replaced records.")
+	}
+}
+
+func TestSQLStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (tracker.RecordStore, func()) {
+		store, _, done := openTestStore(t)
+		return store, done
+	})
+}
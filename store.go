@@ -0,0 +1,93 @@
+package tracker
+
+import (
+	"time"
+
+	"airdispat.ch/identity"
+	"airdispat.ch/message"
+)
+
+// RecordStore is the storage half of a TrackerDelegate. Implementations
+// must be safe for concurrent use, as every client is served in its own
+// goroutine.
+type RecordStore interface {
+	SaveRecord(address *identity.Address, record *message.SignedMessage, alias string)
+
+	GetRecordByAddress(address *identity.Address) *message.SignedMessage
+	GetRecordByAlias(alias string) *message.SignedMessage
+}
+
+// RecordCommitter may be implemented by a RecordStore whose saves can fail,
+// such as one that must first agree with other trackers. The tracker saves
+// registrations with CommitRecord instead of SaveRecord, and refuses any
+// registration that was not saved.
+type RecordCommitter interface {
+	CommitRecord(address *identity.Address, record *message.SignedMessage, alias string) error
+}
+
+// RecordDeleter may be implemented by a RecordStore that supports removing
+// records. Deleting a record also releases its alias.
+type RecordDeleter interface {
+	DeleteRecord(address *identity.Address)
+}
+
+// RecordExpirer may be implemented by a RecordDeleter whose change feed
+// tells lapsed records apart from deleted ones. The sweeper removes records
+// with ExpireRecord, which leaves an expiry tombstone in the feed instead
+// of a deletion.
+type RecordExpirer interface {
+	ExpireRecord(address *identity.Address)
+}
+
+// RecordIterator may be implemented by a RecordStore that is able to list
+// every record it holds, including expired records. Iteration stops at the
+// first error returned by fn, which is then returned.
+type RecordIterator interface {
+	ForEachRecord(fn func(record *StoredRecord) error) error
+}
+
+// ExpiryIterator may be implemented by a RecordStore that indexes records
+// by expiry, so that lapsed records can be found without listing every
+// record. fn is called for each record that expires before the given time.
+type ExpiryIterator interface {
+	ForEachExpired(before time.Time, fn func(record *StoredRecord) error) error
+}
+
+// StoredRecord is a registration along with the fields that stores index it
+// by.
+type StoredRecord struct {
+	Address string
+	Alias   string
+	Expires time.Time
+	Record  *message.SignedMessage
+}
+
+// NewStoredRecord will create a StoredRecord for a registration, reading
+// its expiry from the signed record.
+func NewStoredRecord(address *identity.Address, record *message.SignedMessage, alias string) *StoredRecord {
+	r := &StoredRecord{
+		Address: address.String(),
+		Alias:   alias,
+		Record:  record,
+	}
+
+	if reg := registrationFromRecord(record); reg != nil {
+		r.Expires = reg.Expires
+	}
+
+	return r
+}
+
+// Expired will return true if the record has lapsed at the given time.
+// Records without an expiry never lapse.
+func (r *StoredRecord) Expired(now time.Time) bool {
+	return !r.Expires.IsZero() && !now.Before(r.Expires)
+}
+
+// records will return where the tracker keeps its records.
+func (t *Tracker) records() RecordStore {
+	if t.Store != nil {
+		return t.Store
+	}
+	return t.Delegate
+}
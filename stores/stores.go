@@ -0,0 +1,159 @@
+// Package stores opens any of the tracker's record stores from a short
+// specification, such as one given on the command line.
+//
+// A specification is the kind of store, optionally followed by a colon and
+// a path, and then by options in URL query form:
+//
+//	memory
+//	bolt:/var/lib/tracker/records.db
+//	bolt:/var/lib/tracker/records.db?nosync=true
+//	sqlite:/var/lib/tracker/records.sqlite?history=32
+//	wal:/var/lib/tracker/records?repair=true
+package stores
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"airdispat.ch/tracker"
+	"airdispat.ch/tracker/boltstore"
+	"airdispat.ch/tracker/sqlstore"
+	"airdispat.ch/tracker/walstore"
+)
+
+// Usage describes the specifications understood by Open, for use in flag
+// help text.
+const Usage = "memory, bolt:<path>[?nosync=true&history=<n>], sqlite:<path>[?history=<n>], or wal:<dir>[?nosync=true&repair=true]"
+
+// Spec is a parsed store specification.
+type Spec struct {
+	Kind    string
+	Path    string
+	Options url.Values
+}
+
+// Parse will split a store specification into its parts.
+func Parse(spec string) (*Spec, error) {
+	s := &Spec{}
+
+	query := ""
+	if i := strings.Index(spec, "?"); i >= 0 {
+		spec, query = spec[:i], spec[i+1:]
+	}
+
+	s.Kind = spec
+	if i := strings.Index(spec, ":"); i >= 0 {
+		s.Kind, s.Path = spec[:i], spec[i+1:]
+	}
+
+	if s.Kind == "" {
+		return nil, errors.New("Store specification is missing a kind.")
+	}
+
+	options, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	s.Options = options
+
+	return s, nil
+}
+
+// Bool will read a boolean option, returning false if it is not set.
+func (s *Spec) Bool(name string) (bool, error) {
+	v := s.Options.Get(name)
+	if v == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(v)
+}
+
+// Int will read an integer option, returning zero if it is not set.
+func (s *Spec) Int(name string) (int, error) {
+	v := s.Options.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(v)
+}
+
+// Open will open the store described by spec.
+func Open(spec string) (tracker.RecordStore, error) {
+	s, err := Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	switch s.Kind {
+	case "memory":
+		return tracker.NewMemoryStore(), nil
+
+	case "bolt":
+		if s.Path == "" {
+			return nil, errors.New("The bolt store requires a path.")
+		}
+
+		noSync, err := s.Bool("nosync")
+		if err != nil {
+			return nil, err
+		}
+
+		history, err := s.Int("history")
+		if err != nil {
+			return nil, err
+		}
+
+		return boltstore.Open(s.Path, &boltstore.Options{
+			NoSync:       noSync,
+			HistoryLimit: history,
+		})
+
+	case "sqlite":
+		if s.Path == "" {
+			return nil, errors.New("The sqlite store requires a path.")
+		}
+
+		history, err := s.Int("history")
+		if err != nil {
+			return nil, err
+		}
+
+		return sqlstore.Open(s.Path, &sqlstore.Options{
+			HistoryLimit: history,
+		})
+
+	case "wal":
+		if s.Path == "" {
+			return nil, errors.New("The wal store requires a directory.")
+		}
+
+		noSync, err := s.Bool("nosync")
+		if err != nil {
+			return nil, err
+		}
+
+		repair, err := s.Bool("repair")
+		if err != nil {
+			return nil, err
+		}
+
+		return walstore.Open(s.Path, &walstore.Options{
+			NoSync: noSync,
+			Repair: repair,
+		})
+	}
+
+	return nil, fmt.Errorf("Unknown store kind %q.", s.Kind)
+}
+
+// Close will release the resources held by a store, if it holds any.
+func Close(store tracker.RecordStore) error {
+	if c, ok := store.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,510 @@
+// Package storetest is a conformance suite for tracker.RecordStore
+// implementations, including TrackerDelegates that keep their own records.
+//
+// A store's tests call Run with a function that opens a new, empty store:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) (tracker.RecordStore, func()) {
+//			return tracker.NewMemoryStore(), func() {}
+//		})
+//	}
+//
+// The suite checks the behaviour that the tracker relies on. Optional
+// capabilities, such as tracker.RecordDeleter, tracker.RecordIterator,
+// tracker.ExpiryIterator, tracker.ChangeFeed and tracker.RecordHistory, are
+// only tested if the store implements them.
+package storetest
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"airdispat.ch/crypto"
+	"airdispat.ch/identity"
+	"airdispat.ch/message"
+	"airdispat.ch/tracker"
+)
+
+// Opener will create a new, empty store for a single test, along with a
+// function that releases it.
+type Opener func(t *testing.T) (store tracker.RecordStore, close func())
+
+// aliasOwner is implemented by stores that can report who holds an alias.
+type aliasOwner interface {
+	AliasOwner(alias string) string
+}
+
+// Run will run every conformance test against stores created by open.
+func Run(t *testing.T, open Opener) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, store tracker.RecordStore)
+	}{
+		{"Overwrite", testOverwrite},
+		{"AliasReassignment", testAliasReassignment},
+		{"AliasRelease", testAliasRelease},
+		{"Expiry", testExpiry},
+		{"ExpiryIndex", testExpiryIndex},
+		{"Deletion", testDeletion},
+		{"ChangeFeed", testChangeFeed},
+		{"Sweep", testSweep},
+		{"Iteration", testIteration},
+		{"ConcurrentWriters", testConcurrentWriters},
+		{"LargeRecords", testLargeRecords},
+		{"History", testHistory},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			store, close := open(t)
+			defer close()
+			test.fn(t, store)
+		})
+	}
+}
+
+// CreateRecord will create a new identity and a registration for it, signed
+// as a client would sign it.
+func CreateRecord(t testing.TB, alias string, expires time.Time) (*identity.Identity, *message.SignedMessage) {
+	return createRecord(t, alias, "example.com", expires)
+}
+
+func createRecord(t testing.TB, alias string, location string, expires time.Time) (*identity.Identity, *message.SignedMessage) {
+	id, err := identity.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id.SetLocation(location)
+
+	return id, SignRecord(t, id, alias, expires)
+}
+
+// SignRecord will create a new registration for an existing identity.
+func SignRecord(t testing.TB, id *identity.Identity, alias string, expires time.Time) *message.SignedMessage {
+	signed, err := message.SignMessage(&tracker.RegistrationMessage{
+		Address:  id.Address.String(),
+		Location: id.Address.Location,
+		Alias:    alias,
+		Key:      crypto.RSAToBytes(id.Address.EncryptionKey),
+		Expires:  expires,
+	}, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+// SameRecord will return true if two records are byte for byte identical.
+// Stores that serialize records return copies, so records can not be
+// compared as pointers.
+func SameRecord(a, b *message.SignedMessage) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	x, err := tracker.MarshalRecord(a)
+	if err != nil {
+		return false
+	}
+
+	y, err := tracker.MarshalRecord(b)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(x, y)
+}
+
+func describe(record *message.SignedMessage) string {
+	if record == nil {
+		return "no record"
+	}
+	return "a different record"
+}
+
+func expectAddress(t *testing.T, store tracker.RecordStore, id *identity.Identity, want *message.SignedMessage) {
+	t.Helper()
+	if got := store.GetRecordByAddress(id.Address); !SameRecord(got, want) {
+		t.Errorf("Looking up %s returned %s.", id.Address.String(), describe(got))
+	}
+}
+
+func expectAlias(t *testing.T, store tracker.RecordStore, alias string, want *message.SignedMessage) {
+	t.Helper()
+	if got := store.GetRecordByAlias(alias); !SameRecord(got, want) {
+		t.Errorf("Looking up alias %q returned %s.", alias, describe(got))
+	}
+}
+
+func expectOwner(t *testing.T, store tracker.RecordStore, alias string, want string) {
+	t.Helper()
+	o, ok := store.(aliasOwner)
+	if !ok {
+		return
+	}
+	if got := o.AliasOwner(alias); got != want {
+		t.Errorf("Expected alias %q to be owned by %q, got %q.", alias, want, got)
+	}
+}
+
+func future() time.Time {
+	return time.Now().Add(time.Hour)
+}
+
+// testOverwrite checks that a new registration replaces the old one.
+func testOverwrite(t *testing.T, store tracker.RecordStore) {
+	id, first := CreateRecord(t, "hunter", future())
+	store.SaveRecord(id.Address, first, "hunter")
+	expectAddress(t, store, id, first)
+
+	second := SignRecord(t, id, "hunter", future().Add(time.Hour))
+	store.SaveRecord(id.Address, second, "hunter")
+	expectAddress(t, store, id, second)
+	expectAlias(t, store, "hunter", second)
+
+	// Registering the same address again must not count twice.
+	if c, ok := store.(tracker.RecordCounter); ok {
+		if a, b := c.CountRecords(); a != 1 || b != 1 {
+			t.Errorf("Expected 1 address and 1 alias, got %d and %d.", a, b)
+		}
+	}
+}
+
+// testAliasReassignment checks that the last address to claim an alias
+// owns it, and that earlier owners keep their records.
+func testAliasReassignment(t *testing.T, store tracker.RecordStore) {
+	first, firstRecord := CreateRecord(t, "hunter", future())
+	store.SaveRecord(first.Address, firstRecord, "hunter")
+
+	second, secondRecord := CreateRecord(t, "hunter", future())
+	store.SaveRecord(second.Address, secondRecord, "hunter")
+
+	expectAlias(t, store, "hunter", secondRecord)
+	expectOwner(t, store, "hunter", second.Address.String())
+	expectAddress(t, store, first, firstRecord)
+
+	// Moving the first address to a new alias must not take the old one
+	// from its new owner.
+	renamed := SignRecord(t, first, "other", future())
+	store.SaveRecord(first.Address, renamed, "other")
+	expectAlias(t, store, "hunter", secondRecord)
+	expectAlias(t, store, "other", renamed)
+}
+
+// testAliasRelease checks that changing alias frees the old one.
+func testAliasRelease(t *testing.T, store tracker.RecordStore) {
+	id, record := CreateRecord(t, "before", future())
+	store.SaveRecord(id.Address, record, "before")
+
+	renamed := SignRecord(t, id, "after", future())
+	store.SaveRecord(id.Address, renamed, "after")
+
+	expectAlias(t, store, "before", nil)
+	expectAlias(t, store, "after", renamed)
+	expectOwner(t, store, "before", "")
+
+	// Registering without an alias frees it as well.
+	bare := SignRecord(t, id, "", future())
+	store.SaveRecord(id.Address, bare, "")
+	expectAlias(t, store, "after", nil)
+	expectAddress(t, store, id, bare)
+}
+
+// testExpiry checks that lapsed registrations are hidden, and that a fresh
+// registration brings them back.
+func testExpiry(t *testing.T, store tracker.RecordStore) {
+	id, record := CreateRecord(t, "hunter", time.Now().Add(-time.Minute))
+	store.SaveRecord(id.Address, record, "hunter")
+
+	expectAddress(t, store, id, nil)
+	expectAlias(t, store, "hunter", nil)
+	expectOwner(t, store, "hunter", "")
+
+	// An expired owner does not block someone else from the alias.
+	other, otherRecord := CreateRecord(t, "hunter", future())
+	store.SaveRecord(other.Address, otherRecord, "hunter")
+	expectAlias(t, store, "hunter", otherRecord)
+
+	renewed := SignRecord(t, id, "", future())
+	store.SaveRecord(id.Address, renewed, "")
+	expectAddress(t, store, id, renewed)
+}
+
+// testExpiryIndex checks that lapsed records are found by their expiry.
+func testExpiryIndex(t *testing.T, store tracker.RecordStore) {
+	e, ok := store.(tracker.ExpiryIterator)
+	if !ok {
+		t.Skip("Store does not implement tracker.ExpiryIterator.")
+	}
+
+	id, record := CreateRecord(t, "hunter", time.Now().Add(-time.Minute))
+	store.SaveRecord(id.Address, record, "hunter")
+	live, liveRecord := CreateRecord(t, "live", future())
+	store.SaveRecord(live.Address, liveRecord, "live")
+
+	var expired []string
+	err := e.ForEachExpired(time.Now(), func(r *tracker.StoredRecord) error {
+		expired = append(expired, r.Address)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0] != id.Address.String() {
+		t.Errorf("Expected only the lapsed record, got %v.", expired)
+	}
+}
+
+// testDeletion checks that deleted records and their aliases are gone.
+func testDeletion(t *testing.T, store tracker.RecordStore) {
+	d, ok := store.(tracker.RecordDeleter)
+	if !ok {
+		t.Skip("Store does not implement tracker.RecordDeleter.")
+	}
+
+	id, record := CreateRecord(t, "hunter", future())
+	store.SaveRecord(id.Address, record, "hunter")
+	other, otherRecord := CreateRecord(t, "other", future())
+	store.SaveRecord(other.Address, otherRecord, "other")
+
+	d.DeleteRecord(id.Address)
+	expectAddress(t, store, id, nil)
+	expectAlias(t, store, "hunter", nil)
+	expectOwner(t, store, "hunter", "")
+	expectAddress(t, store, other, otherRecord)
+
+	// Deleting something that is not there is not an error.
+	d.DeleteRecord(id.Address)
+
+	// A deleted address may register again.
+	store.SaveRecord(id.Address, record, "hunter")
+	expectAlias(t, store, "hunter", record)
+}
+
+// testChangeFeed checks that every change is numbered in order, and that
+// deletions and expiries leave tombstones.
+func testChangeFeed(t *testing.T, store tracker.RecordStore) {
+	f, ok := store.(tracker.ChangeFeed)
+	if !ok {
+		t.Skip("Store does not implement tracker.ChangeFeed.")
+	}
+
+	id, record := CreateRecord(t, "hunter", future())
+	store.SaveRecord(id.Address, record, "hunter")
+	other, otherRecord := CreateRecord(t, "other", future())
+	store.SaveRecord(other.Address, otherRecord, "other")
+
+	kinds := []tracker.ChangeKind{tracker.ChangeUpdate, tracker.ChangeUpdate}
+	if d, ok := store.(tracker.RecordDeleter); ok {
+		d.DeleteRecord(id.Address)
+		kinds = append(kinds, tracker.ChangeDelete)
+	}
+	if e, ok := store.(tracker.RecordExpirer); ok {
+		e.ExpireRecord(other.Address)
+		kinds = append(kinds, tracker.ChangeExpire)
+	}
+
+	changes, err := f.ChangesSince(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != len(kinds) {
+		t.Fatalf("Expected %d changes, got %d.", len(kinds), len(changes))
+	}
+	for i, c := range changes {
+		if c.Sequence != uint64(i+1) || c.Kind != kinds[i] {
+			t.Errorf("Expected change %d to be a %s, got %s at %d.", i+1, kinds[i], c.Kind, c.Sequence)
+		}
+		if (c.Kind == tracker.ChangeUpdate) != (c.Record != nil) {
+			t.Errorf("Expected only updates to carry a record, got a %s.", c.Kind)
+		}
+	}
+	if !SameRecord(changes[0].Record, record) || changes[0].Alias != "hunter" {
+		t.Error("Expected the first change to carry the first record.")
+	}
+	if f.LastSequence() != uint64(len(kinds)) {
+		t.Errorf("Expected the last sequence to be %d, got %d.", len(kinds), f.LastSequence())
+	}
+}
+
+// testSweep checks that sweeping a lapsed record only gives up its alias
+// if the record still owns it.
+func testSweep(t *testing.T, store tracker.RecordStore) {
+	if _, ok := store.(tracker.RecordDeleter); !ok {
+		t.Skip("Store does not implement tracker.RecordDeleter.")
+	}
+
+	lapsed := time.Now().Add(-2 * time.Hour)
+	owner, ownerRecord := CreateRecord(t, "lapsed", lapsed)
+	store.SaveRecord(owner.Address, ownerRecord, "lapsed")
+
+	// The alias is taken from a record that lapses afterwards.
+	displaced, displacedRecord := CreateRecord(t, "hunter", lapsed)
+	store.SaveRecord(displaced.Address, displacedRecord, "hunter")
+	holder, holderRecord := CreateRecord(t, "hunter", future())
+	store.SaveRecord(holder.Address, holderRecord, "hunter")
+
+	tr := &tracker.Tracker{
+		Store:   store,
+		Sweeper: &tracker.Sweeper{Grace: time.Hour, AliasHold: time.Hour},
+	}
+
+	result, err := tr.Sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Purged != 2 || result.Aliases != 1 {
+		t.Errorf("Expected 2 records and only the owned alias to be swept, got %+v.", result)
+	}
+
+	expectAddress(t, store, displaced, nil)
+	expectAlias(t, store, "hunter", holderRecord)
+	expectOwner(t, store, "hunter", holder.Address.String())
+}
+
+// testIteration checks that every record is listed, expired or not.
+func testIteration(t *testing.T, store tracker.RecordStore) {
+	it, ok := store.(tracker.RecordIterator)
+	if !ok {
+		t.Skip("Store does not implement tracker.RecordIterator.")
+	}
+
+	want := make(map[string]*message.SignedMessage)
+	for i := 0; i < 5; i++ {
+		expires := future()
+		if i%2 == 0 {
+			expires = time.Now().Add(-time.Minute)
+		}
+
+		alias := fmt.Sprintf("user%d", i)
+		id, record := CreateRecord(t, alias, expires)
+		store.SaveRecord(id.Address, record, alias)
+		want[id.Address.String()] = record
+	}
+
+	seen := make(map[string]bool)
+	err := it.ForEachRecord(func(r *tracker.StoredRecord) error {
+		if seen[r.Address] {
+			t.Errorf("Record %s was listed twice.", r.Address)
+		}
+		seen[r.Address] = true
+
+		if !SameRecord(r.Record, want[r.Address]) {
+			t.Errorf("Record %s does not match what was saved.", r.Address)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(seen) != len(want) {
+		t.Errorf("Expected %d records, got %d.", len(want), len(seen))
+	}
+
+	// Iteration stops at the first error.
+	stop := fmt.Errorf("stop")
+	calls := 0
+	err = it.ForEachRecord(func(r *tracker.StoredRecord) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Error("Expected iteration to stop at the first error.")
+	}
+}
+
+// testConcurrentWriters checks that racing registrations leave the store
+// consistent. It is most useful with the race detector enabled.
+func testConcurrentWriters(t *testing.T, store tracker.RecordStore) {
+	const writers = 8
+
+	ids := make([]*identity.Identity, writers)
+	records := make([]*message.SignedMessage, writers)
+	for i := range ids {
+		ids[i], records[i] = CreateRecord(t, "shared", future())
+	}
+
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				store.SaveRecord(ids[i].Address, records[i], "shared")
+				store.GetRecordByAddress(ids[i].Address)
+				store.GetRecordByAlias("shared")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	owner := store.GetRecordByAlias("shared")
+	found := false
+	for i := range ids {
+		expectAddress(t, store, ids[i], records[i])
+		if SameRecord(owner, records[i]) {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Expected the alias to belong to one of the writers.")
+	}
+
+	if c, ok := store.(tracker.RecordCounter); ok {
+		if a, b := c.CountRecords(); a != writers || b != 1 {
+			t.Errorf("Expected %d addresses and 1 alias, got %d and %d.", writers, a, b)
+		}
+	}
+}
+
+// testLargeRecords checks that records far larger than usual survive.
+func testLargeRecords(t *testing.T, store tracker.RecordStore) {
+	location := strings.Repeat("a", 256<<10) + ".example.com"
+	id, record := createRecord(t, "large", location, future())
+
+	store.SaveRecord(id.Address, record, "large")
+	expectAddress(t, store, id, record)
+	expectAlias(t, store, "large", record)
+}
+
+// testHistory checks that replaced records are remembered, newest first.
+func testHistory(t *testing.T, store tracker.RecordStore) {
+	h, ok := store.(tracker.RecordHistory)
+	if !ok {
+		t.Skip("Store does not implement tracker.RecordHistory.")
+	}
+
+	id, first := CreateRecord(t, "first", future())
+	store.SaveRecord(id.Address, first, "first")
+	second := SignRecord(t, id, "second", future())
+	store.SaveRecord(id.Address, second, "second")
+
+	history, err := h.AddressHistory(id.Address.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || !SameRecord(history[0].Record, second) || !SameRecord(history[1].Record, first) {
+		t.Fatalf("Expected both records, newest first, got %d records.", len(history))
+	}
+	if !history[0].Replaced.IsZero() || history[1].Replaced.IsZero() {
+		t.Error("Expected only the first record to be marked as replaced.")
+	}
+	if at := tracker.RecordAt(history, time.Now()); at == nil || !SameRecord(at.Record, second) {
+		t.Error("Expected the second record to be current now.")
+	}
+
+	history, err = h.AliasHistory("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || !SameRecord(history[0].Record, first) || history[0].Address != id.Address.String() {
+		t.Error("Expected the alias to remember its previous owner.")
+	}
+}
@@ -0,0 +1,247 @@
+package tracker
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"airdispat.ch/identity"
+)
+
+const (
+	// DefaultSweepInterval is how often the sweeper runs if no other
+	// interval is given.
+	DefaultSweepInterval = time.Hour
+
+	// DefaultSweepGrace is how long a lapsed registration is kept, so that
+	// its owner may still renew it, if no other grace period is given.
+	DefaultSweepGrace = 24 * time.Hour
+)
+
+// ErrNotSweepable is returned when the tracker's store is unable to list
+// or delete records.
+var ErrNotSweepable = errors.New("Store must implement RecordIterator and RecordDeleter to be swept.")
+
+// Sweeper removes registrations from the tracker's store once they have
+// lapsed. Reads already hide expired records, but without a sweeper they
+// are never removed from storage.
+type Sweeper struct {
+	// Interval is how often StartSweeper runs a sweep. If it is zero,
+	// DefaultSweepInterval is used.
+	Interval time.Duration
+
+	// Grace is how long after it expires a record is kept before it is
+	// swept. If it is zero, DefaultSweepGrace is used.
+	Grace time.Duration
+
+	// Archive is optional. If it is set, each record is passed to it
+	// before being deleted, and records that fail to archive are kept.
+	Archive func(record *StoredRecord) error
+
+	// AliasHold is how long the alias of a swept record stays reserved for
+	// its former owner. Other addresses may not claim the alias until the
+	// hold runs out. If it is zero, aliases are freed as soon as their
+	// records are swept.
+	AliasHold time.Duration
+
+	lock  sync.Mutex
+	holds map[string]aliasHold
+}
+
+type aliasHold struct {
+	address string
+	until   time.Time
+}
+
+// SweepResult reports what a single sweep did.
+type SweepResult struct {
+	// Purged is the number of records deleted, of which Archived were
+	// archived first.
+	Purged   int
+	Archived int
+
+	// Failed is the number of records kept because they could not be
+	// archived.
+	Failed int
+
+	// Aliases is the number of aliases given up by deleted records.
+	Aliases int
+}
+
+// hold will reserve an alias for the address that used to own it.
+func (s *Sweeper) hold(alias string, address string, now time.Time) {
+	if s.AliasHold <= 0 || alias == "" {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.holds == nil {
+		s.holds = make(map[string]aliasHold)
+	}
+	s.holds[alias] = aliasHold{address, now.Add(s.AliasHold)}
+}
+
+// mayClaim will return false if an alias is being held for an address other
+// than the one trying to claim it. A nil Sweeper holds nothing.
+func (s *Sweeper) mayClaim(alias string, address string, now time.Time) bool {
+	if s == nil || alias == "" {
+		return true
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	h, ok := s.holds[alias]
+	if !ok {
+		return true
+	}
+
+	if !now.Before(h.until) {
+		delete(s.holds, alias)
+		return true
+	}
+
+	return h.address == address
+}
+
+// expireHolds will forget every hold that has run out.
+func (s *Sweeper) expireHolds(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for alias, h := range s.holds {
+		if !now.Before(h.until) {
+			delete(s.holds, alias)
+		}
+	}
+}
+
+// Sweep will remove every record that expired more than the sweeper's
+// grace period ago. Stores that implement RecordExpirer leave an expiry
+// in their change feed for each record rather than a deletion.
+func (t *Tracker) Sweep() (*SweepResult, error) {
+	s := t.Sweeper
+	if s == nil {
+		s = &Sweeper{}
+	}
+
+	grace := s.Grace
+	if grace == 0 {
+		grace = DefaultSweepGrace
+	}
+
+	store := t.records()
+	deleter, ok := store.(RecordDeleter)
+	if !ok {
+		return nil, ErrNotSweepable
+	}
+
+	now := time.Now()
+	cutoff := now.Add(-grace)
+	s.expireHolds(now)
+
+	// Collect first, as stores may hold a lock while iterating.
+	var lapsed []*StoredRecord
+	collect := func(r *StoredRecord) error {
+		if r.Expired(cutoff) {
+			lapsed = append(lapsed, r)
+		}
+		return nil
+	}
+
+	var err error
+	if e, ok := store.(ExpiryIterator); ok {
+		err = e.ForEachExpired(cutoff, collect)
+	} else if it, ok := store.(RecordIterator); ok {
+		err = it.ForEachRecord(collect)
+	} else {
+		return nil, ErrNotSweepable
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &SweepResult{}
+	for _, r := range lapsed {
+		address := identity.CreateAddressFromString(r.Address)
+
+		// The owner may have renewed since the record was listed, so it
+		// is checked again while registrations are held back.
+		t.replicaLock.Lock()
+		if store.GetRecordByAddress(address) != nil {
+			t.replicaLock.Unlock()
+			continue
+		}
+
+		if s.Archive != nil {
+			err = s.Archive(r)
+			if err != nil {
+				t.replicaLock.Unlock()
+				result.Failed++
+				t.handleError("Sweep (Archiving Record)", err)
+				continue
+			}
+			result.Archived++
+		}
+
+		// Some stores leave the alias on a record that has since lost it to
+		// another address. Reads hide the lapsed record itself, so the alias
+		// is only its to give up if no other address holds it.
+		owned := false
+		if r.Alias != "" {
+			owner := registrationFromRecord(store.GetRecordByAlias(r.Alias))
+			owned = owner == nil || owner.Address == r.Address
+		}
+
+		if e, ok := store.(RecordExpirer); ok {
+			e.ExpireRecord(address)
+		} else {
+			deleter.DeleteRecord(address)
+		}
+		t.replicaLock.Unlock()
+		t.Cache.Invalidate(r.Address, r.Alias)
+		result.Purged++
+
+		if owned {
+			result.Aliases++
+			s.hold(r.Alias, r.Address, now)
+		}
+	}
+
+	t.Metrics.inc("tracker_sweeps_total")
+	t.Metrics.add("tracker_swept_records_total", float64(result.Purged), "purged")
+	t.Metrics.add("tracker_swept_records_total", float64(result.Archived), "archived")
+	t.Metrics.add("tracker_swept_records_total", float64(result.Failed), "failed")
+
+	return result, nil
+}
+
+// StartSweeper will sweep the tracker's store every Sweeper.Interval. It
+// blocks like StartServer, and Sweeper must be set before it is called.
+func (t *Tracker) StartSweeper() {
+	interval := t.Sweeper.Interval
+	if interval <= 0 {
+		interval = DefaultSweepInterval
+	}
+
+	t.Delegate.LogMessage("Sweeping Expired Records every " + interval.String())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		result, err := t.Sweep()
+		if err != nil {
+			t.handleError("Sweep", err)
+			continue
+		}
+
+		if result.Purged > 0 || result.Failed > 0 {
+			t.Delegate.LogMessage(fmt.Sprintf("Swept %d expired records (%d archived, %d failed, %d aliases given up).",
+				result.Purged, result.Archived, result.Failed, result.Aliases))
+		}
+	}
+}
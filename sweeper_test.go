@@ -0,0 +1,70 @@
+package tracker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSweep(t *testing.T) {
+	delegate := newTestingTracker()
+	var archived []*StoredRecord
+
+	tracker := &Tracker{
+		Delegate: delegate,
+		Metrics:  NewMetrics(),
+		Sweeper: &Sweeper{
+			Grace:     time.Hour,
+			AliasHold: time.Hour,
+			Archive: func(r *StoredRecord) error {
+				archived = append(archived, r)
+				return nil
+			},
+		},
+	}
+
+	lapsed, lapsedRecord := createTestRecord(t, "lapsed", time.Now().Add(-2*time.Hour))
+	recent, recentRecord := createTestRecord(t, "recent", time.Now().Add(-time.Minute))
+	live, liveRecord := createTestRecord(t, "live", time.Now().Add(time.Hour))
+	delegate.SaveRecord(lapsed.Address, lapsedRecord, "lapsed")
+	delegate.SaveRecord(recent.Address, recentRecord, "recent")
+	delegate.SaveRecord(live.Address, liveRecord, "live")
+
+	result, err := tracker.Sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the record past its grace period is removed.
+	if result.Purged != 1 || result.Archived != 1 || result.Aliases != 1 {
+		t.Errorf("Expected one record to be archived and purged, got %+v.", result)
+	}
+	if len(archived) != 1 || archived[0].Address != lapsed.Address.String() {
+		t.Error("Expected the lapsed record to be archived.")
+	}
+	if a, _ := delegate.CountRecords(); a != 2 {
+		t.Errorf("Expected 2 records to remain, got %d.", a)
+	}
+	if tracker.Metrics.Value("tracker_swept_records_total", "purged") != 1 {
+		t.Error("Expected the sweep to be counted.")
+	}
+
+	changes, err := delegate.ChangesSince(0, DefaultFeedLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := changes[len(changes)-1]; last.Kind != ChangeExpire || last.Address != lapsed.Address.String() {
+		t.Errorf("Expected the sweep to leave an expiry in the change feed, got %+v.", last)
+	}
+
+	// The alias is held for its previous owner.
+	now := time.Now()
+	if tracker.Sweeper.mayClaim("lapsed", live.Address.String(), now) {
+		t.Error("Expected the held alias to be refused to other addresses.")
+	}
+	if !tracker.Sweeper.mayClaim("lapsed", lapsed.Address.String(), now) {
+		t.Error("Expected the held alias to be available to its owner.")
+	}
+	if !tracker.Sweeper.mayClaim("lapsed", live.Address.String(), now.Add(2*time.Hour)) {
+		t.Error("Expected the hold to run out.")
+	}
+}
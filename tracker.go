@@ -3,11 +3,14 @@ package tracker
 import (
 	"errors"
 	"net"
+	"net/http"
+	"sync"
 	"time"
 
 	adErrors "airdispat.ch/errors"
 	"airdispat.ch/identity"
 	"airdispat.ch/message"
+	"airdispat.ch/tracker/audit"
 	"airdispat.ch/tracker/wire"
 	"code.google.com/p/goprotobuf/proto"
 )
@@ -26,10 +29,7 @@ type TrackerDelegate interface {
 	LogMessage(toLog ...string)
 	AllowConnection(fromAddr *identity.Address) bool
 
-	SaveRecord(address *identity.Address, record *message.SignedMessage, alias string)
-
-	GetRecordByAddress(address *identity.Address) *message.SignedMessage
-	GetRecordByAlias(alias string) *message.SignedMessage
+	RecordStore
 }
 
 // The tracker structure that holds variables to the delegate
@@ -37,6 +37,72 @@ type TrackerDelegate interface {
 type Tracker struct {
 	Key      *identity.Identity
 	Delegate TrackerDelegate
+
+	// Store is optional. If it is set, records are saved to and loaded
+	// from the Store instead of the Delegate.
+	Store RecordStore
+
+	// Metrics is optional. If it is set, the tracker will record counters
+	// and latencies for every connection that it serves.
+	Metrics *Metrics
+
+	// Audit is optional. If it is set, every registration that the tracker
+	// accepts or rejects is written to the audit log.
+	Audit *audit.Log
+
+	// Sweeper is optional. If it is set, it controls how StartSweeper
+	// removes lapsed registrations, and aliases that it holds for their
+	// former owners can not be claimed by anyone else.
+	Sweeper *Sweeper
+
+	// Cache is optional. If it is set, queries are answered from the
+	// cache when possible, and records are only loaded from the store
+	// when they are missing or stale.
+	Cache *RecordCache
+
+	// Replication is optional. If it is set, accepted registrations are
+	// shared with its peers, and peers may send registrations in turn.
+	Replication *Replication
+
+	// Mirror is optional. If it is set, the tracker is a read-only copy
+	// of another tracker, refusing registrations and following every
+	// answer with a description of how stale it may be.
+	Mirror *Mirror
+
+	// Partition is optional. If it is set, the tracker only holds the
+	// records that it owns on the partition's ring.
+	Partition *Partition
+
+	// Forwarding is optional. If it is set, queries for records that the
+	// tracker does not hold are passed on to its peers.
+	Forwarding *Forwarding
+
+	// Namespaces is optional. If it is set, aliases qualified with a
+	// domain may only be registered with a delegation from the domain's
+	// admin key.
+	Namespaces *Namespaces
+
+	// MaxLifetime is how far in the future a registration sent by a client
+	// may expire. Registrations that expire later, or never, are refused.
+	// If it is zero, DefaultRegistrationLifetime is used.
+	MaxLifetime time.Duration
+
+	// Migration is optional. If it is set, the tracker has been
+	// decommissioned, and sends clients to its successor.
+	Migration *Migration
+
+	// Connections subscribed to record changes.
+	watchers watchHub
+
+	// Held while a registration is compared and saved, so that two peers
+	// or clients can not both replace the same record or alias, and while
+	// the sweeper removes a record, so that a renewal is not swept.
+	replicaLock sync.Mutex
+
+	// Runtime state reported by the admin server.
+	stateLock sync.RWMutex
+	listener  net.Listener
+	started   time.Time
 }
 
 // The function that starts the Tracking Server on a Specific Port
@@ -53,18 +119,109 @@ func (t *Tracker) StartServer(port string) error {
 	}
 	t.Delegate.LogMessage("Tracker is Running...")
 
+	t.stateLock.Lock()
+	t.listener = listener
+	t.started = time.Now()
+	t.stateLock.Unlock()
+
+	defer func() {
+		t.stateLock.Lock()
+		t.listener = nil
+		t.stateLock.Unlock()
+	}()
+
 	t.trackerLoop(listener)
 	return nil
 }
 
+// StartMetricsServer will serve the tracker's Metrics in the Prometheus text
+// format at /metrics on the specified address. It blocks like StartServer,
+// and Metrics must be set before either server is started.
+func (t *Tracker) StartMetricsServer(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", t.Metrics)
+
+	t.Delegate.LogMessage("Serving Metrics on " + addr)
+	return http.ListenAndServe(addr, mux)
+}
+
 // Called when the Tracker runs into an error. It reports the error to the delegate.
 func (t *Tracker) handleError(location string, error error) {
+	t.Metrics.inc("tracker_errors_total")
 	t.Delegate.HandleError(&TrackerError{
 		Location: location,
 		Error:    error,
 	})
 }
 
+// reply will sign a response with the tracker's key and send it to the
+// requester.
+func (t *Tracker) reply(to *identity.Address, code string, body proto.Message, conn net.Conn) error {
+	signed, err := message.SignMessage(&wireMessage{
+		from: t.Key.Address,
+		code: code,
+		body: body,
+	}, t.Key)
+	if err != nil {
+		return err
+	}
+
+	enc, err := signed.UnencryptedMessage(to)
+	if err != nil {
+		return err
+	}
+
+	return enc.SendMessageToConnection(conn)
+}
+
+// withinLifetime will return true if a registration's expiry, in seconds
+// since the epoch, is set and no later than the tracker's MaxLifetime.
+func (t *Tracker) withinLifetime(expires uint64, now time.Time) bool {
+	max := t.MaxLifetime
+	if max == 0 {
+		max = DefaultRegistrationLifetime
+	}
+	return expires != 0 && !time.Unix(int64(expires), 0).After(now.Add(max))
+}
+
+// Called when the Tracker accepts or rejects a registration. If reason is
+// empty, the registration was accepted and replaced old, and took its alias
+// from owner if owner is another address.
+func (t *Tracker) auditRegistration(from *identity.Address, reg *wire.TrackerRegister, old *message.SignedMessage, owner *message.SignedMessage, reason string) {
+	if t.Audit == nil {
+		return
+	}
+
+	entry := &audit.Entry{
+		Outcome:     audit.Accepted,
+		Reason:      reason,
+		Sender:      from.String(),
+		Alias:       reg.GetUsername(),
+		NewLocation: reg.GetLocation(),
+		NewKey:      audit.KeyFingerprint(reg.GetEncryptionKey()),
+	}
+	if reason != "" {
+		entry.Outcome = audit.Rejected
+	}
+
+	if prev := registrationFromRecord(old); prev != nil {
+		entry.OldAlias = prev.Alias
+		entry.OldLocation = prev.Location
+		entry.OldKey = audit.KeyFingerprint(prev.Key)
+	}
+
+	if prev := registrationFromRecord(owner); prev != nil && prev.Address != entry.Sender {
+		entry.AliasOwner = prev.Address
+		entry.AliasOwnerLocation = prev.Location
+		entry.AliasOwnerKey = audit.KeyFingerprint(prev.Key)
+	}
+
+	err := t.Audit.Append(entry)
+	if err != nil {
+		t.handleError("Audit Registration", err)
+	}
+}
+
 // This is the loop used while the Tracker waits for clients to connect.
 func (t *Tracker) trackerLoop(listener *net.TCPListener) {
 	// Loop Forever while we wait for Clients
@@ -85,7 +242,15 @@ func (t *Tracker) trackerLoop(listener *net.TCPListener) {
 func (t *Tracker) handleClient(conn net.Conn) {
 	t.Delegate.LogMessage("Serving", conn.RemoteAddr().String())
 	tNow := time.Now()
-	defer t.Delegate.LogMessage("Finished with", conn.RemoteAddr().String(), "in", time.Since(tNow).String())
+	typ := "unknown"
+
+	t.Metrics.inc("tracker_connections_total")
+	t.Metrics.add("tracker_active_connections", 1)
+	defer func() {
+		t.Metrics.add("tracker_active_connections", -1)
+		t.Metrics.observe("tracker_handler_duration_seconds", time.Since(tNow).Seconds(), typ)
+		t.Delegate.LogMessage("Finished with", conn.RemoteAddr().String(), "in", time.Since(tNow).String())
+	}()
 
 	defer conn.Close()
 	// Read in the Message Sent from the Client
@@ -104,7 +269,8 @@ func (t *Tracker) handleClient(conn net.Conn) {
 	}
 
 	if !s.Verify() {
-		t.handleError("Unable to verify message.", nil)
+		t.Metrics.inc("tracker_verify_failures_total")
+		t.handleError("Unable to verify message.", errors.New("Invalid signature."))
 		adErrors.CreateError(adErrors.InvalidSignature, "Unable to verify message.", t.Key.Address).Send(t.Key, conn)
 		return
 	}
@@ -121,25 +287,99 @@ func (t *Tracker) handleClient(conn net.Conn) {
 
 	// Handle Registration
 	case wire.RegistrationCode:
+		if t.Migration != nil {
+			t.refuseMigrated(header.From, "register", conn)
+			return
+		}
+
+		if t.Mirror != nil {
+			t.refuseRegistration(header.From, conn)
+			return
+		}
+
 		// Unmarshal the Sent Data
 		assigned := &wire.TrackerRegister{}
 		err := proto.Unmarshal(mes, assigned)
 		if err != nil {
+			t.Metrics.inc("tracker_registrations_total", "rejected")
+			t.auditRegistration(header.From, nil, nil, nil, "Unable to unload message payload.")
 			t.handleError("Handle Client (Unloading Registration Payload)", err)
 			adErrors.CreateError(adErrors.UnexpectedError, "Unable to unload message payload.", t.Key.Address).Send(t.Key, conn)
 			return
 		}
 
 		if assigned.GetAddress() != header.From.String() {
+			t.Metrics.inc("tracker_registrations_total", "rejected")
+			t.Metrics.inc("tracker_verify_failures_total")
+			t.auditRegistration(header.From, assigned, nil, nil, "Signature doesn't match registration address.")
 			t.handleError("Unable to verify message integrity.", errors.New("Unable to verify message integrity."))
 			adErrors.CreateError(adErrors.InvalidSignature, "Signature doesn't match registration address.", t.Key.Address).Send(t.Key, conn)
 			return
 		}
 
-		t.Delegate.SaveRecord(header.From, s, assigned.GetUsername())
+		if !t.withinLifetime(assigned.GetExpires(), time.Now()) {
+			t.Metrics.inc("tracker_registrations_total", "rejected")
+			t.auditRegistration(header.From, assigned, nil, nil, "Registration expires too far in the future.")
+			adErrors.CreateError(adErrors.UnexpectedError, "Registration expires too far in the future.", t.Key.Address).Send(t.Key, conn)
+			return
+		}
+
+		if !t.Sweeper.mayClaim(assigned.GetUsername(), header.From.String(), time.Now()) {
+			t.Metrics.inc("tracker_registrations_total", "rejected")
+			t.auditRegistration(header.From, assigned, nil, nil, "Alias is being held for its previous owner.")
+			adErrors.CreateError(adErrors.UnexpectedError, "Alias is being held for its previous owner.", t.Key.Address).Send(t.Key, conn)
+			return
+		}
+
+		if t.Namespaces != nil {
+			err := t.Namespaces.VerifyRegistration(RegistrationMessageFromBytes(mes), time.Now())
+			if err != nil {
+				t.Metrics.inc("tracker_registrations_total", "rejected")
+				t.auditRegistration(header.From, assigned, nil, nil, err.Error())
+				adErrors.CreateError(adErrors.UnexpectedError, err.Error(), t.Key.Address).Send(t.Key, conn)
+				return
+			}
+		}
+
+		if !t.Partition.owns(t.Key.Address.String(), header.From.String(), assigned.GetUsername()) {
+			t.Metrics.inc("tracker_registrations_total", "rejected")
+			t.auditRegistration(header.From, assigned, nil, nil, "Tracker does not own that address or alias.")
+			adErrors.CreateError(adErrors.UnexpectedError, "Tracker does not own that address or alias.", t.Key.Address).Send(t.Key, conn)
+			return
+		}
+
+		t.replicaLock.Lock()
+
+		// The audit records who held the address and the alias before.
+		var old, owner *message.SignedMessage
+		if t.Audit != nil {
+			old = t.records().GetRecordByAddress(header.From)
+			if assigned.GetUsername() != "" {
+				owner = t.records().GetRecordByAlias(assigned.GetUsername())
+			}
+		}
+
+		err = t.saveRecord(header.From, s, assigned.GetUsername())
+		t.replicaLock.Unlock()
+		if err != nil {
+			t.Metrics.inc("tracker_registrations_total", "rejected")
+			t.auditRegistration(header.From, assigned, old, owner, "Unable to save registration.")
+			t.handleError("Handle Client (Saving Registration)", err)
+			adErrors.CreateError(adErrors.InternalError, "Unable to save registration.", t.Key.Address).Send(t.Key, conn)
+			return
+		}
+
+		t.Metrics.inc("tracker_registrations_total", "accepted")
+		t.auditRegistration(header.From, assigned, old, owner, "")
+		t.replicate(NewStoredRecord(header.From, s, assigned.GetUsername()), "")
 
 	// Handle Query
 	case wire.QueryCode:
+		if t.Migration != nil {
+			t.refuseMigrated(header.From, "query", conn)
+			return
+		}
+
 		// Unmarshall the Sent Data
 		assigned := &wire.TrackerQuery{}
 		err := proto.Unmarshal(mes, assigned)
@@ -151,47 +391,141 @@ func (t *Tracker) handleClient(conn net.Conn) {
 		}
 
 		t.handleQuery(header.From, assigned, conn)
+
+	// Handle Watch
+	case wire.WatchCode:
+		assigned := &wire.TrackerWatch{}
+		err := proto.Unmarshal(mes, assigned)
+
+		if err != nil {
+			t.handleError("Handle Client (Unloading Watch Payload)", err)
+			adErrors.CreateError(adErrors.UnexpectedError, "Unable to unload message payload.", t.Key.Address).Send(t.Key, conn)
+			return
+		}
+
+		t.handleWatch(header.From, assigned, conn)
+
+	// Handle Change Feed
+	case wire.FeedQueryCode:
+		assigned := &wire.TrackerFeedQuery{}
+		err := proto.Unmarshal(mes, assigned)
+
+		if err != nil {
+			t.handleError("Handle Client (Unloading Feed Payload)", err)
+			adErrors.CreateError(adErrors.UnexpectedError, "Unable to unload message payload.", t.Key.Address).Send(t.Key, conn)
+			return
+		}
+
+		t.handleFeed(header.From, assigned, conn)
+
+	// Handle History
+	case wire.HistoryQueryCode:
+		assigned := &wire.TrackerHistoryQuery{}
+		err := proto.Unmarshal(mes, assigned)
+
+		if err != nil {
+			t.handleError("Handle Client (Unloading History Payload)", err)
+			adErrors.CreateError(adErrors.UnexpectedError, "Unable to unload message payload.", t.Key.Address).Send(t.Key, conn)
+			return
+		}
+
+		t.handleHistory(header.From, assigned, conn)
+
+	// Handle Replication
+	case wire.ReplicateCode:
+		assigned := &wire.TrackerReplicate{}
+		err := proto.Unmarshal(mes, assigned)
+
+		if err != nil {
+			t.handleError("Handle Client (Unloading Replicate Payload)", err)
+			adErrors.CreateError(adErrors.UnexpectedError, "Unable to unload message payload.", t.Key.Address).Send(t.Key, conn)
+			return
+		}
+
+		t.handleReplicate(header.From, assigned, conn)
+
+	// Handle Digest
+	case wire.DigestQueryCode:
+		assigned := &wire.TrackerDigestQuery{}
+		err := proto.Unmarshal(mes, assigned)
+
+		if err != nil {
+			t.handleError("Handle Client (Unloading Digest Payload)", err)
+			adErrors.CreateError(adErrors.UnexpectedError, "Unable to unload message payload.", t.Key.Address).Send(t.Key, conn)
+			return
+		}
+
+		t.handleDigest(header.From, assigned, conn)
+	}
+}
+
+// saveRecord will store an accepted registration and let any watchers know
+// that it has changed. Nothing is changed if the store could not save it.
+func (t *Tracker) saveRecord(address *identity.Address, record *message.SignedMessage, alias string) error {
+	if c, ok := t.records().(RecordCommitter); ok {
+		err := c.CommitRecord(address, record, alias)
+		if err != nil {
+			return err
+		}
+	} else {
+		t.records().SaveRecord(address, record, alias)
 	}
+
+	t.Cache.Invalidate(address.String(), alias)
+	t.watchers.notify(t, address.String(), alias, record)
+	return nil
 }
 
 func (t *Tracker) handleQuery(theAddress *identity.Address, req *wire.TrackerQuery, conn net.Conn) {
 	var info *message.SignedMessage
+	kind := "alias"
 	if req.GetUsername() == "" {
+		kind = "address"
 		addr := identity.CreateAddressFromString(req.GetAddress())
 		if addr == nil {
+			t.Metrics.inc("tracker_queries_total", kind, "invalid")
 			adErrors.CreateError(adErrors.UnexpectedError, "Address is not valid.", t.Key.Address).Send(t.Key, conn)
 			return
 		} else {
-			info = t.Delegate.GetRecordByAddress(addr)
+			info = t.lookupAddress(addr)
 		}
 	} else {
-		info = t.Delegate.GetRecordByAlias(req.GetUsername())
+		info = t.lookupAlias(req.GetUsername())
+	}
+
+	if info == nil {
+		info = t.forwardQuery(req)
 	}
 
 	// Return an Error Message if we could not find the address
 	if info == nil {
+		t.Metrics.inc("tracker_queries_total", kind, "not_found")
 		adErrors.CreateError(adErrors.AddressNotFound, "Couldn't find that address.", t.Key.Address).Send(t.Key, conn)
 		return
 	}
 
-	err := info.AddSignature(t.Key)
+	enc, err := t.countersign(info, theAddress)
 	if err != nil {
-		t.handleError("Couldn't add signature.", err)
+		t.Metrics.inc("tracker_queries_total", kind, "error")
+		t.handleError("Couldn't sign query response.", err)
 		adErrors.CreateError(adErrors.InternalError, "Couldn't sign query response.", t.Key.Address).Send(t.Key, conn)
 		return
 	}
 
-	enc, err := info.UnencryptedMessage(theAddress)
-	if err != nil {
-		t.handleError("Create unencrypted message.", err)
-		adErrors.CreateError(adErrors.InternalError, "Couldn't pack query response.", t.Key.Address).Send(t.Key, conn)
-		return
-	}
-
 	err = enc.SendMessageToConnection(conn)
 	if err != nil {
+		t.Metrics.inc("tracker_queries_total", kind, "error")
 		t.handleError("Send unencrypted message.", err)
 		adErrors.CreateError(adErrors.InternalError, "Couldn't send query response.", t.Key.Address).Send(t.Key, conn)
 		return
 	}
+
+	if t.Mirror != nil {
+		err = t.sendMirrorInfo(theAddress, info, conn)
+		if err != nil {
+			t.handleError("Handle Query (Sending Mirror Info)", err)
+		}
+	}
+
+	t.Metrics.inc("tracker_queries_total", kind, "found")
 }
@@ -4,23 +4,55 @@ import (
 	"airdispat.ch/identity"
 	"airdispat.ch/message"
 	"airdispat.ch/tracker"
+	"airdispat.ch/tracker/audit"
+	"airdispat.ch/tracker/cluster"
+	"airdispat.ch/tracker/dump"
+	"airdispat.ch/tracker/encstore"
+	"airdispat.ch/tracker/stores"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
 var port = flag.String("port", "2048", "select the port on which to run the tracking server")
 var key_file = flag.String("key", "", "the file that will save or load your keys")
-
-var storedAddresses map[string]*message.SignedMessage
-var aliasedAddresses map[string]*message.SignedMessage
+var metrics_addr = flag.String("metrics", "", "serve prometheus metrics at /metrics on this address (e.g. :9100)")
+var admin_addr = flag.String("admin", "", "serve health, readiness and status endpoints on this address (e.g. :8080)")
+var audit_dir = flag.String("audit", "", "record every registration in a signed audit log in this directory")
+var store_spec = flag.String("store", "memory", "where to keep registrations: "+stores.Usage)
+var max_lifetime = flag.Duration("max_lifetime", tracker.DefaultRegistrationLifetime, "refuse registrations that expire further in the future than this")
+var sweep_interval = flag.Duration("sweep", 0, "remove lapsed registrations this often (e.g. 1h); zero disables the sweeper")
+var sweep_grace = flag.Duration("sweep_grace", tracker.DefaultSweepGrace, "how long after expiring a registration is kept before it is swept")
+var alias_hold = flag.Duration("alias_hold", 0, "how long the alias of a swept registration is held for its former owner")
+var archive_file = flag.String("archive", "", "append swept registrations to this file before removing them")
+var encrypt = flag.Bool("encrypt", false, "encrypt stored registrations with a key derived from the tracker key")
+var encrypt_keys = flag.String("encrypt_keys", "", "encrypt stored registrations with the keys in this file, the first of which is current")
+var peers = flag.String("peers", "", "replicate registrations with these trackers, as a comma separated list of <host:port> or <address>@<host:port>")
+var sync_interval = flag.Duration("sync", tracker.DefaultSyncInterval, "compare records with every peer this often; zero disables anti-entropy")
+var cache_size = flag.Int("cache_size", 0, "keep up to this many recent lookups in memory; zero disables the cache")
+var cache_ttl = flag.Duration("cache_ttl", tracker.DefaultCacheTTL, "the longest that a cached lookup is kept")
+var cluster_id = flag.String("cluster_id", "", "the name of this tracker in its cluster")
+var cluster_peers = flag.String("cluster", "", "agree on registrations with these trackers using raft, as a comma separated list of <id>=<host:port> that includes this tracker")
+var cluster_dir = flag.String("cluster_dir", "", "keep this tracker's raft log in this directory")
+var mirror_of = flag.String("mirror", "", "serve a read-only copy of the tracker at <address>@<host:port>")
+var mirror_interval = flag.Duration("mirror_interval", tracker.DefaultMirrorInterval, "how often a mirror asks its primary for new changes")
+var mirrors = flag.String("mirrors", "", "allow the mirrors with these addresses, as a comma separated list, to copy every registration")
+var ring_nodes = flag.String("ring", "", "divide registrations between these trackers, as a comma separated list of <address>@<host:port> that includes this tracker")
+var replicas = flag.Int("replicas", tracker.DefaultReplicas, "how many trackers on the ring hold each registration")
+var rebalance_interval = flag.Duration("rebalance", tracker.DefaultRebalanceInterval, "how often to hand registrations to the trackers on the ring that own them")
+var forward_peers = flag.String("forward", "", "ask these trackers for registrations that this tracker does not hold, as a comma separated list of <host:port> or <address>@<host:port>")
+var forward_hops = flag.Int("forward_hops", tracker.DefaultForwardHops, "the most times that a query may be passed between trackers")
+var namespaces = flag.Bool("namespaces", false, "only accept aliases qualified with a domain, such as alice@corp.example, when they are delegated by the admin key in the domain's DNS")
+var migrate_to = flag.String("migrate", "", "decommission this tracker, sending clients to its successor at <address>@<host:port>")
+var linearizable = flag.Bool("linearizable", false, "confirm every lookup with the cluster leader before answering")
 
 func main() {
 	flag.Parse()
 
-	// Initialize the Database of Addresses
-	storedAddresses = make(map[string]*message.SignedMessage)
-	aliasedAddresses = make(map[string]*message.SignedMessage)
-
 	loadedKey, err := identity.LoadKeyFromFile(*key_file)
 
 	if err != nil {
@@ -43,37 +75,326 @@ func main() {
 	}
 	fmt.Println("Loaded Address", loadedKey.Address.String())
 
+	store, err := stores.Open(*store_spec)
+	if err != nil {
+		fmt.Println("Unable to Open Store", err)
+		return
+	}
+	defer stores.Close(store)
+
+	var cache *tracker.RecordCache
+	if *cache_size > 0 {
+		cache = tracker.NewRecordCache(*cache_size, *cache_ttl)
+	}
+
+	// The cluster node is wrapped by the encrypted store, rather than the
+	// other way around, so that registrations are sealed before they are
+	// written to the raft log.
+	if *cluster_peers != "" {
+		if *encrypt && *encrypt_keys == "" {
+			fmt.Println("Unable to Join Cluster: clustered trackers must share their keys with -encrypt_keys")
+			return
+		}
+		if *store_spec != "memory" {
+			fmt.Println("Unable to Join Cluster: the raft log is replayed into the store on every start, so -store must be memory")
+			return
+		}
+
+		node, err := clustered(store, cache)
+		if err != nil {
+			fmt.Println("Unable to Join Cluster", err)
+			return
+		}
+		defer node.Close()
+
+		go func() {
+			err := node.Start()
+			if err != nil {
+				fmt.Println("Unable to Start Cluster Node", err)
+			}
+		}()
+		store = node
+	}
+
+	if *encrypt || *encrypt_keys != "" {
+		store, err = encrypted(store, loadedKey)
+		if err != nil {
+			fmt.Println("Unable to Encrypt Store", err)
+			return
+		}
+	}
+
 	theTracker := &tracker.Tracker{
-		Key:      loadedKey,
-		Delegate: &myTracker{},
+		Key:         loadedKey,
+		Delegate:    &myTracker{},
+		Store:       store,
+		Cache:       cache,
+		MaxLifetime: *max_lifetime,
+	}
+
+	if *metrics_addr != "" {
+		theTracker.Metrics = tracker.NewMetrics()
+	}
+
+	if *audit_dir != "" {
+		theTracker.Audit, err = audit.Open(*audit_dir, loadedKey, audit.DefaultMaxSize)
+		if err != nil {
+			fmt.Println("Unable to Open Audit Log", err)
+			return
+		}
+		defer theTracker.Audit.Close()
+	}
+
+	if *sweep_interval > 0 {
+		theTracker.Sweeper = &tracker.Sweeper{
+			Interval:  *sweep_interval,
+			Grace:     *sweep_grace,
+			AliasHold: *alias_hold,
+		}
+
+		if *archive_file != "" {
+			archive, err := os.OpenFile(*archive_file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+			if err != nil {
+				fmt.Println("Unable to Open Archive", err)
+				return
+			}
+			defer archive.Close()
+
+			theTracker.Sweeper.Archive, err = archiver(archive)
+			if err != nil {
+				fmt.Println("Unable to Write Archive", err)
+				return
+			}
+		}
+	}
+
+	if *peers != "" {
+		theTracker.Replication = &tracker.Replication{}
+		for _, v := range strings.Split(*peers, ",") {
+			peer := &tracker.Peer{URL: v}
+			if i := strings.Index(v, "@"); i >= 0 {
+				peer.Address, peer.URL = v[:i], v[i+1:]
+			}
+			theTracker.Replication.Peers = append(theTracker.Replication.Peers, peer)
+		}
+		theTracker.Replication.SyncInterval = *sync_interval
 	}
+
+	if *ring_nodes != "" {
+		var nodes []*tracker.Peer
+		for _, v := range strings.Split(*ring_nodes, ",") {
+			i := strings.Index(v, "@")
+			if i < 0 {
+				fmt.Println("Unable to Join Ring: members must be of the form <address>@<host:port>")
+				return
+			}
+			nodes = append(nodes, &tracker.Peer{Address: v[:i], URL: v[i+1:]})
+		}
+
+		theTracker.Partition = tracker.NewPartition(tracker.NewRing(0, nodes...), *replicas)
+		theTracker.Partition.RebalanceInterval = *rebalance_interval
+	}
+
+	if *forward_peers != "" {
+		theTracker.Forwarding = &tracker.Forwarding{MaxHops: *forward_hops}
+		for _, v := range strings.Split(*forward_peers, ",") {
+			peer := &tracker.Peer{URL: v}
+			if i := strings.Index(v, "@"); i >= 0 {
+				peer.Address, peer.URL = v[:i], v[i+1:]
+			}
+			theTracker.Forwarding.Peers = append(theTracker.Forwarding.Peers, peer)
+		}
+
+		if *cache_size > 0 {
+			theTracker.Forwarding.Cache = tracker.NewRecordCache(*cache_size, *cache_ttl)
+		}
+	}
+
+	if *namespaces {
+		theTracker.Namespaces = &tracker.Namespaces{}
+	}
+
+	if *migrate_to != "" {
+		i := strings.Index(*migrate_to, "@")
+		if i < 0 {
+			fmt.Println("Unable to Migrate: -migrate must be of the form <address>@<host:port>")
+			return
+		}
+
+		theTracker.Migration = &tracker.Migration{
+			Successor: &tracker.Peer{Address: (*migrate_to)[:i], URL: (*migrate_to)[i+1:]},
+		}
+	}
+
+	if *mirrors != "" {
+		if theTracker.Replication == nil {
+			theTracker.Replication = &tracker.Replication{}
+		}
+		theTracker.Replication.Mirrors = strings.Split(*mirrors, ",")
+	}
+
+	if *mirror_of != "" {
+		i := strings.Index(*mirror_of, "@")
+		if i < 0 {
+			fmt.Println("Unable to Mirror: -mirror must be of the form <address>@<host:port>")
+			return
+		}
+
+		theTracker.Mirror = &tracker.Mirror{
+			Primary:  &tracker.Peer{Address: (*mirror_of)[:i], URL: (*mirror_of)[i+1:]},
+			Interval: *mirror_interval,
+		}
+	}
+
+	// The tracker is only started once it is fully configured, as the
+	// workers below read its fields without locking.
+	if theTracker.Sweeper != nil {
+		go theTracker.StartSweeper()
+	}
+
+	if *peers != "" {
+		go theTracker.StartReplication()
+
+		if *sync_interval > 0 {
+			go theTracker.StartAntiEntropy()
+		}
+	}
+
+	if theTracker.Partition != nil {
+		go theTracker.StartRebalancing()
+	}
+
+	if theTracker.Mirror != nil {
+		go theTracker.StartMirror()
+	}
+
+	if *metrics_addr != "" {
+		go func() {
+			err := theTracker.StartMetricsServer(*metrics_addr)
+			if err != nil {
+				fmt.Println("Unable to Start Metrics Server", err)
+			}
+		}()
+	}
+
+	if *admin_addr != "" {
+		go func() {
+			err := theTracker.StartAdminServer(*admin_addr)
+			if err != nil {
+				fmt.Println("Unable to Start Admin Server", err)
+			}
+		}()
+	}
+
 	theTracker.StartServer(*port)
 }
 
-type myTracker struct {
-	tracker.BasicTracker
+// encrypted will wrap a store so that its records are encrypted, re-sealing
+// any records left under an old key.
+func encrypted(store tracker.RecordStore, key *identity.Identity) (tracker.RecordStore, error) {
+	backend, ok := store.(encstore.Backend)
+	if !ok {
+		return nil, fmt.Errorf("%T can not hold encrypted records", store)
+	}
+
+	keys := [][]byte{encstore.IdentityKey(key)}
+	if *encrypt_keys != "" {
+		var err error
+		keys, err = encstore.LoadKeyFile(*encrypt_keys)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s, err := encstore.New(backend, key, keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) > 1 {
+		moved, err := s.Rotate()
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("Re-encrypted", moved, "records")
+	}
+
+	return s, nil
 }
 
-func (myTracker) SaveRecord(address *identity.Address, record *message.SignedMessage, alias string) {
-	fmt.Println("Saving Address", address.String(), alias)
-	// Store the RegisterdAddress in the Database
-	storedAddresses[address.String()] = record
+// clustered will place a store behind a raft node, so that it only holds
+// registrations that the cluster has agreed on.
+func clustered(store tracker.RecordStore, cache *tracker.RecordCache) (*cluster.Node, error) {
+	config := &cluster.Config{
+		ID:           *cluster_id,
+		Peers:        make(map[string]string),
+		Store:        store,
+		Dir:          *cluster_dir,
+		Linearizable: *linearizable,
+
+		// Registrations committed through other trackers must not be
+		// answered from a stale cache. Encrypted registrations are
+		// sealed before they reach the cluster, so only their hashed
+		// address and alias are known here.
+		OnApply: func(address string, alias string, record *message.SignedMessage) {
+			if *encrypt || *encrypt_keys != "" {
+				cache.Purge()
+				return
+			}
+			cache.Invalidate(address, alias)
+		},
+	}
 
-	if alias != "" {
-		aliasedAddresses[alias] = record
+	for _, v := range strings.Split(*cluster_peers, ",") {
+		i := strings.Index(v, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("cluster member %q is not of the form <id>=<host:port>", v)
+		}
+		config.Peers[v[:i]] = v[i+1:]
 	}
+
+	return cluster.New(config)
 }
 
-func (myTracker) GetRecordByAddress(address *identity.Address) *message.SignedMessage {
-	fmt.Println("Getting Address", address.String())
-	// Lookup the Address (by address) in the Database
-	info, _ := storedAddresses[address.String()]
-	return info
+type myTracker struct {
+	tracker.BasicTracker
 }
 
-func (myTracker) GetRecordByAlias(alias string) *message.SignedMessage {
-	fmt.Println("Getting Address", alias)
-	// Lookup the Address (by address) in the Database
-	info, _ := aliasedAddresses[alias]
-	return info
+// archiver will write swept records to a file in the dump format, so that
+// they can be restored with trackerdb.
+func archiver(f *os.File) (func(r *tracker.StoredRecord) error, error) {
+	var lock sync.Mutex
+	enc := json.NewEncoder(f)
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Size() == 0 {
+		err = enc.Encode(&dump.Header{
+			Format:  dump.Format,
+			Version: dump.Version,
+			Created: time.Now().UTC(),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func(r *tracker.StoredRecord) error {
+		data, err := tracker.MarshalRecord(r.Record)
+		if err != nil {
+			return err
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		return enc.Encode(&dump.Record{
+			Address: r.Address,
+			Alias:   r.Alias,
+			Record:  data,
+		})
+	}, nil
 }
@@ -1,21 +1,51 @@
 package tracker
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
 	"time"
 
+	"airdispat.ch/crypto"
+	adErrors "airdispat.ch/errors"
 	"airdispat.ch/identity"
 	"airdispat.ch/message"
 	"airdispat.ch/routing"
+	"airdispat.ch/tracker/audit"
 )
 
+func createTestRecord(t *testing.T, alias string, expires time.Time) (*identity.Identity, *message.SignedMessage) {
+	id, err := identity.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id.SetLocation("example.com")
+
+	return id, signTestRecord(t, id, alias, expires)
+}
+
+func signTestRecord(t *testing.T, id *identity.Identity, alias string, expires time.Time) *message.SignedMessage {
+	signed, err := message.SignMessage(&RegistrationMessage{
+		Address:  id.Address.String(),
+		Location: id.Address.Location,
+		Alias:    alias,
+		Key:      crypto.RSAToBytes(id.Address.EncryptionKey),
+		Expires:  expires,
+	}, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
 func TestTracker(t *testing.T) {
 	trackerKey, err := identity.CreateIdentity()
 	if err != nil {
 		t.Error(err)
 	}
 
-	testTracker := &testingTracker{
+	testTracker := &mapTestingTracker{
 		addressedStorage: make(map[string]*message.SignedMessage),
 		aliasedStorage:   make(map[string]*message.SignedMessage),
 	}
@@ -79,26 +109,402 @@ func TestTracker(t *testing.T) {
 	}
 }
 
+func TestWatch(t *testing.T) {
+	trackerKey, err := identity.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker := &Tracker{
+		Key:      trackerKey,
+		Delegate: newTestingTracker(),
+	}
+
+	go func() {
+		err := tracker.StartServer("9091")
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// Wait for Server to Startup
+	time.Sleep(1 * time.Second)
+
+	toLog, err := identity.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	toLog.SetLocation("google.com")
+
+	router := &Router{
+		URL:    "localhost:9091",
+		Origin: toLog,
+	}
+
+	err = router.Register(toLog, "hunter", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan bool)
+	defer close(stop)
+
+	updates, err := router.Watch(nil, []string{"hunter"}, stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := func() *identity.Address {
+		select {
+		case addr, ok := <-updates:
+			if !ok {
+				t.Fatal("Watch ended early.")
+			}
+			return addr
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for watch update.")
+		}
+		return nil
+	}
+
+	if addr := next(); addr.Location != "google.com" {
+		t.Error("Expected the current record first, got location", addr.Location)
+	}
+
+	toLog.SetLocation("example.com")
+	err = router.Register(toLog, "hunter", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr := next(); addr.Location != "example.com" || addr.String() != toLog.Address.String() {
+		t.Error("Expected the moved record, got location", addr.Location)
+	}
+}
+
+func TestChangeFeed(t *testing.T) {
+	trackerKey, err := identity.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker := &Tracker{
+		Key: trackerKey,
+		Delegate: &feedTestingTracker{
+			testingTracker: newTestingTracker(),
+			ChangeLog:      &ChangeLog{Capacity: 3},
+		},
+	}
+
+	go func() {
+		err := tracker.StartServer("9092")
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// Wait for Server to Startup
+	time.Sleep(1 * time.Second)
+
+	var registered []string
+	for i := 0; i < 3; i++ {
+		toLog, err := identity.CreateIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		router := &Router{
+			URL:    "localhost:9092",
+			Origin: toLog,
+		}
+
+		err = router.Register(toLog, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		registered = append(registered, toLog.Address.String())
+	}
+
+	reader := &FeedReader{
+		Router: &Router{URL: "localhost:9092", Origin: trackerKey},
+		Limit:  2,
+	}
+
+	var seen []string
+	for {
+		changes, err := reader.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) == 0 {
+			break
+		}
+		for _, c := range changes {
+			if c.Kind != ChangeUpdate || c.Record == nil {
+				t.Error("Expected an update with a record.")
+			}
+			seen = append(seen, c.Address)
+		}
+	}
+
+	if len(seen) != len(registered) || reader.Cursor != 3 || reader.Latest != 3 {
+		t.Fatalf("Expected 3 changes up to cursor 3, got %d up to %d.", len(seen), reader.Cursor)
+	}
+	for i := range seen {
+		if seen[i] != registered[i] {
+			t.Error("Changes were not returned in order.")
+		}
+	}
+
+	// The fourth change pushes the first out of the log.
+	tracker.Delegate.(*feedTestingTracker).Append(ChangeDelete, registered[0], "", nil)
+	_, err = reader.Router.Changes(0, 0)
+	if err != ErrFeedTruncated {
+		t.Error("Expected a truncated feed, got", err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	trackerKey, err := identity.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker := &Tracker{
+		Key:      trackerKey,
+		Delegate: newTestingTracker(),
+	}
+
+	go func() {
+		err := tracker.StartServer("9093")
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// Wait for Server to Startup
+	time.Sleep(1 * time.Second)
+
+	toLog, err := identity.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	toLog.SetLocation("before.example.com")
+
+	router := &Router{
+		URL:    "localhost:9093",
+		Origin: toLog,
+	}
+
+	err = router.Register(toLog, "hunter", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toLog.SetLocation("after.example.com")
+	err = router.Register(toLog, "renamed", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := router.AddressHistory(toLog.Address.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Alias != "renamed" || history[1].Alias != "hunter" {
+		t.Fatal("Expected both registrations, newest first.")
+	}
+
+	history, err = router.AliasHistory("hunter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Address != toLog.Address.String() || history[0].Replaced.IsZero() {
+		t.Error("Expected the alias to remember its replaced owner.")
+	}
+
+	addr, err := router.LookupAt(toLog.Address.String(), time.Now(), routing.LookupTypeDEFAULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.Location != "after.example.com" {
+		t.Error("Expected the current registration, got", addr.Location)
+	}
+
+	_, err = router.LookupAt(toLog.Address.String(), time.Now().Add(-time.Hour), routing.LookupTypeDEFAULT)
+	if err == nil {
+		t.Error("Expected no registration before the first one.")
+	}
+}
+
+// Fake Tracker that Publishes a Change Feed
+type feedTestingTracker struct {
+	*testingTracker
+	*ChangeLog
+}
+
+func (t *feedTestingTracker) SaveRecord(address *identity.Address, record *message.SignedMessage, alias string) {
+	t.testingTracker.SaveRecord(address, record, alias)
+	t.Append(ChangeUpdate, address.String(), alias, record)
+}
+
 // Simple Fake Tracker
 type testingTracker struct {
+	BasicTracker
+	*MemoryStore
+}
+
+func newTestingTracker() *testingTracker {
+	return &testingTracker{
+		MemoryStore: NewMemoryStore(),
+	}
+}
+
+// Map-Backed Fake Tracker, Independent of MemoryStore
+type mapTestingTracker struct {
 	BasicTracker
 	addressedStorage map[string]*message.SignedMessage
 	aliasedStorage   map[string]*message.SignedMessage
 }
 
-func (t testingTracker) SaveRecord(address *identity.Address, record *message.SignedMessage, alias string) {
+func (t mapTestingTracker) SaveRecord(address *identity.Address, record *message.SignedMessage, alias string) {
 	t.addressedStorage[address.String()] = record
 	if alias != "" {
 		t.aliasedStorage[alias] = record
 	}
 }
 
-func (t testingTracker) GetRecordByAddress(address *identity.Address) *message.SignedMessage {
+func (t mapTestingTracker) GetRecordByAddress(address *identity.Address) *message.SignedMessage {
 	info, _ := t.addressedStorage[address.String()]
 	return info
 }
 
-func (t testingTracker) GetRecordByAlias(alias string) *message.SignedMessage {
+func (t mapTestingTracker) GetRecordByAlias(alias string) *message.SignedMessage {
 	info, _ := t.aliasedStorage[alias]
 	return info
 }
+
+func TestTrackerMaxLifetime(t *testing.T) {
+	trackerKey, err := identity.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker := &Tracker{
+		Key:         trackerKey,
+		Delegate:    newTestingTracker(),
+		MaxLifetime: time.Hour,
+	}
+
+	go func() {
+		err := tracker.StartServer("9122")
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// Wait for Server to Startup
+	time.Sleep(1 * time.Second)
+
+	toLog, err := identity.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	toLog.SetLocation("google.com")
+
+	// Routers ask for DefaultRegistrationLifetime, which is too long.
+	err = (&Router{URL: "localhost:9122", Origin: toLog}).Register(toLog, "hunter", nil)
+	if err == nil {
+		t.Error("Expected a registration past the maximum lifetime to be refused.")
+	}
+
+	send := func(record *message.SignedMessage) error {
+		enc, err := record.UnencryptedMessage(toLog.Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := message.ConnectToServer("localhost:9122")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		err = enc.SendMessageToConnection(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return adErrors.CheckConnectionForError(conn)
+	}
+
+	err = send(signTestRecord(t, toLog, "hunter", time.Now().Add(30*time.Minute)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tracker.records().GetRecordByAlias("hunter") == nil {
+		t.Error("Expected a registration within the maximum lifetime to be saved.")
+	}
+}
+
+func TestTrackerAuditAliasOwner(t *testing.T) {
+	trackerKey, err := identity.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	log, err := audit.Open(dir, trackerKey, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	testTracker := newTestingTracker()
+	go (&Tracker{
+		Key:      trackerKey,
+		Delegate: testTracker,
+		Audit:    log,
+	}).StartServer("9119")
+
+	// Wait for Server to Startup
+	time.Sleep(1 * time.Second)
+
+	previous, record := createTestRecord(t, "hunter", time.Now().Add(time.Hour))
+	testTracker.SaveRecord(previous.Address, record, "hunter")
+
+	toLog, err := identity.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	toLog.SetLocation("google.com")
+
+	err = (&Router{URL: "localhost:9119", Origin: toLog}).Register(toLog, "hunter", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []*audit.Entry
+	err = audit.Read(dir, func(e *audit.Entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("Expected one audit entry, got %d.", len(entries))
+	}
+	e := entries[0]
+	if e.AliasOwner != previous.Address.String() || e.AliasOwnerLocation != "example.com" || e.AliasOwnerKey == "" {
+		t.Errorf("Expected the entry to name the alias's previous owner, got %+v.", e)
+	}
+	if e.OldLocation != "" {
+		t.Error("Expected the sender to have no previous registration.")
+	}
+}
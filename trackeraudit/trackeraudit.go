@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"airdispat.ch/identity"
+	"airdispat.ch/tracker/audit"
+)
+
+var dir = flag.String("dir", "audit", "the directory that holds the tracker's audit log")
+var key_file = flag.String("key", "", "the tracker key file used to check entry signatures")
+
+var sender = flag.String("sender", "", "only show entries from this address")
+var alias = flag.String("alias", "", "only show entries that claim or release this alias")
+var outcome = flag.String("outcome", "", "only show accepted or rejected entries")
+var since = flag.String("since", "", "only show entries at or after this time (RFC 3339)")
+var until = flag.String("until", "", "only show entries before this time (RFC 3339)")
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: trackeraudit [flags] verify|query")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		usage()
+	}
+
+	switch flag.Arg(0) {
+	case "verify":
+		verify()
+	case "query":
+		query()
+	default:
+		usage()
+	}
+}
+
+func verify() {
+	var key *ecdsa.PublicKey
+	if *key_file != "" {
+		loadedKey, err := identity.LoadKeyFromFile(*key_file)
+		if err != nil {
+			fmt.Println("Unable to Load Tracker Key", err)
+			os.Exit(1)
+		}
+		key = &loadedKey.SigningKey.PublicKey
+	}
+
+	count, err := audit.Verify(*dir, key)
+	if err != nil {
+		fmt.Println("Audit log is NOT intact after", count, "entries:", err)
+		os.Exit(1)
+	}
+
+	if key == nil {
+		fmt.Println("Verified hash chain of", count, "entries (signatures not checked).")
+	} else {
+		fmt.Println("Verified hash chain and signatures of", count, "entries.")
+	}
+}
+
+func parseTime(value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		fmt.Println("Unable to Parse Time", value, err)
+		os.Exit(2)
+	}
+	return t
+}
+
+func query() {
+	from, to := parseTime(*since), parseTime(*until)
+
+	err := audit.Read(*dir, func(e *audit.Entry) error {
+		switch {
+		case *sender != "" && e.Sender != *sender:
+		case *alias != "" && e.Alias != *alias && e.OldAlias != *alias:
+		case *outcome != "" && e.Outcome != *outcome:
+		case !from.IsZero() && e.Time.Before(from):
+		case !to.IsZero() && !e.Time.Before(to):
+		default:
+			printEntry(e)
+		}
+		return nil
+	})
+
+	if err != nil {
+		fmt.Println("Unable to Read Audit Log", err)
+		os.Exit(1)
+	}
+}
+
+func printEntry(e *audit.Entry) {
+	fmt.Printf("%d\t%s\t%s\t%s", e.Sequence, e.Time.Format(time.RFC3339), e.Outcome, e.Sender)
+	if e.Alias != "" || e.OldAlias != "" {
+		fmt.Printf("\talias %q -> %q", e.OldAlias, e.Alias)
+	}
+	if e.OldLocation != e.NewLocation {
+		fmt.Printf("\tlocation %q -> %q", e.OldLocation, e.NewLocation)
+	}
+	if e.OldKey != e.NewKey {
+		fmt.Printf("\tkey %s -> %s", e.OldKey, e.NewKey)
+	}
+	if e.AliasOwner != "" {
+		fmt.Printf("\ttaken from %s at %q with key %s", e.AliasOwner, e.AliasOwnerLocation, e.AliasOwnerKey)
+	}
+	if e.Reason != "" {
+		fmt.Printf("\t(%s)", e.Reason)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"airdispat.ch/tracker"
+	"airdispat.ch/tracker/dump"
+	"airdispat.ch/tracker/stores"
+)
+
+var store_spec = flag.String("store", "", "the store to export from or import into: "+stores.Usage)
+var to_spec = flag.String("to", "", "the store to migrate into, in the same form as -store")
+var file = flag.String("file", "-", "the dump file to write or read, or - for standard output or input")
+var skip_expired = flag.Bool("skip_expired", false, "leave out registrations that have already lapsed")
+var skip_invalid = flag.Bool("skip_invalid", false, "leave out records with bad signatures instead of stopping")
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: trackerdb -store <spec> [flags] export|import|migrate")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() != 1 || *store_spec == "" {
+		usage()
+	}
+
+	store, err := stores.Open(*store_spec)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to Open Store", err)
+		os.Exit(1)
+	}
+	defer stores.Close(store)
+
+	switch flag.Arg(0) {
+	case "export":
+		err = export(store)
+	case "import":
+		err = load(store)
+	case "migrate":
+		err = migrate(store)
+	default:
+		usage()
+	}
+
+	if err != nil {
+		stores.Close(store)
+		os.Exit(1)
+	}
+}
+
+func options() *dump.Options {
+	return &dump.Options{
+		SkipExpired: *skip_expired,
+		SkipInvalid: *skip_invalid,
+		InvalidHandler: func(address string, err error) {
+			fmt.Fprintln(os.Stderr, "Invalid Record", address, err)
+		},
+	}
+}
+
+func report(stats *dump.Stats) {
+	fmt.Fprintln(os.Stderr, "Copied", stats.Copied, "records, skipped", stats.Expired, "expired and", stats.Invalid, "invalid.")
+}
+
+func export(store tracker.RecordStore) (err error) {
+	var w io.Writer = os.Stdout
+	if *file != "-" {
+		f, err := os.Create(*file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to Create Dump", err)
+			return err
+		}
+		defer func() {
+			if cerr := f.Close(); cerr != nil && err == nil {
+				fmt.Fprintln(os.Stderr, "Unable to Write Dump", cerr)
+				err = cerr
+			}
+		}()
+		w = f
+	}
+
+	count, err := dump.Export(w, store)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to Export Records", err)
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "Exported", count, "records.")
+	return nil
+}
+
+func load(store tracker.RecordStore) error {
+	var r io.Reader = os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to Open Dump", err)
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	stats, err := dump.Import(r, store, options())
+	if stats != nil {
+		report(stats)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to Import Records", err)
+	}
+	return err
+}
+
+func migrate(store tracker.RecordStore) error {
+	if *to_spec == "" {
+		fmt.Fprintln(os.Stderr, "Migrating requires a destination store (-to).")
+		return fmt.Errorf("missing -to")
+	}
+
+	dst, err := stores.Open(*to_spec)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to Open Destination Store", err)
+		return err
+	}
+	defer stores.Close(dst)
+
+	stats, err := dump.Migrate(dst, store, options())
+	if stats != nil {
+		report(stats)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to Migrate Records", err)
+	}
+	return err
+}
@@ -0,0 +1,602 @@
+// Package walstore implements a durable tracker.RecordStore that needs
+// nothing beyond the standard library.
+//
+// Every change is appended to a write-ahead log before it is applied to an
+// in-memory tracker.MemoryStore. On startup the latest snapshot and then the
+// log are replayed to rebuild the store. From time to time the store is
+// compacted: the current records are written to a new snapshot and the log
+// is started afresh.
+//
+// Each entry in both files is framed with its length and a CRC-32 checksum,
+// and every record is a signed registration whose signature, and alias, is
+// checked again during replay, so both accidental corruption and tampering
+// are detected.
+//
+// Each snapshot records the change feed's sequence number, so that the feed
+// carries on from where it was when the store is opened again. The changes
+// themselves are not kept, so readers with an older cursor must start over.
+package walstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"airdispat.ch/identity"
+	"airdispat.ch/message"
+	"airdispat.ch/tracker"
+)
+
+const (
+	logName      = "records.wal"
+	snapshotName = "records.snapshot"
+
+	// DefaultCompactInterval is how often the log is checked for
+	// compaction if no other interval is given.
+	DefaultCompactInterval = 10 * time.Minute
+
+	// DefaultCompactSize is how large the log must grow before it is
+	// compacted if no other size is given.
+	DefaultCompactSize = 16 << 20
+
+	// maxFrameSize guards against allocating huge buffers when reading a
+	// corrupt length.
+	maxFrameSize = 16 << 20
+)
+
+const (
+	opPut      = "put"
+	opDelete   = "delete"
+	opExpire   = "expire"
+	opSequence = "sequence"
+)
+
+// ErrClosed is returned when a store is used after it has been closed.
+var ErrClosed = errors.New("Store is closed.")
+
+// CorruptionError is returned by Open when a file fails its checksum or
+// holds a record with an invalid signature.
+type CorruptionError struct {
+	File   string
+	Offset int64
+	Reason string
+}
+
+func (c *CorruptionError) Error() string {
+	return fmt.Sprintf("Corrupt entry in %s at offset %d: %s", c.File, c.Offset, c.Reason)
+}
+
+// Options configures how the store is opened.
+type Options struct {
+	// NoSync skips the fsync after every append. This is much faster, but
+	// the most recent registrations may be lost if the machine crashes.
+	NoSync bool
+
+	// CompactInterval is how often the log is checked for compaction. A
+	// negative interval disables background compaction.
+	CompactInterval time.Duration
+
+	// CompactSize is how large, in bytes, the log must grow before it is
+	// compacted.
+	CompactSize int64
+
+	// Repair discards the log from the first corrupt entry onwards, rather
+	// than refusing to open. A corrupt snapshot is never repaired.
+	Repair bool
+}
+
+// Store is a tracker.RecordStore backed by a write-ahead log.
+type Store struct {
+	// ErrorHandler is called when writing to disk fails. If it is not set,
+	// errors are logged.
+	ErrorHandler func(err *tracker.TrackerError)
+
+	dir  string
+	opts Options
+
+	lock    sync.Mutex
+	log     *os.File
+	logSize int64
+	records *tracker.MemoryStore
+
+	// The change feed's sequence number when the snapshot was written.
+	snapshotSeq uint64
+
+	stop chan bool
+	done chan bool
+}
+
+// entry is how a change is encoded in the log and the snapshot.
+type entry struct {
+	Op      string `json:"op"`
+	Address string `json:"address"`
+	Alias   string `json:"alias,omitempty"`
+	Record  []byte `json:"record,omitempty"`
+	Seq     uint64 `json:"seq,omitempty"`
+}
+
+// Open will open (or create) a store in the directory dir, replaying any
+// records that it already holds.
+func Open(dir string, opts *Options) (*Store, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	s := &Store{
+		dir:     dir,
+		opts:    *opts,
+		records: tracker.NewMemoryStore(),
+	}
+	if s.opts.CompactInterval == 0 {
+		s.opts.CompactInterval = DefaultCompactInterval
+	}
+	if s.opts.CompactSize == 0 {
+		s.opts.CompactSize = DefaultCompactSize
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	// A snapshot that was never renamed into place is incomplete.
+	os.Remove(filepath.Join(dir, snapshotName+".tmp"))
+
+	_, err = s.replay(snapshotName, false)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	replayed := s.records.LastSequence()
+	good, err := s.replay(logName, s.opts.Repair)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Replaying the log makes the same changes, in the same order, as
+	// when it was written, so the feed carries on from the snapshot by
+	// as many changes as the log made.
+	s.records.ResetFeed(s.snapshotSeq + s.records.LastSequence() - replayed)
+
+	s.log, err = os.OpenFile(filepath.Join(dir, logName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	// Drop a partially written entry left behind by a crash, so that new
+	// entries are not appended after it.
+	err = s.log.Truncate(good)
+	if err == nil {
+		_, err = s.log.Seek(good, io.SeekStart)
+	}
+	if err != nil {
+		s.log.Close()
+		return nil, err
+	}
+	s.logSize = good
+
+	if s.opts.CompactInterval > 0 {
+		s.stop = make(chan bool)
+		s.done = make(chan bool)
+		go s.compactor()
+	}
+
+	return s, nil
+}
+
+// Close will stop compaction and close the log.
+func (s *Store) Close() error {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.log == nil {
+		return ErrClosed
+	}
+
+	err := s.log.Close()
+	s.log = nil
+	return err
+}
+
+func (s *Store) handleError(location string, err error) {
+	if s.ErrorHandler != nil {
+		s.ErrorHandler(&tracker.TrackerError{
+			Location: location,
+			Error:    err,
+		})
+		return
+	}
+	log.Println("WAL Store Error At:", location, "-", err)
+}
+
+// writeFrame will write an entry prefixed by its length and checksum,
+// returning the number of bytes written.
+func writeFrame(w io.Writer, e *entry) (int64, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+
+	frame := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(data))
+	copy(frame[8:], data)
+
+	n, err := w.Write(frame)
+	return int64(n), err
+}
+
+// replay will apply every entry in a file to the in-memory store. It
+// returns the offset just past the last complete entry. A partial entry at
+// the end of the file is the expected result of a crash and is ignored.
+func (s *Store) replay(name string, repair bool) (int64, error) {
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+
+	corrupt := func(reason string) (int64, error) {
+		if repair {
+			s.handleError("Replay", &CorruptionError{name, offset, reason + " (discarded)"})
+			return offset, nil
+		}
+		return 0, &CorruptionError{name, offset, reason}
+	}
+
+	for {
+		var header [8]byte
+		_, err := io.ReadFull(r, header[:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return offset, nil
+		} else if err != nil {
+			return 0, err
+		}
+
+		size := binary.BigEndian.Uint32(header[0:4])
+		if size > maxFrameSize {
+			return corrupt("entry is too large")
+		}
+
+		data := make([]byte, size)
+		_, err = io.ReadFull(r, data)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return offset, nil
+		} else if err != nil {
+			return 0, err
+		}
+
+		if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+			return corrupt("checksum mismatch")
+		}
+
+		e := &entry{}
+		err = json.Unmarshal(data, e)
+		if err != nil {
+			return corrupt(err.Error())
+		}
+
+		err = s.apply(e)
+		if err != nil {
+			return corrupt(err.Error())
+		}
+
+		offset += int64(len(header)) + int64(size)
+	}
+}
+
+// apply will replay a single entry into the in-memory store.
+func (s *Store) apply(e *entry) error {
+	address := identity.CreateAddressFromString(e.Address)
+
+	switch e.Op {
+	case opSequence:
+		s.snapshotSeq = e.Seq
+		return nil
+
+	case opDelete:
+		s.records.DeleteRecord(address)
+		return nil
+
+	case opExpire:
+		s.records.ExpireRecord(address)
+		return nil
+
+	case opPut:
+		record, err := tracker.UnmarshalRecord(e.Record)
+		if err != nil {
+			return err
+		}
+
+		err = tracker.VerifyRecordAlias(e.Address, e.Alias, record)
+		if err != nil {
+			return err
+		}
+
+		s.records.SaveRecord(address, record, e.Alias)
+		return nil
+	}
+
+	return fmt.Errorf("unknown operation %q", e.Op)
+}
+
+// append must be called with the lock held.
+func (s *Store) append(e *entry) error {
+	if s.log == nil {
+		return ErrClosed
+	}
+
+	n, err := writeFrame(s.log, e)
+	s.logSize += n
+	if err != nil {
+		return err
+	}
+
+	if !s.opts.NoSync {
+		return s.log.Sync()
+	}
+	return nil
+}
+
+// SaveRecord will log a record and then store it. If the record cannot be
+// logged it is not stored.
+func (s *Store) SaveRecord(address *identity.Address, record *message.SignedMessage, alias string) {
+	data, err := tracker.MarshalRecord(record)
+	if err != nil {
+		s.handleError("Save Record", err)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err = s.append(&entry{
+		Op:      opPut,
+		Address: address.String(),
+		Alias:   alias,
+		Record:  data,
+	})
+	if err != nil {
+		s.handleError("Save Record", err)
+		return
+	}
+
+	s.records.SaveRecord(address, record, alias)
+}
+
+// DeleteRecord implements tracker.RecordDeleter.
+func (s *Store) DeleteRecord(address *identity.Address) {
+	s.delete(address, opDelete)
+}
+
+// ExpireRecord implements tracker.RecordExpirer.
+func (s *Store) ExpireRecord(address *identity.Address) {
+	s.delete(address, opExpire)
+}
+
+func (s *Store) delete(address *identity.Address, op string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.append(&entry{
+		Op:      op,
+		Address: address.String(),
+	})
+	if err != nil {
+		s.handleError("Delete Record", err)
+		return
+	}
+
+	if op == opExpire {
+		s.records.ExpireRecord(address)
+	} else {
+		s.records.DeleteRecord(address)
+	}
+}
+
+// GetRecordByAddress will return the current record for an address.
+func (s *Store) GetRecordByAddress(address *identity.Address) *message.SignedMessage {
+	return s.records.GetRecordByAddress(address)
+}
+
+// GetRecordByAlias will return the current record of the owner of an alias.
+func (s *Store) GetRecordByAlias(alias string) *message.SignedMessage {
+	return s.records.GetRecordByAlias(alias)
+}
+
+// AliasOwner will return the address that currently owns an alias, or the
+// empty string if it is free.
+func (s *Store) AliasOwner(alias string) string {
+	return s.records.AliasOwner(alias)
+}
+
+// ForEachRecord implements tracker.RecordIterator.
+func (s *Store) ForEachRecord(fn func(record *tracker.StoredRecord) error) error {
+	for _, r := range s.records.Snapshot() {
+		err := fn(r)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CountRecords implements tracker.RecordCounter.
+func (s *Store) CountRecords() (int, int) {
+	return s.records.CountRecords()
+}
+
+// ChangesSince implements tracker.ChangeFeed.
+func (s *Store) ChangesSince(cursor uint64, limit int) ([]*tracker.Change, error) {
+	return s.records.ChangesSince(cursor, limit)
+}
+
+// LastSequence implements tracker.ChangeFeed.
+func (s *Store) LastSequence() uint64 {
+	return s.records.LastSequence()
+}
+
+// CheckHealth implements tracker.HealthChecker.
+func (s *Store) CheckHealth() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.log == nil {
+		return ErrClosed
+	}
+	return nil
+}
+
+// LogSize will return the number of bytes written to the log since it was
+// last compacted.
+func (s *Store) LogSize() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.logSize
+}
+
+// Compact will write every record to a new snapshot and empty the log.
+//
+// The snapshot is renamed into place, and the rename synced to disk, before
+// the log is emptied. If the process dies in between, the old log is
+// replayed on top of the new snapshot, which leaves the records exactly as
+// they were.
+func (s *Store) Compact() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.log == nil {
+		return ErrClosed
+	}
+
+	tmp := filepath.Join(s.dir, snapshotName+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	// Replaying an alias takes it from its earlier holder, so records that
+	// own an alias are written after every record that does not.
+	records := s.records.Snapshot()
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Alias == "" && records[j].Alias != ""
+	})
+
+	w := bufio.NewWriter(f)
+	_, err = writeFrame(w, &entry{Op: opSequence, Seq: s.records.LastSequence()})
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	for _, r := range records {
+		data, err := tracker.MarshalRecord(r.Record)
+		if err == nil {
+			_, err = writeFrame(w, &entry{
+				Op:      opPut,
+				Address: r.Address,
+				Alias:   r.Alias,
+				Record:  data,
+			})
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, filepath.Join(s.dir, snapshotName))
+	if err != nil {
+		return err
+	}
+
+	// Otherwise a crash could keep the emptied log but lose the rename.
+	err = syncDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	err = s.log.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.log.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	s.logSize = 0
+
+	return s.log.Sync()
+}
+
+// syncDir will flush the entries of a directory to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// compactor will compact the log whenever it has grown too large.
+func (s *Store) compactor() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.opts.CompactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if s.LogSize() < s.opts.CompactSize {
+				continue
+			}
+
+			err := s.Compact()
+			if err != nil {
+				s.handleError("Compact", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package walstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"airdispat.ch/identity"
+	"airdispat.ch/tracker"
+	"airdispat.ch/tracker/storetest"
+)
+
+var testOptions = &Options{NoSync: true, CompactInterval: -1}
+
+func TestWALStoreReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := Open(dir, testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	future := time.Now().Add(time.Hour)
+	first, firstRecord := storetest.CreateRecord(t, "hunter", future)
+	second, secondRecord := storetest.CreateRecord(t, "gone", future)
+	store.SaveRecord(first.Address, firstRecord, "hunter")
+	store.SaveRecord(second.Address, secondRecord, "gone")
+
+	// Half of the entries end up in the snapshot, the rest in the log.
+	err = store.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.LogSize() != 0 {
+		t.Error("Expected compaction to empty the log.")
+	}
+
+	third, thirdRecord := storetest.CreateRecord(t, "lapsed", future)
+	store.SaveRecord(third.Address, thirdRecord, "lapsed")
+	store.ExpireRecord(third.Address)
+
+	store.DeleteRecord(second.Address)
+	store.SaveRecord(first.Address, storetest.SignRecord(t, first, "renamed", future), "renamed")
+	last := store.LastSequence()
+	store.Close()
+
+	store, err = Open(dir, testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if store.GetRecordByAlias("renamed") == nil || store.GetRecordByAlias("hunter") != nil {
+		t.Error("Expected the latest alias to be replayed.")
+	}
+	if store.GetRecordByAddress(second.Address) != nil || store.GetRecordByAddress(third.Address) != nil {
+		t.Error("Expected the deleted and expired records to stay removed.")
+	}
+	if a, b := store.CountRecords(); a != 1 || b != 1 {
+		t.Errorf("Expected 1 address and 1 alias, got %d and %d.", a, b)
+	}
+
+	// The change feed carries on from where it was, but readers from
+	// before the restart must start over.
+	if store.LastSequence() != last {
+		t.Errorf("Expected the feed to carry on from %d, got %d.", last, store.LastSequence())
+	}
+	if _, err := store.ChangesSince(last-1, 0); err != tracker.ErrFeedTruncated {
+		t.Errorf("Expected an older cursor to be truncated, got %v.", err)
+	}
+	if changes, err := store.ChangesSince(last, 0); err != nil || len(changes) != 0 {
+		t.Errorf("Expected no changes since the restart, got %v and %v.", changes, err)
+	}
+
+	store.ExpireRecord(first.Address)
+	if changes, err := store.ChangesSince(last, 0); err != nil || len(changes) != 1 || changes[0].Sequence != last+1 {
+		t.Errorf("Expected the next change to follow on, got %v and %v.", changes, err)
+	} else if changes[0].Kind != tracker.ChangeExpire {
+		t.Errorf("Expected an expiry tombstone, got %s.", changes[0].Kind)
+	}
+}
+
+func TestWALStoreCompactAliases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := Open(dir, testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Several addresses hold the alias in turn, so that a snapshot
+	// replayed in the wrong order would give it to an earlier holder.
+	future := time.Now().Add(time.Hour)
+	var owner *identity.Identity
+	for i := 0; i < 10; i++ {
+		id, record := storetest.CreateRecord(t, "hunter", future)
+		store.SaveRecord(id.Address, record, "hunter")
+		owner = id
+	}
+
+	err = store.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = Open(dir, testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if store.AliasOwner("hunter") != owner.Address.String() {
+		t.Error("Expected the alias to stay with its last holder after compaction.")
+	}
+}
+
+func TestWALStoreCorruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := Open(dir, testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	future := time.Now().Add(time.Hour)
+	first, firstRecord := storetest.CreateRecord(t, "first", future)
+	second, secondRecord := storetest.CreateRecord(t, "second", future)
+	store.SaveRecord(first.Address, firstRecord, "first")
+	good := store.LogSize()
+	store.SaveRecord(second.Address, secondRecord, "second")
+	store.Close()
+
+	path := filepath.Join(dir, logName)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A torn write at the end of the log is simply dropped.
+	err = ioutil.WriteFile(path, data[:len(data)-3], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = Open(dir, testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.GetRecordByAddress(first.Address) == nil || store.GetRecordByAddress(second.Address) != nil {
+		t.Error("Expected only the complete entry to be replayed.")
+	}
+	if store.LogSize() != good {
+		t.Error("Expected the partial entry to be truncated.")
+	}
+	store.Close()
+
+	// A flipped byte in the middle of the log fails its checksum.
+	data[good+20] ^= 0xff
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Open(dir, testOptions)
+	if c, ok := err.(*CorruptionError); !ok || c.Offset != good {
+		t.Fatalf("Expected a corruption error at offset %d, got %v.", good, err)
+	}
+
+	store, err = Open(dir, &Options{NoSync: true, CompactInterval: -1, Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if store.GetRecordByAddress(first.Address) == nil || store.LogSize() != good {
+		t.Error("Expected repair to keep the entries before the corruption.")
+	}
+}
+
+func TestWALStoreTampering(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	victim, _ := storetest.CreateRecord(t, "victim", time.Now().Add(time.Hour))
+	_, forged := storetest.CreateRecord(t, "victim", time.Now().Add(time.Hour))
+	data, err := tracker.MarshalRecord(forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The frame is intact, but the record was not signed by the address
+	// that it is filed under.
+	f, err := os.Create(filepath.Join(dir, logName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = writeFrame(f, &entry{
+		Op:      opPut,
+		Address: victim.Address.String(),
+		Alias:   "victim",
+		Record:  data,
+	})
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Open(dir, testOptions)
+	if _, ok := err.(*CorruptionError); !ok {
+		t.Errorf("Expected the forged record to be rejected, got %v.", err)
+	}
+
+	// A genuine record can not be given an alias that it was not signed
+	// with.
+	genuine := storetest.SignRecord(t, victim, "victim", time.Now().Add(time.Hour))
+	data, err = tracker.MarshalRecord(genuine)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = os.Create(filepath.Join(dir, logName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = writeFrame(f, &entry{
+		Op:      opPut,
+		Address: victim.Address.String(),
+		Alias:   "admin",
+		Record:  data,
+	})
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Open(dir, testOptions)
+	if _, ok := err.(*CorruptionError); !ok {
+		t.Errorf("Expected the changed alias to be rejected, got %v.", err)
+	}
+}
+
+func TestWALStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (tracker.RecordStore, func()) {
+		dir, err := ioutil.TempDir("", "walstore")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		store, err := Open(dir, testOptions)
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+
+		return store, func() {
+			store.Close()
+			os.RemoveAll(dir)
+		}
+	})
+}
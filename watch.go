@@ -0,0 +1,186 @@
+package tracker
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	adErrors "airdispat.ch/errors"
+	"airdispat.ch/identity"
+	"airdispat.ch/message"
+	"airdispat.ch/tracker/wire"
+)
+
+const (
+	// watchBuffer is the number of updates that may be queued for a single
+	// watcher before it is considered too slow and disconnected.
+	watchBuffer = 16
+
+	// maxWatchKeys limits how many addresses and aliases a single
+	// connection may subscribe to.
+	maxWatchKeys = 1024
+)
+
+type watcher struct {
+	updates chan *message.SignedMessage
+	slow    chan bool
+	once    sync.Once
+}
+
+// drop will disconnect a watcher that is unable to keep up.
+func (w *watcher) drop() {
+	w.once.Do(func() { close(w.slow) })
+}
+
+// watchHub keeps track of the connections that are subscribed to each
+// address and alias.
+type watchHub struct {
+	lock     sync.Mutex
+	watchers map[string]map[*watcher]bool
+}
+
+func addressWatchKey(address string) string { return "address:" + address }
+func aliasWatchKey(alias string) string     { return "alias:" + alias }
+
+func (h *watchHub) add(w *watcher, keys []string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.watchers == nil {
+		h.watchers = make(map[string]map[*watcher]bool)
+	}
+
+	for _, k := range keys {
+		set, ok := h.watchers[k]
+		if !ok {
+			set = make(map[*watcher]bool)
+			h.watchers[k] = set
+		}
+		set[w] = true
+	}
+}
+
+func (h *watchHub) remove(w *watcher, keys []string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for _, k := range keys {
+		delete(h.watchers[k], w)
+		if len(h.watchers[k]) == 0 {
+			delete(h.watchers, k)
+		}
+	}
+}
+
+// notify will queue a changed record for every watcher of its address or
+// alias. It never blocks; watchers that have fallen behind are dropped.
+func (h *watchHub) notify(t *Tracker, address string, alias string, record *message.SignedMessage) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	keys := []string{addressWatchKey(address)}
+	if alias != "" {
+		keys = append(keys, aliasWatchKey(alias))
+	}
+
+	notified := make(map[*watcher]bool)
+	for _, k := range keys {
+		for w := range h.watchers[k] {
+			if notified[w] {
+				continue
+			}
+			notified[w] = true
+
+			select {
+			case w.updates <- record:
+			default:
+				w.drop()
+			}
+		}
+	}
+}
+
+// handleWatch will hold a connection open and push every change to the
+// requested addresses and aliases until the client hangs up.
+func (t *Tracker) handleWatch(theAddress *identity.Address, req *wire.TrackerWatch, conn net.Conn) {
+	var keys []string
+	for _, v := range req.GetAddress() {
+		keys = append(keys, addressWatchKey(v))
+	}
+	for _, v := range req.GetUsername() {
+		keys = append(keys, aliasWatchKey(v))
+	}
+
+	if len(keys) == 0 || len(keys) > maxWatchKeys {
+		adErrors.CreateError(adErrors.UnexpectedError, "Invalid number of addresses to watch.", t.Key.Address).Send(t.Key, conn)
+		return
+	}
+
+	w := &watcher{
+		updates: make(chan *message.SignedMessage, watchBuffer),
+		slow:    make(chan bool),
+	}
+
+	// Subscribe before sending the current state, so that nothing can be
+	// missed in between.
+	t.watchers.add(w, keys)
+	defer t.watchers.remove(w, keys)
+
+	var current []*message.SignedMessage
+	for _, v := range req.GetAddress() {
+		addr := identity.CreateAddressFromString(v)
+		if addr == nil {
+			continue
+		}
+		if record := t.records().GetRecordByAddress(addr); record != nil {
+			current = append(current, record)
+		}
+	}
+	for _, v := range req.GetUsername() {
+		if record := t.records().GetRecordByAlias(v); record != nil {
+			current = append(current, record)
+		}
+	}
+
+	for _, record := range current {
+		err := t.sendWatchUpdate(record, theAddress, conn)
+		if err != nil {
+			t.handleError("Handle Watch (Sending Current Record)", err)
+			return
+		}
+	}
+
+	// Watchers never send anything after subscribing, so the read only
+	// returns once the client has gone away.
+	closed := make(chan bool)
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(closed)
+	}()
+
+	for {
+		select {
+		case record := <-w.updates:
+			err := t.sendWatchUpdate(record, theAddress, conn)
+			if err != nil {
+				t.handleError("Handle Watch (Sending Update)", err)
+				return
+			}
+		case <-w.slow:
+			t.handleError("Handle Watch", errors.New("Watcher was unable to keep up with updates."))
+			return
+		case <-closed:
+			return
+		}
+	}
+}
+
+func (t *Tracker) sendWatchUpdate(record *message.SignedMessage, to *identity.Address, conn net.Conn) error {
+	enc, err := t.countersign(record, to)
+	if err != nil {
+		return err
+	}
+	return enc.SendMessageToConnection(conn)
+}
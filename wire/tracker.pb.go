@@ -20,6 +20,7 @@ type TrackerRegister struct {
 	Expires          *uint64     `protobuf:"varint,4,req,name=expires" json:"expires,omitempty"`
 	Redirect         []*Redirect `protobuf:"bytes,5,rep,name=redirect" json:"redirect,omitempty"`
 	Username         *string     `protobuf:"bytes,6,opt,name=username" json:"username,omitempty"`
+	Delegation       []byte      `protobuf:"bytes,7,opt,name=delegation" json:"delegation,omitempty"`
 	XXX_unrecognized []byte      `json:"-"`
 }
 
@@ -69,11 +70,20 @@ func (m *TrackerRegister) GetUsername() string {
 	return ""
 }
 
+func (m *TrackerRegister) GetDelegation() []byte {
+	if m != nil {
+		return m.Delegation
+	}
+	return nil
+}
+
 type TrackerQuery struct {
-	Address          *string `protobuf:"bytes,1,opt,name=address" json:"address,omitempty"`
-	Username         *string `protobuf:"bytes,2,opt,name=username" json:"username,omitempty"`
-	NeedKey          *bool   `protobuf:"varint,3,opt,name=need_key" json:"need_key,omitempty"`
-	XXX_unrecognized []byte  `json:"-"`
+	Address          *string  `protobuf:"bytes,1,opt,name=address" json:"address,omitempty"`
+	Username         *string  `protobuf:"bytes,2,opt,name=username" json:"username,omitempty"`
+	NeedKey          *bool    `protobuf:"varint,3,opt,name=need_key" json:"need_key,omitempty"`
+	Hops             *uint32  `protobuf:"varint,4,opt,name=hops" json:"hops,omitempty"`
+	Via              []string `protobuf:"bytes,5,rep,name=via" json:"via,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
 }
 
 func (m *TrackerQuery) Reset()         { *m = TrackerQuery{} }
@@ -101,6 +111,20 @@ func (m *TrackerQuery) GetNeedKey() bool {
 	return false
 }
 
+func (m *TrackerQuery) GetHops() uint32 {
+	if m != nil && m.Hops != nil {
+		return *m.Hops
+	}
+	return 0
+}
+
+func (m *TrackerQuery) GetVia() []string {
+	if m != nil {
+		return m.Via
+	}
+	return nil
+}
+
 type Redirect struct {
 	Types            *string `protobuf:"bytes,1,req,name=types" json:"types,omitempty"`
 	Alias            *string `protobuf:"bytes,2,req,name=alias" json:"alias,omitempty"`
@@ -133,5 +157,653 @@ func (m *Redirect) GetAddress() string {
 	return ""
 }
 
+type TrackerWatch struct {
+	Address          []string `protobuf:"bytes,1,rep,name=address" json:"address,omitempty"`
+	Username         []string `protobuf:"bytes,2,rep,name=username" json:"username,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *TrackerWatch) Reset()         { *m = TrackerWatch{} }
+func (m *TrackerWatch) String() string { return proto.CompactTextString(m) }
+func (*TrackerWatch) ProtoMessage()    {}
+
+func (m *TrackerWatch) GetAddress() []string {
+	if m != nil {
+		return m.Address
+	}
+	return nil
+}
+
+func (m *TrackerWatch) GetUsername() []string {
+	if m != nil {
+		return m.Username
+	}
+	return nil
+}
+
+type TrackerFeedQuery struct {
+	Cursor           *uint64 `protobuf:"varint,1,req,name=cursor" json:"cursor,omitempty"`
+	Limit            *uint32 `protobuf:"varint,2,opt,name=limit" json:"limit,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *TrackerFeedQuery) Reset()         { *m = TrackerFeedQuery{} }
+func (m *TrackerFeedQuery) String() string { return proto.CompactTextString(m) }
+func (*TrackerFeedQuery) ProtoMessage()    {}
+
+func (m *TrackerFeedQuery) GetCursor() uint64 {
+	if m != nil && m.Cursor != nil {
+		return *m.Cursor
+	}
+	return 0
+}
+
+func (m *TrackerFeedQuery) GetLimit() uint32 {
+	if m != nil && m.Limit != nil {
+		return *m.Limit
+	}
+	return 0
+}
+
+type TrackerFeed struct {
+	Entry            []*FeedEntry `protobuf:"bytes,1,rep,name=entry" json:"entry,omitempty"`
+	Cursor           *uint64      `protobuf:"varint,2,req,name=cursor" json:"cursor,omitempty"`
+	More             *bool        `protobuf:"varint,3,req,name=more" json:"more,omitempty"`
+	Latest           *uint64      `protobuf:"varint,4,opt,name=latest" json:"latest,omitempty"`
+	Truncated        *bool        `protobuf:"varint,5,opt,name=truncated" json:"truncated,omitempty"`
+	XXX_unrecognized []byte       `json:"-"`
+}
+
+func (m *TrackerFeed) Reset()         { *m = TrackerFeed{} }
+func (m *TrackerFeed) String() string { return proto.CompactTextString(m) }
+func (*TrackerFeed) ProtoMessage()    {}
+
+func (m *TrackerFeed) GetEntry() []*FeedEntry {
+	if m != nil {
+		return m.Entry
+	}
+	return nil
+}
+
+func (m *TrackerFeed) GetCursor() uint64 {
+	if m != nil && m.Cursor != nil {
+		return *m.Cursor
+	}
+	return 0
+}
+
+func (m *TrackerFeed) GetMore() bool {
+	if m != nil && m.More != nil {
+		return *m.More
+	}
+	return false
+}
+
+func (m *TrackerFeed) GetLatest() uint64 {
+	if m != nil && m.Latest != nil {
+		return *m.Latest
+	}
+	return 0
+}
+
+func (m *TrackerFeed) GetTruncated() bool {
+	if m != nil && m.Truncated != nil {
+		return *m.Truncated
+	}
+	return false
+}
+
+type FeedEntry struct {
+	Sequence         *uint64 `protobuf:"varint,1,req,name=sequence" json:"sequence,omitempty"`
+	Kind             *string `protobuf:"bytes,2,req,name=kind" json:"kind,omitempty"`
+	Address          *string `protobuf:"bytes,3,req,name=address" json:"address,omitempty"`
+	Username         *string `protobuf:"bytes,4,opt,name=username" json:"username,omitempty"`
+	Timestamp        *uint64 `protobuf:"varint,5,req,name=timestamp" json:"timestamp,omitempty"`
+	Record           []byte  `protobuf:"bytes,6,opt,name=record" json:"record,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *FeedEntry) Reset()         { *m = FeedEntry{} }
+func (m *FeedEntry) String() string { return proto.CompactTextString(m) }
+func (*FeedEntry) ProtoMessage()    {}
+
+func (m *FeedEntry) GetSequence() uint64 {
+	if m != nil && m.Sequence != nil {
+		return *m.Sequence
+	}
+	return 0
+}
+
+func (m *FeedEntry) GetKind() string {
+	if m != nil && m.Kind != nil {
+		return *m.Kind
+	}
+	return ""
+}
+
+func (m *FeedEntry) GetAddress() string {
+	if m != nil && m.Address != nil {
+		return *m.Address
+	}
+	return ""
+}
+
+func (m *FeedEntry) GetUsername() string {
+	if m != nil && m.Username != nil {
+		return *m.Username
+	}
+	return ""
+}
+
+func (m *FeedEntry) GetTimestamp() uint64 {
+	if m != nil && m.Timestamp != nil {
+		return *m.Timestamp
+	}
+	return 0
+}
+
+func (m *FeedEntry) GetRecord() []byte {
+	if m != nil {
+		return m.Record
+	}
+	return nil
+}
+
+type TrackerHistoryQuery struct {
+	Address          *string `protobuf:"bytes,1,opt,name=address" json:"address,omitempty"`
+	Username         *string `protobuf:"bytes,2,opt,name=username" json:"username,omitempty"`
+	At               *uint64 `protobuf:"varint,3,opt,name=at" json:"at,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *TrackerHistoryQuery) Reset()         { *m = TrackerHistoryQuery{} }
+func (m *TrackerHistoryQuery) String() string { return proto.CompactTextString(m) }
+func (*TrackerHistoryQuery) ProtoMessage()    {}
+
+func (m *TrackerHistoryQuery) GetAddress() string {
+	if m != nil && m.Address != nil {
+		return *m.Address
+	}
+	return ""
+}
+
+func (m *TrackerHistoryQuery) GetUsername() string {
+	if m != nil && m.Username != nil {
+		return *m.Username
+	}
+	return ""
+}
+
+func (m *TrackerHistoryQuery) GetAt() uint64 {
+	if m != nil && m.At != nil {
+		return *m.At
+	}
+	return 0
+}
+
+type TrackerHistory struct {
+	Entry            []*HistoryEntry `protobuf:"bytes,1,rep,name=entry" json:"entry,omitempty"`
+	XXX_unrecognized []byte          `json:"-"`
+}
+
+func (m *TrackerHistory) Reset()         { *m = TrackerHistory{} }
+func (m *TrackerHistory) String() string { return proto.CompactTextString(m) }
+func (*TrackerHistory) ProtoMessage()    {}
+
+func (m *TrackerHistory) GetEntry() []*HistoryEntry {
+	if m != nil {
+		return m.Entry
+	}
+	return nil
+}
+
+type HistoryEntry struct {
+	Address          *string `protobuf:"bytes,1,req,name=address" json:"address,omitempty"`
+	Username         *string `protobuf:"bytes,2,opt,name=username" json:"username,omitempty"`
+	Saved            *uint64 `protobuf:"varint,3,req,name=saved" json:"saved,omitempty"`
+	Replaced         *uint64 `protobuf:"varint,4,opt,name=replaced" json:"replaced,omitempty"`
+	Record           []byte  `protobuf:"bytes,5,req,name=record" json:"record,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *HistoryEntry) Reset()         { *m = HistoryEntry{} }
+func (m *HistoryEntry) String() string { return proto.CompactTextString(m) }
+func (*HistoryEntry) ProtoMessage()    {}
+
+func (m *HistoryEntry) GetAddress() string {
+	if m != nil && m.Address != nil {
+		return *m.Address
+	}
+	return ""
+}
+
+func (m *HistoryEntry) GetUsername() string {
+	if m != nil && m.Username != nil {
+		return *m.Username
+	}
+	return ""
+}
+
+func (m *HistoryEntry) GetSaved() uint64 {
+	if m != nil && m.Saved != nil {
+		return *m.Saved
+	}
+	return 0
+}
+
+func (m *HistoryEntry) GetReplaced() uint64 {
+	if m != nil && m.Replaced != nil {
+		return *m.Replaced
+	}
+	return 0
+}
+
+func (m *HistoryEntry) GetRecord() []byte {
+	if m != nil {
+		return m.Record
+	}
+	return nil
+}
+
+type TrackerReplicate struct {
+	Record           []*ReplicatedRecord `protobuf:"bytes,1,rep,name=record" json:"record,omitempty"`
+	XXX_unrecognized []byte              `json:"-"`
+}
+
+func (m *TrackerReplicate) Reset()         { *m = TrackerReplicate{} }
+func (m *TrackerReplicate) String() string { return proto.CompactTextString(m) }
+func (*TrackerReplicate) ProtoMessage()    {}
+
+func (m *TrackerReplicate) GetRecord() []*ReplicatedRecord {
+	if m != nil {
+		return m.Record
+	}
+	return nil
+}
+
+type ReplicatedRecord struct {
+	Address          *string `protobuf:"bytes,1,req,name=address" json:"address,omitempty"`
+	Record           []byte  `protobuf:"bytes,2,req,name=record" json:"record,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *ReplicatedRecord) Reset()         { *m = ReplicatedRecord{} }
+func (m *ReplicatedRecord) String() string { return proto.CompactTextString(m) }
+func (*ReplicatedRecord) ProtoMessage()    {}
+
+func (m *ReplicatedRecord) GetAddress() string {
+	if m != nil && m.Address != nil {
+		return *m.Address
+	}
+	return ""
+}
+
+func (m *ReplicatedRecord) GetRecord() []byte {
+	if m != nil {
+		return m.Record
+	}
+	return nil
+}
+
+type TrackerReplicateAck struct {
+	Accepted         *uint32 `protobuf:"varint,1,req,name=accepted" json:"accepted,omitempty"`
+	Stale            *uint32 `protobuf:"varint,2,req,name=stale" json:"stale,omitempty"`
+	Invalid          *uint32 `protobuf:"varint,3,req,name=invalid" json:"invalid,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *TrackerReplicateAck) Reset()         { *m = TrackerReplicateAck{} }
+func (m *TrackerReplicateAck) String() string { return proto.CompactTextString(m) }
+func (*TrackerReplicateAck) ProtoMessage()    {}
+
+func (m *TrackerReplicateAck) GetAccepted() uint32 {
+	if m != nil && m.Accepted != nil {
+		return *m.Accepted
+	}
+	return 0
+}
+
+func (m *TrackerReplicateAck) GetStale() uint32 {
+	if m != nil && m.Stale != nil {
+		return *m.Stale
+	}
+	return 0
+}
+
+func (m *TrackerReplicateAck) GetInvalid() uint32 {
+	if m != nil && m.Invalid != nil {
+		return *m.Invalid
+	}
+	return 0
+}
+
+type TrackerDigestQuery struct {
+	Bucket           []string `protobuf:"bytes,1,rep,name=bucket" json:"bucket,omitempty"`
+	Fetch            []string `protobuf:"bytes,2,rep,name=fetch" json:"fetch,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *TrackerDigestQuery) Reset()         { *m = TrackerDigestQuery{} }
+func (m *TrackerDigestQuery) String() string { return proto.CompactTextString(m) }
+func (*TrackerDigestQuery) ProtoMessage()    {}
+
+func (m *TrackerDigestQuery) GetBucket() []string {
+	if m != nil {
+		return m.Bucket
+	}
+	return nil
+}
+
+func (m *TrackerDigestQuery) GetFetch() []string {
+	if m != nil {
+		return m.Fetch
+	}
+	return nil
+}
+
+type TrackerDigest struct {
+	Bucket           []*BucketDigest     `protobuf:"bytes,1,rep,name=bucket" json:"bucket,omitempty"`
+	Entry            []*DigestEntry      `protobuf:"bytes,2,rep,name=entry" json:"entry,omitempty"`
+	Record           []*ReplicatedRecord `protobuf:"bytes,3,rep,name=record" json:"record,omitempty"`
+	XXX_unrecognized []byte              `json:"-"`
+}
+
+func (m *TrackerDigest) Reset()         { *m = TrackerDigest{} }
+func (m *TrackerDigest) String() string { return proto.CompactTextString(m) }
+func (*TrackerDigest) ProtoMessage()    {}
+
+func (m *TrackerDigest) GetBucket() []*BucketDigest {
+	if m != nil {
+		return m.Bucket
+	}
+	return nil
+}
+
+func (m *TrackerDigest) GetEntry() []*DigestEntry {
+	if m != nil {
+		return m.Entry
+	}
+	return nil
+}
+
+func (m *TrackerDigest) GetRecord() []*ReplicatedRecord {
+	if m != nil {
+		return m.Record
+	}
+	return nil
+}
+
+type BucketDigest struct {
+	Prefix           *string `protobuf:"bytes,1,req,name=prefix" json:"prefix,omitempty"`
+	Hash             []byte  `protobuf:"bytes,2,req,name=hash" json:"hash,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *BucketDigest) Reset()         { *m = BucketDigest{} }
+func (m *BucketDigest) String() string { return proto.CompactTextString(m) }
+func (*BucketDigest) ProtoMessage()    {}
+
+func (m *BucketDigest) GetPrefix() string {
+	if m != nil && m.Prefix != nil {
+		return *m.Prefix
+	}
+	return ""
+}
+
+func (m *BucketDigest) GetHash() []byte {
+	if m != nil {
+		return m.Hash
+	}
+	return nil
+}
+
+type DigestEntry struct {
+	Address          *string `protobuf:"bytes,1,req,name=address" json:"address,omitempty"`
+	Expires          *uint64 `protobuf:"varint,2,req,name=expires" json:"expires,omitempty"`
+	Hash             []byte  `protobuf:"bytes,3,req,name=hash" json:"hash,omitempty"`
+	Alias            *string `protobuf:"bytes,4,opt,name=alias" json:"alias,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *DigestEntry) Reset()         { *m = DigestEntry{} }
+func (m *DigestEntry) String() string { return proto.CompactTextString(m) }
+func (*DigestEntry) ProtoMessage()    {}
+
+func (m *DigestEntry) GetAddress() string {
+	if m != nil && m.Address != nil {
+		return *m.Address
+	}
+	return ""
+}
+
+func (m *DigestEntry) GetExpires() uint64 {
+	if m != nil && m.Expires != nil {
+		return *m.Expires
+	}
+	return 0
+}
+
+func (m *DigestEntry) GetHash() []byte {
+	if m != nil {
+		return m.Hash
+	}
+	return nil
+}
+
+func (m *DigestEntry) GetAlias() string {
+	if m != nil && m.Alias != nil {
+		return *m.Alias
+	}
+	return ""
+}
+
+type TrackerMirror struct {
+	Primary          *string `protobuf:"bytes,1,req,name=primary" json:"primary,omitempty"`
+	PrimaryUrl       *string `protobuf:"bytes,2,opt,name=primary_url" json:"primary_url,omitempty"`
+	Cursor           *uint64 `protobuf:"varint,3,req,name=cursor" json:"cursor,omitempty"`
+	Latest           *uint64 `protobuf:"varint,4,req,name=latest" json:"latest,omitempty"`
+	Synced           *uint64 `protobuf:"varint,5,opt,name=synced" json:"synced,omitempty"`
+	Lag              *uint64 `protobuf:"varint,6,opt,name=lag" json:"lag,omitempty"`
+	RecordHash       []byte  `protobuf:"bytes,7,opt,name=record_hash" json:"record_hash,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *TrackerMirror) Reset()         { *m = TrackerMirror{} }
+func (m *TrackerMirror) String() string { return proto.CompactTextString(m) }
+func (*TrackerMirror) ProtoMessage()    {}
+
+func (m *TrackerMirror) GetPrimary() string {
+	if m != nil && m.Primary != nil {
+		return *m.Primary
+	}
+	return ""
+}
+
+func (m *TrackerMirror) GetPrimaryUrl() string {
+	if m != nil && m.PrimaryUrl != nil {
+		return *m.PrimaryUrl
+	}
+	return ""
+}
+
+func (m *TrackerMirror) GetCursor() uint64 {
+	if m != nil && m.Cursor != nil {
+		return *m.Cursor
+	}
+	return 0
+}
+
+func (m *TrackerMirror) GetLatest() uint64 {
+	if m != nil && m.Latest != nil {
+		return *m.Latest
+	}
+	return 0
+}
+
+func (m *TrackerMirror) GetSynced() uint64 {
+	if m != nil && m.Synced != nil {
+		return *m.Synced
+	}
+	return 0
+}
+
+func (m *TrackerMirror) GetLag() uint64 {
+	if m != nil && m.Lag != nil {
+		return *m.Lag
+	}
+	return 0
+}
+
+func (m *TrackerMirror) GetRecordHash() []byte {
+	if m != nil {
+		return m.RecordHash
+	}
+	return nil
+}
+
+type TrackerDelegation struct {
+	Namespace        *string `protobuf:"bytes,1,req,name=namespace" json:"namespace,omitempty"`
+	Alias            *string `protobuf:"bytes,2,req,name=alias" json:"alias,omitempty"`
+	Address          *string `protobuf:"bytes,3,req,name=address" json:"address,omitempty"`
+	Expires          *uint64 `protobuf:"varint,4,req,name=expires" json:"expires,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *TrackerDelegation) Reset()         { *m = TrackerDelegation{} }
+func (m *TrackerDelegation) String() string { return proto.CompactTextString(m) }
+func (*TrackerDelegation) ProtoMessage()    {}
+
+func (m *TrackerDelegation) GetNamespace() string {
+	if m != nil && m.Namespace != nil {
+		return *m.Namespace
+	}
+	return ""
+}
+
+func (m *TrackerDelegation) GetAlias() string {
+	if m != nil && m.Alias != nil {
+		return *m.Alias
+	}
+	return ""
+}
+
+func (m *TrackerDelegation) GetAddress() string {
+	if m != nil && m.Address != nil {
+		return *m.Address
+	}
+	return ""
+}
+
+func (m *TrackerDelegation) GetExpires() uint64 {
+	if m != nil && m.Expires != nil {
+		return *m.Expires
+	}
+	return 0
+}
+
+type TrackerMigration struct {
+	Successor        *string `protobuf:"bytes,1,req,name=successor" json:"successor,omitempty"`
+	SuccessorUrl     *string `protobuf:"bytes,2,req,name=successor_url" json:"successor_url,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *TrackerMigration) Reset()         { *m = TrackerMigration{} }
+func (m *TrackerMigration) String() string { return proto.CompactTextString(m) }
+func (*TrackerMigration) ProtoMessage()    {}
+
+func (m *TrackerMigration) GetSuccessor() string {
+	if m != nil && m.Successor != nil {
+		return *m.Successor
+	}
+	return ""
+}
+
+func (m *TrackerMigration) GetSuccessorUrl() string {
+	if m != nil && m.SuccessorUrl != nil {
+		return *m.SuccessorUrl
+	}
+	return ""
+}
+
+type TrackerDirectory struct {
+	Tracker          []*DirectoryEntry `protobuf:"bytes,1,rep,name=tracker" json:"tracker,omitempty"`
+	Issued           *uint64           `protobuf:"varint,2,req,name=issued" json:"issued,omitempty"`
+	Expires          *uint64           `protobuf:"varint,3,opt,name=expires" json:"expires,omitempty"`
+	XXX_unrecognized []byte            `json:"-"`
+}
+
+func (m *TrackerDirectory) Reset()         { *m = TrackerDirectory{} }
+func (m *TrackerDirectory) String() string { return proto.CompactTextString(m) }
+func (*TrackerDirectory) ProtoMessage()    {}
+
+func (m *TrackerDirectory) GetTracker() []*DirectoryEntry {
+	if m != nil {
+		return m.Tracker
+	}
+	return nil
+}
+
+func (m *TrackerDirectory) GetIssued() uint64 {
+	if m != nil && m.Issued != nil {
+		return *m.Issued
+	}
+	return 0
+}
+
+func (m *TrackerDirectory) GetExpires() uint64 {
+	if m != nil && m.Expires != nil {
+		return *m.Expires
+	}
+	return 0
+}
+
+type DirectoryEntry struct {
+	Url              *string  `protobuf:"bytes,1,req,name=url" json:"url,omitempty"`
+	Address          *string  `protobuf:"bytes,2,req,name=address" json:"address,omitempty"`
+	EncryptionKey    []byte   `protobuf:"bytes,3,opt,name=encryption_key" json:"encryption_key,omitempty"`
+	Region           *string  `protobuf:"bytes,4,opt,name=region" json:"region,omitempty"`
+	Capability       []string `protobuf:"bytes,5,rep,name=capability" json:"capability,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *DirectoryEntry) Reset()         { *m = DirectoryEntry{} }
+func (m *DirectoryEntry) String() string { return proto.CompactTextString(m) }
+func (*DirectoryEntry) ProtoMessage()    {}
+
+func (m *DirectoryEntry) GetUrl() string {
+	if m != nil && m.Url != nil {
+		return *m.Url
+	}
+	return ""
+}
+
+func (m *DirectoryEntry) GetAddress() string {
+	if m != nil && m.Address != nil {
+		return *m.Address
+	}
+	return ""
+}
+
+func (m *DirectoryEntry) GetEncryptionKey() []byte {
+	if m != nil {
+		return m.EncryptionKey
+	}
+	return nil
+}
+
+func (m *DirectoryEntry) GetRegion() string {
+	if m != nil && m.Region != nil {
+		return *m.Region
+	}
+	return ""
+}
+
+func (m *DirectoryEntry) GetCapability() []string {
+	if m != nil {
+		return m.Capability
+	}
+	return nil
+}
+
 func init() {
 }
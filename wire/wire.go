@@ -5,4 +5,17 @@ const (
 	RegistrationCode = "TRG"
 	QueryCode        = "TQE"
 	ResponseCode     = "TRS"
+	WatchCode        = "TWA"
+	FeedQueryCode    = "TFQ"
+	FeedCode         = "TFD"
+	HistoryQueryCode = "THQ"
+	HistoryCode      = "THS"
+	ReplicateCode    = "TRP"
+	ReplicateAckCode = "TRA"
+	DigestQueryCode  = "TDQ"
+	DigestCode       = "TDG"
+	MirrorCode       = "TMI"
+	DelegationCode   = "TDL"
+	MigrationCode    = "TMG"
+	DirectoryCode    = "TDR"
 )